@@ -0,0 +1,608 @@
+package mpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// arrayElements returns a copy of the elements of the array, so that they can
+// be reordered without changing the data
+func arrayElements(val any, fnName FT_FunctionType) ([]any, error) {
+	out, ok, wasStruct := getAsStructOrSlice(val)
+	if !ok || wasStruct {
+		return nil, fmt.Errorf("func %s: value wasn't array", fnName)
+	}
+
+	return append([]any{}, out.([]any)...), nil
+}
+
+// sortKey returns the value as one that can be compared by compareSortKeys;
+// numbers are compared as decimals, and only primitives and dates can be
+// compared
+func sortKey(val any) (any, error) {
+	v := reflect.ValueOf(val)
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil, nil
+		}
+		val = v.Elem().Interface()
+	}
+
+	switch t := convertToDecimalIfNumber(val).(type) {
+	case nil, bool, decimal.Decimal, string, time.Time:
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("cannot compare values of type %T", val)
+}
+
+// sortRank orders values of different types: nulls, then booleans, numbers,
+// strings and dates
+func sortRank(key any) int {
+	switch key.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case decimal.Decimal:
+		return 2
+	case string:
+		return 3
+	}
+
+	return 4
+}
+
+func compareSortKeys(a, b any) int {
+	if ra, rb := sortRank(a), sortRank(b); ra != rb {
+		return ra - rb
+	}
+
+	switch at := a.(type) {
+	case bool:
+		bt := b.(bool)
+		switch {
+		case at == bt:
+			return 0
+		case bt:
+			return -1
+		}
+		return 1
+	case decimal.Decimal:
+		return at.Cmp(b.(decimal.Decimal))
+	case string:
+		return strings.Compare(at, b.(string))
+	case time.Time:
+		return at.Compare(b.(time.Time))
+	}
+
+	return 0
+}
+
+// sortElements sorts the elements by the keys from keyFn, keeping the order
+// of elements with equal keys
+func sortElements(elems []any, descending bool, keyFn func(any) (any, error)) error {
+	keys := make([]any, len(elems))
+	for i, elem := range elems {
+		key, err := keyFn(elem)
+		if err != nil {
+			return err
+		}
+
+		if keys[i], err = sortKey(key); err != nil {
+			return err
+		}
+	}
+
+	indexes := make([]int, len(elems))
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	sort.SliceStable(indexes, func(i, j int) bool {
+		c := compareSortKeys(keys[indexes[i]], keys[indexes[j]])
+		if descending {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	sorted := make([]any, len(elems))
+	for i, index := range indexes {
+		sorted[i] = elems[index]
+	}
+	copy(elems, sorted)
+
+	return nil
+}
+
+// distinctKey returns a string that is the same for equal values; numbers
+// are equal if they have the same value, and dates if they are the same
+// instant
+func distinctKey(val any) (string, error) {
+	key, err := sortKey(val)
+	if err != nil {
+		b, err := json.Marshal(val)
+		if err != nil {
+			return "", fmt.Errorf("cannot compare values of type %T", val)
+		}
+		return "o:" + string(b), nil
+	}
+
+	switch t := key.(type) {
+	case nil:
+		return "null", nil
+	case decimal.Decimal:
+		return "n:" + t.String(), nil
+	case time.Time:
+		return "t:" + t.UTC().Format(time.RFC3339Nano), nil
+	}
+
+	return fmt.Sprintf("%d:%v", sortRank(key), key), nil
+}
+
+// distinctElements removes the elements that have the same key from keyFn as
+// an earlier element
+func distinctElements(elems []any, keyFn func(any) (any, error)) ([]any, error) {
+	seen := map[string]struct{}{}
+	out := []any{}
+
+	for _, elem := range elems {
+		val, err := keyFn(elem)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := distinctKey(val)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		out = append(out, elem)
+	}
+
+	return out, nil
+}
+
+func identityKey(elem any) (any, error) { return elem, nil }
+
+// queryKey returns a func that runs the query in the parameter at the
+// position against each element, for functions such as SortBy
+func queryKey(ev *evaluation, rtParams FunctionParameterTypes, position int, fnName FT_FunctionType) (func(any) (any, error), error) {
+	query, err := paramsGetStringAt(rtParams, position)
+	if err != nil {
+		return nil, fmt.Errorf("func %s: %w", fnName, err)
+	}
+
+	op, err := ev.parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("func %s: error parsing query: %w", fnName, err)
+	}
+
+	return func(elem any) (any, error) {
+		if err := ev.cancelled(); err != nil {
+			return nil, err
+		}
+
+		return op.do(ev, elem, elem)
+	}, nil
+}
+
+func sortFunc(rtParams FunctionParameterTypes, val any, descending bool, fnName FT_FunctionType) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(0); !ok {
+		return nil, errNumParams(fnName, 0, got)
+	}
+
+	elems, err := arrayElements(val, fnName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = sortElements(elems, descending, identityKey); err != nil {
+		return errAny(fnName, err)
+	}
+
+	return elems, nil
+}
+
+const FT_Sort FT_FunctionType = "Sort"
+
+func func_Sort(rtParams FunctionParameterTypes, val any) (any, error) {
+	return sortFunc(rtParams, val, false, FT_Sort)
+}
+
+const FT_SortDesc FT_FunctionType = "SortDesc"
+
+func func_SortDesc(rtParams FunctionParameterTypes, val any) (any, error) {
+	return sortFunc(rtParams, val, true, FT_SortDesc)
+}
+
+const FT_SortBy FT_FunctionType = "SortBy"
+
+func func_SortBy(rtParams FunctionParameterTypes, val any) (any, error) {
+	return errAny(FT_SortBy, ErrOnlyInQuery)
+}
+
+func evalFunc_SortBy(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	keyFn, err := queryKey(ev, rtParams, 0, FT_SortBy)
+	if err != nil {
+		return nil, err
+	}
+
+	elems, err := arrayElements(val, FT_SortBy)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = sortElements(elems, false, keyFn); err != nil {
+		return errAny(FT_SortBy, err)
+	}
+
+	return elems, nil
+}
+
+const FT_Distinct FT_FunctionType = "Distinct"
+
+func func_Distinct(rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(0); !ok {
+		return nil, errNumParams(FT_Distinct, 0, got)
+	}
+
+	elems, err := arrayElements(val, FT_Distinct)
+	if err != nil {
+		return nil, err
+	}
+
+	if elems, err = distinctElements(elems, identityKey); err != nil {
+		return errAny(FT_Distinct, err)
+	}
+
+	return elems, nil
+}
+
+const FT_DistinctBy FT_FunctionType = "DistinctBy"
+
+func func_DistinctBy(rtParams FunctionParameterTypes, val any) (any, error) {
+	return errAny(FT_DistinctBy, ErrOnlyInQuery)
+}
+
+func evalFunc_DistinctBy(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	keyFn, err := queryKey(ev, rtParams, 0, FT_DistinctBy)
+	if err != nil {
+		return nil, err
+	}
+
+	elems, err := arrayElements(val, FT_DistinctBy)
+	if err != nil {
+		return nil, err
+	}
+
+	if elems, err = distinctElements(elems, keyFn); err != nil {
+		return errAny(FT_DistinctBy, err)
+	}
+
+	return elems, nil
+}
+
+const FT_Reverse FT_FunctionType = "Reverse"
+
+func func_Reverse(rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(0); !ok {
+		return nil, errNumParams(FT_Reverse, 0, got)
+	}
+
+	elems, err := arrayElements(val, FT_Reverse)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(elems)-1; i < j; i, j = i+1, j-1 {
+		elems[i], elems[j] = elems[j], elems[i]
+	}
+
+	return elems, nil
+}
+
+func pageFunc(rtParams FunctionParameterTypes, val any, fn func(elems []any, n int) []any, fnName FT_FunctionType) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(1); !ok {
+		return nil, errNumParams(fnName, 1, got)
+	}
+
+	n, err := paramsGetIntAt(rtParams, 0)
+	if err != nil {
+		return errAny(fnName, err)
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("func %s: parameter must not be negative", fnName)
+	}
+
+	elems, err := arrayElements(val, fnName)
+	if err != nil {
+		return nil, err
+	}
+
+	return fn(elems, min(n, len(elems))), nil
+}
+
+const FT_Take FT_FunctionType = "Take"
+
+func func_Take(rtParams FunctionParameterTypes, val any) (any, error) {
+	return pageFunc(rtParams, val, func(elems []any, n int) []any { return elems[:n] }, FT_Take)
+}
+
+const FT_Skip FT_FunctionType = "Skip"
+
+func func_Skip(rtParams FunctionParameterTypes, val any) (any, error) {
+	return pageFunc(rtParams, val, func(elems []any, n int) []any { return elems[n:] }, FT_Skip)
+}
+
+const FT_Flatten FT_FunctionType = "Flatten"
+
+func func_Flatten(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_Flatten(backgroundEvaluation(), rtParams, val)
+}
+
+// evalFunc_Flatten replaces the elements that are arrays with their
+// elements; only one level of arrays is flattened
+func evalFunc_Flatten(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(0); !ok {
+		return nil, errNumParams(FT_Flatten, 0, got)
+	}
+
+	elems, err := arrayElements(val, FT_Flatten)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []any{}
+	for _, elem := range elems {
+		inner, ok, wasStruct := getAsStructOrSlice(elem)
+		if !ok || wasStruct {
+			out = append(out, elem)
+			continue
+		}
+
+		out = append(out, inner.([]any)...)
+		if err := ev.checkCollectionSize(len(out)); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// groupKey returns the key of the group for the value. Numbers, booleans and
+// dates are written as text, and elements without a value are in the group
+// named null. Text that could be read as one of those (e.g. "1", "true",
+// "null" or "") is quoted, so that values of different types are never in the
+// same group.
+func groupKey(val any) (string, error) {
+	// Text is grouped as text, even if it is a number
+	if v := reflect.Indirect(reflect.ValueOf(val)); v.Kind() == reflect.String {
+		if needsQuotedGroupKey(v.String()) {
+			return strconv.Quote(v.String()), nil
+		}
+		return v.String(), nil
+	}
+
+	key, err := sortKey(val)
+	if err != nil {
+		return "", fmt.Errorf("cannot group by a value of type %T", val)
+	}
+
+	switch t := key.(type) {
+	case decimal.Decimal:
+		return t.String(), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case time.Time:
+		return t.Format(time.RFC3339Nano), nil
+	}
+
+	return "null", nil
+}
+
+// needsQuotedGroupKey returns whether the text could be mistaken for the key
+// of a group of another type, or of quoted text
+func needsQuotedGroupKey(s string) bool {
+	if s == "" || strings.HasPrefix(s, `"`) || isLiteralIdent(s) {
+		return true
+	}
+
+	_, err := time.Parse(time.RFC3339Nano, s)
+	return err == nil
+}
+
+// groupElements returns the elements in groups by the key from the query in
+// the first parameter; the elements stay in the same order within each group
+func groupElements(ev *evaluation, rtParams FunctionParameterTypes, val any, fnName FT_FunctionType) (map[string][]any, error) {
+	keyFn, err := queryKey(ev, rtParams, 0, fnName)
+	if err != nil {
+		return nil, err
+	}
+
+	elems, err := arrayElements(val, fnName)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string][]any{}
+	for _, elem := range elems {
+		val, err := keyFn(elem)
+		if err != nil {
+			return nil, fmt.Errorf("func %s: %w", fnName, err)
+		}
+
+		key, err := groupKey(val)
+		if err != nil {
+			return nil, fmt.Errorf("func %s: %w", fnName, err)
+		}
+
+		groups[key] = append(groups[key], elem)
+	}
+
+	return groups, nil
+}
+
+const FT_GroupBy FT_FunctionType = "GroupBy"
+
+func func_GroupBy(rtParams FunctionParameterTypes, val any) (any, error) {
+	return errAny(FT_GroupBy, ErrOnlyInQuery)
+}
+
+// evalFunc_GroupBy returns a map of the name of each group to its elements.
+// As with any map, the groups are in the order of their names when they are
+// read with Keys, Values or Entries, or encoded as json.
+func evalFunc_GroupBy(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(1); !ok {
+		return nil, errNumParams(FT_GroupBy, 1, got)
+	}
+
+	groups, err := groupElements(ev, rtParams, val, FT_GroupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]any, len(groups))
+	for key, group := range groups {
+		out[key] = group
+	}
+
+	return out, nil
+}
+
+const FT_CountBy FT_FunctionType = "CountBy"
+
+func func_CountBy(rtParams FunctionParameterTypes, val any) (any, error) {
+	return errAny(FT_CountBy, ErrOnlyInQuery)
+}
+
+func evalFunc_CountBy(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(1); !ok {
+		return nil, errNumParams(FT_CountBy, 1, got)
+	}
+
+	groups, err := groupElements(ev, rtParams, val, FT_CountBy)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]any, len(groups))
+	for key, group := range groups {
+		out[key] = decimal.NewFromInt(int64(len(group)))
+	}
+
+	return out, nil
+}
+
+// keyedAggregate groups the elements by the query in the first parameter,
+// and aggregates the numbers from the query in the second parameter for each
+// group; null numbers are left out
+func keyedAggregate(ev *evaluation, rtParams FunctionParameterTypes, val any, aggregate func([]decimal.Decimal) any, fnName FT_FunctionType) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(2); !ok {
+		return nil, errNumParams(fnName, 2, got)
+	}
+
+	valueFn, err := queryKey(ev, rtParams, 1, fnName)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := groupElements(ev, rtParams, val, fnName)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]any, len(groups))
+	for key, group := range groups {
+		numbers := make([]decimal.Decimal, 0, len(group))
+		for _, elem := range group {
+			val, err := valueFn(elem)
+			if err != nil {
+				return nil, fmt.Errorf("func %s: %w", fnName, err)
+			}
+			if val == nil {
+				continue
+			}
+
+			number, ok := convertToDecimalIfNumber(val).(decimal.Decimal)
+			if !ok {
+				return nil, fmt.Errorf("func %s: value of type %T is not a number", fnName, val)
+			}
+			numbers = append(numbers, number)
+		}
+
+		out[key] = aggregate(numbers)
+	}
+
+	return out, nil
+}
+
+// aggregateOrNull returns a func that aggregates the numbers with fn, or
+// returns null if there are no numbers
+func aggregateOrNull(fn func(decimal.Decimal, ...decimal.Decimal) decimal.Decimal) func([]decimal.Decimal) any {
+	return func(numbers []decimal.Decimal) any {
+		if len(numbers) == 0 {
+			return nil
+		}
+
+		return fn(numbers[0], numbers[1:]...)
+	}
+}
+
+const FT_SumBy FT_FunctionType = "SumBy"
+
+func func_SumBy(rtParams FunctionParameterTypes, val any) (any, error) {
+	return errAny(FT_SumBy, ErrOnlyInQuery)
+}
+
+func evalFunc_SumBy(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	return keyedAggregate(ev, rtParams, val, func(numbers []decimal.Decimal) any {
+		if len(numbers) == 0 {
+			return decimal.Zero
+		}
+
+		return decimal.Sum(numbers[0], numbers[1:]...)
+	}, FT_SumBy)
+}
+
+const FT_AverageBy FT_FunctionType = "AverageBy"
+
+func func_AverageBy(rtParams FunctionParameterTypes, val any) (any, error) {
+	return errAny(FT_AverageBy, ErrOnlyInQuery)
+}
+
+func evalFunc_AverageBy(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	return keyedAggregate(ev, rtParams, val, aggregateOrNull(decimal.Avg), FT_AverageBy)
+}
+
+const FT_MinimumBy FT_FunctionType = "MinimumBy"
+
+func func_MinimumBy(rtParams FunctionParameterTypes, val any) (any, error) {
+	return errAny(FT_MinimumBy, ErrOnlyInQuery)
+}
+
+func evalFunc_MinimumBy(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	return keyedAggregate(ev, rtParams, val, aggregateOrNull(decimal.Min), FT_MinimumBy)
+}
+
+const FT_MaximumBy FT_FunctionType = "MaximumBy"
+
+func func_MaximumBy(rtParams FunctionParameterTypes, val any) (any, error) {
+	return errAny(FT_MaximumBy, ErrOnlyInQuery)
+}
+
+func evalFunc_MaximumBy(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	return keyedAggregate(ev, rtParams, val, aggregateOrNull(decimal.Max), FT_MaximumBy)
+}
@@ -0,0 +1,137 @@
+package mpath
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	// DefaultOperationCacheSize is the number of parsed queries that are kept
+	// by CueValidate for each registry
+	DefaultOperationCacheSize = 1000
+
+	// DefaultCueValueCacheSize is the number of compiled cue files that are
+	// kept by CueValidate for each registry
+	DefaultCueValueCacheSize = 100
+
+	// DefaultPlanCacheSize is the number of struct field lookups, regular
+	// expressions and subqueries that are each kept by a Plan
+	DefaultPlanCacheSize = 1000
+)
+
+// Cache is used by CueValidate to keep parsed queries and compiled cue files
+// between calls. Implementations must be safe for concurrent use.
+type Cache interface {
+	Get(key string) (value any, ok bool)
+	Add(key string, value any)
+	Reset()
+	Stats() CacheStats
+}
+
+// CacheStats are the statistics of a cache since it was created or last reset.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+	Capacity  int
+}
+
+// lruCache is a Cache that evicts the least recently used value once it holds
+// more than its capacity; plans also use it with keys that are not strings
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[any]*list.Element
+	order    *list.List
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type lruEntry struct {
+	key   any
+	value any
+}
+
+// NewLRUCache returns a Cache that holds at most capacity values, evicting the
+// least recently used value when it is full. A capacity of zero or less means
+// there is no limit.
+func NewLRUCache(capacity int) Cache {
+	return newLRUCache(capacity)
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		items:    map[any]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (c *lruCache) Get(key string) (value any, ok bool) {
+	return c.get(key)
+}
+
+func (c *lruCache) Add(key string, value any) {
+	c.add(key, value)
+}
+
+func (c *lruCache) get(key any) (value any, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	c.order.MoveToFront(el)
+
+	return el.Value.(*lruEntry).value, true
+}
+
+func (c *lruCache) add(key any, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruEntry).value = value
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+
+	for c.capacity > 0 && c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+		c.evictions++
+	}
+}
+
+func (c *lruCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = map[any]*list.Element{}
+	c.order.Init()
+	c.hits, c.misses, c.evictions = 0, 0, 0
+}
+
+func (c *lruCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Size:      c.order.Len(),
+		Capacity:  c.capacity,
+	}
+}
@@ -0,0 +1,420 @@
+package mpath
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var ErrCalendarNotFound = fmt.Errorf("calendar not found")
+
+// maxBusinessDays limits the number of business days that can be added to a
+// date, as they are counted one day at a time
+const maxBusinessDays = 100000
+
+// Holiday is a day that is not a business day; only the calendar date of
+// Date is used
+type Holiday struct {
+	Date time.Time `json:"date"`
+	Name string    `json:"name"`
+}
+
+// HolidayCalendar is a set of holidays and the days of the week that are not
+// business days (the weekend). Calendars are made available to queries by
+// name with EvalOptions.Calendars; they cannot be changed once they are made,
+// so they can be shared between evaluations.
+type HolidayCalendar struct {
+	weekend  map[time.Weekday]bool
+	holidays map[calendarDate]string
+}
+
+// calendarDate is a day, without a time or time zone
+type calendarDate struct {
+	year  int
+	month time.Month
+	day   int
+}
+
+func calendarDateOf(t time.Time) calendarDate {
+	year, month, day := t.Date()
+	return calendarDate{year, month, day}
+}
+
+// NewHolidayCalendar returns a calendar with the holidays. The weekend is
+// Saturday and Sunday unless other days are given.
+func NewHolidayCalendar(holidays []Holiday, weekend ...time.Weekday) (*HolidayCalendar, error) {
+	if len(weekend) == 0 {
+		weekend = []time.Weekday{time.Saturday, time.Sunday}
+	}
+
+	c := &HolidayCalendar{
+		weekend:  make(map[time.Weekday]bool, len(weekend)),
+		holidays: make(map[calendarDate]string, len(holidays)),
+	}
+
+	for _, wd := range weekend {
+		if wd < time.Sunday || wd > time.Saturday {
+			return nil, fmt.Errorf("%d is not a day of the week", wd)
+		}
+		c.weekend[wd] = true
+	}
+
+	if len(c.weekend) == 7 {
+		return nil, fmt.Errorf("a calendar must have at least one business day each week")
+	}
+
+	for _, h := range holidays {
+		c.holidays[calendarDateOf(h.Date)] = h.Name
+	}
+
+	return c, nil
+}
+
+// Holiday returns the name of the holiday on the calendar date of t, if
+// there is one.
+func (c *HolidayCalendar) Holiday(t time.Time) (name string, isHoliday bool) {
+	name, isHoliday = c.holidays[calendarDateOf(t)]
+	return
+}
+
+// IsBusinessDay returns whether the calendar date of t is neither a holiday
+// nor on the weekend.
+func (c *HolidayCalendar) IsBusinessDay(t time.Time) bool {
+	if c.weekend[t.Weekday()] {
+		return false
+	}
+
+	_, isHoliday := c.Holiday(t)
+
+	return !isHoliday
+}
+
+// AddBusinessDays moves t forward (or backward, for negative n) by n
+// business days, keeping the time of day. Zero days returns t, even if it is
+// not a business day.
+func (c *HolidayCalendar) AddBusinessDays(t time.Time, n int) time.Time {
+	step := 1
+	if n < 0 {
+		step, n = -1, -n
+	}
+
+	for n > 0 {
+		t = t.AddDate(0, 0, step)
+		if c.IsBusinessDay(t) {
+			n--
+		}
+	}
+
+	return t
+}
+
+// BusinessDaysBetween returns the number of business days after the calendar
+// date of t1, up to and including the calendar date of t2. It is negative if
+// t2 is before t1.
+func (c *HolidayCalendar) BusinessDaysBetween(t1, t2 time.Time) int {
+	d1, d2 := calendarDateOf(t1), calendarDateOf(t2.In(t1.Location()))
+
+	from := time.Date(d1.year, d1.month, d1.day, 12, 0, 0, 0, time.UTC)
+	to := time.Date(d2.year, d2.month, d2.day, 12, 0, 0, 0, time.UTC)
+
+	sign := 1
+	if to.Before(from) {
+		from, to, sign = to, from, -1
+	}
+
+	// Whole weeks are counted without looking at each day, so that the
+	// time taken does not depend on how far apart the dates are
+	days := (to.Unix() - from.Unix()) / (24 * 60 * 60)
+	weeks := days / 7
+	count := weeks * int64(7-len(c.weekend))
+
+	for day := from.AddDate(0, 0, int(weeks*7)+1); !day.After(to); day = day.AddDate(0, 0, 1) {
+		if !c.weekend[day.Weekday()] {
+			count++
+		}
+	}
+
+	for date := range c.holidays {
+		day := time.Date(date.year, date.month, date.day, 12, 0, 0, 0, time.UTC)
+		if day.After(from) && !day.After(to) && !c.weekend[day.Weekday()] {
+			count--
+		}
+	}
+
+	return sign * int(count)
+}
+
+// LoadHolidayCalendarJSON reads a calendar from JSON in the format:
+//
+//	{
+//		"weekend": ["Saturday", "Sunday"],
+//		"holidays": [
+//			{"date": "2024-01-01", "name": "New Year's Day"}
+//		]
+//	}
+//
+// The weekend is Saturday and Sunday if it is not given.
+func LoadHolidayCalendarJSON(r io.Reader) (*HolidayCalendar, error) {
+	var file struct {
+		Weekend  []string `json:"weekend"`
+		Holidays []struct {
+			Date string `json:"date"`
+			Name string `json:"name"`
+		} `json:"holidays"`
+	}
+
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to decode calendar: %w", err)
+	}
+
+	var weekend []time.Weekday
+	for _, name := range file.Weekend {
+		wd, err := parseWeekday(name)
+		if err != nil {
+			return nil, err
+		}
+		weekend = append(weekend, wd)
+	}
+
+	var holidays []Holiday
+	for _, h := range file.Holidays {
+		date, err := time.Parse(time.DateOnly, h.Date)
+		if err != nil {
+			return nil, fmt.Errorf("holiday '%s' has an invalid date '%s'; expected YYYY-MM-DD", h.Name, h.Date)
+		}
+		holidays = append(holidays, Holiday{Date: date, Name: h.Name})
+	}
+
+	return NewHolidayCalendar(holidays, weekend...)
+}
+
+func parseWeekday(name string) (time.Weekday, error) {
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		if strings.EqualFold(wd.String(), name) {
+			return wd, nil
+		}
+	}
+
+	return 0, fmt.Errorf("'%s' is not a day of the week", name)
+}
+
+// LoadHolidayCalendarICal reads a calendar from the events in an iCalendar
+// (.ics) file, such as those published for public holidays. Each day of each
+// event is a holiday; recurring events are not supported. The weekend is
+// Saturday and Sunday unless other days are given.
+func LoadHolidayCalendarICal(r io.Reader, weekend ...time.Weekday) (*HolidayCalendar, error) {
+	lines, err := unfoldICalLines(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read calendar: %w", err)
+	}
+
+	var holidays []Holiday
+	var inEvent bool
+	var start, end, summary string
+
+	for i, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		// Drop the parameters, e.g. DTSTART;VALUE=DATE
+		name, _, _ = strings.Cut(name, ";")
+
+		switch strings.ToUpper(name) {
+		case "BEGIN":
+			if strings.EqualFold(value, "VEVENT") {
+				inEvent = true
+				start, end, summary = "", "", ""
+			}
+		case "DTSTART":
+			start = value
+		case "DTEND":
+			end = value
+		case "SUMMARY":
+			summary = unescapeICalText(value)
+		case "RRULE":
+			if inEvent {
+				return nil, fmt.Errorf("line %d: recurring events are not supported", i+1)
+			}
+		case "END":
+			if !inEvent || !strings.EqualFold(value, "VEVENT") {
+				continue
+			}
+			inEvent = false
+
+			days, err := iCalEventDays(start, end)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: event '%s': %w", i+1, summary, err)
+			}
+			for _, day := range days {
+				holidays = append(holidays, Holiday{Date: day, Name: summary})
+			}
+		}
+	}
+
+	return NewHolidayCalendar(holidays, weekend...)
+}
+
+// unfoldICalLines reads the lines of the file, joining those that have been
+// folded onto the following lines
+func unfoldICalLines(r io.Reader) (lines []string, err error) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, sc.Err()
+}
+
+func unescapeICalText(s string) string {
+	return strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\N`, " ", `\\`, `\`).Replace(s)
+}
+
+// iCalEventDays returns the days of an event; the end date of an all day
+// event is the day after it finishes
+func iCalEventDays(start, end string) (days []time.Time, err error) {
+	parse := func(value string) (time.Time, error) {
+		if len(value) < 8 {
+			return time.Time{}, fmt.Errorf("invalid date '%s'", value)
+		}
+		return time.Parse("20060102", value[:8])
+	}
+
+	first, err := parse(start)
+	if err != nil {
+		return nil, err
+	}
+
+	days = append(days, first)
+	if end == "" {
+		return days, nil
+	}
+
+	last, err := parse(end)
+	if err != nil {
+		return nil, err
+	}
+
+	for day := first.AddDate(0, 0, 1); day.Before(last); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+
+	return days, nil
+}
+
+// calendar returns the calendar with the name from the options
+func (ev *evaluation) calendar(name string) (*HolidayCalendar, error) {
+	c, ok := ev.opts.Calendars[name]
+	if !ok || c == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrCalendarNotFound, name)
+	}
+
+	return c, nil
+}
+
+func paramsGetCalendarAt(ev *evaluation, rtParams FunctionParameterTypes, position int) (*HolidayCalendar, error) {
+	name, err := paramsGetStringAt(rtParams, position)
+	if err != nil {
+		return nil, err
+	}
+
+	return ev.calendar(name)
+}
+
+const FT_AddBusinessDays FT_FunctionType = "AddBusinessDays"
+
+func func_AddBusinessDays(rtParams FunctionParameterTypes, val any) (any, error) {
+	return errAny(FT_AddBusinessDays, ErrOnlyInQuery)
+}
+
+func evalFunc_AddBusinessDays(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(2); !ok {
+		return nil, errNumParams(FT_AddBusinessDays, 2, got)
+	}
+
+	n, err := paramsGetFirstOfNumber(rtParams[:1])
+	if err != nil {
+		return errAny(FT_AddBusinessDays, err)
+	}
+	if !n.IsInteger() {
+		return errAny(FT_AddBusinessDays, fmt.Errorf("can only add a whole number of business days"))
+	}
+	if n.Abs().GreaterThan(decimal.NewFromInt(maxBusinessDays)) {
+		return errAny(FT_AddBusinessDays, fmt.Errorf("can add at most %d business days", maxBusinessDays))
+	}
+
+	c, err := paramsGetCalendarAt(ev, rtParams, 1)
+	if err != nil {
+		return errAny(FT_AddBusinessDays, err)
+	}
+
+	t, err := convertToTime(val)
+	if err != nil {
+		return errAny(FT_AddBusinessDays, err)
+	}
+
+	return c.AddBusinessDays(t, int(n.IntPart())), nil
+}
+
+const FT_IsBusinessDay FT_FunctionType = "IsBusinessDay"
+
+func func_IsBusinessDay(rtParams FunctionParameterTypes, val any) (any, error) {
+	return errAny(FT_IsBusinessDay, ErrOnlyInQuery)
+}
+
+func evalFunc_IsBusinessDay(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(1); !ok {
+		return false, errNumParams(FT_IsBusinessDay, 1, got)
+	}
+
+	c, err := paramsGetCalendarAt(ev, rtParams, 0)
+	if err != nil {
+		return errBool(FT_IsBusinessDay, err)
+	}
+
+	t, err := convertToTime(val)
+	if err != nil {
+		return errBool(FT_IsBusinessDay, err)
+	}
+
+	return c.IsBusinessDay(t), nil
+}
+
+const FT_BusinessDaysBetween FT_FunctionType = "BusinessDaysBetween"
+
+func func_BusinessDaysBetween(rtParams FunctionParameterTypes, val any) (any, error) {
+	return errAny(FT_BusinessDaysBetween, ErrOnlyInQuery)
+}
+
+func evalFunc_BusinessDaysBetween(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(2); !ok {
+		return nil, errNumParams(FT_BusinessDaysBetween, 2, got)
+	}
+
+	other, err := paramsGetDateAt(rtParams, 0)
+	if err != nil {
+		return errAny(FT_BusinessDaysBetween, err)
+	}
+
+	c, err := paramsGetCalendarAt(ev, rtParams, 1)
+	if err != nil {
+		return errAny(FT_BusinessDaysBetween, err)
+	}
+
+	t, err := convertToTime(val)
+	if err != nil {
+		return errAny(FT_BusinessDaysBetween, err)
+	}
+
+	return decimal.NewFromInt(int64(c.BusinessDaysBetween(t, other))), nil
+}
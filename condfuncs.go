@@ -0,0 +1,167 @@
+package mpath
+
+import (
+	"errors"
+	"fmt"
+)
+
+// lazyParameters runs the parameters of a function only as they are used, so
+// that a parameter that is not used cannot fail the query
+type lazyParameters struct {
+	ev           *evaluation
+	params       FunctionParameterTypes
+	currentData  any
+	originalData any
+}
+
+func (p lazyParameters) len() int {
+	return len(p.params)
+}
+
+// value returns the value of the parameter at the position, running it if it
+// is a path or a logical operation
+func (p lazyParameters) value(position int) (any, error) {
+	if position >= len(p.params) {
+		return nil, fmt.Errorf("no parameter at position %d", position)
+	}
+
+	var op Operation
+	switch t := p.params[position].(type) {
+	case *FP_Path:
+		op = t.Value
+	case *FP_LogicalOperation:
+		op = t.Value
+	default:
+		return t.GetValue(), nil
+	}
+
+	val, err := op.do(p.ev, p.currentData, p.originalData)
+	if err != nil {
+		return nil, fmt.Errorf("issue with path parameter: %w", err)
+	}
+
+	if _, ok := val.(string); !ok {
+		val = convertToDecimalIfNumber(val)
+	}
+
+	return val, nil
+}
+
+// commonType returns the type that describes each of the types; if they are
+// not all the same, the values can be of any type
+func commonType(types ...InputOrOutput) (out InputOrOutput) {
+	for i, t := range types {
+		if i == 0 {
+			out = inputOrOutput(t.Type, t.IOType)
+			continue
+		}
+
+		if t.Type != out.Type {
+			out.Type = PT_Any
+		}
+		if t.IOType != out.IOType {
+			return inputOrOutput(PT_Any, IOOT_Single)
+		}
+	}
+
+	return out
+}
+
+// parameterTypes returns the types of the parameters from the position on
+func parameterTypes(params []*FunctionParameter, from int) (types []InputOrOutput) {
+	for i := from; i < len(params); i++ {
+		types = append(types, params[i].Type)
+	}
+
+	return types
+}
+
+// coalescedType returns the type of the value or the parameters; the root is
+// not a value (e.g. $.Coalesce($.a, $.b))
+func coalescedType(previousType InputOrOutput, params []*FunctionParameter) InputOrOutput {
+	types := parameterTypes(params, 0)
+	if previousType.Type != PT_Root {
+		types = append([]InputOrOutput{previousType}, types...)
+	}
+
+	return commonType(types...)
+}
+
+const FT_If FT_FunctionType = "If"
+
+func func_If(rtParams FunctionParameterTypes, val any) (any, error) {
+	return lazyFunc_If(lazyParameters{ev: backgroundEvaluation(), params: rtParams, currentData: val}, val)
+}
+
+func lazyFunc_If(params lazyParameters, _ any) (any, error) {
+	if params.len() != 3 {
+		return nil, errNumParams(FT_If, 3, params.len())
+	}
+
+	condition, err := params.value(0)
+	if err != nil {
+		return nil, fmt.Errorf("func %s: %w", FT_If, err)
+	}
+
+	// A null condition (e.g. from a missing field) is false
+	isTrue, err := conditionValue(FT_If, condition)
+	if err != nil {
+		return nil, err
+	}
+
+	if isTrue {
+		return params.value(1)
+	}
+
+	return params.value(2)
+}
+
+const FT_Coalesce FT_FunctionType = "Coalesce"
+
+func func_Coalesce(rtParams FunctionParameterTypes, val any) (any, error) {
+	return lazyFunc_Coalesce(lazyParameters{ev: backgroundEvaluation(), params: rtParams, currentData: val}, val)
+}
+
+func lazyFunc_Coalesce(params lazyParameters, val any) (any, error) {
+	return coalesce(FT_Coalesce, params, val)
+}
+
+// coalesce returns the value if it is not null, otherwise the first of the
+// parameters that is not null
+func coalesce(fnName FT_FunctionType, params lazyParameters, val any) (any, error) {
+	if !isNil(val) {
+		return val, nil
+	}
+
+	for i := 0; i < params.len(); i++ {
+		v, err := params.value(i)
+		if err != nil {
+			// A parameter that addresses a missing field is null
+			if errors.Is(err, ErrKeyNotFound) {
+				continue
+			}
+
+			return nil, fmt.Errorf("func %s: %w", fnName, err)
+		}
+
+		if !isNil(v) {
+			return v, nil
+		}
+	}
+
+	return nil, nil
+}
+
+const FT_Default FT_FunctionType = "Default"
+
+func func_Default(rtParams FunctionParameterTypes, val any) (any, error) {
+	return lazyFunc_Default(lazyParameters{ev: backgroundEvaluation(), params: rtParams, currentData: val}, val)
+}
+
+func lazyFunc_Default(params lazyParameters, val any) (any, error) {
+	if params.len() != 1 {
+		return nil, errNumParams(FT_Default, 1, params.len())
+	}
+
+	return coalesce(FT_Default, params, val)
+}
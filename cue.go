@@ -4,14 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 
 	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/ast"
 	"cuelang.org/go/cue/cuecontext"
 	"github.com/google/uuid"
 )
 
 func ListFunctions() (funcs map[FT_FunctionType]FunctionDescriptor) {
-	return funcMap
+	return defaultRegistry.ListFunctions()
 }
 
 type CanBeAPart interface {
@@ -38,6 +40,17 @@ func (x *HasError) SetError(errMessage string) {
 
 type CuePath []string
 
+// The segments of a cue path that stand for the children of the value (for a
+// wildcard), the fields with a name at any depth (for a recursive descent,
+// followed by the name) or a field that was written as a quoted key and would
+// otherwise be taken for a definition (followed by the name, e.g. `$["#tag"]`);
+// they start with a character that cannot be in a name
+const (
+	cuePathWildcard   = "\x00*"
+	cuePathDescendant = "\x00.."
+	cuePathQuoted     = "\x00\""
+)
+
 func (c CuePath) Add(s string) CuePath {
 	if len(c) == 0 {
 		return CuePath{s}
@@ -50,33 +63,73 @@ func (c CuePath) Add(s string) CuePath {
 // cueFile: the cue file
 // currentPath: the id of the step for which this query is an input value, or if for the output, leave blank
 func CueValidate(query, cueFile, currentPath string) (tc CanBeAPart, err error) {
+	return defaultRegistry.CueValidate(query, cueFile, currentPath)
+}
+
+// cueValueEntry is a compiled cue file, as held in the cue value cache
+type cueValueEntry struct {
+	mu    sync.Mutex
+	value cue.Value
+}
+
+// SetCueValidateCaches replaces the caches used by the package level
+// CueValidate; see FunctionRegistry.SetCaches.
+func SetCueValidateCaches(operations, cueValues Cache) {
+	defaultRegistry.SetCaches(operations, cueValues)
+}
+
+// CueValidateCacheStats returns the statistics of the caches used by the
+// package level CueValidate.
+func CueValidateCacheStats() (operations, cueValues CacheStats) {
+	return defaultRegistry.CacheStats()
+}
+
+// ResetCueValidateCaches empties the caches used by the package level
+// CueValidate.
+func ResetCueValidateCaches() {
+	defaultRegistry.ResetCaches()
+}
+
+// CueValidate validates the query against the cue file, using the functions
+// in the registry; see the package level CueValidate for the parameters.
+func (r *FunctionRegistry) CueValidate(query, cueFile, currentPath string) (tc CanBeAPart, err error) {
 	if query == "" || cueFile == "" {
 		return nil, fmt.Errorf("missing parameter value")
 	}
 
-	var ok bool
+	operationCache, cueValueCache := r.caches()
 
 	// mpath operations are cached to ensure speed of execution as this method is expected to be hit many times
 	var op Operation
-	if op, ok = mpathOpCache[query]; !ok {
-		op, err = ParseString(query)
+	if cached, ok := operationCache.Get(query); ok {
+		op, _ = cached.(Operation)
+	} else {
+		op, err = r.ParseString(query)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse mpath query: %w", err)
 		}
-		mpathOpCache[query] = op
+		operationCache.Add(query, op)
 	}
 
 	// cue values are cached to ensure speed of execution as this method is expected to be hit many times
-	var rootValue cue.Value
-	if rootValue, ok = cueValueCache[cueFile]; !ok {
+	var entry *cueValueEntry
+	if cached, ok := cueValueCache.Get(cueFile); ok {
+		entry = cached.(*cueValueEntry)
+	} else {
 		ctx := cuecontext.New()
-		rootValue = ctx.CompileString(cueFile)
-		if rootValue.Err() != nil {
-			return nil, fmt.Errorf("failed to parse cue file: %w", rootValue.Err())
+		entry = &cueValueEntry{value: ctx.CompileString(cueFile)}
+		if entry.value.Err() != nil {
+			return nil, fmt.Errorf("failed to parse cue file: %w", entry.value.Err())
 		}
-		cueValueCache[cueFile] = rootValue
+		cueValueCache.Add(cueFile, entry)
 	}
 
+	// cue values are not safe for concurrent use, so validations against
+	// the same cue file take turns
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	rootValue := entry.value
+
 	var blockedRootFields []string
 	if currentPath != "" {
 		blockedRootFields, err = getBlockedRootFields(rootValue, currentPath)
@@ -89,6 +142,24 @@ func CueValidate(query, cueFile, currentPath string) (tc CanBeAPart, err error)
 	// thus the next steps are to walk through the "paths" in the returned AST
 	// and doubt check that they are valid given the cueFile.
 
+	if q, ok := op.(*opQuery); ok {
+		for _, v := range q.Variables {
+			vv := v.validate(rootValue, blockedRootFields)
+			if vv.part.HasErrors() {
+				err = fmt.Errorf("variable '#%s': %s", v.Name, vv.part.GetErrors())
+				return vv.part, err
+			}
+
+			// The values of literals are added to the cue value, so that the
+			// paths that start at the variable can be validated
+			if vv.value != nil {
+				rootValue = rootValue.FillPath(cue.MakePath(cue.Def(v.cueDefinition())), *vv.value)
+			}
+		}
+
+		op = q.Operation
+	}
+
 	switch t := op.(type) {
 	case *opPath:
 		ptc, _ := t.Validate(rootValue, CuePath{}, blockedRootFields)
@@ -114,6 +185,17 @@ func CueValidate(query, cueFile, currentPath string) (tc CanBeAPart, err error)
 
 		pps := t.Sprint(0)
 		logicalOperation.PrettyPrintedString = &pps
+
+	case *opLiteral:
+		literal, _ := t.Validate(rootValue, CuePath{}, blockedRootFields)
+		tc = literal
+		if literal.HasErrors() {
+			err = fmt.Errorf("%s", literal.GetErrors())
+			return
+		}
+
+		pps := t.Sprint(0)
+		literal.PrettyPrintedString = &pps
 	}
 
 	return
@@ -134,6 +216,15 @@ func strInStrSlice(s string, ss []string) (isInSlice bool) {
 }
 
 func getSelectorForField(inputValue cue.Value, name string) (selector cue.Selector) {
+	if field, ok := strings.CutPrefix(name, cuePathQuoted); ok {
+		return cue.Str(field)
+	}
+
+	if strings.HasPrefix(name, "#") && ast.IsValidIdent(name) {
+		// Definitions hold the types of variables passed in to the query
+		return cue.Def(name)
+	}
+
 	if !(strings.HasPrefix(name, "_") && !strings.Contains(name, "-")) {
 		return cue.Str(name)
 	}
@@ -150,6 +241,7 @@ func getSelectorForField(inputValue cue.Value, name string) (selector cue.Select
 
 func findValueAtPath(inputValue cue.Value, cuePath CuePath) (outputValue cue.Value, err error) {
 	errFunc := func(s string, v cue.Value, _ error) (cue.Value, error) {
+		s = strings.ReplaceAll(s, cuePathQuoted, "")
 		return v, fmt.Errorf("couldn't access field '%s'", s)
 		// return v, fmt.Errorf("couldn't access field '%s': %w; value is %#v", s, err, v)
 	}
@@ -161,7 +253,19 @@ func findValueAtPath(inputValue cue.Value, cuePath CuePath) (outputValue cue.Val
 	*/
 
 	var thisValue cue.Value
-	for _, cp := range cuePath {
+	for i, cp := range cuePath {
+		switch {
+		case cp == cuePathWildcard:
+			children, err := childrenOfValue(outputValue)
+			if err != nil {
+				return outputValue, err
+			}
+			return findValueAtPaths(children, cuePath[i+1:], "*")
+		case strings.HasPrefix(cp, cuePathDescendant):
+			name := strings.TrimPrefix(cp, cuePathDescendant)
+			return findValueAtPaths(descendantsOfValue(outputValue, name), cuePath[i+1:], ".."+name)
+		}
+
 		selector := getSelectorForField(outputValue, cp)
 		thisValue = outputValue.LookupPath(cue.MakePath(selector))
 		if thisValue.Err() != nil {
@@ -212,6 +316,115 @@ func findValueAtPath(inputValue cue.Value, cuePath CuePath) (outputValue cue.Val
 	return outputValue, outputValue.Err()
 }
 
+// childrenOfValue returns the values of the fields of a struct, or the value
+// of the elements of a list
+func childrenOfValue(v cue.Value) ([]cue.Value, error) {
+	switch v.IncompleteKind() {
+	case cue.ListKind:
+		elem, err := getUnderlyingValue(v)
+		if err != nil {
+			return nil, err
+		}
+		return []cue.Value{elem}, nil
+	case cue.StructKind:
+	default:
+		return nil, fmt.Errorf("only objects and arrays have children for '*'")
+	}
+
+	it, err := v.Fields(cue.Optional(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list fields: %w", err)
+	}
+
+	children := []cue.Value{}
+	for it.Next() {
+		children = append(children, it.Value())
+	}
+
+	return children, nil
+}
+
+// maxDescendantDepth limits how deeply the cue is searched for a recursive
+// descent, as definitions can refer to themselves
+const maxDescendantDepth = 32
+
+// descendantsOfValue returns the values of the fields with the name at any
+// depth within the value; names match in the same way as idents
+func descendantsOfValue(v cue.Value, name string) (found []cue.Value) {
+	var walk func(v cue.Value, depth int)
+	walk = func(v cue.Value, depth int) {
+		if depth > maxDescendantDepth {
+			return
+		}
+
+		switch v.IncompleteKind() {
+		case cue.ListKind:
+			if elem, err := getUnderlyingValue(v); err == nil {
+				walk(elem, depth+1)
+			}
+		case cue.StructKind:
+			it, err := v.Fields(cue.Optional(true))
+			if err != nil {
+				return
+			}
+
+			for it.Next() {
+				if strings.EqualFold(strings.Trim(it.Selector().String(), `"?!`), name) {
+					found = append(found, it.Value())
+				}
+				walk(it.Value(), depth+1)
+			}
+		}
+	}
+	walk(v, 0)
+
+	return found
+}
+
+// findValueAtPaths finds the value at the cue path within each of the values
+// that were matched by a wildcard or a recursive descent, and returns the
+// value that describes all of those that are found; in the same way as when
+// the query is run, values without the field are skipped
+func findValueAtPaths(values []cue.Value, cuePath CuePath, matchedBy string) (outputValue cue.Value, err error) {
+	found := []cue.Value{}
+	for _, v := range values {
+		if fv, err := findValueAtPath(v, cuePath); err == nil {
+			found = append(found, fv)
+		}
+	}
+
+	if len(found) == 0 {
+		if len(cuePath) == 0 {
+			return outputValue, fmt.Errorf("nothing is matched by '%s'", matchedBy)
+		}
+		return outputValue, fmt.Errorf("couldn't access field '%s' of the values matched by '%s'", strings.ReplaceAll(strings.Join(cuePath, "."), cuePathQuoted, ""), matchedBy)
+	}
+
+	kind := cue.BottomKind
+	for _, v := range found {
+		kind |= v.IncompleteKind()
+	}
+
+	switch {
+	case kind == cue.StructKind:
+		// Structs are unified so that the fields of all of them are known
+		outputValue = found[0]
+		for _, v := range found[1:] {
+			outputValue = outputValue.Unify(v)
+		}
+		if outputValue.Err() != nil {
+			outputValue = found[0]
+		}
+		return outputValue, nil
+	case kind&(kind-1) == 0, kind&^cue.NumberKind == 0:
+		// The values are all of the same kind
+		return found[0], nil
+	}
+
+	// Values of different kinds can only be described by top
+	return found[0].Context().CompileString("_"), nil
+}
+
 func getUnderlyingKind(v cue.Value) (kind cue.Kind, err error) {
 	if v.IncompleteKind() == cue.ListKind {
 		var it cue.Iterator
@@ -278,6 +491,11 @@ func getAvailableFieldsForValue(v cue.Value, blockedRootFields []string) (fields
 			continue
 		}
 
+		if it.Selector().IsDefinition() {
+			// Definitions are the types of variables rather than fields
+			continue
+		}
+
 		if checkIfValueInList(fldName, blockedRootFields) {
 			continue
 		}
@@ -312,11 +530,6 @@ func checkIfValueInList(value string, list []string) (isInList bool) {
 	return false
 }
 
-var (
-	mpathOpCache  = map[string]Operation{}
-	cueValueCache = map[string]cue.Value{}
-)
-
 type BP_BasePath string
 
 const (
@@ -572,6 +785,128 @@ func (x *PathIdent) MarshalJSON() ([]byte, error) {
 	})
 }
 
+type sliceFields struct {
+	HasError
+
+	String    string        `json:"string"`
+	Type      InputOrOutput `json:"type"`
+	Available *Available    `json:"available,omitempty"`
+}
+
+type Slice struct {
+	sliceFields
+}
+
+func (x *Slice) PathString() string {
+	return x.String
+}
+
+func (x *Slice) HasErrors() (out bool) {
+	return x.Error != nil
+}
+
+func (x *Slice) GetErrors() (errMessage string) {
+	if x.Error != nil {
+		return *x.Error
+	}
+
+	return
+}
+
+func (x *Slice) ReturnType() InputOrOutput {
+	return x.Type
+}
+func (x *Slice) PartType() string {
+	return "Slice"
+}
+func (x *Slice) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID       string `json:"id"`
+		PartType string `json:"partType"`
+		sliceFields
+	}{
+		ID:          uuid.New().String(),
+		PartType:    x.PartType(),
+		sliceFields: x.sliceFields,
+	})
+}
+
+type literalFields struct {
+	HasError
+
+	String              string           `json:"string"`
+	PrettyPrintedString *string          `json:"prettyPrintedString,omitempty"`
+	Type                InputOrOutput    `json:"type"`
+	Members             []*LiteralMember `json:"members,omitempty"`
+	Available           *Available       `json:"available,omitempty"`
+}
+
+// LiteralMember is a field of an object literal or an element of an array
+// literal; Part is nil for literal values
+type LiteralMember struct {
+	Key    *string       `json:"key,omitempty"`
+	String string        `json:"string"`
+	Type   InputOrOutput `json:"type"`
+	Part   CanBeAPart    `json:"part,omitempty"`
+}
+
+type Literal struct {
+	literalFields
+}
+
+func (x *Literal) PathString() string {
+	return x.String
+}
+
+func (x *Literal) HasErrors() (out bool) {
+	if x.Error != nil {
+		return true
+	}
+
+	for _, m := range x.Members {
+		if m.Part != nil && m.Part.HasErrors() {
+			return true
+		}
+	}
+
+	return
+}
+
+func (x *Literal) GetErrors() (errMessage string) {
+	errMessages := []string{}
+	if x.Error != nil && *x.Error != "" {
+		errMessages = append(errMessages, *x.Error)
+	}
+
+	for _, m := range x.Members {
+		if m.Part != nil && m.Part.HasErrors() {
+			if errs := m.Part.GetErrors(); errs != "" {
+				errMessages = append(errMessages, errs)
+			}
+		}
+	}
+
+	return strings.Join(errMessages, "; ")
+}
+
+func (x *Literal) ReturnType() InputOrOutput {
+	return x.Type
+}
+func (x *Literal) PartType() string {
+	return "Literal"
+}
+func (x *Literal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID       string `json:"id"`
+		PartType string `json:"partType"`
+		literalFields
+	}{
+		ID:            uuid.New().String(),
+		PartType:      x.PartType(),
+		literalFields: x.literalFields,
+	})
+}
+
 type FunctionParameter struct {
 	String                          string        `json:"string"`
 	Type                            InputOrOutput `json:"type"`
@@ -594,6 +929,10 @@ type functionFields struct {
 
 type Function struct {
 	functionFields
+
+	// calledOn is the name of the field that the function is called on, if it
+	// is known; it is used to explain the function
+	calledOn string
 }
 
 func (x *Function) PathString() string {
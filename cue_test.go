@@ -3,6 +3,7 @@ package mpath
 import (
 	"encoding/json"
 	"sort"
+	"sync"
 	"testing"
 )
 
@@ -337,6 +338,115 @@ func Test_CueStringTableTests(t *testing.T) {
 	}
 }
 
+func Test_CueValidateConcurrent(t *testing.T) {
+	t.Parallel()
+
+	// Small caches make sure that values are evicted while in use
+	reg := NewFunctionRegistry()
+	reg.SetCaches(NewLRUCache(5), NewLRUCache(1))
+
+	cueFiles := []string{cueStringForTests, cueStringForTests + "\n#other: string\n"}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			cueFile := cueFiles[g%len(cueFiles)]
+			for _, test := range cueTableTests {
+				tc, err := reg.CueValidate(test.mq, cueFile, test.cp)
+				if err != nil && !test.expectErrors {
+					t.Errorf("test '%s'; got unexpected returned error: %v", test.name, err)
+				}
+				if tc != nil && tc.HasErrors() != test.expectErrors {
+					t.Errorf("test '%s'; expected %t got %t for HasErrors(); err was '%v'", test.name, test.expectErrors, tc.HasErrors(), tc.GetErrors())
+				}
+			}
+		}(g)
+
+		if g == 4 {
+			reg.ResetCaches()
+		}
+	}
+	wg.Wait()
+
+	operations, cueValues := reg.CacheStats()
+	if operations.Size > 5 || cueValues.Size > 1 {
+		t.Errorf("caches exceeded their capacity: %+v, %+v", operations, cueValues)
+	}
+	if operations.Hits+operations.Misses == 0 || cueValues.Evictions == 0 {
+		t.Errorf("expected the caches to be used: %+v, %+v", operations, cueValues)
+	}
+
+	reg.ResetCaches()
+	if operations, cueValues = reg.CacheStats(); operations != (CacheStats{Capacity: 5}) || cueValues != (CacheStats{Capacity: 1}) {
+		t.Errorf("expected the caches to be empty after reset: %+v, %+v", operations, cueValues)
+	}
+}
+
+type countingCache struct {
+	Cache
+	mu   sync.Mutex
+	adds int
+}
+
+func (c *countingCache) Add(key string, value any) {
+	c.mu.Lock()
+	c.adds++
+	c.mu.Unlock()
+
+	c.Cache.Add(key, value)
+}
+
+func Test_CueValidateCustomCache(t *testing.T) {
+	t.Parallel()
+
+	reg := NewFunctionRegistry()
+	operations := &countingCache{Cache: NewLRUCache(0)}
+	reg.SetCaches(operations, nil)
+
+	for i := 0; i < 3; i++ {
+		if _, err := reg.CueValidate(`$.a`, `"a": string`, ""); err != nil {
+			t.Fatalf("got unexpected error: %v", err)
+		}
+	}
+
+	if operations.adds != 1 {
+		t.Errorf("expected the query to be added to the cache once, got %d", operations.adds)
+	}
+
+	stats, _ := reg.CacheStats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Size != 1 {
+		t.Errorf("unexpected cache stats: %+v", stats)
+	}
+}
+
+func Test_LRUCache(t *testing.T) {
+	t.Parallel()
+
+	c := NewLRUCache(2)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Get("a")    // a is now the most recently used
+	c.Add("c", 3) // so b is evicted
+
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("expected 'b' to be evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Errorf("expected 'a' to be 1, got %v", v)
+	}
+	if v, ok := c.Get("c"); !ok || v != 3 {
+		t.Errorf("expected 'c' to be 3, got %v", v)
+	}
+
+	expected := CacheStats{Hits: 3, Misses: 1, Evictions: 1, Size: 2, Capacity: 2}
+	if stats := c.Stats(); stats != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+}
+
 type tableTest struct {
 	name         string
 	mq           string
@@ -456,6 +566,508 @@ var (
 			mq:   `$.step1.result.AsJSON()`,
 			cp:   "step2",
 		},
+		{
+			name: "variable can be used as a function parameter",
+			mq:   `#num = $.step1.num; $.step2.num.Greater(#num)`,
+			cp:   "step3",
+		},
+		{
+			name: "variable can be addressed into",
+			mq:   `#first = $.step1.result.First(); #first.age.Greater(1)`,
+			cp:   "step2",
+		},
+		{
+			name: "logical operation can be used as a variable",
+			mq:   `#adult = {$.step1.num.Greater(17)}; {OR,#adult,$.step1.result.First().age.Equal(1)}`,
+			cp:   "step2",
+		},
+		{
+			name: "infix comparisons",
+			mq:   `$.step1.num >= 10 && !($.input.name == "x" || $.step1.num < 1)`,
+			cp:   "step2",
+		},
+		{
+			name:         "infix comparisons are type checked",
+			mq:           `$.input.name > 10`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name: "infix arithmetic",
+			mq:   `($.step1.num + 1) * 2 > 10`,
+			cp:   "step2",
+		},
+		{
+			name:         "infix arithmetic is type checked",
+			mq:           `$.input.name + 1`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "infix arithmetic with a path is type checked",
+			mq:           `$.step1.num * $.input.name`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "number parameters cannot be string literals",
+			mq:           `$.step1.num.Add("1")`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "number parameters cannot be string paths",
+			mq:           `$.step1.num.Multiply($.input.name)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "string parameters cannot be number paths",
+			mq:           `$.input.name.Contains($.step1.num)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "parameters that take any type are not type checked",
+			mq:           `$.step1.num.Equal($.input.name)`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name: "infix arithmetic with a number on the left",
+			mq:   `100 / $.step1.num > 10 % $.step1.num`,
+			cp:   "step2",
+		},
+		{
+			name:         "infix arithmetic with a number on the left is type checked",
+			mq:           `100 / $.input.name`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "functions called on a number are type checked",
+			mq:           `(10).ToUpper()`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name: "date functions can be used on strings",
+			mq:   `$.input.name.AddDuration(1, "day").IsBefore($.Now())`,
+			cp:   "step2",
+		},
+		{
+			name:         "date functions are type checked",
+			mq:           `$.step1.num.DayOfWeek()`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "date parameters are type checked",
+			mq:           `$.input.name.IsBefore($.step1.num)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name: "time zones",
+			mq:   `$.input.name.ParseDate("2006-01-02", "Australia/Perth").InTimezone("Pacific/Auckland").LocalDate()`,
+			cp:   "step2",
+		},
+		{
+			name:         "time zone literals are validated",
+			mq:           `$.input.name.InTimezone("Australia/Narnia")`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "default time zone literals are validated",
+			mq:           `$.input.name.ParseDate("2006-01-02", "Perth")`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name: "business day functions",
+			mq:   `$.input.name.AddBusinessDays($.step1.num, "NSW").BusinessDaysBetween($.Now(), "NSW") > 2`,
+			cp:   "step2",
+		},
+		{
+			name: "string functions chain through split",
+			mq:   `$.input.name.TrimSpace().Split(",").First().ToUpper().PadLeft($.step1.num, "0")`,
+			cp:   "step2",
+		},
+		{
+			name: "split results can be joined",
+			mq:   `$.input.name.Split(" ").Join("-").Substring(0, 10).Length() > $.step1.num`,
+			cp:   "step2",
+		},
+		{
+			name: "split results can be counted",
+			mq:   `$.input.name.Split(",").Count() > 1`,
+			cp:   "step2",
+		},
+		{
+			name:         "string functions are type checked",
+			mq:           `$.step1.num.ToUpper()`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "join is only valid on arrays",
+			mq:           `$.input.name.Join(",")`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "string function parameters are type checked",
+			mq:           `$.input.name.Repeat("twice")`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name: "fold functions",
+			mq:   `$.input.name.EqualFold("abc", "StripDiacritics") && $.input.name.AnyOfFold("abc", "def")`,
+			cp:   "step2",
+		},
+		{
+			name:         "fold functions are type checked",
+			mq:           `$.step1.num.ContainsFold("abc")`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name: "sorting and paging keep the fields of object arrays",
+			mq:   `$.step1.result.SortBy("$.age").Reverse().Skip(1).Take(3).First().name`,
+			cp:   "step2",
+		},
+		{
+			name: "distinct keeps the element type",
+			mq:   `$.step1.result.DistinctBy("$.name").Last().age > 18`,
+			cp:   "step2",
+		},
+		{
+			name:         "sorted object arrays are type checked",
+			mq:           `$.step1.result.Sort().First().height`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "sorted arrays cannot be addressed into",
+			mq:           `$.step1.result.SortDesc().name`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name: "grouped results can be addressed",
+			mq:   `$.step1.result.GroupBy("$.name").TNT.Count() > 1`,
+			cp:   "step2",
+		},
+		{
+			name: "keyed aggregations",
+			mq:   `$.step1.result.SumBy("$.name", "$.age").AsJSON()`,
+			cp:   "step2",
+		},
+		{
+			name:         "keyed aggregations take queries",
+			mq:           `$.step1.result.SumBy("$.name", $.step1.num)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name: "map functions",
+			mq:   `$.step1.Keys().First().ToUpper().Equal("NUM") && $.step1.HasKey("num")`,
+			cp:   "step2",
+		},
+		{
+			name: "keys of grouped results",
+			mq:   `$.step1.result.GroupBy("$.name").Keys().Count()`,
+			cp:   "step2",
+		},
+		{
+			name:         "elements of returned arrays keep their type",
+			mq:           `$.step1.Keys().First().Add(1)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "map functions are only valid on objects",
+			mq:           `$.step1.num.Keys()`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "map functions are not valid on arrays",
+			mq:           `$.step1.result.Entries()`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "quoted keys are looked up in cue",
+			mq:           `$["4ebec022-4119-4cc8-bb7f-7a713790305c"].result.ToUpper()`,
+			cp:           "87e54fe3-6e64-454e-acf7-1a36801f1b87",
+			expectErrors: false,
+		},
+		{
+			name:         "quoted keys that start with '#' are fields rather than definitions",
+			mq:           `$.step1["#tag"].ToUpper()`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "quoted keys that start with '#' do not address definitions",
+			mq:           `$["#rate"]`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "quoted keys must exist in cue",
+			mq:           `$.step1["not a field"]`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "slices keep the element type",
+			mq:           `$.step1.result[1:].First().name.ToUpper()`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "slices can follow functions",
+			mq:           `$.step1.result.SortBy("$.age")[::-1].Count()`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "only arrays can be sliced",
+			mq:           `$.step1.num[0:1]`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "index within closed list",
+			mq:           `$.step1.result.Index(-1).name`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "index outside of closed list",
+			mq:           `$.step1.result.Index(1).name`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "index of open list is not checked",
+			mq:           `$.step2.result.Index(5).age`,
+			cp:           "step3",
+			expectErrors: false,
+		},
+		{
+			name:         "index after slice is not checked",
+			mq:           `$.step1.result[0:].Index(1).name`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "wildcard selects the field from each child",
+			mq:           `$.step7.results.*.example.First().ToUpper()`,
+			cp:           "step8",
+			expectErrors: false,
+		},
+		{
+			name:         "wildcard children must have the field",
+			mq:           `$.step7.results.*.missing`,
+			cp:           "step8",
+			expectErrors: true,
+		},
+		{
+			name:         "wildcard cannot be used on primitives",
+			mq:           `$.step7.results.First().example.*`,
+			cp:           "step8",
+			expectErrors: true,
+		},
+		{
+			name:         "recursive descent finds nested fields",
+			mq:           `$.step7..nested.First().boolean`,
+			cp:           "step8",
+			expectErrors: false,
+		},
+		{
+			name:         "recursive descent must find the field",
+			mq:           `$.step7..missing`,
+			cp:           "step8",
+			expectErrors: true,
+		},
+		{
+			name:         "if returns the type of its branches",
+			mq:           `$.If($.step1.num > 3, "PALLET", "CARTON").ToLower()`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "if condition must be boolean",
+			mq:           `$.If($.step1.num, "PALLET", "CARTON")`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "default keeps the type of the value",
+			mq:           `$.step1.num.Default(0).Add(1)`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "coalesce of different types",
+			mq:           `$.Coalesce($.step1.num, "none").Add(1)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "object literal of paths",
+			mq:           `{"num": $.step1.num, "names": $.step1.result.Select("$.name"), "isOld": $.step1.result.First().age > 60}`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "object literal members are validated",
+			mq:           `{"num": $.step1.missing}`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "fields of object literal variable are validated",
+			mq:           `#o = {"num": $.step1.num, "first": $.step1.result.First()}; #o.first.name.ToUpper()`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "object literal variable must have the field",
+			mq:           `#o = {"num": $.step1.num}; #o.missing`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "fields of object literal variable are type checked",
+			mq:           `#o = {"num": $.step1.num, "label": "a"}; #o.num.ToUpper()`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "array literal of numbers",
+			mq:           `#a = [$.step1.num, 2]; #a.Sum()`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "pick on object",
+			mq:           `$.step1.result.First().Pick("name", "age")`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "pick on number",
+			mq:           `$.step1.num.Pick("name")`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "map of element fields",
+			mq:           `$.step1.result.Map(@.age.Add($.step1.num))`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "map body is validated against the element",
+			mq:           `$.step1.result.Map(@.missing)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "map returns an array of the body type",
+			mq:           `$.step1.result.Map(@.name).Sum()`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "where condition must be boolean",
+			mq:           `$.step1.result.Where(@.age)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "where returns the elements",
+			mq:           `$.step1.result.Where(@.age > $.step1.num).Count()`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "function parameters in lambda start at the element",
+			mq:           `$.step1.result.All(@.name.Equal(@.name))`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "lambda element fields must exist in function parameters",
+			mq:           `$.step1.result.AnyMatch(@.age.Equal(@.missing))`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "reduce accumulator has the type of the initial value",
+			mq:           `$.step1.result.Reduce(0, #acc.Add(@.age))`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "reduce accumulator is type checked",
+			mq:           `$.step1.result.Reduce("", #acc.Add(@.age))`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "none of the elements",
+			mq:           `$.step1.result.None(@.name == "a")`,
+			cp:           "step2",
+			expectErrors: false,
+		},
+		{
+			name:         "exactly needs a number",
+			mq:           `$.step1.result.Exactly("2", @.age > 1)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "exactly condition is validated against the element",
+			mq:           `$.step1.result.Exactly(2, @.missing)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "variable usage is type checked",
+			mq:           `#name = $.input.name; $.step1.num.Add(#name)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "functions on variable are type checked",
+			mq:           `#name = $.input.name; #name.Add(1)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name:         "variable cannot be declared from unavailable field",
+			mq:           `#num = $.step2.num; $.step1.num.Equal(#num)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
+		{
+			name: "variable passed in is typed by cue definition",
+			mq:   `$.step1.num.Multiply(#rate)`,
+			cp:   "step2",
+		},
+		{
+			name:         "variable that is not declared",
+			mq:           `$.step1.num.Multiply(#missing)`,
+			cp:           "step2",
+			expectErrors: true,
+		},
 	}
 )
 
@@ -465,6 +1077,7 @@ const (
 	
 		step1: {
 			num: int
+			"#tag": string
 			_dependencies: [] 
 			result: [{
 				name: string
@@ -619,6 +1232,8 @@ const (
 			test: string
 			_dependencies: []
 		}
+
+		#rate: number
 	`
 )
 
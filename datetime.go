@@ -0,0 +1,404 @@
+package mpath
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// dateLayouts are the layouts that strings are parsed with when they are used
+// as dates without a call to ParseDate; dates without a time zone are in UTC
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	time.DateOnly,
+}
+
+// namedDateLayouts can be used in place of a layout in ParseDate and
+// FormatDate
+var namedDateLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"DateTime":    time.DateTime,
+	"DateOnly":    time.DateOnly,
+	"TimeOnly":    time.TimeOnly,
+	"Kitchen":     time.Kitchen,
+}
+
+func dateLayout(layout string) string {
+	if named, ok := namedDateLayouts[layout]; ok {
+		return named
+	}
+
+	return layout
+}
+
+// convertToTime returns the value as a time; strings are parsed with any of
+// the dateLayouts
+func convertToTime(val any) (t time.Time, err error) {
+	switch vt := val.(type) {
+	case time.Time:
+		return vt, nil
+	case *time.Time:
+		if vt != nil {
+			return *vt, nil
+		}
+	case string:
+		for _, layout := range dateLayouts {
+			if t, err = time.Parse(layout, vt); err == nil {
+				return t, nil
+			}
+		}
+		return t, fmt.Errorf("'%s' is not a recognised date; use ParseDate to parse it with a layout", vt)
+	}
+
+	return t, fmt.Errorf("value of type %T is not a date", val)
+}
+
+type dateUnit string
+
+const (
+	du_Year   dateUnit = "year"
+	du_Month  dateUnit = "month"
+	du_Week   dateUnit = "week"
+	du_Day    dateUnit = "day"
+	du_Hour   dateUnit = "hour"
+	du_Minute dateUnit = "minute"
+	du_Second dateUnit = "second"
+)
+
+var dateUnitDurations = map[dateUnit]time.Duration{
+	du_Week:   7 * 24 * time.Hour,
+	du_Day:    24 * time.Hour,
+	du_Hour:   time.Hour,
+	du_Minute: time.Minute,
+	du_Second: time.Second,
+}
+
+// parseDateUnit reads the unit, which may be plural and in any case
+func parseDateUnit(s string) (dateUnit, error) {
+	unit := dateUnit(strings.TrimSuffix(strings.ToLower(s), "s"))
+
+	switch unit {
+	case du_Year, du_Month, du_Week, du_Day, du_Hour, du_Minute, du_Second:
+		return unit, nil
+	}
+
+	return unit, fmt.Errorf("'%s' is not a unit of time; use one of year, month, week, day, hour, minute or second", s)
+}
+
+// paramsGetAt returns the value of the parameter at the position
+func paramsGetAt(rtParams FunctionParameterTypes, position int) (val any, err error) {
+	if position >= len(rtParams) {
+		return nil, fmt.Errorf("no parameter at position %d", position)
+	}
+
+	return rtParams[position].GetValue(), nil
+}
+
+func paramsGetDateAt(rtParams FunctionParameterTypes, position int) (t time.Time, err error) {
+	val, err := paramsGetAt(rtParams, position)
+	if err != nil {
+		return t, err
+	}
+
+	return convertToTime(val)
+}
+
+func paramsGetStringAt(rtParams FunctionParameterTypes, position int) (s string, err error) {
+	val, err := paramsGetAt(rtParams, position)
+	if err != nil {
+		return s, err
+	}
+
+	s, ok := val.(string)
+	if !ok {
+		return s, fmt.Errorf("parameter at position %d was not a string", position)
+	}
+
+	return s, nil
+}
+
+func paramsGetUnitAt(rtParams FunctionParameterTypes, position int) (unit dateUnit, err error) {
+	s, err := paramsGetStringAt(rtParams, position)
+	if err != nil {
+		return unit, err
+	}
+
+	return parseDateUnit(s)
+}
+
+const FT_Now FT_FunctionType = "Now"
+
+func func_Now(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_Now(backgroundEvaluation(), rtParams, val)
+}
+
+func evalFunc_Now(ev *evaluation, rtParams FunctionParameterTypes, _ any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(0); !ok {
+		return nil, errNumParams(FT_Now, 0, got)
+	}
+
+	return ev.now(), nil
+}
+
+const FT_ParseDate FT_FunctionType = "ParseDate"
+
+func func_ParseDate(rtParams FunctionParameterTypes, val any) (any, error) {
+	got, _ := rtParams.checkLengthOfParams(-1)
+	if got != 1 && got != 2 {
+		return nil, fmt.Errorf("(%s) expected 1 or 2 params, got %d", FT_ParseDate, got)
+	}
+
+	layout, err := paramsGetStringAt(rtParams, 0)
+	if err != nil {
+		return errAny(FT_ParseDate, err)
+	}
+
+	// Dates without a time zone are in the default zone, if there is one
+	loc := time.UTC
+	if got == 2 {
+		if loc, err = paramsGetLocationAt(rtParams, 1); err != nil {
+			return errAny(FT_ParseDate, err)
+		}
+	}
+
+	switch vt := val.(type) {
+	case string:
+		t, err := time.ParseInLocation(dateLayout(layout), vt, loc)
+		if err != nil {
+			return errAny(FT_ParseDate, fmt.Errorf("'%s' does not match the layout '%s'", vt, layout))
+		}
+		return t, nil
+	case time.Time, *time.Time:
+		return convertToTime(vt)
+	}
+
+	return errAny(FT_ParseDate, fmt.Errorf("value was not a string"))
+}
+
+const FT_FormatDate FT_FunctionType = "FormatDate"
+
+func func_FormatDate(rtParams FunctionParameterTypes, val any) (any, error) {
+	layout, err := paramsGetFirstOfString(rtParams)
+	if err != nil {
+		return errString(FT_FormatDate, err)
+	}
+
+	t, err := convertToTime(val)
+	if err != nil {
+		return errString(FT_FormatDate, err)
+	}
+
+	return t.Format(dateLayout(layout)), nil
+}
+
+const FT_AddDuration FT_FunctionType = "AddDuration"
+
+func func_AddDuration(rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(2); !ok {
+		return nil, errNumParams(FT_AddDuration, 2, got)
+	}
+
+	amount, err := paramsGetFirstOfNumber(rtParams[:1])
+	if err != nil {
+		return errAny(FT_AddDuration, err)
+	}
+
+	unit, err := paramsGetUnitAt(rtParams, 1)
+	if err != nil {
+		return errAny(FT_AddDuration, err)
+	}
+
+	t, err := convertToTime(val)
+	if err != nil {
+		return errAny(FT_AddDuration, err)
+	}
+
+	// Years and months are added to the calendar date; they must be whole
+	switch unit {
+	case du_Year, du_Month:
+		if !amount.IsInteger() {
+			return errAny(FT_AddDuration, fmt.Errorf("can only add a whole number of %ss", unit))
+		}
+		if amount.Abs().GreaterThan(maxCalendarAmount) {
+			return errAny(FT_AddDuration, fmt.Errorf("cannot add %s %ss, as it is more than %s", amount, unit, maxCalendarAmount))
+		}
+		if unit == du_Year {
+			return t.AddDate(int(amount.IntPart()), 0, 0), nil
+		}
+		return t.AddDate(0, int(amount.IntPart()), 0), nil
+	}
+
+	d := amount.Mul(decimal.NewFromInt(int64(dateUnitDurations[unit])))
+	if d.Abs().GreaterThan(maxDuration) {
+		return errAny(FT_AddDuration, fmt.Errorf("cannot add %s %ss, as it is longer than %s", amount, unit, time.Duration(math.MaxInt64)))
+	}
+
+	return t.Add(time.Duration(d.IntPart())), nil
+}
+
+var (
+	// maxDuration is the longest duration that can be added to a date, which
+	// is about 292 years
+	maxDuration = decimal.NewFromInt(math.MaxInt64)
+
+	// maxCalendarAmount is the largest number of years or months that can be
+	// added to a date
+	maxCalendarAmount = decimal.NewFromInt(math.MaxInt32)
+)
+
+const FT_DateDiff FT_FunctionType = "DateDiff"
+
+func func_DateDiff(rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(2); !ok {
+		return nil, errNumParams(FT_DateDiff, 2, got)
+	}
+
+	other, err := paramsGetDateAt(rtParams, 0)
+	if err != nil {
+		return errAny(FT_DateDiff, err)
+	}
+
+	unit, err := paramsGetUnitAt(rtParams, 1)
+	if err != nil {
+		return errAny(FT_DateDiff, err)
+	}
+
+	t, err := convertToTime(val)
+	if err != nil {
+		return errAny(FT_DateDiff, err)
+	}
+
+	switch unit {
+	case du_Year:
+		return decimal.NewFromInt(int64(monthsBetween(t, other) / 12)), nil
+	case du_Month:
+		return decimal.NewFromInt(int64(monthsBetween(t, other))), nil
+	}
+
+	// The difference is found in nanoseconds as a decimal, as a
+	// time.Duration cannot hold more than about 292 years
+	seconds := decimal.NewFromInt(other.Unix()).Sub(decimal.NewFromInt(t.Unix()))
+	nanoseconds := seconds.Shift(9).Add(decimal.NewFromInt(int64(other.Nanosecond() - t.Nanosecond())))
+	units, _ := nanoseconds.QuoRem(decimal.NewFromInt(int64(dateUnitDurations[unit])), 0)
+
+	return units, nil
+}
+
+// monthsBetween returns the number of whole calendar months from t1 to t2,
+// which is negative if t2 is before t1
+func monthsBetween(t1, t2 time.Time) int {
+	if t2.Before(t1) {
+		return -monthsBetween(t2, t1)
+	}
+
+	months := (t2.Year()-t1.Year())*12 + int(t2.Month()-t1.Month())
+	if t1.AddDate(0, months, 0).After(t2) {
+		months--
+	}
+
+	return months
+}
+
+const FT_StartOf FT_FunctionType = "StartOf"
+
+func func_StartOf(rtParams FunctionParameterTypes, val any) (any, error) {
+	s, err := paramsGetFirstOfString(rtParams)
+	if err != nil {
+		return errAny(FT_StartOf, err)
+	}
+
+	unit, err := parseDateUnit(s)
+	if err != nil {
+		return errAny(FT_StartOf, err)
+	}
+
+	t, err := convertToTime(val)
+	if err != nil {
+		return errAny(FT_StartOf, err)
+	}
+
+	return startOf(t, unit), nil
+}
+
+// startOf returns the start of the unit of time that t is in; weeks start on
+// Monday
+func startOf(t time.Time, unit dateUnit) time.Time {
+	year, month, day := t.Date()
+
+	switch unit {
+	case du_Year:
+		return time.Date(year, time.January, 1, 0, 0, 0, 0, t.Location())
+	case du_Month:
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+	case du_Week:
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-daysSinceMonday, 0, 0, 0, 0, t.Location())
+	case du_Day:
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	case du_Hour:
+		return time.Date(year, month, day, t.Hour(), 0, 0, 0, t.Location())
+	case du_Minute:
+		return time.Date(year, month, day, t.Hour(), t.Minute(), 0, 0, t.Location())
+	}
+
+	return time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+}
+
+const FT_DayOfWeek FT_FunctionType = "DayOfWeek"
+
+func func_DayOfWeek(rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(0); !ok {
+		return "", errNumParams(FT_DayOfWeek, 0, got)
+	}
+
+	t, err := convertToTime(val)
+	if err != nil {
+		return errString(FT_DayOfWeek, err)
+	}
+
+	return t.Weekday().String(), nil
+}
+
+func dateBoolFunc(rtParams FunctionParameterTypes, val any, fn func(t1, t2 time.Time) bool, fnName FT_FunctionType) (bool, error) {
+	if got, ok := rtParams.checkLengthOfParams(1); !ok {
+		return false, errNumParams(fnName, 1, got)
+	}
+
+	other, err := paramsGetDateAt(rtParams, 0)
+	if err != nil {
+		return errBool(fnName, err)
+	}
+
+	t, err := convertToTime(val)
+	if err != nil {
+		return errBool(fnName, err)
+	}
+
+	return fn(t, other), nil
+}
+
+const FT_IsBefore FT_FunctionType = "IsBefore"
+
+func func_IsBefore(rtParams FunctionParameterTypes, val any) (any, error) {
+	return dateBoolFunc(rtParams, val, time.Time.Before, FT_IsBefore)
+}
+
+const FT_IsAfter FT_FunctionType = "IsAfter"
+
+func func_IsAfter(rtParams FunctionParameterTypes, val any) (any, error) {
+	return dateBoolFunc(rtParams, val, time.Time.After, FT_IsAfter)
+}
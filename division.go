@@ -0,0 +1,80 @@
+package mpath
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// DivisionOptions sets how the results of Divide (and the `/` operator) are
+// rounded. Without them, results are rounded half away from zero to 16
+// decimal places.
+type DivisionOptions struct {
+	// Precision is the number of decimal places that results are rounded to
+	Precision int32
+
+	// Rounding is how results are rounded to the precision; the default is
+	// RM_HalfUp
+	Rounding RoundingMode
+}
+
+type RoundingMode string
+
+const (
+	// RM_HalfUp rounds to the nearest value, and halves away from zero
+	RM_HalfUp RoundingMode = "HalfUp"
+	// RM_HalfEven rounds to the nearest value, and halves to the even value
+	// (also known as banker's rounding)
+	RM_HalfEven RoundingMode = "HalfEven"
+	// RM_Up rounds away from zero
+	RM_Up RoundingMode = "Up"
+	// RM_Down rounds towards zero
+	RM_Down RoundingMode = "Down"
+	// RM_Ceiling rounds towards positive infinity
+	RM_Ceiling RoundingMode = "Ceiling"
+	// RM_Floor rounds towards negative infinity
+	RM_Floor RoundingMode = "Floor"
+)
+
+// divide divides d1 by d2, which must not be zero, rounding as set by the
+// options. The result is rounded exactly, from the remainder of the division.
+func (o *DivisionOptions) divide(d1, d2 decimal.Decimal) decimal.Decimal {
+	if o == nil {
+		return d1.Div(d2)
+	}
+
+	// q is rounded towards zero
+	q, r := d1.QuoRem(d2, o.Precision)
+	if r.IsZero() {
+		return q
+	}
+
+	sign := int64(d1.Sign() * d2.Sign())
+
+	var awayFromZero bool
+	switch o.Rounding {
+	case RM_Up:
+		awayFromZero = true
+	case RM_Down:
+		awayFromZero = false
+	case RM_Ceiling:
+		awayFromZero = sign > 0
+	case RM_Floor:
+		awayFromZero = sign < 0
+	default:
+		// Compare the remainder to half of the smallest step at the precision
+		half := r.Abs().Mul(decimal.NewFromInt(2)).Cmp(d2.Abs().Shift(-o.Precision))
+		switch {
+		case half > 0:
+			awayFromZero = true
+		case half == 0 && o.Rounding == RM_HalfEven:
+			awayFromZero = q.Shift(o.Precision).BigInt().Bit(0) == 1
+		case half == 0:
+			awayFromZero = true
+		}
+	}
+
+	if awayFromZero {
+		q = q.Add(decimal.New(sign, -o.Precision))
+	}
+
+	return q
+}
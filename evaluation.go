@@ -0,0 +1,295 @@
+package mpath
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"time"
+)
+
+var ErrVariableNotFound = fmt.Errorf("variable not found")
+
+// ErrOnlyInQuery is returned by the Fn of the built in functions that need the
+// state of an evaluation (e.g. the calendars in the EvalOptions), which can
+// only be run as part of a query with Do or DoContext.
+var ErrOnlyInQuery = fmt.Errorf("the function can only be run as part of a query, with Do or DoContext")
+
+// EvalOptions configures a single evaluation of an operation. The zero value
+// has no variables and no limits.
+type EvalOptions struct {
+	// Variables are available to the query by name (e.g. `#rate` for the key
+	// "rate"); variables declared at the top of the query take precedence
+	Variables map[string]any
+
+	// MaxSteps limits the number of operations that are run; zero means
+	// there is no limit
+	MaxSteps int
+
+	// MaxCollectionSize limits the number of items in any array or map that
+	// is produced while running the operations; zero means there is no limit
+	MaxCollectionSize int
+
+	// MaxDepth limits how deeply operations can be nested while running (e.g.
+	// a Select within a filter within a Select); zero means there is no limit
+	MaxDepth int
+
+	// Division sets the precision and rounding of division; nil means that
+	// results are rounded half away from zero to 16 decimal places
+	Division *DivisionOptions
+
+	// Clock returns the current time for the Now function; nil means that
+	// time.Now is used
+	Clock func() time.Time
+
+	// Calendars are the holiday calendars that are used by the business day
+	// functions, by name (e.g. `AddBusinessDays(3, "NSW")` for the key "NSW")
+	Calendars map[string]*HolidayCalendar
+
+	// StructTags are the struct tags that name the fields of structs, in
+	// order of precedence; nil means the precedence set with
+	// SetStructTagPrecedence is used (by default "mpath", "json", "yaml")
+	StructTags []string
+}
+
+// StepLimitError is returned when an evaluation runs more operations than
+// allowed by EvalOptions.MaxSteps
+type StepLimitError struct {
+	Limit int
+}
+
+func (e *StepLimitError) Error() string {
+	return fmt.Sprintf("evaluation exceeded the limit of %d steps", e.Limit)
+}
+
+// CollectionSizeLimitError is returned when an evaluation produces an array
+// or map with more items than allowed by EvalOptions.MaxCollectionSize
+type CollectionSizeLimitError struct {
+	Limit int
+	Size  int
+}
+
+func (e *CollectionSizeLimitError) Error() string {
+	return fmt.Sprintf("evaluation produced a collection of %d items, which exceeds the limit of %d", e.Size, e.Limit)
+}
+
+// DepthLimitError is returned when an evaluation nests operations more deeply
+// than allowed by EvalOptions.MaxDepth
+type DepthLimitError struct {
+	Limit int
+}
+
+func (e *DepthLimitError) Error() string {
+	return fmt.Sprintf("evaluation exceeded the nesting depth limit of %d", e.Limit)
+}
+
+// evaluation holds the state of a single call to Do; it is passed down through
+// the operation tree so that operations can be shared between goroutines
+type evaluation struct {
+	ctx       context.Context
+	opts      EvalOptions
+	variables map[string]any
+
+	// registry parses the queries that are run as part of the evaluation; it
+	// is the registry that parsed the operation being run
+	registry *FunctionRegistry
+
+	// elements are the elements that the lambdas being run are called for,
+	// innermost last
+	elements []any
+
+	// plan is set when a compiled plan is being run
+	plan *Plan
+
+	// fields is set when the options name the struct tags to use
+	fields *structFieldResolver
+
+	steps int
+	depth int
+}
+
+func newEvaluation(ctx context.Context, opts EvalOptions) *evaluation {
+	ev := &evaluation{
+		ctx:       ctx,
+		opts:      opts,
+		variables: make(map[string]any, len(opts.Variables)),
+	}
+
+	for name, val := range opts.Variables {
+		if _, ok := val.(string); !ok {
+			val = convertToDecimalIfNumber(val)
+		}
+		ev.variables[name] = val
+	}
+
+	if opts.StructTags != nil {
+		ev.fields = structFieldResolverFor(opts.StructTags)
+	}
+
+	return ev
+}
+
+// backgroundEvaluation is used when a function is called directly rather
+// than as part of an operation
+func backgroundEvaluation() *evaluation {
+	return newEvaluation(context.Background(), EvalOptions{})
+}
+
+// evaluationFor is used by the Do method of each operation
+func evaluationFor(op Operation) *evaluation {
+	ev := backgroundEvaluation()
+	ev.registry = registryOf(op)
+
+	return ev
+}
+
+// now returns the current time from the clock in the options
+func (ev *evaluation) now() time.Time {
+	if ev.opts.Clock != nil {
+		return ev.opts.Clock()
+	}
+
+	return time.Now()
+}
+
+func (ev *evaluation) variable(name string) (val any, err error) {
+	val, ok := ev.variables[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: '#%s'", ErrVariableNotFound, name)
+	}
+
+	return val, nil
+}
+
+// element returns the element that the innermost lambda being run is called
+// for
+func (ev *evaluation) element() (val any, ok bool) {
+	if len(ev.elements) == 0 {
+		return nil, false
+	}
+
+	return ev.elements[len(ev.elements)-1], true
+}
+
+func (ev *evaluation) fieldIndex(t reflect.Type, identName string) (index []int, found bool) {
+	if ev.plan != nil && ev.fields == nil {
+		return ev.plan.fieldIndex(t, identName)
+	}
+
+	return ev.structFieldResolver().fieldIndex(t, identName)
+}
+
+// structFields returns the fields of the struct type, in the order they are
+// declared
+func (ev *evaluation) structFields(t reflect.Type) []structField {
+	return ev.structFieldResolver().fieldsOf(t)
+}
+
+// structFieldResolver returns the resolver for the struct tags in the options,
+// then for the plan, and otherwise for the current tag precedence
+func (ev *evaluation) structFieldResolver() *structFieldResolver {
+	switch {
+	case ev.fields != nil:
+		return ev.fields
+	case ev.plan != nil:
+		return ev.plan.structFields
+	}
+
+	return getStructFieldResolver()
+}
+
+func (ev *evaluation) regexp(pattern string) (*regexp.Regexp, error) {
+	if ev.plan != nil {
+		return ev.plan.regexp(pattern)
+	}
+
+	return regexp.Compile(pattern)
+}
+
+// parse parses a query that is run as part of the evaluation (e.g. by Select)
+func (ev *evaluation) parse(query string) (op Operation, err error) {
+	if ev.plan != nil {
+		return ev.plan.parse(query)
+	}
+
+	if ev.registry != nil {
+		return ev.registry.ParseString(query)
+	}
+
+	return ParseString(query)
+}
+
+// enter is called as each operation starts running; leave must be called
+// when the operation finishes
+func (ev *evaluation) enter() error {
+	ev.steps++
+	if ev.opts.MaxSteps > 0 && ev.steps > ev.opts.MaxSteps {
+		return &StepLimitError{Limit: ev.opts.MaxSteps}
+	}
+
+	ev.depth++
+	if ev.opts.MaxDepth > 0 && ev.depth > ev.opts.MaxDepth {
+		ev.depth--
+		return &DepthLimitError{Limit: ev.opts.MaxDepth}
+	}
+
+	return nil
+}
+
+func (ev *evaluation) leave() {
+	ev.depth--
+}
+
+// cancelled returns an error if the context of the evaluation is done
+func (ev *evaluation) cancelled() error {
+	if err := ev.ctx.Err(); err != nil {
+		return fmt.Errorf("evaluation cancelled: %w", err)
+	}
+
+	return nil
+}
+
+func (ev *evaluation) checkCollectionSize(size int) error {
+	if ev.opts.MaxCollectionSize > 0 && size > ev.opts.MaxCollectionSize {
+		return &CollectionSizeLimitError{Limit: ev.opts.MaxCollectionSize, Size: size}
+	}
+
+	return nil
+}
+
+// checkOutput checks the size of the value if it is a collection
+func (ev *evaluation) checkOutput(val any) error {
+	if ev.opts.MaxCollectionSize <= 0 || val == nil {
+		return nil
+	}
+
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return ev.checkCollectionSize(v.Len())
+	}
+
+	return nil
+}
+
+// DoContext runs the operation against the data. The evaluation stops with an
+// error if the context is cancelled, or if any of the limits in opts are
+// exceeded.
+func DoContext(ctx context.Context, op Operation, data any, opts EvalOptions) (dataToUse any, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, fmt.Errorf("evaluation cancelled: %w", err)
+	}
+
+	ev := newEvaluation(ctx, opts)
+	ev.registry = registryOf(op)
+
+	return op.do(ev, data, data)
+}
+
+// DoWithVariables runs the operation against the data, with each of the
+// variables available to the query by name (e.g. `#rate` for the key "rate").
+// Variables declared at the top of the query take precedence over those
+// passed in.
+func DoWithVariables(op Operation, data any, variables map[string]any) (dataToUse any, err error) {
+	return DoContext(context.Background(), op, data, EvalOptions{Variables: variables})
+}
@@ -0,0 +1,675 @@
+package mpath
+
+import (
+	"strings"
+	sc "text/scanner"
+
+	"github.com/shopspring/decimal"
+)
+
+// exprParser parses expressions that are written with infix operators, e.g.
+// `$.weight >= 10 && !($.status == "held" || $.isNull)`.
+//
+// Expressions are desugared as they are parsed: comparisons and arithmetic
+// become calls to the comparison and arithmetic functions (`$.weight >= 10` is
+// `$.weight.GreaterOrEqual(10)`, and `$.price * 2` is `$.price.Multiply(2)`),
+// `&&` and `||` become logical operations, and `!` calls Not or applies De
+// Morgan's laws to a logical operation. This means that expressions are
+// validated, run and printed in the same way as if they had been written out
+// in full.
+//
+// From lowest to highest precedence, the operators are `||`, `&&`, `!`, the
+// comparisons `==`, `!=`, `<`, `<=`, `>` and `>=` (which cannot be chained),
+// `+` and `-`, `*`, `/` and `%`, and then unary `-`. Parentheses group
+// expressions. As `+`, `-` and `%` can be part of a name or number, they must
+// be separated from their operands by spaces.
+type exprParser struct {
+	s *scanner
+
+	// isFilter is set when parsing within a filter, where paths cannot start
+	// at the root
+	isFilter bool
+}
+
+// operand is an operation or a literal value that is part of an expression
+type operand struct {
+	op Operation
+
+	literal     FunctionParameterType
+	literalText string
+	isNull      bool
+}
+
+func (o operand) isLiteral() bool {
+	return o.op == nil
+}
+
+var comparisonFunctions = map[string]FT_FunctionType{
+	"==": FT_Equal,
+	"!=": FT_NotEqual,
+	"<":  FT_Less,
+	"<=": FT_LessOrEqual,
+	">":  FT_Greater,
+	">=": FT_GreaterOrEqual,
+}
+
+var arithmeticFunctions = map[string]FT_FunctionType{
+	"+": FT_Add,
+	"-": FT_Subtract,
+	"*": FT_Multiply,
+	"/": FT_Divide,
+	"%": FT_Modulo,
+}
+
+// flippedComparisons are used when the literal is on the left of the path,
+// e.g. `10 < $.weight` is `$.weight > 10`
+var flippedComparisons = map[string]string{
+	"==": "==",
+	"!=": "!=",
+	"<":  ">",
+	"<=": ">=",
+	">":  "<",
+	">=": "<=",
+}
+
+// parseExpression parses an expression that starts at r. If first is not nil,
+// it is the path that has already been parsed at the start of the expression.
+func (p *exprParser) parseExpression(r rune, first *opPath) (op Operation, nextR rune, err error) {
+	o, r, err := p.parseLogical(r, first, "||")
+	if err != nil {
+		return nil, r, err
+	}
+	if err = p.notValue(o); err != nil {
+		return nil, r, err
+	}
+
+	return o.op, r, nil
+}
+
+// parseBooleanExpression parses an expression that must return a boolean,
+// such as a part of a logical operation
+func (p *exprParser) parseBooleanExpression(r rune) (op Operation, nextR rune, err error) {
+	if op, r, err = p.parseExpression(r, nil); err != nil {
+		return op, r, err
+	}
+	if _, ok := op.(*opLiteral); ok {
+		return op, r, erAt(p.s, "objects and arrays cannot be used as conditions")
+	}
+
+	return booleanOperand(op), r, nil
+}
+
+// parseLogical parses the operands that are joined by the operator, which is
+// either `||` or `&&`. The operand that is returned is only a literal value
+// if there is no operator, e.g. for `(10)`.
+func (p *exprParser) parseLogical(r rune, first *opPath, operator string) (o operand, nextR rune, err error) {
+	parseOperand := func(r rune, first *opPath) (operand, rune, error) {
+		if operator == "||" {
+			return p.parseLogical(r, first, "&&")
+		}
+		return p.parseNot(r, first)
+	}
+
+	if o, r, err = parseOperand(r, first); err != nil {
+		return o, r, err
+	}
+
+	if p.operator(r) != operator {
+		return o, r, nil
+	}
+	if err = p.notOperand(o, operator); err != nil {
+		return o, r, err
+	}
+
+	lo := &opLogicalOperation{LogicalOperationType: LOT_And}
+	if operator == "||" {
+		lo.LogicalOperationType = LOT_Or
+	}
+	lo.Operations = append(lo.Operations, booleanOperand(o.op))
+
+	for p.operator(r) == operator {
+		r = p.consumeOperator(operator)
+
+		if o, r, err = parseOperand(r, nil); err != nil {
+			return o, r, err
+		}
+		if err = p.notOperand(o, operator); err != nil {
+			return o, r, err
+		}
+		lo.Operations = append(lo.Operations, booleanOperand(o.op))
+	}
+
+	lo.setUserString()
+
+	return operand{op: lo}, r, nil
+}
+
+func (p *exprParser) parseNot(r rune, first *opPath) (o operand, nextR rune, err error) {
+	if first != nil || p.operator(r) != "!" {
+		return p.parseComparison(r, first)
+	}
+
+	r = p.consumeOperator("!")
+	if o, r, err = p.parseNot(r, nil); err != nil {
+		return o, r, err
+	}
+	if err = p.notOperand(o, "!"); err != nil {
+		return o, r, err
+	}
+
+	return operand{op: negate(p.s, booleanOperand(o.op))}, r, nil
+}
+
+func (p *exprParser) parseComparison(r rune, first *opPath) (o operand, nextR rune, err error) {
+	left, r, err := p.parseArithmetic(r, first, "+", "-")
+	if err != nil {
+		return o, r, err
+	}
+
+	operator := p.operator(r)
+	if _, ok := comparisonFunctions[operator]; !ok {
+		return left, r, nil
+	}
+	r = p.consumeOperator(operator)
+
+	right, r, err := p.parseArithmetic(r, nil, "+", "-")
+	if err != nil {
+		return o, r, err
+	}
+
+	if o.op, err = p.comparison(operator, left, right); err != nil {
+		return o, r, err
+	}
+
+	if _, ok := comparisonFunctions[p.operator(r)]; ok {
+		return o, r, erAt(p.s, "comparisons cannot be chained; use '&&' to combine them")
+	}
+
+	return o, r, nil
+}
+
+// comparison desugars the comparison to a call to the comparison function on
+// the path, e.g. `$.weight >= 10` is `$.weight.GreaterOrEqual(10)`
+func (p *exprParser) comparison(operator string, left, right operand) (op Operation, err error) {
+	for _, side := range []operand{left, right} {
+		if err = p.notLiteral(side.op, operator); err != nil {
+			return nil, err
+		}
+	}
+
+	if left.isLiteral() {
+		if right.isLiteral() {
+			return nil, erAt(p.s, "a comparison must have a path on at least one side")
+		}
+
+		left, right = right, left
+		operator = flippedComparisons[operator]
+	}
+
+	path, ok := left.op.(*opPath)
+	if !ok {
+		return nil, erAt(p.s, "only paths can be compared with '%s'", operator)
+	}
+
+	fn := &opFunction{FunctionType: comparisonFunctions[operator], registry: p.s.registry}
+
+	switch {
+	case right.isNull:
+		switch operator {
+		case "==":
+			fn.FunctionType = FT_IsNull
+		case "!=":
+			fn.FunctionType = FT_IsNotNull
+		default:
+			return nil, erAt(p.s, "null can only be compared with '==' or '!='")
+		}
+		fn.userString = string(fn.FunctionType) + "()"
+
+	case right.isLiteral():
+		fn.Params = FunctionParameterTypes{right.literal}
+		fn.userString = string(fn.FunctionType) + "(" + right.literalText + ")"
+
+	default:
+		switch t := right.op.(type) {
+		case *opPath:
+			fn.Params = FunctionParameterTypes{&FP_Path{t}}
+		case *opLogicalOperation:
+			fn.Params = FunctionParameterTypes{&FP_LogicalOperation{t}}
+		}
+		fn.userString = string(fn.FunctionType) + "(" + right.op.UserString() + ")"
+	}
+
+	path.appendFunction(fn)
+
+	return path, nil
+}
+
+// parseArithmetic parses the operands that are joined by the operators, which
+// are either `+` and `-`, or `*`, `/` and `%`
+func (p *exprParser) parseArithmetic(r rune, first *opPath, operators ...string) (o operand, nextR rune, err error) {
+	parseOperand := func(r rune, first *opPath) (operand, rune, error) {
+		if operators[0] == "+" {
+			return p.parseArithmetic(r, first, "*", "/", "%")
+		}
+		return p.parseUnary(r, first)
+	}
+
+	if o, r, err = parseOperand(r, first); err != nil {
+		return o, r, err
+	}
+
+	for {
+		operator := p.operator(r)
+		if !strInStrSlice(operator, operators) {
+			return o, r, nil
+		}
+		r = p.consumeOperator(operator)
+
+		right, nextR, err := parseOperand(r, nil)
+		if err != nil {
+			return o, nextR, err
+		}
+		r = nextR
+
+		if o, err = p.arithmetic(operator, o, right); err != nil {
+			return o, r, err
+		}
+	}
+}
+
+func (p *exprParser) parseUnary(r rune, first *opPath) (o operand, nextR rune, err error) {
+	if first != nil || p.operator(r) != "-" {
+		return p.parseOperand(r, first)
+	}
+
+	r = p.consumeOperator("-")
+	if o, r, err = p.parseUnary(r, nil); err != nil {
+		return o, r, err
+	}
+
+	o, err = p.arithmetic("*", o, minusOne())
+
+	return o, r, err
+}
+
+// arithmetic desugars the arithmetic to a call to the arithmetic function on
+// the path, e.g. `$.price * 2` is `$.price.Multiply(2)`. Arithmetic on two
+// numbers is done as the query is parsed.
+func (p *exprParser) arithmetic(operator string, left, right operand) (o operand, err error) {
+	for _, side := range []operand{left, right} {
+		if _, ok := side.literal.(*FP_Number); side.isLiteral() && !ok {
+			return o, erAt(p.s, "'%s' can only be used with numbers, not %s", operator, side.literalText)
+		}
+		if _, ok := side.op.(*opLogicalOperation); ok {
+			return o, erAt(p.s, "'%s' can only be used with numbers, not logical operations", operator)
+		}
+		if err = p.notLiteral(side.op, operator); err != nil {
+			return o, err
+		}
+	}
+
+	// The precision of division is not known until the query is run, so
+	// the division of two numbers is not done as the query is parsed
+	if left.isLiteral() && right.isLiteral() && operator != "/" {
+		return p.foldArithmetic(operator, left.literal.(*FP_Number).Value, right.literal.(*FP_Number).Value)
+	}
+
+	if left.isLiteral() {
+		switch operator {
+		case "+", "*":
+			left, right = right, left
+		case "-":
+			// c - x is -x + c
+			c := left
+			if left, err = p.arithmetic("*", right, minusOne()); err != nil {
+				return o, err
+			}
+			right, operator = c, "+"
+		default:
+			// c / x is (c).Divide(x)
+			path := &opPath{IsFilter: p.isFilter}
+			path.setLiteral(p.s, left.literal.(*FP_Number))
+			left = operand{op: path}
+		}
+	}
+
+	path := left.op.(*opPath)
+	fn := &opFunction{FunctionType: arithmeticFunctions[operator], registry: p.s.registry}
+
+	if right.isLiteral() {
+		fn.Params = FunctionParameterTypes{right.literal}
+		fn.userString = string(fn.FunctionType) + "(" + right.literalText + ")"
+	} else {
+		fn.Params = FunctionParameterTypes{&FP_Path{right.op.(*opPath)}}
+		fn.userString = string(fn.FunctionType) + "(" + right.op.UserString() + ")"
+	}
+
+	path.appendFunction(fn)
+
+	return operand{op: path}, nil
+}
+
+func minusOne() operand {
+	return operand{literal: &FP_Number{decimal.NewFromInt(-1)}, literalText: "-1"}
+}
+
+// foldArithmetic does arithmetic on two numbers
+func (p *exprParser) foldArithmetic(operator string, d1, d2 decimal.Decimal) (o operand, err error) {
+	var result decimal.Decimal
+
+	switch operator {
+	case "+":
+		result = d1.Add(d2)
+	case "-":
+		result = d1.Sub(d2)
+	case "*":
+		result = d1.Mul(d2)
+	case "%":
+		if d2.IsZero() {
+			return o, erAt(p.s, "cannot divide by zero")
+		}
+		result = d1.Mod(d2)
+	}
+
+	return operand{literal: &FP_Number{result}, literalText: result.String()}, nil
+}
+
+func (p *exprParser) parseOperand(r rune, first *opPath) (o operand, nextR rune, err error) {
+	if first != nil {
+		return operand{op: first}, r, nil
+	}
+
+	switch r {
+	case '(':
+		if o, r, err = p.parseLogical(p.s.Scan(), nil, "||"); err != nil {
+			return o, r, err
+		}
+		if r != ')' {
+			return o, r, erInvalid(p.s, ')')
+		}
+
+		// Functions can be called on a number in parentheses, e.g.
+		// `(10).Divide($.count)`
+		number, ok := o.literal.(*FP_Number)
+		if r = p.s.Scan(); !ok || r != '.' {
+			return o, r, nil
+		}
+
+		path := &opPath{IsFilter: p.isFilter}
+		path.setLiteral(p.s, number)
+		r, err = path.parseOperations(p.s, r)
+		return operand{op: path}, r, err
+
+	case '$', '@', '#':
+		path := &opPath{IsFilter: p.isFilter}
+		r, err = path.Parse(p.s, r)
+		o.op = path
+		return o, r, err
+
+	case '{':
+		if isObjectLiteralAhead(p.s) {
+			literal := &opLiteral{}
+			r, err = literal.Parse(p.s, r)
+			o.op = literal
+			return o, r, err
+		}
+
+		lo := &opLogicalOperation{}
+		r, err = lo.Parse(p.s, r)
+		o.op = lo
+		return o, r, err
+
+	case '[':
+		literal := &opLiteral{}
+		r, err = literal.Parse(p.s, r)
+		o.op = literal
+		return o, r, err
+
+	case sc.String, sc.RawString, sc.Char:
+		o.literalText = p.s.TokenText()
+		o.literal = &FP_String{unescape(unquote(o.literalText))}
+		return o, p.s.Scan(), nil
+
+	case sc.Ident:
+		tt := p.s.TokenText()
+		switch tt {
+		case "true", "false":
+			o.literalText = tt
+			o.literal = &FP_Bool{tt == "true"}
+			return o, p.s.Scan(), nil
+		case "null":
+			o.literalText = tt
+			o.isNull = true
+			return o, p.s.Scan(), nil
+		}
+
+		number, text, err := scanNumber(p.s)
+		if err != nil {
+			return o, r, err
+		}
+		o.literalText = text
+		o.literal = &FP_Number{number}
+		return o, p.s.Scan(), nil
+	}
+
+	return o, r, erInvalid(p.s, '$', '@', '#', '{', '[', '(')
+}
+
+// notValue returns an error if the operand is a literal value, which can only
+// be used with a path
+func (p *exprParser) notValue(o operand) error {
+	if o.isLiteral() {
+		return erAt(p.s, "the value %s must be compared to a path", o.literalText)
+	}
+
+	return nil
+}
+
+// notOperand returns an error if the operand cannot be used with a logical
+// operator, which is the case for literal values, objects and arrays
+func (p *exprParser) notOperand(o operand, operator string) error {
+	if err := p.notValue(o); err != nil {
+		return err
+	}
+
+	return p.notLiteral(o.op, operator)
+}
+
+// notLiteral returns an error if the operation is an object or array
+// literal, as they cannot be used with operators
+func (p *exprParser) notLiteral(op Operation, operator string) error {
+	if _, ok := op.(*opLiteral); ok {
+		return erAt(p.s, "'%s' cannot be used with objects or arrays", operator)
+	}
+
+	return nil
+}
+
+// operator returns the operator that starts at r, if any, without consuming
+// it
+func (p *exprParser) operator(r rune) string {
+	next := p.s.sx.Peek()
+
+	switch r {
+	case '=':
+		if next == '=' {
+			return "=="
+		}
+	case '!', '<', '>':
+		if next == '=' {
+			return string(r) + "="
+		}
+		return string(r)
+	case '&':
+		if next == '&' {
+			return "&&"
+		}
+	case '|':
+		if next == '|' {
+			return "||"
+		}
+	case '*', '/':
+		return string(r)
+	case sc.Ident:
+		// As they are ident runes, these operators are read as idents when
+		// they are separated by spaces
+		switch tt := p.s.TokenText(); tt {
+		case "+", "-", "%":
+			return tt
+		}
+	}
+
+	return ""
+}
+
+// consumeOperator moves past the operator, returning the rune after it
+func (p *exprParser) consumeOperator(operator string) rune {
+	if len(operator) == 2 {
+		p.s.Scan()
+	}
+
+	return p.s.Scan()
+}
+
+// isOperatorRune returns whether the rune can start an operator, and so can
+// end a path
+func isOperatorRune(r rune) bool {
+	switch r {
+	case '=', '!', '<', '>', '&', '|', '*', '/':
+		return true
+	}
+
+	return false
+}
+
+// isArithmeticIdent returns whether the ident is one of the arithmetic
+// operators that are read as idents
+func isArithmeticIdent(tt string) bool {
+	switch tt {
+	case "+", "-", "%":
+		return true
+	}
+
+	return false
+}
+
+// erOperatorNotSeparated is returned when an arithmetic operator has been read
+// as part of a name or number because it was not separated from it by spaces,
+// e.g. `$.a+$.b`
+func erOperatorNotSeparated(s *scanner) error {
+	return erAt(s, "operators must be separated by spaces, as '+', '-' and '%%' can be part of a name or number")
+}
+
+// endsInArithmeticOperator returns whether the name ends in an arithmetic
+// operator, e.g. `a+` when `$.a+$.b` is read
+func endsInArithmeticOperator(name string) bool {
+	return len(name) > 1 && strings.ContainsAny(name[len(name)-1:], "+-%")
+}
+
+// isNumberWithOperator returns whether the ident is a number that has been
+// read together with an arithmetic operator, e.g. `10+` when `10+$.a` is read
+// or `1+2`
+func isNumberWithOperator(tt string) bool {
+	if len(tt) < 2 || !isRuneInString(rune(tt[0]), "0123456789") || !strings.ContainsAny(tt[1:], "+-%") {
+		return false
+	}
+
+	_, err := decimal.NewFromString(tt)
+	return err != nil
+}
+
+// startsWithLiteral returns whether the expression that starts at r starts
+// with a literal or a unary minus, e.g. `10 < $.x` or `- $.x`
+func startsWithLiteral(s *scanner, r rune) bool {
+	switch r {
+	case sc.String, sc.RawString, sc.Char:
+		return true
+	case sc.Ident:
+		return isLiteralIdent(s.TokenText()) || s.TokenText() == "-"
+	}
+
+	return false
+}
+
+// isLiteralIdent returns whether the ident is a literal value rather than a
+// name
+func isLiteralIdent(tt string) bool {
+	switch tt {
+	case "true", "false", "null":
+		return true
+	}
+
+	_, err := decimal.NewFromString(tt)
+	return err == nil
+}
+
+// scanNumber reads the number at the current ident; as '.' is not part of an
+// ident, the fractional part of a decimal is read as a separate ident
+func scanNumber(s *scanner) (number decimal.Decimal, text string, err error) {
+	text = s.TokenText()
+
+	if s.sx.Peek() == '.' {
+		s.Scan() // the dot
+		if isRuneInString(s.sx.Peek(), "0123456789") {
+			s.Scan()
+			text += "." + s.TokenText()
+		}
+	}
+
+	if number, err = decimal.NewFromString(text); err != nil {
+		if isNumberWithOperator(text) {
+			return number, text, erOperatorNotSeparated(s)
+		}
+		return number, text, erAt(s, "couldn't convert '%s' to a number", text)
+	}
+
+	return number, text, nil
+}
+
+func unquote(tt string) string {
+	if len(tt) >= 2 && strings.HasPrefix(tt, `"`) && strings.HasSuffix(tt, `"`) {
+		return tt[1 : len(tt)-1]
+	}
+
+	return tt
+}
+
+// booleanOperand marks a path that is used as a boolean, in the same way as
+// the paths that are part of a logical operation
+func booleanOperand(op Operation) Operation {
+	if path, ok := op.(*opPath); ok && !path.MustEndInFunctionOrIdent {
+		path.MustEndInFunctionOrIdent = true
+		if !path.endsInBoolean() {
+			path.IsInvalid = true
+		}
+	}
+
+	return op
+}
+
+// negate returns the inverse of the boolean operation: a path calls Not, and
+// a logical operation has its type swapped and each of its operations
+// negated, following De Morgan's laws
+func negate(s *scanner, op Operation) Operation {
+	switch t := op.(type) {
+	case *opPath:
+		fn := &opFunction{FunctionType: FT_Not, registry: s.registry}
+		fn.userString = string(FT_Not) + "()"
+		t.appendFunction(fn)
+
+	case *opLogicalOperation:
+		switch t.LogicalOperationType {
+		case LOT_And:
+			t.LogicalOperationType = LOT_Or
+		case LOT_Or:
+			t.LogicalOperationType = LOT_And
+		}
+
+		for i, o := range t.Operations {
+			t.Operations[i] = negate(s, o)
+		}
+		t.setUserString()
+	}
+
+	return op
+}
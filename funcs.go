@@ -4,9 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
-	"regexp"
 	"sort"
 	"strings"
+	"time"
 	"unicode"
 
 	xj "github.com/basgys/goxml2json"
@@ -99,6 +99,10 @@ func errString(name FT_FunctionType, err error) (string, error) {
 	return "", fmt.Errorf("func %s: %w", name, err)
 }
 
+func errAny(name FT_FunctionType, err error) (any, error) {
+	return nil, fmt.Errorf("func %s: %w", name, err)
+}
+
 func errNumParams(name FT_FunctionType, expected, got int) error {
 	return fmt.Errorf("(%s) expected %d params, got %d", name, expected, got)
 }
@@ -118,6 +122,12 @@ func func_Equal(rtParams FunctionParameterTypes, val any) (any, error) {
 			return vt.Equal(pt), nil
 		}
 		return false, nil
+	case time.Time:
+		switch pt := param.(type) {
+		case time.Time:
+			return vt.Equal(pt), nil
+		}
+		return false, nil
 	}
 
 	return val == param, nil
@@ -404,8 +414,14 @@ func func_Index(rtParams FunctionParameterTypes, val any) (any, error) {
 
 	switch v.Kind() {
 	case reflect.Slice, reflect.Array:
-		if v.Len()-1 >= int(param.IntPart()) {
-			return convertToDecimalIfNumber(v.Index(int(param.IntPart())).Interface()), nil
+		// Negative indices count back from the end of the array
+		idx := int(param.IntPart())
+		if idx < 0 {
+			idx += v.Len()
+		}
+
+		if idx >= 0 && idx < v.Len() {
+			return convertToDecimalIfNumber(v.Index(idx).Interface()), nil
 		} else {
 			return nil, fmt.Errorf("nothing in array")
 		}
@@ -536,7 +552,15 @@ func func_Subtract(rtParams FunctionParameterTypes, val any) (any, error) {
 const FT_Divide FT_FunctionType = "Divide"
 
 func func_Divide(rtParams FunctionParameterTypes, val any) (any, error) {
-	return func_decimal(rtParams, val, decimal.Decimal.Div, FT_Divide)
+	return evalFunc_Divide(backgroundEvaluation(), rtParams, val)
+}
+
+func evalFunc_Divide(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	if param, err := paramsGetFirstOfNumber(rtParams); err == nil && param.IsZero() {
+		return nil, fmt.Errorf("(%s) cannot divide by zero", FT_Divide)
+	}
+
+	return func_decimal(rtParams, val, ev.opts.Division.divide, FT_Divide)
 }
 
 const FT_Multiply FT_FunctionType = "Multiply"
@@ -548,6 +572,10 @@ func func_Multiply(rtParams FunctionParameterTypes, val any) (any, error) {
 const FT_Modulo FT_FunctionType = "Modulo"
 
 func func_Modulo(rtParams FunctionParameterTypes, val any) (any, error) {
+	if param, err := paramsGetFirstOfNumber(rtParams); err == nil && param.IsZero() {
+		return nil, fmt.Errorf("(%s) cannot divide by zero", FT_Modulo)
+	}
+
 	return func_decimal(rtParams, val, decimal.Decimal.Mod, FT_Modulo)
 }
 
@@ -654,12 +682,16 @@ func func_Left(rtParams FunctionParameterTypes, val any) (any, error) {
 const FT_DoesMatchRegex FT_FunctionType = "DoesMatchRegex"
 
 func func_DoesMatchRegex(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_DoesMatchRegex(backgroundEvaluation(), rtParams, val)
+}
+
+func evalFunc_DoesMatchRegex(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
 	param, err := paramsGetFirstOfString(rtParams)
 	if err != nil {
 		return errBool(FT_DoesMatchRegex, err)
 	}
 
-	exp, err := regexp.Compile(param)
+	exp, err := ev.regexp(param)
 	if err != nil {
 		return false, fmt.Errorf("regular expression is invalid")
 	}
@@ -674,6 +706,10 @@ func func_DoesMatchRegex(rtParams FunctionParameterTypes, val any) (any, error)
 const FT_ReplaceRegex FT_FunctionType = "ReplaceRegex"
 
 func func_ReplaceRegex(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_ReplaceRegex(backgroundEvaluation(), rtParams, val)
+}
+
+func evalFunc_ReplaceRegex(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
 	if got, ok := rtParams.checkLengthOfParams(2); !ok {
 		return "", errNumParams(FT_ReplaceRegex, 1, got)
 	}
@@ -701,7 +737,7 @@ func func_ReplaceRegex(rtParams FunctionParameterTypes, val any) (any, error) {
 	if !foundReplace {
 		return "", fmt.Errorf("replace parameter missing")
 	}
-	exp, err := regexp.Compile(rgx)
+	exp, err := ev.regexp(rgx)
 	if err != nil {
 		return "", fmt.Errorf("regular expression is invalid")
 	}
@@ -863,6 +899,10 @@ func func_ParseTOML(rtParams FunctionParameterTypes, val any) (any, error) {
 const FT_RemoveKeysByRegex FT_FunctionType = "RemoveKeysByRegex"
 
 func func_RemoveKeysByRegex(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_RemoveKeysByRegex(backgroundEvaluation(), rtParams, val)
+}
+
+func evalFunc_RemoveKeysByRegex(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
 	if got, ok := rtParams.checkLengthOfParams(1); !ok {
 		return nil, errNumParams(FT_RemoveKeysByRegex, 1, got)
 	}
@@ -872,7 +912,7 @@ func func_RemoveKeysByRegex(rtParams FunctionParameterTypes, val any) (any, erro
 		return nil, err
 	}
 
-	exp, err := regexp.Compile(param)
+	exp, err := ev.regexp(param)
 	if err != nil {
 		return nil, fmt.Errorf("regular expression is invalid")
 	}
@@ -1054,6 +1094,10 @@ func func_IsNotNullOrEmpty(rtParams FunctionParameterTypes, val any) (any, error
 const FT_Select FT_FunctionType = "Select"
 
 func func_Select(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_Select(backgroundEvaluation(), rtParams, val)
+}
+
+func evalFunc_Select(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
 	// Expect exactly one parameter: the query string.
 	query, err := paramsGetFirstOfString(rtParams)
 	if err != nil {
@@ -1061,7 +1105,7 @@ func func_Select(rtParams FunctionParameterTypes, val any) (any, error) {
 	}
 
 	// Parse the query string (e.g., "$.IntField") into an operation.
-	op, err := ParseString(query)
+	op, err := ev.parse(query)
 	if err != nil {
 		return nil, fmt.Errorf("func %s: error parsing query: %w", FT_Select, err)
 	}
@@ -1074,23 +1118,35 @@ func func_Select(rtParams FunctionParameterTypes, val any) (any, error) {
 
 	var results []any
 
+	selectFromElem := func(elem any) error {
+		if err := ev.cancelled(); err != nil {
+			return err
+		}
+
+		res, err := op.do(ev, elem, elem)
+		if err != nil {
+			return fmt.Errorf("func %s: error selecting field: %w", FT_Select, err)
+		}
+
+		// If the result is itself a slice/array, flatten it.
+		resVal := reflect.ValueOf(res)
+		if resVal.Kind() == reflect.Slice || resVal.Kind() == reflect.Array {
+			for j := 0; j < resVal.Len(); j++ {
+				results = append(results, resVal.Index(j).Interface())
+			}
+		} else {
+			results = append(results, res)
+		}
+
+		return ev.checkCollectionSize(len(results))
+	}
+
 	switch v.Kind() {
 	case reflect.Slice, reflect.Array:
 		// Iterate over each element in the slice/array.
 		for i := 0; i < v.Len(); i++ {
-			elem := v.Index(i).Interface()
-			res, err := op.Do(elem, elem)
-			if err != nil {
-				return nil, fmt.Errorf("func %s: error selecting field: %w", FT_Select, err)
-			}
-			// If the result is itself a slice/array, flatten it.
-			resVal := reflect.ValueOf(res)
-			if resVal.Kind() == reflect.Slice || resVal.Kind() == reflect.Array {
-				for j := 0; j < resVal.Len(); j++ {
-					results = append(results, resVal.Index(j).Interface())
-				}
-			} else {
-				results = append(results, res)
+			if err := selectFromElem(v.Index(i).Interface()); err != nil {
+				return nil, err
 			}
 		}
 	case reflect.Map:
@@ -1102,18 +1158,8 @@ func func_Select(rtParams FunctionParameterTypes, val any) (any, error) {
 		})
 
 		for _, key := range orderedMapValues {
-			elem := v.MapIndex(key).Interface()
-			res, err := op.Do(elem, elem)
-			if err != nil {
-				return nil, fmt.Errorf("func %s: error selecting field: %w", FT_Select, err)
-			}
-			resVal := reflect.ValueOf(res)
-			if resVal.Kind() == reflect.Slice || resVal.Kind() == reflect.Array {
-				for j := 0; j < resVal.Len(); j++ {
-					results = append(results, resVal.Index(j).Interface())
-				}
-			} else {
-				results = append(results, res)
+			if err := selectFromElem(v.MapIndex(key).Interface()); err != nil {
+				return nil, err
 			}
 		}
 	default:
@@ -1160,23 +1206,15 @@ func inputOrOutput(typ PT_ParameterType, ioType IOOT_InputOrOutputType) InputOrO
 	}
 }
 
-var functionTypeByName = map[string]FT_FunctionType{}
-
-func init() {
-	for k, v := range funcMap {
-		functionTypeByName[string(v.Name)] = k
-	}
-}
-
 const FT_NotSet FT_FunctionType = "NotSet"
 
-func ft_GetByName(s string) (FT_FunctionType, error) {
-	ft, ok := functionTypeByName[s]
+func ft_GetByName(reg *FunctionRegistry, s string) (FT_FunctionType, error) {
+	fd, ok := reg.lookup(FT_FunctionType(s))
 	if !ok {
 		return FT_NotSet, fmt.Errorf("function '%s' is not a recognised function", s)
 	}
 
-	return ft, nil
+	return fd.Name, nil
 }
 
 func ft_GetName(x FT_FunctionType) string {
@@ -1194,8 +1232,34 @@ const (
 	PT_Object      PT_ParameterType = "Object"
 	PT_Root        PT_ParameterType = "Root"
 	PT_ElementRoot PT_ParameterType = "ElementRoot"
+	PT_DateTime    PT_ParameterType = "DateTime"
+	PT_TimeZone    PT_ParameterType = "TimeZone"
 )
 
+// accepts returns whether a value of the other type can be used where this
+// type is expected; dates and time zones are written as strings, so strings
+// can be used as either
+func (pt PT_ParameterType) accepts(other PT_ParameterType) bool {
+	return pt == other || ((pt == PT_DateTime || pt == PT_TimeZone) && other == PT_String)
+}
+
+// validateLiteral checks a value that is written in the query, for the types
+// that can be checked before the query is run
+func (pt PT_ParameterType) validateLiteral(p FunctionParameterType) error {
+	s, ok := p.(*FP_String)
+	if !ok {
+		return nil
+	}
+
+	switch pt {
+	case PT_TimeZone:
+		_, err := loadLocation(s.Value)
+		return err
+	}
+
+	return nil
+}
+
 func (pt PT_ParameterType) IsPrimitive() bool {
 	switch pt {
 	case PT_String, PT_Boolean, PT_Number:
@@ -1220,6 +1284,8 @@ func (pt PT_ParameterType) CueExpr() *string {
 		out = "{...}"
 	case PT_Bytes:
 		out = "bytes"
+	case PT_DateTime, PT_TimeZone:
+		out = "string"
 	}
 
 	return &out
@@ -1233,12 +1299,41 @@ type FunctionDescriptor struct {
 	Returns            InputOrOutput         `json:"returns"`
 	ReturnsKnownValues bool                  `json:"returnsKnownValues"`
 
-	fn              FuncFunction
-	explanationFunc func(tf Function) string
+	// Fn is the implementation of the function; it is called with the
+	// evaluated parameters and the value the function was called on. The Fn
+	// of a built in function that needs the state of the evaluation (e.g.
+	// AddBusinessDays, which uses the calendars in the EvalOptions, or
+	// SortBy, which runs its query with the variables and limits) returns
+	// ErrOnlyInQuery, as the function can only be run within Do or DoContext.
+	Fn FuncFunction `json:"-"`
+
+	// ExplanationFunc returns a human readable explanation of the function
+	// as it is used in a validated query.
+	ExplanationFunc func(tf Function) string `json:"-"`
+
+	// evalFn is used in place of Fn by built in functions that need the
+	// state of the evaluation (e.g. to run a nested query)
+	evalFn evalFuncFunction
+
+	// lazyFn is used in place of Fn by built in functions that only run the
+	// parameters they use (e.g. If), so that the others cannot fail the query
+	lazyFn lazyFuncFunction
+
+	// lambda is set for built in functions whose last parameter is the body
+	// of a lambda, which is run for each element with '@' as the element
+	lambda bool
+
+	// returnTypeFn is used by built in functions that return one of their
+	// parameters to find the type they return when they are validated
+	returnTypeFn func(previousType InputOrOutput, params []*FunctionParameter) InputOrOutput
 }
 
 type FuncFunction func(rtParams FunctionParameterTypes, val any) (any, error)
 
+type evalFuncFunction func(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error)
+
+type lazyFuncFunction func(params lazyParameters, val any) (any, error)
+
 func (fd FunctionDescriptor) GetParamAtPosition(position int) (pd ParameterDescriptor, err error) {
 	if (len(fd.Params) - 1) < position {
 		return pd, fmt.Errorf("no parameter at position %d", position)
@@ -1289,9 +1384,9 @@ func (fd FunctionDescriptor) FriendlyName() (friendlyName string) {
 	return
 }
 
-func getAvailableFunctionsForKind(iot InputOrOutput) (names []string) {
-	for _, fd := range funcMap {
-		if iot == fd.ValidOn || (fd.ValidOn.Type == PT_Any && (fd.ValidOn.IOType == IOOT_Variadic || fd.ValidOn.IOType == iot.IOType)) {
+func getAvailableFunctionsForKind(reg *FunctionRegistry, iot InputOrOutput) (names []string) {
+	for _, fd := range reg.ListFunctions() {
+		if iot == fd.ValidOn || (fd.ValidOn.IOType == iot.IOType && fd.ValidOn.Type.accepts(iot.Type)) || (fd.ValidOn.Type == PT_Any && (fd.ValidOn.IOType == IOOT_Variadic || fd.ValidOn.IOType == iot.IOType)) {
 			names = append(names, string(fd.Name))
 		}
 	}
@@ -1328,8 +1423,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Boolean, IOOT_Single),
-			fn:          func_Not,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Not,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1343,8 +1438,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Variadic),
-			fn:          func_IsNull,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_IsNull,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1358,8 +1453,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Variadic),
-			fn:          func_IsNotNull,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_IsNotNull,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1373,8 +1468,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Variadic),
-			fn:          func_IsNullOrEmpty,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_IsNullOrEmpty,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1388,8 +1483,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Variadic),
-			fn:          func_IsNotNullOrEmpty,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_IsNotNullOrEmpty,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1403,8 +1498,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Variadic),
-			fn:          func_IsEmpty,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_IsEmpty,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1418,8 +1513,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Variadic),
-			fn:          func_IsNotEmpty,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_IsNotEmpty,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1433,8 +1528,9 @@ var (
 			Params:      singleParam("mpath query to run against each element", PT_String, IOOT_Single),
 			Returns:     inputOrOutput(PT_Any, IOOT_Array),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Array),
-			fn:          func_Select,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Select,
+			evalFn:      evalFunc_Select,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1449,8 +1545,8 @@ var (
 			Params:      singleParam("value to match", PT_Any, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Variadic),
-			fn:          func_Equal,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Equal,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1464,8 +1560,8 @@ var (
 			Params:      singleParam("value to match", PT_Any, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Variadic),
-			fn:          func_NotEqual,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_NotEqual,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1479,8 +1575,8 @@ var (
 			Params:      singleParam("number to compare", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Single),
-			fn:          func_Less,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Less,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1494,8 +1590,8 @@ var (
 			Params:      singleParam("number to compare", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Single),
-			fn:          func_LessOrEqual,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_LessOrEqual,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1509,8 +1605,8 @@ var (
 			Params:      singleParam("number to compare", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Single),
-			fn:          func_Greater,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Greater,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1524,8 +1620,8 @@ var (
 			Params:      singleParam("number to compare", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Single),
-			fn:          func_GreaterOrEqual,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_GreaterOrEqual,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1539,8 +1635,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Boolean, IOOT_Single),
-			fn:          func_Invert,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Invert,
+			ExplanationFunc: func(tf Function) string {
 				return "inverts the input"
 			},
 		},
@@ -1550,8 +1646,8 @@ var (
 			Params:      singleParam("string to match", PT_String, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_Contains,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Contains,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1565,8 +1661,8 @@ var (
 			Params:      singleParam("string to match", PT_String, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_NotContains,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_NotContains,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1580,8 +1676,8 @@ var (
 			Params:      singleParam("prefix to match", PT_String, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_Prefix,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Prefix,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1595,8 +1691,8 @@ var (
 			Params:      singleParam("prefix to match", PT_String, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_NotPrefix,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_NotPrefix,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1610,8 +1706,8 @@ var (
 			Params:      singleParam("suffix to match", PT_String, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_Suffix,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Suffix,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1625,8 +1721,8 @@ var (
 			Params:      singleParam("suffix to match", PT_String, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_NotSuffix,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_NotSuffix,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1640,8 +1736,8 @@ var (
 			Params:      singleParam("arguments", PT_Any, IOOT_Variadic),
 			Returns:     inputOrOutput(PT_String, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_Sprintf,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Sprintf,
+			ExplanationFunc: func(tf Function) string {
 				return "builds a string from the input as a template" //todo: do better
 			},
 		},
@@ -1651,8 +1747,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Number, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Array),
-			fn:          func_Count,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Count,
+			ExplanationFunc: func(tf Function) string {
 				return "count of the number of elements"
 			},
 		},
@@ -1663,8 +1759,8 @@ var (
 			Returns:            inputOrOutput(PT_Any, IOOT_Single),
 			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
 			ReturnsKnownValues: true,
-			fn:                 func_First,
-			explanationFunc: func(tf Function) string {
+			Fn:                 func_First,
+			ExplanationFunc: func(tf Function) string {
 				return "the first element"
 			},
 		},
@@ -1675,20 +1771,20 @@ var (
 			Returns:            inputOrOutput(PT_Any, IOOT_Single),
 			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
 			ReturnsKnownValues: true,
-			fn:                 func_Last,
-			explanationFunc: func(tf Function) string {
+			Fn:                 func_Last,
+			ExplanationFunc: func(tf Function) string {
 				return "the last element"
 			},
 		},
 		FT_Index: {
 			Name:               FT_Index,
-			Description:        "Returns the element at the zero based index of the array",
+			Description:        "Returns the element at the zero based index of the array; negative indices count back from the end",
 			Params:             singleParam("index", PT_Number, IOOT_Single),
 			Returns:            inputOrOutput(PT_Any, IOOT_Single),
 			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
 			ReturnsKnownValues: true,
-			fn:                 func_Index,
-			explanationFunc: func(tf Function) string {
+			Fn:                 func_Index,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1702,8 +1798,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Array),
-			fn:          func_Any,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Any,
+			ExplanationFunc: func(tf Function) string {
 				return "has any elements"
 			},
 		},
@@ -1713,8 +1809,8 @@ var (
 			Params:      singleParam("extra numbers", PT_Number, IOOT_Variadic),
 			Returns:     inputOrOutput(PT_Number, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Array),
-			fn:          func_Sum,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Sum,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) == 0 {
 					return "the sum of all elements"
 				}
@@ -1728,8 +1824,8 @@ var (
 			Params:      singleParam("extra numbers", PT_Number, IOOT_Variadic),
 			Returns:     inputOrOutput(PT_Number, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Array),
-			fn:          func_Average,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Average,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) == 0 {
 					return "the average of all elements"
 				}
@@ -1743,8 +1839,8 @@ var (
 			Params:      singleParam("extra numbers", PT_Number, IOOT_Variadic),
 			Returns:     inputOrOutput(PT_Number, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Array),
-			fn:          func_Maximum,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Maximum,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) == 0 {
 					return "the maximum of all elements"
 				}
@@ -1758,8 +1854,8 @@ var (
 			Params:      singleParam("extra numbers", PT_Number, IOOT_Variadic),
 			Returns:     inputOrOutput(PT_Number, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Array),
-			fn:          func_Minimum,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Minimum,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) == 0 {
 					return "the minimum of all elements"
 				}
@@ -1774,8 +1870,8 @@ var (
 			Returns:            inputOrOutput(PT_Any, IOOT_Array),
 			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
 			ReturnsKnownValues: true,
-			fn:                 func_AsArray,
-			explanationFunc: func(tf Function) string {
+			Fn:                 func_AsArray,
+			ExplanationFunc: func(tf Function) string {
 				return "creates an array that contains the value"
 			},
 		},
@@ -1785,8 +1881,8 @@ var (
 			Params:      singleParam("number to add", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_Number, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Single),
-			fn:          func_Add,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Add,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1800,8 +1896,8 @@ var (
 			Params:      singleParam("number to subtract", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_Number, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Single),
-			fn:          func_Subtract,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Subtract,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1815,8 +1911,9 @@ var (
 			Params:      singleParam("number to divide by", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_Number, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Single),
-			fn:          func_Divide,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Divide,
+			evalFn:      evalFunc_Divide,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1830,8 +1927,8 @@ var (
 			Params:      singleParam("number to multiply by", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_Number, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Single),
-			fn:          func_Multiply,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Multiply,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1845,8 +1942,8 @@ var (
 			Params:      singleParam("number to modulo by", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_Number, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Number, IOOT_Single),
-			fn:          func_Modulo,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Modulo,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1860,8 +1957,8 @@ var (
 			Params:      singleParam("the values to match against", PT_Any, IOOT_Variadic),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Single),
-			fn:          func_AnyOf,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_AnyOf,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) == 0 {
 					return "will return false as there are no parameters to compare against"
 				}
@@ -1881,8 +1978,8 @@ var (
 			Params:      singleParam("number of characters", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_String, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_TrimRight,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_TrimRight,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1896,8 +1993,8 @@ var (
 			Params:      singleParam("number of characters", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_String, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_TrimLeft,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_TrimLeft,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1911,8 +2008,8 @@ var (
 			Params:      singleParam("number of characters", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_String, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_Right,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Right,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1926,8 +2023,8 @@ var (
 			Params:      singleParam("number of characters", PT_Number, IOOT_Single),
 			Returns:     inputOrOutput(PT_String, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_Left,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_Left,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1941,8 +2038,9 @@ var (
 			Params:      singleParam("regular expression to match", PT_String, IOOT_Single),
 			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_DoesMatchRegex,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_DoesMatchRegex,
+			evalFn:      evalFunc_DoesMatchRegex,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -1965,8 +2063,9 @@ var (
 			},
 			Returns: inputOrOutput(PT_String, IOOT_Single),
 			ValidOn: inputOrOutput(PT_String, IOOT_Single),
-			fn:      func_ReplaceRegex,
-			explanationFunc: func(tf Function) string {
+			Fn:      func_ReplaceRegex,
+			evalFn:  evalFunc_ReplaceRegex,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 2 {
 					return ""
 				}
@@ -1989,8 +2088,8 @@ var (
 			},
 			Returns: inputOrOutput(PT_String, IOOT_Single),
 			ValidOn: inputOrOutput(PT_String, IOOT_Single),
-			fn:      func_ReplaceAll,
-			explanationFunc: func(tf Function) string {
+			Fn:      func_ReplaceAll,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 2 {
 					return ""
 				}
@@ -2004,8 +2103,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_String, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Any, IOOT_Variadic),
-			fn:          func_AsJSON,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_AsJSON,
+			ExplanationFunc: func(tf Function) string {
 				return "converts to a JSON string"
 			},
 		},
@@ -2015,8 +2114,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Object, IOOT_Variadic),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_ParseJSON,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_ParseJSON,
+			ExplanationFunc: func(tf Function) string {
 				return "parses as JSON to become an object"
 			},
 		},
@@ -2026,8 +2125,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Object, IOOT_Variadic),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_ParseXML,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_ParseXML,
+			ExplanationFunc: func(tf Function) string {
 				return "parses as XML to become an object"
 			},
 		},
@@ -2037,8 +2136,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Object, IOOT_Variadic),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_ParseYAML,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_ParseYAML,
+			ExplanationFunc: func(tf Function) string {
 				return "parses as YAML to become an object"
 			},
 		},
@@ -2048,8 +2147,8 @@ var (
 			Params:      nil,
 			Returns:     inputOrOutput(PT_Object, IOOT_Variadic),
 			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
-			fn:          func_ParseTOML,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_ParseTOML,
+			ExplanationFunc: func(tf Function) string {
 				return "parses as TOML to become an object"
 			},
 		},
@@ -2059,8 +2158,9 @@ var (
 			Params:      singleParam("regular expression to match", PT_String, IOOT_Single),
 			Returns:     inputOrOutput(PT_Object, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Object, IOOT_Single),
-			fn:          func_RemoveKeysByRegex,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_RemoveKeysByRegex,
+			evalFn:      evalFunc_RemoveKeysByRegex,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -2074,8 +2174,8 @@ var (
 			Params:      singleParam("prefix to match", PT_String, IOOT_Single),
 			Returns:     inputOrOutput(PT_Object, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Object, IOOT_Single),
-			fn:          func_RemoveKeysByPrefix,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_RemoveKeysByPrefix,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -2089,8 +2189,8 @@ var (
 			Params:      singleParam("suffix to match", PT_String, IOOT_Single),
 			Returns:     inputOrOutput(PT_Object, IOOT_Single),
 			ValidOn:     inputOrOutput(PT_Object, IOOT_Single),
-			fn:          func_RemoveKeysBySuffix,
-			explanationFunc: func(tf Function) string {
+			Fn:          func_RemoveKeysBySuffix,
+			ExplanationFunc: func(tf Function) string {
 				if len(tf.FunctionParameters) != 1 {
 					return ""
 				}
@@ -2098,22 +2198,1154 @@ var (
 				return fmt.Sprintf("removes any keys with suffix {{%s}}", tf.FunctionParameters[0].String)
 			},
 		},
-		/*
-			- Functions to add:
-				-	Select(fieldName string)
-					This will return an array of [whatever the field type is] by selecting
-					only that field from an array of objects
-		*/
-	}
-)
+		FT_Now: {
+			Name:        FT_Now,
+			Description: "Returns the current date and time",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_DateTime, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_Any, IOOT_Variadic),
+			Fn:          func_Now,
+			evalFn:      evalFunc_Now,
+			ExplanationFunc: func(tf Function) string {
+				return "is the current date and time"
+			},
+		},
+		FT_ParseDate: {
+			Name:        FT_ParseDate,
+			Description: "Parses the value as a date with the layout in the parameter; dates without a time zone are in the optional default time zone, or UTC",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "layout",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+				{
+					Name:          "default time zone (optional)",
+					InputOrOutput: inputOrOutput(PT_TimeZone, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_DateTime, IOOT_Single),
+			ValidOn: inputOrOutput(PT_String, IOOT_Single),
+			Fn:      func_ParseDate,
+			ExplanationFunc: func(tf Function) string {
+				switch len(tf.FunctionParameters) {
+				case 1:
+					return fmt.Sprintf("parses as a date with layout {{%s}}", tf.FunctionParameters[0].String)
+				case 2:
+					return fmt.Sprintf("parses as a date with layout {{%s}} in time zone {{%s}}", tf.FunctionParameters[0].String, tf.FunctionParameters[1].String)
+				}
 
-func ft_IsBoolFunc(ft FT_FunctionType) bool {
-	fn, ok := funcMap[ft]
-	if !ok {
-		return false
-	}
+				return ""
+			},
+		},
+		FT_FormatDate: {
+			Name:        FT_FormatDate,
+			Description: "Formats the date with the layout in the parameter",
+			Params:      singleParam("layout", PT_String, IOOT_Single),
+			Returns:     inputOrOutput(PT_String, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:          func_FormatDate,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
 
-	return fn.Returns.Type == PT_Boolean && fn.Returns.IOType == IOOT_Single
+				return fmt.Sprintf("formats with layout {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_AddDuration: {
+			Name:        FT_AddDuration,
+			Description: "Adds the amount of the unit of time (e.g. 2 \"day\") to the date",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "amount",
+					InputOrOutput: inputOrOutput(PT_Number, IOOT_Single),
+				},
+				{
+					Name:          "unit",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_DateTime, IOOT_Single),
+			ValidOn: inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:      func_AddDuration,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 2 {
+					return ""
+				}
+
+				return fmt.Sprintf("adds {{%s}} {{%s}}", tf.FunctionParameters[0].String, tf.FunctionParameters[1].String)
+			},
+		},
+		FT_DateDiff: {
+			Name:        FT_DateDiff,
+			Description: "Returns the number of whole units of time from the date until the other date",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "other date",
+					InputOrOutput: inputOrOutput(PT_DateTime, IOOT_Single),
+				},
+				{
+					Name:          "unit",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_Number, IOOT_Single),
+			ValidOn: inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:      func_DateDiff,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 2 {
+					return ""
+				}
+
+				return fmt.Sprintf("is the number of {{%s}} until {{%s}}", tf.FunctionParameters[1].String, tf.FunctionParameters[0].String)
+			},
+		},
+		FT_StartOf: {
+			Name:        FT_StartOf,
+			Description: "Returns the start of the unit of time (e.g. \"day\" or \"month\") that the date is in",
+			Params:      singleParam("unit", PT_String, IOOT_Single),
+			Returns:     inputOrOutput(PT_DateTime, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:          func_StartOf,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("is the start of the {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_DayOfWeek: {
+			Name:        FT_DayOfWeek,
+			Description: "Returns the name of the day of the week of the date (e.g. \"Monday\")",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_String, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:          func_DayOfWeek,
+			ExplanationFunc: func(tf Function) string {
+				return "is the day of the week"
+			},
+		},
+		FT_IsBefore: {
+			Name:        FT_IsBefore,
+			Description: "Checks whether the date is before the date in the parameter",
+			Params:      singleParam("date to compare", PT_DateTime, IOOT_Single),
+			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:          func_IsBefore,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("is before {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_IsAfter: {
+			Name:        FT_IsAfter,
+			Description: "Checks whether the date is after the date in the parameter",
+			Params:      singleParam("date to compare", PT_DateTime, IOOT_Single),
+			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:          func_IsAfter,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("is after {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_InTimezone: {
+			Name:        FT_InTimezone,
+			Description: "Converts the date to the IANA time zone in the parameter (e.g. \"Australia/Perth\")",
+			Params:      singleParam("time zone", PT_TimeZone, IOOT_Single),
+			Returns:     inputOrOutput(PT_DateTime, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:          func_InTimezone,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("in time zone {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_ToUTC: {
+			Name:        FT_ToUTC,
+			Description: "Converts the date to UTC",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_DateTime, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:          func_ToUTC,
+			ExplanationFunc: func(tf Function) string {
+				return "in UTC"
+			},
+		},
+		FT_LocalDate: {
+			Name:        FT_LocalDate,
+			Description: "Returns the calendar date (e.g. \"2024-03-15\") of the date in its time zone",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_String, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:          func_LocalDate,
+			ExplanationFunc: func(tf Function) string {
+				return "is the calendar date"
+			},
+		},
+		FT_AddBusinessDays: {
+			Name:        FT_AddBusinessDays,
+			Description: "Adds the number of business days in the holiday calendar to the date",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "number of business days",
+					InputOrOutput: inputOrOutput(PT_Number, IOOT_Single),
+				},
+				{
+					Name:          "calendar",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_DateTime, IOOT_Single),
+			ValidOn: inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:      func_AddBusinessDays,
+			evalFn:  evalFunc_AddBusinessDays,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 2 {
+					return ""
+				}
+
+				return fmt.Sprintf("adds {{%s}} business days in calendar {{%s}}", tf.FunctionParameters[0].String, tf.FunctionParameters[1].String)
+			},
+		},
+		FT_IsBusinessDay: {
+			Name:        FT_IsBusinessDay,
+			Description: "Checks whether the date is a business day in the holiday calendar",
+			Params:      singleParam("calendar", PT_String, IOOT_Single),
+			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:          func_IsBusinessDay,
+			evalFn:      evalFunc_IsBusinessDay,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("is a business day in calendar {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_BusinessDaysBetween: {
+			Name:        FT_BusinessDaysBetween,
+			Description: "Returns the number of business days in the holiday calendar after the date, up to and including the other date",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "other date",
+					InputOrOutput: inputOrOutput(PT_DateTime, IOOT_Single),
+				},
+				{
+					Name:          "calendar",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_Number, IOOT_Single),
+			ValidOn: inputOrOutput(PT_DateTime, IOOT_Single),
+			Fn:      func_BusinessDaysBetween,
+			evalFn:  evalFunc_BusinessDaysBetween,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 2 {
+					return ""
+				}
+
+				return fmt.Sprintf("is the number of business days in calendar {{%s}} until {{%s}}", tf.FunctionParameters[1].String, tf.FunctionParameters[0].String)
+			},
+		},
+		FT_ToUpper: {
+			Name:        FT_ToUpper,
+			Description: "Converts the value to upper case",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_String, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
+			Fn:          func_ToUpper,
+			ExplanationFunc: func(tf Function) string {
+				return "converts to upper case"
+			},
+		},
+		FT_ToLower: {
+			Name:        FT_ToLower,
+			Description: "Converts the value to lower case",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_String, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
+			Fn:          func_ToLower,
+			ExplanationFunc: func(tf Function) string {
+				return "converts to lower case"
+			},
+		},
+		FT_Title: {
+			Name:        FT_Title,
+			Description: "Converts the first letter of each word in the value to upper case, and the other letters to lower case",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_String, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
+			Fn:          func_Title,
+			ExplanationFunc: func(tf Function) string {
+				return "converts to title case"
+			},
+		},
+		FT_TrimSpace: {
+			Name:        FT_TrimSpace,
+			Description: "Removes any whitespace from the start and end of the value",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_String, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
+			Fn:          func_TrimSpace,
+			ExplanationFunc: func(tf Function) string {
+				return "trims whitespace"
+			},
+		},
+		FT_Length: {
+			Name:        FT_Length,
+			Description: "Returns the number of characters in the value",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_Number, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
+			Fn:          func_Length,
+			ExplanationFunc: func(tf Function) string {
+				return "is the number of characters"
+			},
+		},
+		FT_Split: {
+			Name:        FT_Split,
+			Description: "Splits the value into an array of strings at each occurrence of the separator in the parameter",
+			Params:      singleParam("separator", PT_String, IOOT_Single),
+			Returns:     inputOrOutput(PT_String, IOOT_Array),
+			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
+			Fn:          func_Split,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("splits at {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_Join: {
+			Name:        FT_Join,
+			Description: "Joins the array into a string, with the separator in the parameter between each element",
+			Params:      singleParam("separator", PT_String, IOOT_Single),
+			Returns:     inputOrOutput(PT_String, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_String, IOOT_Array),
+			Fn:          func_Join,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("joins with {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_IndexOf: {
+			Name:        FT_IndexOf,
+			Description: "Returns the position of the first occurrence of the parameter in the value, counting from zero, or -1 if it does not occur",
+			Params:      singleParam("string to find", PT_String, IOOT_Single),
+			Returns:     inputOrOutput(PT_Number, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
+			Fn:          func_IndexOf,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("is the position of {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_Substring: {
+			Name:        FT_Substring,
+			Description: "Returns the part of the value that starts at the position (counting from zero) and has the length in the parameters",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "start",
+					InputOrOutput: inputOrOutput(PT_Number, IOOT_Single),
+				},
+				{
+					Name:          "length",
+					InputOrOutput: inputOrOutput(PT_Number, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_String, IOOT_Single),
+			ValidOn: inputOrOutput(PT_String, IOOT_Single),
+			Fn:      func_Substring,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 2 {
+					return ""
+				}
+
+				return fmt.Sprintf("is the {{%s}} characters from position {{%s}}", tf.FunctionParameters[1].String, tf.FunctionParameters[0].String)
+			},
+		},
+		FT_PadLeft: {
+			Name:        FT_PadLeft,
+			Description: "Pads the value on the left to the width in the parameter, with the optional padding or spaces",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "width",
+					InputOrOutput: inputOrOutput(PT_Number, IOOT_Single),
+				},
+				{
+					Name:          "padding (optional)",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_String, IOOT_Single),
+			ValidOn: inputOrOutput(PT_String, IOOT_Single),
+			Fn:      func_PadLeft,
+			ExplanationFunc: func(tf Function) string {
+				switch len(tf.FunctionParameters) {
+				case 1:
+					return fmt.Sprintf("pads on the left to {{%s}} characters", tf.FunctionParameters[0].String)
+				case 2:
+					return fmt.Sprintf("pads on the left to {{%s}} characters with {{%s}}", tf.FunctionParameters[0].String, tf.FunctionParameters[1].String)
+				}
+
+				return ""
+			},
+		},
+		FT_PadRight: {
+			Name:        FT_PadRight,
+			Description: "Pads the value on the right to the width in the parameter, with the optional padding or spaces",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "width",
+					InputOrOutput: inputOrOutput(PT_Number, IOOT_Single),
+				},
+				{
+					Name:          "padding (optional)",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_String, IOOT_Single),
+			ValidOn: inputOrOutput(PT_String, IOOT_Single),
+			Fn:      func_PadRight,
+			ExplanationFunc: func(tf Function) string {
+				switch len(tf.FunctionParameters) {
+				case 1:
+					return fmt.Sprintf("pads on the right to {{%s}} characters", tf.FunctionParameters[0].String)
+				case 2:
+					return fmt.Sprintf("pads on the right to {{%s}} characters with {{%s}}", tf.FunctionParameters[0].String, tf.FunctionParameters[1].String)
+				}
+
+				return ""
+			},
+		},
+		FT_Repeat: {
+			Name:        FT_Repeat,
+			Description: "Repeats the value the number of times in the parameter",
+			Params:      singleParam("number of times", PT_Number, IOOT_Single),
+			Returns:     inputOrOutput(PT_String, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
+			Fn:          func_Repeat,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("repeats {{%s}} times", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_EqualFold: {
+			Name:        FT_EqualFold,
+			Description: "Checks whether the value equals the parameter, ignoring case; the optional normalisation (NFC, NFKD or StripDiacritics) is applied to both before they are compared",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "value to match",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+				{
+					Name:          "normalisation (optional)",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn: inputOrOutput(PT_String, IOOT_Single),
+			Fn:      func_EqualFold,
+			ExplanationFunc: func(tf Function) string {
+				return foldExplanation(tf, "is equal to {{%s}}")
+			},
+		},
+		FT_ContainsFold: {
+			Name:        FT_ContainsFold,
+			Description: "Checks whether the value contains the parameter, ignoring case; the optional normalisation (NFC, NFKD or StripDiacritics) is applied to both before they are compared",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "value to find",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+				{
+					Name:          "normalisation (optional)",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn: inputOrOutput(PT_String, IOOT_Single),
+			Fn:      func_ContainsFold,
+			ExplanationFunc: func(tf Function) string {
+				return foldExplanation(tf, "contains {{%s}}")
+			},
+		},
+		FT_PrefixFold: {
+			Name:        FT_PrefixFold,
+			Description: "Checks whether the value has the parameter as a prefix, ignoring case; the optional normalisation (NFC, NFKD or StripDiacritics) is applied to both before they are compared",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "prefix to match",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+				{
+					Name:          "normalisation (optional)",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn: inputOrOutput(PT_String, IOOT_Single),
+			Fn:      func_PrefixFold,
+			ExplanationFunc: func(tf Function) string {
+				return foldExplanation(tf, "has the prefix {{%s}}")
+			},
+		},
+		FT_AnyOfFold: {
+			Name:        FT_AnyOfFold,
+			Description: "Checks whether the value matches any of the parameters, ignoring case",
+			Params:      singleParam("the values to match against", PT_String, IOOT_Variadic),
+			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_String, IOOT_Single),
+			Fn:          func_AnyOfFold,
+			ExplanationFunc: func(tf Function) string {
+				return anyOfFoldExplanation(tf.FunctionParameters, nm_None)
+			},
+		},
+		FT_AnyOfFoldNormalised: {
+			Name:        FT_AnyOfFoldNormalised,
+			Description: "Checks whether the value matches any of the parameters after the first, ignoring case, once the normalisation in the first parameter (NFC, NFKD or StripDiacritics) has been applied to both",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "normalisation",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+				{
+					Name:          "the values to match against",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Variadic),
+				},
+			},
+			Returns: inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn: inputOrOutput(PT_String, IOOT_Single),
+			Fn:      func_AnyOfFoldNormalised,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) == 0 {
+					return ""
+				}
+
+				n, ok := explainedNormalisation(tf.FunctionParameters[0])
+				if !ok {
+					return ""
+				}
+
+				return anyOfFoldExplanation(tf.FunctionParameters[1:], n)
+			},
+		},
+		FT_Sort: {
+			Name:               FT_Sort,
+			Description:        "Sorts the elements of the array in ascending order",
+			Params:             nil,
+			Returns:            inputOrOutput(PT_Any, IOOT_Array),
+			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
+			ReturnsKnownValues: true,
+			Fn:                 func_Sort,
+			ExplanationFunc: func(tf Function) string {
+				return "sorted in ascending order"
+			},
+		},
+		FT_SortDesc: {
+			Name:               FT_SortDesc,
+			Description:        "Sorts the elements of the array in descending order",
+			Params:             nil,
+			Returns:            inputOrOutput(PT_Any, IOOT_Array),
+			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
+			ReturnsKnownValues: true,
+			Fn:                 func_SortDesc,
+			ExplanationFunc: func(tf Function) string {
+				return "sorted in descending order"
+			},
+		},
+		FT_SortBy: {
+			Name:               FT_SortBy,
+			Description:        "Sorts the elements of the array in ascending order of the result of the query in the parameter, which is run against each element",
+			Params:             singleParam("mpath query to run against each element", PT_String, IOOT_Single),
+			Returns:            inputOrOutput(PT_Any, IOOT_Array),
+			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
+			ReturnsKnownValues: true,
+			Fn:                 func_SortBy,
+			evalFn:             evalFunc_SortBy,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("sorted by {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_Distinct: {
+			Name:               FT_Distinct,
+			Description:        "Removes the elements of the array that are equal to an earlier element",
+			Params:             nil,
+			Returns:            inputOrOutput(PT_Any, IOOT_Array),
+			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
+			ReturnsKnownValues: true,
+			Fn:                 func_Distinct,
+			ExplanationFunc: func(tf Function) string {
+				return "with duplicates removed"
+			},
+		},
+		FT_DistinctBy: {
+			Name:               FT_DistinctBy,
+			Description:        "Removes the elements of the array for which the query in the parameter returns the same result as for an earlier element",
+			Params:             singleParam("mpath query to run against each element", PT_String, IOOT_Single),
+			Returns:            inputOrOutput(PT_Any, IOOT_Array),
+			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
+			ReturnsKnownValues: true,
+			Fn:                 func_DistinctBy,
+			evalFn:             evalFunc_DistinctBy,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("with duplicates of {{%s}} removed", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_Reverse: {
+			Name:               FT_Reverse,
+			Description:        "Reverses the order of the elements of the array",
+			Params:             nil,
+			Returns:            inputOrOutput(PT_Any, IOOT_Array),
+			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
+			ReturnsKnownValues: true,
+			Fn:                 func_Reverse,
+			ExplanationFunc: func(tf Function) string {
+				return "in reverse order"
+			},
+		},
+		FT_Take: {
+			Name:               FT_Take,
+			Description:        "Returns the number of elements in the parameter from the start of the array",
+			Params:             singleParam("number of elements", PT_Number, IOOT_Single),
+			Returns:            inputOrOutput(PT_Any, IOOT_Array),
+			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
+			ReturnsKnownValues: true,
+			Fn:                 func_Take,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("the first {{%s}} elements", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_Skip: {
+			Name:               FT_Skip,
+			Description:        "Returns the elements of the array after skipping the number of elements in the parameter",
+			Params:             singleParam("number of elements", PT_Number, IOOT_Single),
+			Returns:            inputOrOutput(PT_Any, IOOT_Array),
+			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
+			ReturnsKnownValues: true,
+			Fn:                 func_Skip,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("without the first {{%s}} elements", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_Flatten: {
+			Name:        FT_Flatten,
+			Description: "Replaces the elements of the array that are arrays with their elements",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_Any, IOOT_Array),
+			ValidOn:     inputOrOutput(PT_Any, IOOT_Array),
+			Fn:          func_Flatten,
+			evalFn:      evalFunc_Flatten,
+			ExplanationFunc: func(tf Function) string {
+				return "with nested arrays flattened"
+			},
+		},
+		FT_GroupBy: {
+			Name:        FT_GroupBy,
+			Description: "Groups the elements of the array by the result of the query in the parameter, which is run against each element, and returns an object of each result to the array of elements in its group",
+			Params:      singleParam("mpath query to run against each element", PT_String, IOOT_Single),
+			Returns:     inputOrOutput(PT_Object, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_Any, IOOT_Array),
+			Fn:          func_GroupBy,
+			evalFn:      evalFunc_GroupBy,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("grouped by {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_CountBy: {
+			Name:        FT_CountBy,
+			Description: "Groups the elements of the array by the result of the query in the parameter, which is run against each element, and returns an object of each result to the number of elements in its group",
+			Params:      singleParam("mpath query to run against each element", PT_String, IOOT_Single),
+			Returns:     inputOrOutput(PT_Object, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_Any, IOOT_Array),
+			Fn:          func_CountBy,
+			evalFn:      evalFunc_CountBy,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("the number of elements for each {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_SumBy: {
+			Name:        FT_SumBy,
+			Description: "Groups the elements of the array by the result of the query in the first parameter, and returns an object of each result to the sum of the numbers from the query in the second parameter for the elements in its group",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "mpath query for the group of each element",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+				{
+					Name:          "mpath query for the number of each element",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_Object, IOOT_Single),
+			ValidOn: inputOrOutput(PT_Any, IOOT_Array),
+			Fn:      func_SumBy,
+			evalFn:  evalFunc_SumBy,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 2 {
+					return ""
+				}
+
+				return fmt.Sprintf("the sum of {{%s}} for each {{%s}}", tf.FunctionParameters[1].String, tf.FunctionParameters[0].String)
+			},
+		},
+		FT_AverageBy: {
+			Name:        FT_AverageBy,
+			Description: "Groups the elements of the array by the result of the query in the first parameter, and returns an object of each result to the average of the numbers from the query in the second parameter for the elements in its group",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "mpath query for the group of each element",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+				{
+					Name:          "mpath query for the number of each element",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_Object, IOOT_Single),
+			ValidOn: inputOrOutput(PT_Any, IOOT_Array),
+			Fn:      func_AverageBy,
+			evalFn:  evalFunc_AverageBy,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 2 {
+					return ""
+				}
+
+				return fmt.Sprintf("the average of {{%s}} for each {{%s}}", tf.FunctionParameters[1].String, tf.FunctionParameters[0].String)
+			},
+		},
+		FT_MinimumBy: {
+			Name:        FT_MinimumBy,
+			Description: "Groups the elements of the array by the result of the query in the first parameter, and returns an object of each result to the minimum of the numbers from the query in the second parameter for the elements in its group",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "mpath query for the group of each element",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+				{
+					Name:          "mpath query for the number of each element",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_Object, IOOT_Single),
+			ValidOn: inputOrOutput(PT_Any, IOOT_Array),
+			Fn:      func_MinimumBy,
+			evalFn:  evalFunc_MinimumBy,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 2 {
+					return ""
+				}
+
+				return fmt.Sprintf("the minimum of {{%s}} for each {{%s}}", tf.FunctionParameters[1].String, tf.FunctionParameters[0].String)
+			},
+		},
+		FT_MaximumBy: {
+			Name:        FT_MaximumBy,
+			Description: "Groups the elements of the array by the result of the query in the first parameter, and returns an object of each result to the maximum of the numbers from the query in the second parameter for the elements in its group",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "mpath query for the group of each element",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+				{
+					Name:          "mpath query for the number of each element",
+					InputOrOutput: inputOrOutput(PT_String, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_Object, IOOT_Single),
+			ValidOn: inputOrOutput(PT_Any, IOOT_Array),
+			Fn:      func_MaximumBy,
+			evalFn:  evalFunc_MaximumBy,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 2 {
+					return ""
+				}
+
+				return fmt.Sprintf("the maximum of {{%s}} for each {{%s}}", tf.FunctionParameters[1].String, tf.FunctionParameters[0].String)
+			},
+		},
+		FT_Keys: {
+			Name:        FT_Keys,
+			Description: "Returns the names of the fields of the object; the keys of maps are sorted, and the fields of structs are in the order they are declared",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_String, IOOT_Array),
+			ValidOn:     inputOrOutput(PT_Object, IOOT_Single),
+			Fn:          func_Keys,
+			evalFn:      evalFunc_Keys,
+			ExplanationFunc: func(tf Function) string {
+				return "the names of the fields"
+			},
+		},
+		FT_Values: {
+			Name:        FT_Values,
+			Description: "Returns the values of the fields of the object, in the same order as Keys",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_Any, IOOT_Array),
+			ValidOn:     inputOrOutput(PT_Object, IOOT_Single),
+			Fn:          func_Values,
+			evalFn:      evalFunc_Values,
+			ExplanationFunc: func(tf Function) string {
+				return "the values of the fields"
+			},
+		},
+		FT_Entries: {
+			Name:        FT_Entries,
+			Description: "Returns an array of objects with the key and value of each field of the object, in the same order as Keys",
+			Params:      nil,
+			Returns:     inputOrOutput(PT_Object, IOOT_Array),
+			ValidOn:     inputOrOutput(PT_Object, IOOT_Single),
+			Fn:          func_Entries,
+			evalFn:      evalFunc_Entries,
+			ExplanationFunc: func(tf Function) string {
+				return "the key and value of each field"
+			},
+		},
+		FT_HasKey: {
+			Name:        FT_HasKey,
+			Description: "Checks whether the object has the field named by the parameter, which is matched in the same way as a path",
+			Params:      singleParam("name of the field", PT_String, IOOT_Single),
+			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_Object, IOOT_Single),
+			Fn:          func_HasKey,
+			evalFn:      evalFunc_HasKey,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("has the field {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_Get: {
+			Name:        FT_Get,
+			Description: "Returns the field of the object named by the parameter, which is matched in the same way as a path",
+			Params:      singleParam("name of the field", PT_String, IOOT_Single),
+			Returns:     inputOrOutput(PT_Any, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_Object, IOOT_Single),
+			Fn:          func_Get,
+			evalFn:      evalFunc_Get,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("the field {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_Pick: {
+			Name:        FT_Pick,
+			Description: "Returns an object with only the fields of the object that are named by the parameters, which are matched in the same way as a path; names that are not fields are ignored",
+			Params:      singleParam("names of the fields to keep", PT_String, IOOT_Variadic),
+			Returns:     inputOrOutput(PT_Object, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_Object, IOOT_Single),
+			Fn:          func_Pick,
+			evalFn:      evalFunc_Pick,
+			ExplanationFunc: func(tf Function) string {
+				params := []string{}
+				for _, p := range tf.FunctionParameters {
+					params = append(params, fmt.Sprintf("{{%s}}", p.String))
+				}
+
+				return fmt.Sprintf("only the fields %s", strings.Join(params, ", "))
+			},
+		},
+		FT_Omit: {
+			Name:        FT_Omit,
+			Description: "Returns an object with the fields of the object other than those named by the parameters, which are matched in the same way as a path",
+			Params:      singleParam("names of the fields to remove", PT_String, IOOT_Variadic),
+			Returns:     inputOrOutput(PT_Object, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_Object, IOOT_Single),
+			Fn:          func_Omit,
+			evalFn:      evalFunc_Omit,
+			ExplanationFunc: func(tf Function) string {
+				params := []string{}
+				for _, p := range tf.FunctionParameters {
+					params = append(params, fmt.Sprintf("{{%s}}", p.String))
+				}
+
+				return fmt.Sprintf("without the fields %s", strings.Join(params, ", "))
+			},
+		},
+		FT_If: {
+			Name:        FT_If,
+			Description: "Returns the second parameter if the condition in the first parameter is true, otherwise the third parameter; only the parameter that is returned is run",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "condition",
+					InputOrOutput: inputOrOutput(PT_Boolean, IOOT_Single),
+				},
+				{
+					Name:          "value if true",
+					InputOrOutput: inputOrOutput(PT_Any, IOOT_Variadic),
+				},
+				{
+					Name:          "value if false",
+					InputOrOutput: inputOrOutput(PT_Any, IOOT_Variadic),
+				},
+			},
+			Returns: inputOrOutput(PT_Any, IOOT_Single),
+			ValidOn: inputOrOutput(PT_Any, IOOT_Variadic),
+			Fn:      func_If,
+			lazyFn:  lazyFunc_If,
+			returnTypeFn: func(_ InputOrOutput, params []*FunctionParameter) InputOrOutput {
+				return commonType(parameterTypes(params, 1)...)
+			},
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 3 {
+					return ""
+				}
+
+				return fmt.Sprintf("{{%s}} if {{%s}}, otherwise {{%s}}", tf.FunctionParameters[1].String, tf.FunctionParameters[0].String, tf.FunctionParameters[2].String)
+			},
+		},
+		FT_Coalesce: {
+			Name:         FT_Coalesce,
+			Description:  "Returns the value if it is not null, otherwise the first of the parameters that is not null; parameters after that one are not run, and parameters that address a missing field are null",
+			Params:       singleParam("values to use in turn", PT_Any, IOOT_Variadic),
+			Returns:      inputOrOutput(PT_Any, IOOT_Single),
+			ValidOn:      inputOrOutput(PT_Any, IOOT_Variadic),
+			Fn:           func_Coalesce,
+			lazyFn:       lazyFunc_Coalesce,
+			returnTypeFn: coalescedType,
+			ExplanationFunc: func(tf Function) string {
+				params := []string{}
+				for _, p := range tf.FunctionParameters {
+					params = append(params, fmt.Sprintf("{{%s}}", p.String))
+				}
+
+				return fmt.Sprintf("or else the first of %s that is not null", strings.Join(params, ", "))
+			},
+		},
+		FT_Default: {
+			Name:         FT_Default,
+			Description:  "Returns the value if it is not null, otherwise the parameter, which is only run if it is needed",
+			Params:       singleParam("value to use if null", PT_Any, IOOT_Variadic),
+			Returns:      inputOrOutput(PT_Any, IOOT_Single),
+			ValidOn:      inputOrOutput(PT_Any, IOOT_Variadic),
+			Fn:           func_Default,
+			lazyFn:       lazyFunc_Default,
+			returnTypeFn: coalescedType,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("or else {{%s}} if null", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_Map: {
+			Name:         FT_Map,
+			Description:  "Returns an array of the results of the parameter, which is run for each element with '@' as the element and '$' as the root of the data",
+			Params:       singleParam("value for each element", PT_Any, IOOT_Variadic),
+			Returns:      inputOrOutput(PT_Any, IOOT_Array),
+			ValidOn:      inputOrOutput(PT_Any, IOOT_Array),
+			Fn:           func_Map,
+			lazyFn:       lazyFunc_Map,
+			lambda:       true,
+			returnTypeFn: mappedType,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("{{%s}} for each element", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_Where: {
+			Name:               FT_Where,
+			Description:        "Returns the elements of the array for which the condition in the parameter is true; the condition is run for each element with '@' as the element and '$' as the root of the data",
+			Params:             singleParam("condition for each element", PT_Boolean, IOOT_Single),
+			Returns:            inputOrOutput(PT_Any, IOOT_Array),
+			ValidOn:            inputOrOutput(PT_Any, IOOT_Array),
+			ReturnsKnownValues: true,
+			Fn:                 func_Where,
+			lazyFn:             lazyFunc_Where,
+			lambda:             true,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return fmt.Sprintf("the elements where {{%s}}", tf.FunctionParameters[0].String)
+			},
+		},
+		FT_All: {
+			Name:        FT_All,
+			Description: "Returns true if the condition in the parameter is true for every element of the array; the condition is run for each element with '@' as the element and '$' as the root of the data, stopping at the first element for which it is false",
+			Params:      singleParam("condition for each element", PT_Boolean, IOOT_Single),
+			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_Any, IOOT_Array),
+			Fn:          func_All,
+			lazyFn:      lazyFunc_All,
+			lambda:      true,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return quantifiedExplanation(tf, "all", tf.FunctionParameters[0])
+			},
+		},
+		FT_AnyMatch: {
+			Name:        FT_AnyMatch,
+			Description: "Returns true if the condition in the parameter is true for any element of the array; the condition is run for each element with '@' as the element and '$' as the root of the data, stopping at the first element for which it is true",
+			Params:      singleParam("condition for each element", PT_Boolean, IOOT_Single),
+			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_Any, IOOT_Array),
+			Fn:          func_AnyMatch,
+			lazyFn:      lazyFunc_AnyMatch,
+			lambda:      true,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return quantifiedExplanation(tf, "some", tf.FunctionParameters[0])
+			},
+		},
+		FT_None: {
+			Name:        FT_None,
+			Description: "Returns true if the condition in the parameter is false for every element of the array; the condition is run for each element with '@' as the element and '$' as the root of the data, stopping at the first element for which it is true",
+			Params:      singleParam("condition for each element", PT_Boolean, IOOT_Single),
+			Returns:     inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn:     inputOrOutput(PT_Any, IOOT_Array),
+			Fn:          func_None,
+			lazyFn:      lazyFunc_None,
+			lambda:      true,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 1 {
+					return ""
+				}
+
+				return quantifiedExplanation(tf, "no", tf.FunctionParameters[0])
+			},
+		},
+		FT_Exactly: {
+			Name:        FT_Exactly,
+			Description: "Returns true if the condition in the second parameter is true for exactly the number of elements in the first parameter; the condition is run for each element with '@' as the element and '$' as the root of the data, stopping once the result is known",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "number of elements",
+					InputOrOutput: inputOrOutput(PT_Number, IOOT_Single),
+				},
+				{
+					Name:          "condition for each element",
+					InputOrOutput: inputOrOutput(PT_Boolean, IOOT_Single),
+				},
+			},
+			Returns: inputOrOutput(PT_Boolean, IOOT_Single),
+			ValidOn: inputOrOutput(PT_Any, IOOT_Array),
+			Fn:      func_Exactly,
+			lazyFn:  lazyFunc_Exactly,
+			lambda:  true,
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 2 {
+					return ""
+				}
+
+				return quantifiedExplanation(tf, fmt.Sprintf("exactly {{%s}}", tf.FunctionParameters[0].String), tf.FunctionParameters[1])
+			},
+		},
+		FT_Reduce: {
+			Name:        FT_Reduce,
+			Description: "Returns the result of the second parameter after it is run for each element in turn, with '@' as the element, '#acc' as the result so far and '$' as the root of the data; the result so far starts as the first parameter",
+			Params: []ParameterDescriptor{
+				{
+					Name:          "initial value",
+					InputOrOutput: inputOrOutput(PT_Any, IOOT_Variadic),
+				},
+				{
+					Name:          "next value for each element",
+					InputOrOutput: inputOrOutput(PT_Any, IOOT_Variadic),
+				},
+			},
+			Returns: inputOrOutput(PT_Any, IOOT_Single),
+			ValidOn: inputOrOutput(PT_Any, IOOT_Array),
+			Fn:      func_Reduce,
+			lazyFn:  lazyFunc_Reduce,
+			lambda:  true,
+			returnTypeFn: func(_ InputOrOutput, params []*FunctionParameter) InputOrOutput {
+				return commonType(parameterTypes(params, 0)...)
+			},
+			ExplanationFunc: func(tf Function) string {
+				if len(tf.FunctionParameters) != 2 {
+					return ""
+				}
+
+				return fmt.Sprintf("{{%s}} for each element in turn, starting with {{%s}}", tf.FunctionParameters[1].String, tf.FunctionParameters[0].String)
+			},
+		},
+		/*
+			- Functions to add:
+				-	Select(fieldName string)
+					This will return an array of [whatever the field type is] by selecting
+					only that field from an array of objects
+		*/
+	}
+)
+
+func ft_IsBoolFunc(reg *FunctionRegistry, ft FT_FunctionType) bool {
+	fn, ok := reg.lookup(ft)
+	if !ok {
+		return false
+	}
+
+	return fn.Returns.Type == PT_Boolean && fn.Returns.IOType == IOOT_Single
+}
+
+func ft_IsValidOnAny(reg *FunctionRegistry, ft FT_FunctionType) bool {
+	fn, ok := reg.lookup(ft)
+	if !ok {
+		return false
+	}
+
+	return fn.ValidOn.Type == PT_Any && fn.ValidOn.IOType == IOOT_Variadic
 }
 
 func isMap(val any) bool {
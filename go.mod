@@ -12,6 +12,7 @@ require (
 	github.com/pelletier/go-toml/v2 v2.0.5
 	github.com/pkg/errors v0.9.1
 	github.com/shopspring/decimal v1.3.1
+	golang.org/x/text v0.14.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -21,6 +22,5 @@ require (
 	github.com/bitly/go-simplejson v0.5.1 // indirect
 	github.com/cockroachdb/apd/v3 v3.2.1 // indirect
 	golang.org/x/net v0.22.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -3,6 +3,7 @@ package mpath
 import (
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/shopspring/decimal"
 )
@@ -99,7 +100,11 @@ func isNumberKind(k reflect.Kind) bool {
 	return false
 }
 
-func getValuesByName(identName string, data any) (out any, err error) {
+// fieldIndexFunc returns the index of the field of the struct type that is
+// addressed by the ident name
+type fieldIndexFunc func(t reflect.Type, identName string) (index []int, found bool)
+
+func getValuesByName(identName string, data any, fieldIndex fieldIndexFunc) (out any, err error) {
 	v := reflect.ValueOf(data)
 
 	if !isEmptyValue(v) {
@@ -111,7 +116,7 @@ func getValuesByName(identName string, data any) (out any, err error) {
 		switch v.Kind() {
 		case reflect.Struct:
 			var wasFound bool
-			out, wasFound = getFieldValueByNameFromStruct(identName, v)
+			out, wasFound = getFieldValueByNameFromStruct(identName, v, fieldIndex)
 			if wasFound {
 				return
 			}
@@ -135,7 +140,7 @@ func getValuesByName(identName string, data any) (out any, err error) {
 			var slc []any
 			var found bool
 			for i := 0; i < v.Len(); i++ {
-				if out, found = getFieldValueByNameFromStruct(identName, v.Index(i)); found {
+				if out, found = getFieldValueByNameFromStruct(identName, v.Index(i), fieldIndex); found {
 					slc = append(slc, out)
 				}
 			}
@@ -164,6 +169,10 @@ func getAsStructOrSlice(data any) (out any, ok, wasStruct bool) {
 
 	switch v.Kind() {
 	case reflect.Struct:
+		if v.Type() == timeType {
+			// Dates are values rather than objects
+			return nil, false, false
+		}
 		return v.Interface(), true, true
 	case reflect.Array, reflect.Slice:
 		if v.Len() == 0 {
@@ -185,7 +194,7 @@ func getAsStructOrSlice(data any) (out any, ok, wasStruct bool) {
 	return nil, false, false
 }
 
-func getFieldValueByNameFromStruct(identName string, structValue reflect.Value) (out any, found bool) {
+func getFieldValueByNameFromStruct(identName string, structValue reflect.Value, fieldIndex fieldIndexFunc) (out any, found bool) {
 	if isEmptyValue(structValue) {
 		return nil, false
 	}
@@ -225,45 +234,52 @@ func getFieldValueByNameFromStruct(identName string, structValue reflect.Value)
 		return nil, false
 	}
 
-	st := structValue.Type()
-
-	for fn := 0; fn < structValue.NumField(); fn++ {
-		structFieldName := st.Field(fn).Name
-		if strings.EqualFold(structFieldName, identName) {
-			out = structValue.Field(fn).Interface()
-
-			switch outType := out.(type) {
-			case float64:
-				out = decimal.NewFromFloat(outType)
-			case float32:
-				out = decimal.NewFromFloat(float64(outType))
-			case int:
-				out = decimal.NewFromInt(int64(outType))
-			case int8:
-				out = decimal.NewFromInt(int64(outType))
-			case int16:
-				out = decimal.NewFromInt(int64(outType))
-			case int32:
-				out = decimal.NewFromInt(int64(outType))
-			case int64:
-				out = decimal.NewFromInt(int64(outType))
-			case uint:
-				out = decimal.NewFromInt(int64(outType))
-			case uint8:
-				out = decimal.NewFromInt(int64(outType))
-			case uint16:
-				out = decimal.NewFromInt(int64(outType))
-			case uint32:
-				out = decimal.NewFromInt(int64(outType))
-			case uint64:
-				out = decimal.NewFromInt(int64(outType))
-			}
+	index, found := fieldIndex(structValue.Type(), identName)
+	if !found {
+		return nil, false
+	}
+
+	// The field may be in an embedded struct that is a nil pointer
+	fieldValue, err := structValue.FieldByIndexErr(index)
+	if err != nil {
+		return nil, false
+	}
+
+	out = fieldValue.Interface()
 
-			return out, true
+	switch outType := out.(type) {
+	case float64:
+		out = decimal.NewFromFloat(outType)
+	case float32:
+		out = decimal.NewFromFloat(float64(outType))
+	case int:
+		out = decimal.NewFromInt(int64(outType))
+	case int8:
+		out = decimal.NewFromInt(int64(outType))
+	case int16:
+		out = decimal.NewFromInt(int64(outType))
+	case int32:
+		out = decimal.NewFromInt(int64(outType))
+	case int64:
+		out = decimal.NewFromInt(int64(outType))
+	case uint:
+		out = decimal.NewFromInt(int64(outType))
+	case uint8:
+		out = decimal.NewFromInt(int64(outType))
+	case uint16:
+		out = decimal.NewFromInt(int64(outType))
+	case uint32:
+		out = decimal.NewFromInt(int64(outType))
+	case uint64:
+		out = decimal.NewFromInt(int64(outType))
+	case *time.Time:
+		if outType == nil {
+			return nil, true
 		}
+		out = *outType
 	}
 
-	return nil, false
+	return out, true
 }
 
 func doForMapPerKey(valueThatShouldBeMap any, doFunc func(keyAsString string, keyAsValue, mapAsValue reflect.Value)) {
@@ -0,0 +1,499 @@
+package mpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"cuelang.org/go/cue"
+	"github.com/shopspring/decimal"
+)
+
+// The body of a lambda is the last parameter of a function such as Map or
+// Where; it is parsed with the query and run for each element of the array,
+// with '@' as the element and '$' as the root of the data, e.g.
+// `$.items.Map(@.price.Multiply(@.qty))`
+
+// accumulatorVariable is the variable that holds the result so far in the
+// body of Reduce, e.g. `$.items.Reduce(0, #acc.Add(@.price))`
+const accumulatorVariable = "acc"
+
+// cueLambdaElement is the prefix of the definitions that describe the element
+// of each lambda while the query is validated; they are numbered from 1 for
+// the outermost lambda
+const cueLambdaElement = "#mpathElement"
+
+// bindLambdaBody marks the paths in the body that start at '@', so that they
+// start at the element even when they are the parameters of a function within
+// the body. The filters in the body are not changed, as '@' in a filter is the
+// value being filtered.
+func bindLambdaBody(op Operation, isReduce bool) {
+	switch t := op.(type) {
+	case *opPath:
+		if t.IsFilter {
+			return
+		}
+
+		if t.VariableName == "" && t.literal == nil && !t.StartAtRoot {
+			t.startsAtElement = true
+		}
+
+		if isReduce && t.VariableName == accumulatorVariable {
+			// This is the accumulator, even if a variable of the same name
+			// is declared in the query
+			t.variable = nil
+		}
+
+		for _, o := range t.Operations {
+			if fn, ok := o.(*opFunction); ok {
+				for _, p := range fn.Params {
+					bindLambdaBody(paramOperation(p), isReduce)
+				}
+			}
+		}
+
+	case *opLogicalOperation:
+		for _, o := range t.Operations {
+			bindLambdaBody(o, isReduce)
+		}
+	}
+}
+
+// paramOperation returns the operation of a parameter that is a path or a
+// logical operation, or nil for a literal
+func paramOperation(p FunctionParameterType) Operation {
+	switch t := p.(type) {
+	case *FP_Path:
+		return t.Value
+	case *FP_LogicalOperation:
+		return t.Value
+	}
+
+	return nil
+}
+
+// lambdaDefinition is the name of the definition that describes the element
+// of the lambda at the depth while the query is validated
+func lambdaDefinition(depth int) string {
+	return cueLambdaElement + strconv.Itoa(depth)
+}
+
+// lambdaDepth returns the number of lambdas that the cue value is validating
+// within
+func lambdaDepth(rootValue cue.Value) (depth int) {
+	for rootValue.LookupPath(cue.MakePath(cue.Def(lambdaDefinition(depth + 1)))).Exists() {
+		depth++
+	}
+
+	return
+}
+
+// withLambdaElement returns the root value with a definition that describes
+// the elements of the array at the cue path, and the cue path of that
+// definition, which is where the body of a lambda is validated
+func withLambdaElement(rootValue cue.Value, cuePath CuePath) (cue.Value, CuePath) {
+	def := lambdaDefinition(lambdaDepth(rootValue) + 1)
+
+	element := rootValue.Context().CompileString("_")
+	if v, err := findValueAtPath(rootValue, cuePath); err == nil && v.IncompleteKind() == cue.ListKind {
+		if elem, err := getUnderlyingValue(v); err == nil {
+			element = elem
+		}
+	}
+
+	return rootValue.FillPath(cue.MakePath(cue.Def(def)), element), CuePath{def}
+}
+
+// withAccumulator returns the root value with the definition of the variable
+// that holds the result so far in the body of Reduce
+func withAccumulator(rootValue cue.Value, accumulatorType InputOrOutput) cue.Value {
+	return rootValue.FillPath(cue.MakePath(cue.Def("#"+accumulatorVariable)), describeType(rootValue.Context(), accumulatorType))
+}
+
+// valueForElement returns the value of the parameter for the element of the
+// array, which is '@' within the parameter
+func (p lazyParameters) valueForElement(position int, element any) (any, error) {
+	p.ev.elements = append(p.ev.elements, element)
+	defer func() { p.ev.elements = p.ev.elements[:len(p.ev.elements)-1] }()
+
+	p.currentData = element
+	return p.value(position)
+}
+
+// lambdaCondition returns the value of the condition in the parameter for the
+// element; in the same way as a filter, a condition that addresses a missing
+// field is an error unless the field is followed by '?'
+func lambdaCondition(fnName FT_FunctionType, params lazyParameters, position int, element any) (bool, error) {
+	condition, err := params.valueForElement(position, element)
+	if err != nil {
+		return false, fmt.Errorf("func %s: %w", fnName, err)
+	}
+
+	return conditionValue(fnName, condition)
+}
+
+// conditionValue returns the value of a condition; null is false
+func conditionValue(fnName FT_FunctionType, condition any) (bool, error) {
+	isTrue, ok := condition.(bool)
+	if !ok && !isNil(condition) {
+		return false, fmt.Errorf("func %s: condition wasn't boolean", fnName)
+	}
+
+	return isTrue, nil
+}
+
+// lambdaElements returns the elements of the array that the lambda is called
+// on, checking that the lambda has the number of parameters expected
+func lambdaElements(fnName FT_FunctionType, params lazyParameters, expected int, val any) ([]any, error) {
+	if params.len() != expected {
+		return nil, errNumParams(fnName, expected, params.len())
+	}
+
+	return arrayElements(val, fnName)
+}
+
+const FT_Map FT_FunctionType = "Map"
+
+func func_Map(rtParams FunctionParameterTypes, val any) (any, error) {
+	return lazyFunc_Map(lazyParameters{ev: backgroundEvaluation(), params: rtParams, currentData: val}, val)
+}
+
+func lazyFunc_Map(params lazyParameters, val any) (any, error) {
+	elems, err := lambdaElements(FT_Map, params, 1, val)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]any, 0, len(elems))
+	for _, elem := range elems {
+		if err := params.ev.cancelled(); err != nil {
+			return nil, err
+		}
+
+		res, err := params.valueForElement(0, elem)
+		if err != nil {
+			return nil, fmt.Errorf("func %s: %w", FT_Map, err)
+		}
+		out = append(out, res)
+	}
+
+	return out, nil
+}
+
+const FT_Where FT_FunctionType = "Where"
+
+func func_Where(rtParams FunctionParameterTypes, val any) (any, error) {
+	return lazyFunc_Where(lazyParameters{ev: backgroundEvaluation(), params: rtParams, currentData: val}, val)
+}
+
+func lazyFunc_Where(params lazyParameters, val any) (any, error) {
+	elems, err := lambdaElements(FT_Where, params, 1, val)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []any{}
+	for _, elem := range elems {
+		if err := params.ev.cancelled(); err != nil {
+			return nil, err
+		}
+
+		isTrue, err := lambdaCondition(FT_Where, params, 0, elem)
+		if err != nil {
+			return nil, err
+		}
+
+		if isTrue {
+			out = append(out, convertToDecimalIfNumber(elem))
+		}
+	}
+
+	return out, nil
+}
+
+const FT_All FT_FunctionType = "All"
+
+func func_All(rtParams FunctionParameterTypes, val any) (any, error) {
+	return lazyFunc_All(lazyParameters{ev: backgroundEvaluation(), params: rtParams, currentData: val}, val)
+}
+
+func lazyFunc_All(params lazyParameters, val any) (any, error) {
+	elems, err := lambdaElements(FT_All, params, 1, val)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, elem := range elems {
+		if err := params.ev.cancelled(); err != nil {
+			return nil, err
+		}
+
+		isTrue, err := lambdaCondition(FT_All, params, 0, elem)
+		if err != nil {
+			return nil, err
+		}
+
+		// The rest of the elements do not need to be checked
+		if !isTrue {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+const FT_AnyMatch FT_FunctionType = "AnyMatch"
+
+func func_AnyMatch(rtParams FunctionParameterTypes, val any) (any, error) {
+	return lazyFunc_AnyMatch(lazyParameters{ev: backgroundEvaluation(), params: rtParams, currentData: val}, val)
+}
+
+func lazyFunc_AnyMatch(params lazyParameters, val any) (any, error) {
+	elems, err := lambdaElements(FT_AnyMatch, params, 1, val)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, elem := range elems {
+		if err := params.ev.cancelled(); err != nil {
+			return nil, err
+		}
+
+		isTrue, err := lambdaCondition(FT_AnyMatch, params, 0, elem)
+		if err != nil {
+			return nil, err
+		}
+
+		// The rest of the elements do not need to be checked
+		if isTrue {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+const FT_None FT_FunctionType = "None"
+
+func func_None(rtParams FunctionParameterTypes, val any) (any, error) {
+	return lazyFunc_None(lazyParameters{ev: backgroundEvaluation(), params: rtParams, currentData: val}, val)
+}
+
+func lazyFunc_None(params lazyParameters, val any) (any, error) {
+	elems, err := lambdaElements(FT_None, params, 1, val)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, elem := range elems {
+		if err := params.ev.cancelled(); err != nil {
+			return nil, err
+		}
+
+		isTrue, err := lambdaCondition(FT_None, params, 0, elem)
+		if err != nil {
+			return nil, err
+		}
+
+		// The rest of the elements do not need to be checked
+		if isTrue {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+const FT_Exactly FT_FunctionType = "Exactly"
+
+func func_Exactly(rtParams FunctionParameterTypes, val any) (any, error) {
+	return lazyFunc_Exactly(lazyParameters{ev: backgroundEvaluation(), params: rtParams, currentData: val}, val)
+}
+
+func lazyFunc_Exactly(params lazyParameters, val any) (any, error) {
+	elems, err := lambdaElements(FT_Exactly, params, 2, val)
+	if err != nil {
+		return nil, err
+	}
+
+	nVal, err := params.value(0)
+	if err != nil {
+		return nil, fmt.Errorf("func %s: %w", FT_Exactly, err)
+	}
+
+	n, ok := nVal.(decimal.Decimal)
+	if !ok || !n.IsInteger() || n.IsNegative() {
+		return nil, fmt.Errorf("func %s: the number of elements must be a whole number that is not negative", FT_Exactly)
+	}
+
+	var count int64
+	for i, elem := range elems {
+		if err := params.ev.cancelled(); err != nil {
+			return nil, err
+		}
+
+		// The rest of the elements do not need to be checked once there are
+		// too many, or too few left to reach the number
+		if count > n.IntPart() || count+int64(len(elems)-i) < n.IntPart() {
+			return false, nil
+		}
+
+		isTrue, err := lambdaCondition(FT_Exactly, params, 1, elem)
+		if err != nil {
+			return nil, err
+		}
+
+		if isTrue {
+			count++
+		}
+	}
+
+	return count == n.IntPart(), nil
+}
+
+const FT_Reduce FT_FunctionType = "Reduce"
+
+func func_Reduce(rtParams FunctionParameterTypes, val any) (any, error) {
+	return lazyFunc_Reduce(lazyParameters{ev: backgroundEvaluation(), params: rtParams, currentData: val}, val)
+}
+
+func lazyFunc_Reduce(params lazyParameters, val any) (any, error) {
+	elems, err := lambdaElements(FT_Reduce, params, 2, val)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := params.value(0)
+	if err != nil {
+		return nil, fmt.Errorf("func %s: %w", FT_Reduce, err)
+	}
+
+	// The accumulator hides any variable of the same name while the body
+	// is run
+	previous, hadPrevious := params.ev.variables[accumulatorVariable]
+	defer func() {
+		if hadPrevious {
+			params.ev.variables[accumulatorVariable] = previous
+		} else {
+			delete(params.ev.variables, accumulatorVariable)
+		}
+	}()
+
+	for _, elem := range elems {
+		if err := params.ev.cancelled(); err != nil {
+			return nil, err
+		}
+
+		params.ev.variables[accumulatorVariable] = acc
+		if acc, err = params.valueForElement(1, elem); err != nil {
+			return nil, fmt.Errorf("func %s: %w", FT_Reduce, err)
+		}
+	}
+
+	return acc, nil
+}
+
+// mappedType is the type returned by Map, which is an array of the values
+// returned by its body
+func mappedType(_ InputOrOutput, params []*FunctionParameter) InputOrOutput {
+	if len(params) != 1 || params[0].Type.IOType != IOOT_Single {
+		return inputOrOutput(PT_Any, IOOT_Array)
+	}
+
+	return inputOrOutput(params[0].Type.Type, IOOT_Array)
+}
+
+// quantifiedExplanation explains a function that checks how many of the
+// elements the condition is true for, e.g. "all items have dg equal to
+// {{true}}"
+func quantifiedExplanation(tf Function, quantifier string, condition *FunctionParameter) string {
+	elements := "elements"
+	if tf.calledOn != "" {
+		elements = tf.calledOn
+	}
+
+	if explanation, ok := explainCondition(condition.Part); ok {
+		return fmt.Sprintf("%s %s %s", quantifier, elements, explanation)
+	}
+
+	return fmt.Sprintf("%s %s match {{%s}}", quantifier, elements, condition.String)
+}
+
+// explainCondition explains the condition in the body of a lambda as what is
+// true of the element, e.g. "have dg equal to {{true}}"; it returns false if
+// the condition cannot be explained in this way
+func explainCondition(part CanBeAPart) (string, bool) {
+	switch t := part.(type) {
+	case *Path:
+		if len(t.Parts) < 2 {
+			return "", false
+		}
+
+		// The first part is the element itself
+		idents := []string{}
+		for i, p := range t.Parts[1:] {
+			switch pt := p.(type) {
+			case *PathIdent:
+				if pt.Filter != nil {
+					return "", false
+				}
+				idents = append(idents, pt.String)
+
+			case *Function:
+				if i != len(t.Parts)-2 || pt.FunctionExplanation == nil {
+					return "", false
+				}
+
+				// Only functions that are explained as a state of the value
+				// (e.g. "is equal to {{true}}") can be explained
+				explanation, isState := strings.CutPrefix(*pt.FunctionExplanation, "is ")
+				switch {
+				case !isState:
+					return "", false
+				case len(idents) == 0:
+					return "are " + explanation, true
+				}
+
+				return fmt.Sprintf("have %s %s", strings.Join(idents, "."), explanation), true
+
+			default:
+				return "", false
+			}
+		}
+
+		// A field on its own is a boolean that must be true
+		return fmt.Sprintf("have %s equal to {{true}}", strings.Join(idents, ".")), true
+
+	case *LogicalOperation:
+		if t.LogicalOperator == nil || len(t.Parts) == 0 {
+			return "", false
+		}
+
+		var conjunction string
+		switch *t.LogicalOperator {
+		case LOT_And:
+			conjunction = " and "
+		case LOT_Or:
+			conjunction = " or "
+		default:
+			return "", false
+		}
+
+		explanations := make([]string, len(t.Parts))
+		for i, p := range t.Parts {
+			var ok bool
+			if explanations[i], ok = explainCondition(p); !ok {
+				return "", false
+			}
+
+			// e.g. "have qty greater than {{1}} and dg equal to {{true}}"
+			if i > 0 && strings.HasPrefix(explanations[0], "have ") {
+				explanations[i] = strings.TrimPrefix(explanations[i], "have ")
+			}
+		}
+
+		return strings.Join(explanations, conjunction), true
+	}
+
+	return "", false
+}
@@ -0,0 +1,297 @@
+package mpath
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// objectValue returns the value if it is a map or a struct
+func objectValue(val any, fnName FT_FunctionType) (reflect.Value, error) {
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		return v, nil
+	case reflect.Struct:
+		// Dates and numbers are values rather than objects
+		if v.Type() != timeType && v.Type() != decimalType {
+			return v, nil
+		}
+	}
+
+	return v, fmt.Errorf("func %s: value wasn't object", fnName)
+}
+
+// mapKeyString returns the key of the map as a string, if it is one that can
+// be addressed by a path ident
+func mapKeyString(key reflect.Value) (string, bool) {
+	if s, ok := key.Interface().(string); ok {
+		return s, true
+	}
+
+	if key.Type().ConvertibleTo(reflect.TypeOf("")) {
+		if s := key.Convert(reflect.TypeOf("")).String(); s != "" {
+			return s, true
+		}
+	}
+
+	return "", false
+}
+
+// objectFields returns the names and values of the fields of the map or
+// struct in the same form as they are addressed by path idents. The keys of
+// maps are sorted, and the fields of structs are in the order they are
+// declared.
+func objectFields(ev *evaluation, val any, fnName FT_FunctionType) (keys []string, values []any, err error) {
+	v, err := objectValue(val, fnName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if v.Kind() == reflect.Map {
+		byKey := map[string]reflect.Value{}
+		for _, e := range v.MapKeys() {
+			if key, ok := mapKeyString(e); ok {
+				keys = append(keys, key)
+				byKey[key] = e
+			}
+		}
+		sort.Strings(keys)
+
+		values = make([]any, len(keys))
+		for i, key := range keys {
+			values[i] = v.MapIndex(byKey[key]).Interface()
+			if _, ok := values[i].(string); !ok {
+				values[i] = convertToDecimalIfNumber(values[i])
+			}
+		}
+
+		return keys, values, nil
+	}
+
+	for _, f := range ev.structFields(v.Type()) {
+		if f.embedded {
+			continue
+		}
+
+		index := f.index
+		fieldValue, found := getFieldValueByNameFromStruct(f.name, v, func(reflect.Type, string) ([]int, bool) { return index, true })
+		if !found {
+			// The field is in an embedded struct that is a nil pointer
+			continue
+		}
+
+		keys = append(keys, f.name)
+		values = append(values, fieldValue)
+	}
+
+	return keys, values, nil
+}
+
+const FT_Keys FT_FunctionType = "Keys"
+
+func func_Keys(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_Keys(backgroundEvaluation(), rtParams, val)
+}
+
+func evalFunc_Keys(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(0); !ok {
+		return nil, errNumParams(FT_Keys, 0, got)
+	}
+
+	keys, _, err := objectFields(ev, val, FT_Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]any, len(keys))
+	for i, key := range keys {
+		out[i] = key
+	}
+
+	return out, nil
+}
+
+const FT_Values FT_FunctionType = "Values"
+
+func func_Values(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_Values(backgroundEvaluation(), rtParams, val)
+}
+
+// evalFunc_Values returns the values of the fields in the same order as Keys:
+// by key for maps (e.g. the groups of GroupBy), and in the order they are
+// declared for structs
+func evalFunc_Values(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(0); !ok {
+		return nil, errNumParams(FT_Values, 0, got)
+	}
+
+	_, values, err := objectFields(ev, val, FT_Values)
+	if err != nil {
+		return nil, err
+	}
+
+	if values == nil {
+		values = []any{}
+	}
+
+	return values, nil
+}
+
+const FT_Entries FT_FunctionType = "Entries"
+
+func func_Entries(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_Entries(backgroundEvaluation(), rtParams, val)
+}
+
+// evalFunc_Entries returns an object with a key and a value for each field,
+// in the same order as Keys
+func evalFunc_Entries(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(0); !ok {
+		return nil, errNumParams(FT_Entries, 0, got)
+	}
+
+	keys, values, err := objectFields(ev, val, FT_Entries)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]any, len(keys))
+	for i, key := range keys {
+		out[i] = map[string]any{
+			"key":   key,
+			"value": values[i],
+		}
+	}
+
+	return out, nil
+}
+
+// getField returns the field of the object with the name, in the same way as
+// a path ident
+func getField(ev *evaluation, rtParams FunctionParameterTypes, val any, fnName FT_FunctionType) (any, error) {
+	name, err := paramsGetFirstOfString(rtParams)
+	if err != nil {
+		return errAny(fnName, err)
+	}
+
+	if _, err := objectValue(val, fnName); err != nil {
+		return nil, err
+	}
+
+	return (&opPathIdent{IdentName: name}).do(ev, val, val)
+}
+
+const FT_HasKey FT_FunctionType = "HasKey"
+
+func func_HasKey(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_HasKey(backgroundEvaluation(), rtParams, val)
+}
+
+func evalFunc_HasKey(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	_, err := getField(ev, rtParams, val, FT_HasKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+const FT_Get FT_FunctionType = "Get"
+
+func func_Get(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_Get(backgroundEvaluation(), rtParams, val)
+}
+
+func evalFunc_Get(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	out, err := getField(ev, rtParams, val, FT_Get)
+	if err != nil {
+		return nil, fmt.Errorf("func %s: %w", FT_Get, err)
+	}
+
+	return out, nil
+}
+
+// projectFields returns an object with the fields of the object that are
+// named by the parameters (or that are not, if omit is set); names are
+// matched in the same way as a path
+func projectFields(ev *evaluation, rtParams FunctionParameterTypes, val any, fnName FT_FunctionType, omit bool) (any, error) {
+	names := rtParams.Strings()
+	if len(names) != len(rtParams) {
+		return nil, fmt.Errorf("func %s: names of fields must be strings", fnName)
+	}
+
+	keys, values, err := objectFields(ev, val, fnName)
+	if err != nil {
+		return nil, err
+	}
+
+	// The fields of a struct are found by each name in the same way as a
+	// path ident, which includes their Go names
+	var structFields map[string]bool
+	if v, _ := objectValue(val, fnName); v.Kind() == reflect.Struct {
+		structFields = map[string]bool{}
+		for _, n := range names {
+			index, found := ev.fieldIndex(v.Type(), n.Value)
+			if !found {
+				continue
+			}
+
+			for _, f := range ev.structFields(v.Type()) {
+				if !f.embedded && slices.Equal(f.index, index) {
+					structFields[f.name] = true
+				}
+			}
+		}
+	}
+
+	out := map[string]any{}
+	for i, key := range keys {
+		named := structFields[key]
+		if structFields == nil {
+			for _, n := range names {
+				if strings.EqualFold(key, n.Value) {
+					named = true
+					break
+				}
+			}
+		}
+
+		if named != omit {
+			out[key] = values[i]
+		}
+	}
+
+	return out, nil
+}
+
+const FT_Pick FT_FunctionType = "Pick"
+
+func func_Pick(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_Pick(backgroundEvaluation(), rtParams, val)
+}
+
+func evalFunc_Pick(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	return projectFields(ev, rtParams, val, FT_Pick, false)
+}
+
+const FT_Omit FT_FunctionType = "Omit"
+
+func func_Omit(rtParams FunctionParameterTypes, val any) (any, error) {
+	return evalFunc_Omit(backgroundEvaluation(), rtParams, val)
+}
+
+func evalFunc_Omit(ev *evaluation, rtParams FunctionParameterTypes, val any) (any, error) {
+	return projectFields(ev, rtParams, val, FT_Omit, true)
+}
@@ -7,6 +7,7 @@ import (
 	"sync"
 	sc "text/scanner"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
@@ -15,6 +16,7 @@ import (
 var invalidRunes = map[rune]bool{
 	'\'': true, '"': true, '(': true, ')': true, '[': true, ']': true,
 	'{': true, '}': true, '@': true, '$': true, '&': true, '.': true,
+	'#': true,
 	',': true, '=': true, '>': true, '<': true, '|': true, '!': true,
 	';': true, '/': true, '*': true,
 }
@@ -35,9 +37,6 @@ var (
 
 				return unicode.IsPrint(ch)
 			}
-			s.sx.Error = func(es *sc.Scanner, msg string) {
-				//todo: find a way to pipe this out
-			}
 			return s
 		},
 	}
@@ -45,9 +44,18 @@ var (
 
 // ParseReadSeeker takes an io.ReadSeeker and parses it into an operation tree.
 func ParseReadSeeker(r io.ReadSeeker) (topOp Operation, err error) {
+	return defaultRegistry.ParseReadSeeker(r)
+}
+
+func parseReadSeeker(reg *FunctionRegistry, r io.ReadSeeker) (topOp Operation, err error) {
 	s := scannerPool.Get().(*scanner)
+	s.registry = reg
+	s.variables = map[string]*variableDeclaration{}
 	defer func() {
 		s.err = nil
+		s.source = ""
+		s.registry = nil
+		s.variables = nil
 		scannerPool.Put(s)
 	}()
 
@@ -56,6 +64,22 @@ func ParseReadSeeker(r io.ReadSeeker) (topOp Operation, err error) {
 		return nil, err
 	}
 
+	topOp, err = parseTopOperation(s)
+
+	// An error from the scanner (e.g. an unterminated string) is the cause of
+	// any error that follows it
+	if scanErr := s.Err(); scanErr != nil {
+		return nil, scanErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func parseTopOperation(s *scanner) (topOp Operation, err error) {
 	var tok rune
 	tok = s.Scan()
 	for {
@@ -63,78 +87,187 @@ func ParseReadSeeker(r io.ReadSeeker) (topOp Operation, err error) {
 			break
 		}
 
+		if startsWithLiteral(s, tok) && topOp == nil {
+			p := &exprParser{s: s}
+			if topOp, tok, err = p.parseExpression(tok, nil); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		switch tok {
-		case '{':
+		case '{', '[':
 			if topOp != nil {
 				return nil, erAt(s, "operation not terminated properly: found Logical Operation after top operation already defined")
 			}
-			topOp = &opLogicalOperation{}
-			tok, err = topOp.Parse(s, tok)
+			p := &exprParser{s: s}
+			topOp, tok, err = p.parseExpression(tok, nil)
 			if err != nil {
 				return nil, err
 			}
-		case '@', '$':
+		case '@', '$', '(', '!':
 			if topOp != nil {
 				return nil, erAt(s, "operation not terminated properly: found Path after top operation already defined")
 			}
-			topOp = &opPath{}
-			tok, err = topOp.Parse(s, tok)
+			p := &exprParser{s: s}
+			topOp, tok, err = p.parseExpression(tok, nil)
 			if err != nil {
 				return nil, err
 			}
+		case '#':
+			if topOp != nil {
+				return nil, erAt(s, "operation not terminated properly: found Variable after top operation already defined")
+			}
+			query := &opQuery{}
+			tok, err = query.Parse(s, tok)
+			if err != nil {
+				return nil, err
+			}
+
+			// Queries without variable declarations are returned as they
+			// would have been without the wrapping query
+			topOp = query
+			if len(query.Variables) == 0 {
+				topOp = query.Operation
+			}
 		default:
 			if topOp == nil {
-				return nil, errors.Wrap(erInvalid(s, '{', '@', '$'), "invalid query")
+				if tok == sc.Ident && isNumberWithOperator(s.TokenText()) {
+					return nil, erOperatorNotSeparated(s)
+				}
+				return nil, errors.Wrap(erInvalid(s, '{', '@', '$', '#'), "invalid query")
 			}
 			return nil, erAt(s, "operation not terminated properly: found '%s' (%d) after top operation already defined", s.TokenText(), tok)
 		}
 	}
 
-	// return scanner error if any
-	if err := s.Err(); err != nil {
-		return nil, err
-	}
-
 	return
 }
 
 func ParseString(ss string) (topOp Operation, err error) {
-	sr := strings.NewReader(ss)
-	return ParseReadSeeker(sr)
+	return defaultRegistry.ParseString(ss)
 }
 
-func erAt(s *scanner, str string, args ...any) (err error) {
-	args = append([]any{s.sx.Pos().Line, s.sx.Pos().Column}, args...)
-	err = fmt.Errorf("error at line %d col %d: "+str, args...)
-	return
+// ParseError is returned when a query cannot be parsed. It may be wrapped
+// with further context, so use errors.As to retrieve it.
+type ParseError struct {
+	// Line and Column (both starting at 1) and Offset (in bytes, starting at
+	// 0) are the position immediately after the offending token
+	Line   int
+	Column int
+	Offset int
+
+	// Token is the text of the offending token; it is empty at the end of
+	// the query
+	Token string
+
+	// Expected are the tokens that would have been valid instead, if known
+	Expected []string
+
+	// Message describes the problem
+	Message string
+
+	// Snippet is the line of the query with the error, followed by a line
+	// with carets under the offending token
+	Snippet string
 }
 
-func erInvalid(s *scanner, validRunes ...rune) error {
-	if len(validRunes) == 0 {
-		return erAt(s, "invalid next character '%s'", s.TokenText())
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("error at line %d col %d: %s", e.Line, e.Column, e.Message)
+}
+
+func newParseError(s *scanner, message string) *ParseError {
+	pos := s.sx.Pos()
+
+	e := &ParseError{
+		Line:    pos.Line,
+		Column:  pos.Column,
+		Offset:  pos.Offset,
+		Token:   s.TokenText(),
+		Message: message,
+	}
+	e.Snippet = snippetAt(s.source, e.Offset, e.Token)
+
+	return e
+}
+
+// snippetAt returns the line of the source that contains the offset, and a
+// line of carets under the token that ends at the offset
+func snippetAt(source string, offset int, token string) string {
+	if offset < 0 || offset > len(source) {
+		return ""
+	}
+
+	start := offset - len(token)
+	if start < 0 || !strings.HasSuffix(source[:offset], token) {
+		start = offset
+	}
+
+	lineStart := strings.LastIndex(source[:start], "\n") + 1
+	lineEnd := strings.Index(source[start:], "\n")
+	if lineEnd < 0 {
+		lineEnd = len(source)
+	} else {
+		lineEnd += start
 	}
-	if len(validRunes) == 1 {
-		return erAt(s, "invalid next character '%s': must be '%s'", s.TokenText(), string(validRunes[0]))
+
+	// Tabs are kept so that the carets line up with the line above
+	var caretLine strings.Builder
+	for _, c := range source[lineStart:start] {
+		if c == '\t' {
+			caretLine.WriteRune('\t')
+		} else {
+			caretLine.WriteRune(' ')
+		}
 	}
 
+	tokenEnd := offset
+	if tokenEnd > lineEnd {
+		tokenEnd = lineEnd
+	}
+	caretLine.WriteString(strings.Repeat("^", max(1, utf8.RuneCountInString(source[start:tokenEnd]))))
+
+	return source[lineStart:lineEnd] + "\n" + caretLine.String()
+}
+
+func erAt(s *scanner, str string, args ...any) (err error) {
+	return newParseError(s, fmt.Sprintf(str, args...))
+}
+
+func erInvalid(s *scanner, validRunes ...rune) error {
 	validRunesAsStrings := make([]string, len(validRunes))
 	for idx, vr := range validRunes {
 		validRunesAsStrings[idx] = string(vr)
 	}
-	return erAt(s, "invalid next character '%s': must be one of '%s'", s.TokenText(), strings.Join(validRunesAsStrings, "', '"))
+
+	var e *ParseError
+	switch len(validRunes) {
+	case 0:
+		e = newParseError(s, fmt.Sprintf("invalid next character '%s'", s.TokenText()))
+	case 1:
+		e = newParseError(s, fmt.Sprintf("invalid next character '%s': must be '%s'", s.TokenText(), validRunesAsStrings[0]))
+	default:
+		e = newParseError(s, fmt.Sprintf("invalid next character '%s': must be one of '%s'", s.TokenText(), strings.Join(validRunesAsStrings, "', '")))
+	}
+	if len(validRunesAsStrings) > 0 {
+		e.Expected = validRunesAsStrings
+	}
+
+	return e
 }
 
 type scanner struct {
-	sx  *sc.Scanner
-	err error
+	sx       *sc.Scanner
+	err      error
+	source   string
+	registry *FunctionRegistry
+
+	// variables that have been declared so far in the query being parsed
+	variables map[string]*variableDeclaration
 }
 
 func newScanner() *scanner {
-	s := &scanner{sx: &sc.Scanner{}}
-	s.sx.Error = func(es *sc.Scanner, msg string) {
-		s.err = errors.New(msg)
-	}
-	return s
+	return &scanner{sx: &sc.Scanner{}}
 }
 
 func (s *scanner) TokenText() (t string) {
@@ -146,8 +279,25 @@ func (s *scanner) Reset(reader io.ReadSeeker) error {
 	if err != nil {
 		return err
 	}
-	s.sx.Init(reader)
+
+	// The source is kept to show where any parse error is
+	source, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	s.source = string(source)
+
+	s.sx.Init(strings.NewReader(s.source))
 	s.sx.Mode = sc.ScanIdents | sc.ScanChars | sc.ScanStrings | sc.ScanRawStrings | sc.ScanComments | sc.SkipComments
+
+	// Init clears the error handler, so it is set each time; only the first
+	// error is kept, as any later errors follow from it
+	s.sx.Error = func(es *sc.Scanner, msg string) {
+		if s.err == nil {
+			s.err = newParseError(s, msg)
+		}
+	}
+
 	return nil
 }
 
@@ -1,12 +1,17 @@
 package mpath
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/shopspring/decimal"
 )
@@ -71,6 +76,12 @@ func Test_ParseAndDo(t *testing.T) {
 					return
 				}
 
+				if test.ExpectedResultType != RT_error {
+					if rt := ResultTypeOf(dataToUse); rt != test.ExpectedResultType {
+						t.Errorf("'%s' (%s) expected result type '%s'; got '%s'", test.Name, iterationName, test.ExpectedResultType, rt)
+					}
+				}
+
 				switch test.ExpectedResultType {
 				case RT_string:
 					if d, ok := dataToUse.(string); !ok {
@@ -118,12 +129,18 @@ func Test_ParseAndDo(t *testing.T) {
 
 func Benchmark_ParseAndDo(b *testing.B) {
 	var data map[string]any
+	var dataAsStruct TestDataStruct
 
 	err := json.Unmarshal([]byte(jsn), &data)
 	if err != nil {
 		b.Error("got unexpected json marshal error: %w", err)
 	}
 
+	err = json.Unmarshal([]byte(jsn), &dataAsStruct)
+	if err != nil {
+		b.Error("got unexpected json marshal error: %w", err)
+	}
+
 	var op Operation
 	sort.Slice(testQueries, func(i, j int) bool {
 		return len(testQueries[i].Name) > len(testQueries[j].Name)
@@ -167,6 +184,65 @@ func Benchmark_ParseAndDo(b *testing.B) {
 		})
 	}
 
+	b.Log("Do compiled:")
+
+	for _, test := range testQueries {
+		b.Run("Do compiled "+test.Name, func(b *testing.B) {
+			op, err = ParseString(test.Query)
+			plan, err := Compile(op)
+			if err != nil {
+				b.Fatalf("'%s' got error from Compile(): %v", test.Name, err)
+			}
+
+			for n := 0; n < b.N; n++ {
+				b.ReportAllocs()
+				_, err = plan.Do(data)
+				if err != nil {
+					b.Errorf("'%s' got error from Do(): %v", test.Name, err)
+				}
+				b.SetBytes(int64(len(test.Query)))
+			}
+		})
+	}
+
+	b.Log("Do struct:")
+
+	for _, test := range testQueries {
+		b.Run("Do struct "+test.Name, func(b *testing.B) {
+			op, err = ParseString(test.Query)
+
+			for n := 0; n < b.N; n++ {
+				b.ReportAllocs()
+				_, err = op.Do(dataAsStruct, dataAsStruct)
+				if err != nil {
+					b.Errorf("'%s' got error from Do(): %v", test.Name, err)
+				}
+				b.SetBytes(int64(len(test.Query)))
+			}
+		})
+	}
+
+	b.Log("Do compiled struct:")
+
+	for _, test := range testQueries {
+		b.Run("Do compiled struct "+test.Name, func(b *testing.B) {
+			op, err = ParseString(test.Query)
+			plan, err := Compile(op)
+			if err != nil {
+				b.Fatalf("'%s' got error from Compile(): %v", test.Name, err)
+			}
+
+			for n := 0; n < b.N; n++ {
+				b.ReportAllocs()
+				_, err = plan.Do(dataAsStruct)
+				if err != nil {
+					b.Errorf("'%s' got error from Do(): %v", test.Name, err)
+				}
+				b.SetBytes(int64(len(test.Query)))
+			}
+		})
+	}
+
 	b.Log("Parse and Do:")
 
 	for _, test := range testQueries {
@@ -250,147 +326,2564 @@ func Test_AddressedPaths(t *testing.T) {
 
 		gotError := false
 
-		if lGot, lWanted := len(addressedPaths), len(test.ExpectedAddressedPaths); lGot != lWanted {
-			t.Errorf("'%s': got bad addressedPaths length: wanted: %d; got: %d", test.Name, lWanted, lGot)
-			gotError = true
-			goto Error
+		if lGot, lWanted := len(addressedPaths), len(test.ExpectedAddressedPaths); lGot != lWanted {
+			t.Errorf("'%s': got bad addressedPaths length: wanted: %d; got: %d", test.Name, lWanted, lGot)
+			gotError = true
+			goto Error
+		}
+
+		for i, fpWanted := range test.ExpectedAddressedPaths {
+			fpGot := addressedPaths[i]
+			if len(fpWanted) != len(fpGot) {
+				t.Errorf("'%s': got bad addressedPaths length at index %d: wanted: %d; got: %d", test.Name, i, len(fpWanted), len(fpGot))
+				gotError = true
+				continue
+			}
+
+			for ii, fpWI := range fpWanted {
+				fpGI := fpGot[ii]
+
+				if fpGI != fpWI {
+					gotError = true
+					t.Errorf("'%s': wrong addressedPaths value at index %d: wanted: '%s'; got: '%s'", test.Name, ii, fpWI, fpGI)
+				}
+			}
+		}
+
+	Error:
+		if gotError {
+			for _, w := range test.ExpectedAddressedPaths {
+				t.Errorf("'%s': wanted: %v", test.Name, w)
+			}
+			for _, g := range addressedPaths {
+				t.Errorf("'%s': got: %v", test.Name, g)
+			}
+		}
+	}
+}
+
+func Test_ParseErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name              string
+		Query             string
+		ExpectErrorString string
+	}{
+		{
+			Name:              "opPath access root in filter",
+			Query:             `$.x[$.a.Equal("b")]`,
+			ExpectErrorString: "cannot use '$' (root) inside filter: error at line 1 col 6: invalid next character '$': must be '@'",
+		},
+	}
+
+	// We need only test that the Sprint doesn't throw an error
+	for _, test := range tests {
+		op, err := ParseString(test.Query)
+		if err == nil {
+			t.Errorf("%s: expected error, got none", test.Name)
+			continue
+		}
+		if err.Error() != test.ExpectErrorString {
+			t.Errorf("%s: got wrong error string; wanted '%s', got: '%s'", test.Name, test.ExpectErrorString, err.Error())
+			continue
+		}
+		if op != nil {
+			t.Errorf("%s: expected nil op", test.Name)
+		}
+	}
+}
+
+func Test_ParseErrorDetails(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name   string
+		Query  string
+		Expect ParseError
+	}{
+		{
+			Name:  "wrapped error in filter",
+			Query: `$.x[$.a.Equal("b")]`,
+			Expect: ParseError{
+				Line: 1, Column: 6, Offset: 5,
+				Token:    "$",
+				Expected: []string{"@"},
+				Message:  "invalid next character '$': must be '@'",
+				Snippet:  "$.x[$.a.Equal(\"b\")]\n    ^",
+			},
+		},
+		{
+			Name:  "error on a later line",
+			Query: "{AND,\n\t$.a.Equal(1),\n\t;}",
+			Expect: ParseError{
+				Line: 3, Column: 3, Offset: 23,
+				Token:   ";",
+				Message: "invalid next character ';'",
+				Snippet: "\t;}\n\t^",
+			},
+		},
+		{
+			Name:  "error from the scanner",
+			Query: `$.a.Equal("abc`,
+			Expect: ParseError{
+				Line: 1, Column: 15, Offset: 14,
+				Token:   `"abc`,
+				Message: "literal not terminated",
+				Snippet: "$.a.Equal(\"abc\n          ^^^^",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		_, err := ParseString(test.Query)
+
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("%s: expected a ParseError, got: %v", test.Name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(*pe, test.Expect) {
+			t.Errorf("%s: expected %+v, got %+v", test.Name, test.Expect, *pe)
+		}
+	}
+}
+
+func Test_ManualMap(t *testing.T) {
+	t.Parallel()
+
+	query := "$.x.Multiply(12.146)"
+
+	data := map[string]any{
+		"x": 10,
+	}
+
+	op, err := ParseString(query)
+
+	if err != nil {
+		t.Fatalf("Failed to parse string: %s", err)
+	}
+
+	_, err = op.Do(data, data)
+
+	if err != nil {
+		t.Fatalf("Failed to do mpath: %s", err)
+	}
+}
+
+func Test_DecimalAtRoot(t *testing.T) {
+	t.Parallel()
+
+	const testName = "Test_DecimalAtRoot"
+
+	data := float64(40)
+	op, err := ParseString("$")
+	if err != nil {
+		t.Errorf("'%s' has error: %v,", testName, err)
+		return
+	}
+
+	dataToUse, err := op.Do(data, data)
+	if err != nil {
+		t.Errorf("'%s' got error from Do(): %v", testName, err)
+		return
+	}
+
+	if d, ok := dataToUse.(decimal.Decimal); ok {
+		t.Logf("value was float and was %s", d)
+	} else {
+		t.Error("wasn't decimal.Decimal")
+	}
+}
+
+func Test_CustomStringTypeMap(t *testing.T) {
+	t.Parallel()
+
+	const outStrConst = "hello world"
+	data := map[CustomStringTypeForTest]any{"varname": outStrConst}
+	queryString := "$.varname"
+
+	op, err := ParseString(queryString)
+
+	if err != nil {
+		t.Errorf("failed to parse query: %s", err)
+	}
+
+	out, err := op.Do(data, data)
+
+	if err != nil {
+		t.Errorf("failed to do mpath: %s", err)
+	}
+
+	outStr, ok := out.(string)
+	if !ok {
+		t.Error("out was not a string")
+	}
+
+	if outStr != outStrConst {
+		t.Errorf("outStr was wrong; expected: '%s', got '%s'", outStrConst, outStr)
+	}
+}
+
+func Test_Eval(t *testing.T) {
+	t.Parallel()
+
+	var data map[string]any
+	if err := json.Unmarshal([]byte(jsn), &data); err != nil {
+		t.Fatalf("got unexpected json unmarshal error: %v", err)
+	}
+
+	mustParse := func(query string) Operation {
+		op, err := ParseString(query)
+		if err != nil {
+			t.Fatalf("failed to parse '%s': %v", query, err)
+		}
+		return op
+	}
+
+	if b, err := EvalBool(mustParse(`$.bool`), data); err != nil || !b {
+		t.Errorf("EvalBool: expected true, got %v (%v)", b, err)
+	}
+
+	if s, err := EvalString(mustParse(`$.string`), data); err != nil || s != "abcDEF" {
+		t.Errorf("EvalString: expected 'abcDEF', got %v (%v)", s, err)
+	}
+
+	if d, err := EvalDecimal(mustParse(`$.numbers.Sum()`), data); err != nil || !d.Equal(decimal.NewFromInt(6912)) {
+		t.Errorf("EvalDecimal: expected 6912, got %v (%v)", d, err)
+	}
+
+	if a, err := EvalSlice(mustParse(`$.numbers`), data); err != nil || !reflect.DeepEqual(a, []any{decimal.NewFromInt(1234), decimal.NewFromInt(5678)}) {
+		t.Errorf("EvalSlice: expected the numbers, got %v (%v)", a, err)
+	}
+
+	// The result is not of the type asked for
+	var rtErr *ResultTypeError
+	if _, err := EvalBool(mustParse(`$.string`), data); !errors.As(err, &rtErr) || rtErr.Expected != RT_bool || rtErr.Actual != RT_string {
+		t.Errorf("EvalBool: expected a ResultTypeError, got %v", err)
+	}
+
+	if _, err := EvalDecimal(mustParse(`$.numberInString`), data); !errors.As(err, &rtErr) || rtErr.Actual != RT_string {
+		t.Errorf("EvalDecimal: expected a ResultTypeError, got %v", err)
+	}
+
+	if _, err := EvalSlice(mustParse(`$.isNull`), data); !errors.As(err, &rtErr) || rtErr.Actual != RT_null {
+		t.Errorf("EvalSlice: expected a ResultTypeError, got %v", err)
+	}
+
+	// Results are decoded into structs by their json tags
+	type objectB struct {
+		B int `json:"b"`
+	}
+
+	objects, err := Eval[map[string]objectB](mustParse(`$.mapOfObjects`), data)
+	if err != nil {
+		t.Errorf("Eval: got unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(objects, map[string]objectB{"a": {B: 5}, "c": {B: 6}, "d": {B: 7}}) {
+		t.Errorf("Eval: got unexpected result: %v", objects)
+	}
+
+	floats, err := Eval[[]float64](mustParse(`$.floats`), data)
+	if err != nil || !reflect.DeepEqual(floats, []float64{1234.56, 5678.9}) {
+		t.Errorf("Eval: expected the floats, got %v (%v)", floats, err)
+	}
+
+	if ptr, err := Eval[*objectB](mustParse(`$.isNull`), data); err != nil || ptr != nil {
+		t.Errorf("Eval: expected nil for a null result, got %v (%v)", ptr, err)
+	}
+
+	if _, err := Eval[objectB](mustParse(`$.numbers`), data); !errors.As(err, &rtErr) || rtErr.Expected != RT_object || rtErr.Actual != RT_array {
+		t.Errorf("Eval: expected a ResultTypeError, got %v", err)
+	}
+
+	if _, err := Eval[[]int](mustParse(`$.floats`), data); err == nil {
+		t.Errorf("Eval: expected an error decoding floats into ints")
+	}
+
+	// Decimals within structs and typed maps are decoded as numbers
+	type line struct {
+		Kg    decimal.Decimal            `json:"kg"`
+		Rates map[string]decimal.Decimal `json:"rates"`
+		At    time.Time                  `json:"at"`
+	}
+	type consignment struct {
+		Ref   string           `json:"ref"`
+		Lines []line           `json:"lines"`
+		Total *decimal.Decimal `json:"total"`
+		Note  *string          `json:"note"`
+	}
+	type decodedLine struct {
+		Kg    float64            `json:"kg"`
+		Rates map[string]float64 `json:"rates"`
+		At    time.Time          `json:"at"`
+	}
+	type decoded struct {
+		Ref   string        `json:"ref"`
+		Lines []decodedLine `json:"lines"`
+		Total float64       `json:"total"`
+		Note  *string       `json:"note"`
+	}
+
+	at := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	total := decimal.RequireFromString("12.5")
+	structData := map[string]any{
+		"consignment": consignment{
+			Ref:   "C1",
+			Lines: []line{{Kg: decimal.RequireFromString("2.5"), Rates: map[string]decimal.Decimal{"base": decimal.NewFromInt(5)}, At: at}},
+			Total: &total,
+		},
+	}
+
+	c, err := Eval[decoded](mustParse(`$.consignment`), structData)
+	if err != nil {
+		t.Errorf("Eval: got unexpected error decoding a struct with decimals: %v", err)
+	}
+	expectedDecoded := decoded{Ref: "C1", Lines: []decodedLine{{Kg: 2.5, Rates: map[string]float64{"base": 5}, At: at}}, Total: 12.5}
+	if !reflect.DeepEqual(c, expectedDecoded) {
+		t.Errorf("Eval: expected %+v, got %+v", expectedDecoded, c)
+	}
+}
+
+func Test_InfixOperators(t *testing.T) {
+	t.Parallel()
+
+	var data map[string]any
+	if err := json.Unmarshal([]byte(jsn), &data); err != nil {
+		t.Fatalf("got unexpected json unmarshal error: %v", err)
+	}
+
+	// Each expression must parse to the same operations as the query written
+	// out in full
+	tests := []struct {
+		query      string
+		equivalent string
+	}{
+		{`$.number >= 1000`, `$.number.GreaterOrEqual(1000)`},
+		{`1000 < $.number`, `$.number.Greater(1000)`},
+		{`$.number <= 1234.5`, `$.number.LessOrEqual(1234.5)`},
+		{`$.number == 1234 && $.string != "x"`, `{AND,$.number.Equal(1234),$.string.NotEqual("x")}`},
+		{`$.number < 10 || $.bool`, `{OR,$.number.Less(10),$.bool}`},
+		{`!($.number < 10 || $.bool)`, `{AND,$.number.Less(10).Not(),$.bool.Not()}`},
+		{`!$.bool`, `$.bool.Not()`},
+		{`$.number == 1 || $.number == 2 && $.bool`, `{OR,$.number.Equal(1),{AND,$.number.Equal(2),$.bool}}`},
+		{`($.number == 1 || $.number == 1234) && $.bool`, `{AND,{OR,$.number.Equal(1),$.number.Equal(1234)},$.bool}`},
+		{`$.number == 1 && $.bool && $.string == "abcDEF"`, `{AND,$.number.Equal(1),$.bool,$.string.Equal("abcDEF")}`},
+		{`$.isNull == null`, `$.isNull.IsNull()`},
+		{`$.string != null`, `$.string.IsNotNull()`},
+		{`$.number == $.number`, `$.number.Equal($.number)`},
+		{`$.bool == true`, `$.bool.Equal(true)`},
+		{`$.numbers[@ > 2000].Count()`, `$.numbers[@.Greater(2000)].Count()`},
+		{`$.numbers[@ > 2000 && @ < 6000].Count()`, `$.numbers[{AND,@.Greater(2000),@.Less(6000)}].Count()`},
+		{`{OR,$.number == 1,$.bool}`, `{OR,$.number.Equal(1),$.bool}`},
+		{`$.numbers.Sum() > 1000`, `$.numbers.Sum().Greater(1000)`},
+		{`#n = $.number > 1; #n && $.bool`, `#n = $.number.Greater(1); {AND,#n,$.bool}`},
+		{`#n = $.number; #n == 1234`, `#n = $.number; #n.Equal(1234)`},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		equivalent, err := ParseString(test.equivalent)
+		if err != nil {
+			t.Fatalf("'%s': failed to parse: %v", test.equivalent, err)
+		}
+
+		if op.Sprint(0) != equivalent.Sprint(0) {
+			t.Errorf("'%s': expected to print as\n%s\ngot\n%s", test.query, equivalent.Sprint(0), op.Sprint(0))
+		}
+
+		if !reflect.DeepEqual(AddressedPaths(op), AddressedPaths(equivalent)) {
+			t.Errorf("'%s': expected addressed paths %v, got %v", test.query, AddressedPaths(equivalent), AddressedPaths(op))
+		}
+
+		out, err := op.Do(data, data)
+		expected, expectedErr := equivalent.Do(data, data)
+		if (err == nil) != (expectedErr == nil) || !reflect.DeepEqual(out, expected) {
+			t.Errorf("'%s': expected %v (%v), got %v (%v)", test.query, expected, expectedErr, out, err)
+		}
+	}
+
+	invalid := []string{
+		`1 == 2`,
+		`$.number == 1 == 2`,
+		`$.number < null`,
+		`$.number = 1`,
+		`($.number == 1`,
+		`$.number == 1 &`,
+		`true`,
+		`{AND,$.bool,$.number ==}`,
+	}
+
+	for _, query := range invalid {
+		if _, err := ParseString(query); err == nil {
+			t.Errorf("'%s': expected a parse error", query)
+		}
+	}
+}
+
+func Test_InfixArithmetic(t *testing.T) {
+	t.Parallel()
+
+	var data map[string]any
+	if err := json.Unmarshal([]byte(jsn), &data); err != nil {
+		t.Fatalf("got unexpected json unmarshal error: %v", err)
+	}
+
+	// Each expression must parse to the same operations as the query written
+	// out in full
+	tests := []struct {
+		query      string
+		equivalent string
+		expected   string
+	}{
+		{`$.number + 1`, `$.number.Add(1)`, "1235"},
+		{`$.number - 1.5`, `$.number.Subtract(1.5)`, "1232.5"},
+		{`$.number * 2 + 1`, `$.number.Multiply(2).Add(1)`, "2469"},
+		{`$.number + 2 * 3`, `$.number.Add(6)`, "1240"},
+		{`($.number + 2) * 3`, `$.number.Add(2).Multiply(3)`, "3708"},
+		{`$.number / 4`, `$.number.Divide(4)`, "308.5"},
+		{`$.number % 100`, `$.number.Modulo(100)`, "34"},
+		{`2 * $.number`, `$.number.Multiply(2)`, "2468"},
+		{`2000 - $.number`, `$.number.Multiply(-1).Add(2000)`, "766"},
+		{`- $.number`, `$.number.Multiply(-1)`, "-1234"},
+		{`$.number - $.number * 2`, `$.number.Subtract($.number.Multiply(2))`, "-1234"},
+		{`$.numbers.Sum() / $.numbers.Count()`, `$.numbers.Sum().Divide($.numbers.Count())`, ""},
+		{`$.number * 2 > 2000`, `$.number.Multiply(2).Greater(2000)`, ""},
+		{`$.number > 1000 + 200`, `$.number.Greater(1200)`, ""},
+		{`2468 / $.number`, `(2468).Divide($.number)`, "2"},
+		{`(2468) / $.number`, `(2468).Divide($.number)`, "2"},
+		{`2000 % $.number`, `(2000).Modulo($.number)`, "766"},
+		{`-2468 / $.number + 1`, `(-2468).Divide($.number).Add(1)`, "-1"},
+		{`10 / 4`, `(10).Divide(4)`, "2.5"},
+		{`$.number > 10 / 4`, `$.number.Greater((10).Divide(4))`, ""},
+		{`$.number > 10 % 4`, `$.number.Greater(2)`, ""},
+		{`$.number > (10) * 4`, `$.number.Greater(40)`, ""},
+		{`$.number.Add(1 + 2)`, `$.number.Add(3)`, "1237"},
+		{`$.number.Add(2 * 3 - 1)`, `$.number.Add(5)`, "1239"},
+		{`$.number.Multiply(- 1)`, `$.number.Multiply(-1)`, "-1234"},
+		{`$.number.Add(10 - $.number)`, `$.number.Add($.number.Multiply(-1).Add(10))`, "10"},
+		{`$.number.Equal(1234 == $.number)`, `$.number.Equal($.number.Equal(1234))`, ""},
+		{`#v = 10 - $.number; #v.Add(1)`, `#v = $.number.Multiply(-1).Add(10); #v.Add(1)`, "-1223"},
+		{`#v = 1 + 2 * $.number; #v`, `#v = $.number.Multiply(2).Add(1); #v`, "2469"},
+		{`#v = - $.number; #v`, `#v = $.number.Multiply(-1); #v`, "-1234"},
+		{`#v = $.number; 2468 / #v`, `#v = $.number; (2468).Divide(#v)`, "2"},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		equivalent, err := ParseString(test.equivalent)
+		if err != nil {
+			t.Fatalf("'%s': failed to parse: %v", test.equivalent, err)
+		}
+
+		if op.Sprint(0) != equivalent.Sprint(0) {
+			t.Errorf("'%s': expected to print as\n%s\ngot\n%s", test.query, equivalent.Sprint(0), op.Sprint(0))
+		}
+
+		out, err := op.Do(data, data)
+		expected, expectedErr := equivalent.Do(data, data)
+		if (err == nil) != (expectedErr == nil) || !reflect.DeepEqual(out, expected) {
+			t.Errorf("'%s': expected %v (%v), got %v (%v)", test.query, expected, expectedErr, out, err)
+		}
+
+		if d, ok := out.(decimal.Decimal); test.expected != "" && (!ok || d.String() != test.expected) {
+			t.Errorf("'%s': expected %s, got %v", test.query, test.expected, out)
+		}
+	}
+
+	invalid := []string{
+		`$.number + "a"`,
+		`$.number * true`,
+		`$.number - null`,
+		`1 + 2`,
+		`(10)`,
+		`(10) && $.bool`,
+		`"a" / $.number`,
+		`10 % 0`,
+		`$.number + ($.bool || $.bool)`,
+		`$.number * `,
+		`$.number.Add(null)`,
+		`$.number number`,
+		`$.number[@ > 1]number`,
+	}
+
+	for _, query := range invalid {
+		if _, err := ParseString(query); err == nil {
+			t.Errorf("'%s': expected a parse error", query)
+		}
+	}
+
+	// As '+', '-' and '%' can be part of a name or a number, operators that
+	// are not separated from their operands by spaces are reported as such
+	for _, query := range []string{
+		`$.number+$.number`,
+		`$.number+ $.number`,
+		`$.number-@.number`,
+		`$.number%#rate`,
+		`$.number+($.number)`,
+		`10+$.number`,
+		`$.number > 1+2`,
+		`$.number -2`,
+		`$.number %2`,
+	} {
+		var pe *ParseError
+		if _, err := ParseString(query); !errors.As(err, &pe) || !strings.Contains(pe.Message, "operators must be separated by spaces") {
+			t.Errorf("'%s': expected an error about separating operators, got: %v", query, err)
+		}
+	}
+
+	if op, _ := ParseString(`$.number / 0`); op == nil {
+		t.Errorf("failed to parse a division by zero")
+	} else if _, err := op.Do(data, data); err == nil {
+		t.Errorf("expected an error when dividing by zero")
+	}
+}
+
+func Test_DivisionOptions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		query    string
+		options  *DivisionOptions
+		expected string
+	}{
+		{`$.n / 3`, nil, "0.6666666666666667"},
+		{`$.n / 3`, &DivisionOptions{Precision: 2}, "0.67"},
+		{`$.n / 8`, &DivisionOptions{Precision: 2}, "0.25"},
+		{`$.n / 16`, &DivisionOptions{Precision: 2}, "0.13"},
+		{`$.n / 16`, &DivisionOptions{Precision: 2, Rounding: RM_HalfEven}, "0.12"},
+		{`$.n / 48`, &DivisionOptions{Precision: 3, Rounding: RM_HalfEven}, "0.042"},
+		{`$.n / 3`, &DivisionOptions{Precision: 2, Rounding: RM_Down}, "0.66"},
+		{`$.n / 6`, &DivisionOptions{Precision: 2, Rounding: RM_Up}, "0.34"},
+		{`$.n / -3`, &DivisionOptions{Precision: 2, Rounding: RM_Ceiling}, "-0.66"},
+		{`$.n / -3`, &DivisionOptions{Precision: 2, Rounding: RM_Floor}, "-0.67"},
+		{`$.n / 3`, &DivisionOptions{Precision: 0, Rounding: RM_HalfUp}, "1"},
+		{`$.n.Divide(3)`, &DivisionOptions{Precision: 1}, "0.7"},
+	}
+
+	data := map[string]any{"n": 2}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Fatalf("'%s': failed to parse: %v", test.query, err)
+		}
+
+		out, err := DoContext(context.Background(), op, data, EvalOptions{Division: test.options})
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if d, ok := out.(decimal.Decimal); !ok || d.String() != test.expected {
+			t.Errorf("'%s' (%+v): expected %s, got %v", test.query, test.options, test.expected, out)
+		}
+	}
+}
+
+func Test_DateFunctions(t *testing.T) {
+	t.Parallel()
+
+	type Consignment struct {
+		DespatchDateTime time.Time
+		DeliveredAt      *time.Time
+		DateCreated      string
+	}
+
+	despatch := time.Date(2024, time.March, 15, 14, 30, 0, 0, time.UTC)
+	delivered := time.Date(2024, time.March, 18, 9, 0, 0, 0, time.UTC)
+	now := time.Date(2024, time.March, 20, 12, 0, 0, 0, time.UTC)
+
+	data := Consignment{
+		DespatchDateTime: despatch,
+		DeliveredAt:      &delivered,
+		DateCreated:      "2024-03-14T08:00:00+10:00",
+	}
+
+	tests := []struct {
+		query    string
+		expected any
+		isError  bool
+	}{
+		{query: `$.Now()`, expected: now},
+		{query: `$.DespatchDateTime`, expected: despatch},
+		{query: `$.DeliveredAt`, expected: delivered},
+		{query: `$.DespatchDateTime.FormatDate("2006-01-02")`, expected: "2024-03-15"},
+		{query: `$.DespatchDateTime.FormatDate("RFC3339")`, expected: "2024-03-15T14:30:00Z"},
+		{query: `$.DateCreated.FormatDate("DateTime")`, expected: "2024-03-14 08:00:00"},
+		{query: `$.DateCreated.ParseDate("RFC3339").IsBefore($.DespatchDateTime)`, expected: true},
+		{query: `$.DateCreated.ParseDate("2006-01-02")`, isError: true},
+		{query: `$.DespatchDateTime.AddDuration(2, "days")`, expected: time.Date(2024, time.March, 17, 14, 30, 0, 0, time.UTC)},
+		{query: `$.DespatchDateTime.AddDuration(-1.5, "hour")`, expected: time.Date(2024, time.March, 15, 13, 0, 0, 0, time.UTC)},
+		{query: `$.DespatchDateTime.AddDuration(1, "month")`, expected: time.Date(2024, time.April, 15, 14, 30, 0, 0, time.UTC)},
+		{query: `$.DespatchDateTime.AddDuration(0.5, "month")`, isError: true},
+		{query: `$.DespatchDateTime.AddDuration(1, "fortnight")`, isError: true},
+		{query: `$.DespatchDateTime.DateDiff($.Now(), "days")`, expected: decimal.NewFromInt(4)},
+		{query: `$.DespatchDateTime.DateDiff($.DeliveredAt, "hours")`, expected: decimal.NewFromInt(66)},
+		{query: `$.Now().DateDiff($.DespatchDateTime, "day")`, expected: decimal.NewFromInt(-4)},
+		{query: `$.DespatchDateTime.DateDiff("2025-03-15", "year")`, expected: decimal.NewFromInt(0)},
+		{query: `$.DespatchDateTime.DateDiff("2025-03-16", "year")`, expected: decimal.NewFromInt(1)},
+		{query: `$.DespatchDateTime.DateDiff("2024-01-31", "months")`, expected: decimal.NewFromInt(-1)},
+		{query: `$.DespatchDateTime.AddDuration(300, "years").DateDiff($.DespatchDateTime, "days")`, expected: decimal.NewFromInt(-109572)},
+		{query: `$.DespatchDateTime.DateDiff("2524-03-15T14:30:00Z", "seconds")`, expected: decimal.NewFromInt(15778454400)},
+		{query: `$.DespatchDateTime.AddDuration(200000, "days")`, isError: true},
+		{query: `$.DespatchDateTime.AddDuration(-200000, "days")`, isError: true},
+		{query: `$.DespatchDateTime.AddDuration(10000000000, "years")`, isError: true},
+		{query: `$.DespatchDateTime.StartOf("day")`, expected: time.Date(2024, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{query: `$.DespatchDateTime.StartOf("week")`, expected: time.Date(2024, time.March, 11, 0, 0, 0, 0, time.UTC)},
+		{query: `$.DespatchDateTime.StartOf("month")`, expected: time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{query: `$.DespatchDateTime.StartOf("Year")`, expected: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{query: `$.DespatchDateTime.DayOfWeek()`, expected: "Friday"},
+		{query: `$.DespatchDateTime.IsBefore($.Now())`, expected: true},
+		{query: `$.DespatchDateTime.IsAfter($.Now())`, expected: false},
+		{query: `$.DespatchDateTime.IsAfter("2024-03-15")`, expected: true},
+		{query: `$.DespatchDateTime.Equal($.DespatchDateTime.AddDuration(0, "day"))`, expected: true},
+		{query: `$.DespatchDateTime.AddDuration(2, "day").DateDiff($.Now(), "day") >= 0`, expected: true},
+		{query: `$.DateCreated.IsBefore("not a date")`, isError: true},
+	}
+
+	opts := EvalOptions{Clock: func() time.Time { return now }}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		out, err := DoContext(context.Background(), op, data, opts)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if d, ok := test.expected.(decimal.Decimal); ok {
+			if od, ok := out.(decimal.Decimal); !ok || !od.Equal(d) {
+				t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+		}
+	}
+
+	if rt := ResultTypeOf(despatch); rt != RT_datetime {
+		t.Errorf("expected a time to be a %s, got %s", RT_datetime, rt)
+	}
+
+	op, err := ParseString(`$.DespatchDateTime.StartOf("day")`)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if d, err := Eval[time.Time](op, data); err != nil || !d.Equal(despatch.Truncate(24*time.Hour)) {
+		t.Errorf("expected Eval to return the date, got %v (%v)", d, err)
+	}
+
+	// Dates are values, so cannot be filtered like objects
+	if op, err = ParseString(`$.DespatchDateTime[@.IsNotNull()]`); err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if _, err := op.Do(data, data); err == nil {
+		t.Errorf("expected a date to not be filterable")
+	}
+}
+
+func Test_Timezones(t *testing.T) {
+	t.Parallel()
+
+	data := map[string]any{
+		"despatch": "2024-03-15T23:30:00Z",
+		"local":    "15/03/2024 09:00",
+	}
+
+	perth, err := time.LoadLocation("Australia/Perth")
+	if err != nil {
+		t.Fatalf("failed to load zone: %v", err)
+	}
+
+	tests := []struct {
+		query    string
+		expected any
+		isError  bool
+	}{
+		{query: `$.despatch.InTimezone("Australia/Perth").FormatDate("2006-01-02 15:04 MST")`, expected: "2024-03-16 07:30 AWST"},
+		{query: `$.despatch.InTimezone("Pacific/Auckland").LocalDate()`, expected: "2024-03-16"},
+		{query: `$.despatch.LocalDate()`, expected: "2024-03-15"},
+		{query: `$.despatch.InTimezone("Australia/Sydney").ToUTC()`, expected: time.Date(2024, time.March, 15, 23, 30, 0, 0, time.UTC)},
+		{query: `$.despatch.InTimezone("Australia/Sydney").Equal($.despatch.InTimezone("Australia/Perth"))`, expected: true},
+		{query: `$.local.ParseDate("02/01/2006 15:04", "Australia/Perth")`, expected: time.Date(2024, time.March, 15, 9, 0, 0, 0, perth)},
+		{query: `$.local.ParseDate("02/01/2006 15:04", "Australia/Perth").ToUTC()`, expected: time.Date(2024, time.March, 15, 1, 0, 0, 0, time.UTC)},
+		{query: `$.local.ParseDate("02/01/2006 15:04")`, expected: time.Date(2024, time.March, 15, 9, 0, 0, 0, time.UTC)},
+		{query: `$.local.ParseDate("02/01/2006 15:04", "Australia/Perth").IsBefore($.despatch)`, expected: true},
+		{query: `$.despatch.InTimezone("Australia/Narnia")`, isError: true},
+		{query: `$.despatch.InTimezone("Local")`, isError: true},
+		{query: `$.local.ParseDate("02/01/2006 15:04", "Mars/Olympus")`, isError: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if tt, ok := test.expected.(time.Time); ok {
+			if ot, ok := out.(time.Time); !ok || !ot.Equal(tt) || ot.Location().String() != tt.Location().String() {
+				t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+		}
+	}
+}
+
+func Test_BusinessDays(t *testing.T) {
+	t.Parallel()
+
+	nsw, err := LoadHolidayCalendarJSON(strings.NewReader(`{
+		"holidays": [
+			{"date": "2024-03-29", "name": "Good Friday"},
+			{"date": "2024-04-01", "name": "Easter Monday"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("failed to load the JSON calendar: %v", err)
+	}
+
+	nz, err := LoadHolidayCalendarICal(strings.NewReader(strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"BEGIN:VEVENT",
+		"DTSTART;VALUE=DATE:20240325",
+		"DTEND;VALUE=DATE:20240327",
+		"SUMMARY:Two day",
+		"  holiday",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")))
+	if err != nil {
+		t.Fatalf("failed to load the iCal calendar: %v", err)
+	}
+
+	if name, ok := nz.Holiday(time.Date(2024, time.March, 26, 0, 0, 0, 0, time.UTC)); !ok || name != "Two day holiday" {
+		t.Errorf("expected the second day of the event to be a holiday, got '%s' (%t)", name, ok)
+	}
+
+	// The weekend in the Middle East is Friday and Saturday
+	me, err := NewHolidayCalendar(nil, time.Friday, time.Saturday)
+	if err != nil {
+		t.Fatalf("failed to make the calendar: %v", err)
+	}
+
+	opts := EvalOptions{Calendars: map[string]*HolidayCalendar{"NSW": nsw, "NZ": nz, "ME": me}}
+
+	// Thursday before Easter
+	data := map[string]any{"despatch": "2024-03-28T15:00:00Z"}
+
+	tests := []struct {
+		query    string
+		expected any
+		isError  bool
+	}{
+		{query: `$.despatch.AddBusinessDays(1, "NSW")`, expected: time.Date(2024, time.April, 2, 15, 0, 0, 0, time.UTC)},
+		{query: `$.despatch.AddBusinessDays(3, "NSW").FormatDate("DateOnly")`, expected: "2024-04-04"},
+		{query: `$.despatch.AddBusinessDays(-3, "NZ").FormatDate("DateOnly")`, expected: "2024-03-21"},
+		{query: `$.despatch.AddBusinessDays(1, "ME").FormatDate("DateOnly")`, expected: "2024-03-31"},
+		{query: `$.despatch.AddBusinessDays(0, "NSW").FormatDate("DateOnly")`, expected: "2024-03-28"},
+		{query: `$.despatch.IsBusinessDay("NSW")`, expected: true},
+		{query: `$.despatch.AddBusinessDays(1, "NZ").IsBusinessDay("NSW")`, expected: false},
+		{query: `$.despatch.BusinessDaysBetween("2024-04-05", "NSW")`, expected: decimal.NewFromInt(4)},
+		{query: `$.despatch.BusinessDaysBetween("2024-03-20", "NZ")`, expected: decimal.NewFromInt(-4)},
+		{query: `$.despatch.BusinessDaysBetween($.despatch, "NSW")`, expected: decimal.NewFromInt(0)},
+		{query: `$.despatch.BusinessDaysBetween($.despatch.AddBusinessDays(10, "NSW"), "NSW") == 10`, expected: true},
+		{query: `$.despatch.BusinessDaysBetween("3024-03-28", "NSW")`, expected: decimal.NewFromInt(260884)},
+		{query: `$.despatch.BusinessDaysBetween("1024-03-28", "ME")`, expected: decimal.NewFromInt(-260889)},
+		{query: `$.despatch.AddBusinessDays(1, "VIC")`, isError: true},
+		{query: `$.despatch.AddBusinessDays(1.5, "NSW")`, isError: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		out, err := DoContext(context.Background(), op, data, opts)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if d, ok := test.expected.(decimal.Decimal); ok {
+			if od, ok := out.(decimal.Decimal); !ok || !od.Equal(d) {
+				t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+		}
+	}
+
+	// Business days are counted in whole weeks, which must give the same
+	// answer as counting each day
+	start := time.Date(2024, time.March, 14, 9, 0, 0, 0, time.UTC)
+	for _, c := range []*HolidayCalendar{nsw, nz, me} {
+		for i := -40; i <= 40; i++ {
+			end := start.AddDate(0, 0, i)
+
+			from, to, sign := start, end, 1
+			if i < 0 {
+				from, to, sign = end, start, -1
+			}
+
+			var want int
+			for day := from.AddDate(0, 0, 1); !day.After(to); day = day.AddDate(0, 0, 1) {
+				if c.IsBusinessDay(day) {
+					want += sign
+				}
+			}
+
+			if got := c.BusinessDaysBetween(start, end); got != want {
+				t.Errorf("business days from %s to %s: expected %d, got %d", start.Format(time.DateOnly), end.Format(time.DateOnly), want, got)
+			}
+		}
+	}
+
+	// Calendars only come from the options
+	op, err := ParseString(`$.despatch.IsBusinessDay("NSW")`)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if _, err := op.Do(data, data); !errors.Is(err, ErrCalendarNotFound) {
+		t.Errorf("expected ErrCalendarNotFound, got %v", err)
+	}
+
+	// The functions need the calendars in the options, so they cannot be
+	// called outside of a query
+	funcs := ListFunctions()
+	for _, ft := range []FT_FunctionType{FT_AddBusinessDays, FT_IsBusinessDay, FT_BusinessDaysBetween} {
+		if _, err := funcs[ft].Fn(FunctionParameterTypes{&FP_String{"NSW"}}, data["despatch"]); !errors.Is(err, ErrOnlyInQuery) {
+			t.Errorf("%s: expected ErrOnlyInQuery from Fn, got %v", ft, err)
+		}
+	}
+
+	invalid := []string{
+		`{"weekend": ["Caturday"]}`,
+		`{"holidays": [{"date": "29/03/2024", "name": "Good Friday"}]}`,
+		`{"weekend": ["Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"]}`,
+	}
+	for _, file := range invalid {
+		if _, err := LoadHolidayCalendarJSON(strings.NewReader(file)); err == nil {
+			t.Errorf("'%s': expected an error", file)
+		}
+	}
+
+	if _, err := LoadHolidayCalendarICal(strings.NewReader("BEGIN:VEVENT\nDTSTART:20240101\nRRULE:FREQ=YEARLY\nEND:VEVENT\n")); err == nil {
+		t.Errorf("expected an error for a recurring event")
+	}
+}
+
+func Test_StringFunctions(t *testing.T) {
+	t.Parallel()
+
+	data := map[string]any{
+		"name":  "  Jane O'BRIEN  ",
+		"tags":  "fragile,urgent,,heavy",
+		"empty": "",
+		"code":  "A7",
+		"city":  "Zürich",
+		"items": []any{"a", decimal.NewFromInt(2), true, nil},
+	}
+
+	tests := []struct {
+		query    string
+		expected any
+		isError  bool
+	}{
+		{query: `$.name.ToUpper()`, expected: "  JANE O'BRIEN  "},
+		{query: `$.name.ToLower()`, expected: "  jane o'brien  "},
+		{query: `$.name.TrimSpace()`, expected: "Jane O'BRIEN"},
+		{query: `$.name.TrimSpace().Title()`, expected: "Jane O'brien"},
+		{query: `$.city.Length()`, expected: decimal.NewFromInt(6)},
+		{query: `$.empty.Length()`, expected: decimal.NewFromInt(0)},
+		{query: `$.tags.Split(",")`, expected: []any{"fragile", "urgent", "", "heavy"}},
+		{query: `$.tags.Split(",").Count()`, expected: decimal.NewFromInt(4)},
+		{query: `$.tags.Split(",").First().ToUpper()`, expected: "FRAGILE"},
+		{query: `$.tags.Split(",")[@.NotEqual("")].Count()`, expected: decimal.NewFromInt(3)},
+		{query: `$.tags.Split(",").Join("|")`, expected: "fragile|urgent||heavy"},
+		{query: `$.empty.Split(",").Count()`, expected: decimal.NewFromInt(0)},
+		{query: `$.items.Join("-")`, expected: "a-2-true-"},
+		{query: `$.city.IndexOf("ch")`, expected: decimal.NewFromInt(4)},
+		{query: `$.city.IndexOf("x")`, expected: decimal.NewFromInt(-1)},
+		{query: `$.city.Substring(1, 3)`, expected: "üri"},
+		{query: `$.city.Substring(4, 10)`, expected: "ch"},
+		{query: `$.city.Substring(10, 1)`, expected: ""},
+		{query: `$.code.PadLeft(5, "0")`, expected: "000A7"},
+		{query: `$.code.PadLeft(5)`, expected: "   A7"},
+		{query: `$.code.PadRight(6, "ab")`, expected: "A7abab"},
+		{query: `$.code.PadRight(1)`, expected: "A7"},
+		{query: `$.code.Repeat(3)`, expected: "A7A7A7"},
+		{query: `$.city.Substring(-1, 2)`, isError: true},
+		{query: `$.city.Substring(1.5, 2)`, isError: true},
+		{query: `$.code.PadLeft(5, "")`, isError: true},
+		{query: `$.code.Repeat(-1)`, isError: true},
+		{query: `$.code.Repeat(1000000)`, isError: true},
+		{query: `$.items.ToUpper()`, isError: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if d, ok := test.expected.(decimal.Decimal); ok {
+			if od, ok := out.(decimal.Decimal); !ok || !od.Equal(d) {
+				t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+		}
+	}
+}
+
+func Test_FoldFunctions(t *testing.T) {
+	t.Parallel()
+
+	data := map[string]any{
+		"carrier":    "Toll IPEC",
+		"suburb":     "Café Hill",
+		"decomposed": "Cafe\u0301 Hill",
+		"fullwidth":  "ＴＯＬＬ IPEC",
+		"strasse":    "Hauptstraße",
+		"code":       "nfkd",
+	}
+
+	tests := []struct {
+		query    string
+		expected any
+		isError  bool
+	}{
+		{query: `$.carrier.EqualFold("toll ipec")`, expected: true},
+		{query: `$.carrier.EqualFold("toll")`, expected: false},
+		{query: `$.carrier.ContainsFold("ipec")`, expected: true},
+		{query: `$.carrier.PrefixFold("TOLL")`, expected: true},
+		{query: `$.carrier.PrefixFold("ipec")`, expected: false},
+		{query: `$.strasse.EqualFold("HAUPTSTRASSE")`, expected: true},
+		{query: `$.suburb.EqualFold("cafe hill")`, expected: false},
+		{query: `$.suburb.EqualFold("cafe hill", "StripDiacritics")`, expected: true},
+		{query: `$.suburb.ContainsFold("CAFE", "StripDiacritics")`, expected: true},
+		{query: `$.suburb.EqualFold($.decomposed)`, expected: false},
+		{query: `$.suburb.EqualFold($.decomposed, "NFC")`, expected: true},
+		{query: `$.suburb.EqualFold($.decomposed, "NFKD")`, expected: true},
+		{query: `$.fullwidth.PrefixFold("toll")`, expected: false},
+		{query: `$.fullwidth.PrefixFold("toll", "NFKD")`, expected: true},
+		{query: `$.carrier.AnyOfFold("StarTrack", "TOLL IPEC")`, expected: true},
+		{query: `$.carrier.AnyOfFold("StarTrack", "Couriers Please")`, expected: false},
+		{query: `$.suburb.AnyOfFold("Cafe Hill", "Cafe Valley")`, expected: false},
+		{query: `$.suburb.AnyOfFold("Cafe Hill", "Cafe Valley", "StripDiacritics")`, expected: false},
+		{query: `$.suburb.AnyOfFoldNormalised("StripDiacritics", "Cafe Hill", "Cafe Valley")`, expected: true},
+		{query: `$.carrier.AnyOfFold("NFC")`, expected: false},
+		// Values that are the names of normalisations are only ever values
+		{query: `$.code.AnyOfFold("NFC", "NFKD")`, expected: true},
+		{query: `$.code.AnyOfFoldNormalised("NFC", "NFKD")`, expected: true},
+		{query: `$.code.AnyOfFoldNormalised("NFKD")`, expected: false},
+		{query: `$.code.AnyOfFoldNormalised("NFD", "NFKD")`, isError: true},
+		{query: `$.carrier.EqualFold("toll ipec", "NFD")`, isError: true},
+		{query: `$.carrier.EqualFold()`, isError: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+		}
+	}
+
+	explanations := map[string]string{
+		`$.input.name.EqualFold("abc")`:                         `is equal to {{"abc"}}, ignoring case`,
+		`$.input.name.ContainsFold("abc", "StripDiacritics")`:   `contains {{"abc"}}, ignoring case and accents`,
+		`$.input.name.PrefixFold("abc", "NFKD")`:                `has the prefix {{"abc"}}, ignoring case, after NFKD normalisation`,
+		`$.input.name.AnyOfFold("abc", "NFC")`:                  `checks whether the value is any of {{"abc"}}, {{"NFC"}}, ignoring case`,
+		`$.input.name.AnyOfFoldNormalised("NFC", "abc", "def")`: `checks whether the value is any of {{"abc"}}, {{"def"}}, ignoring case, after NFC normalisation`,
+	}
+
+	for query, expected := range explanations {
+		tc, err := CueValidate(query, cueStringForTests, "step2")
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", query, err)
+			continue
+		}
+
+		path, ok := tc.(*Path)
+		if !ok || len(path.Parts) == 0 {
+			t.Errorf("'%s': expected a path, got %T", query, tc)
+			continue
+		}
+
+		fn, ok := path.Parts[len(path.Parts)-1].(*Function)
+		if !ok || fn.FunctionExplanation == nil || *fn.FunctionExplanation != expected {
+			t.Errorf("'%s': expected the explanation '%s'", query, expected)
+		}
+	}
+}
+
+func Test_ArrayFunctions(t *testing.T) {
+	t.Parallel()
+
+	type item struct {
+		Name    string
+		Carrier string
+		Price   float64
+	}
+
+	data := map[string]any{
+		"numbers": []any{3, 1.5, "10", 2, 1.50},
+		"words":   []any{"pear", "Apple", "fig", "apple"},
+		"mixed":   []any{"b", 2, nil, true, "a"},
+		"nested":  []any{[]any{1, 2}, 3, []any{}, []any{[]any{4}}},
+		"items": []item{
+			{Name: "a", Carrier: "Toll", Price: 20},
+			{Name: "b", Carrier: "StarTrack", Price: 35.5},
+			{Name: "c", Carrier: "Toll", Price: 5},
+			{Name: "d", Carrier: "Aramex", Price: 35.5},
+			{Name: "e", Carrier: "StarTrack", Price: 12},
+		},
+		"objects": []any{
+			map[string]any{"a": 1},
+			map[string]any{"a": 1.0},
+			map[string]any{"a": 2},
+		},
+	}
+
+	d := decimal.NewFromFloat
+
+	tests := []struct {
+		query    string
+		expected any
+		isError  bool
+	}{
+		{query: `$.numbers.Sort()`, expected: []any{1.5, 1.50, 2, 3, "10"}},
+		{query: `$.numbers.SortDesc()`, expected: []any{"10", 3, 2, 1.5, 1.50}},
+		{query: `$.numbers.Sort().First()`, expected: d(1.5)},
+		{query: `$.numbers.Distinct()`, expected: []any{3, 1.5, "10", 2}},
+		{query: `$.words.Sort()`, expected: []any{"Apple", "apple", "fig", "pear"}},
+		{query: `$.mixed.Sort()`, expected: []any{nil, true, 2, "a", "b"}},
+		{query: `$.words.Reverse()`, expected: []any{"apple", "fig", "Apple", "pear"}},
+		{query: `$.words.Take(2)`, expected: []any{"pear", "Apple"}},
+		{query: `$.words.Take(10)`, expected: []any{"pear", "Apple", "fig", "apple"}},
+		{query: `$.words.Skip(3)`, expected: []any{"apple"}},
+		{query: `$.words.Skip(10)`, expected: []any{}},
+		{query: `$.words.Skip(1).Take(2)`, expected: []any{"Apple", "fig"}},
+		{query: `$.nested.Flatten()`, expected: []any{1, 2, 3, []any{4}}},
+		{query: `$.nested.Flatten().Flatten().Count()`, expected: d(4)},
+		{query: `$.objects.Distinct().Count()`, expected: d(2)},
+		{query: `$.items.SortBy("$.Price").Select("$.Name")`, expected: []any{"c", "e", "a", "b", "d"}},
+		{query: `$.items.SortBy("$.Price").Reverse().Take(3).Select("$.Name")`, expected: []any{"d", "b", "a"}},
+		{query: `$.items.SortBy("$.Carrier").First().Name`, expected: "d"},
+		{query: `$.items.DistinctBy("$.Carrier").Select("$.Name")`, expected: []any{"a", "b", "d"}},
+		{query: `$.items.Select("$.Carrier").Distinct().Sort()`, expected: []any{"Aramex", "StarTrack", "Toll"}},
+		{query: `$.items.Sort()`, isError: true},
+		{query: `$.objects.Sort()`, isError: true},
+		{query: `$.items.SortBy("$.Missing")`, isError: true},
+		{query: `$.items.SortBy("$.")`, isError: true},
+		{query: `$.words.Take(-1)`, isError: true},
+		{query: `$.words.Skip(1.5)`, isError: true},
+		{query: `$.items.First().Name.Sort()`, isError: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if d, ok := test.expected.(decimal.Decimal); ok {
+			if od, ok := out.(decimal.Decimal); !ok || !od.Equal(d) {
+				t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+		}
+	}
+
+	// The data is not reordered
+	if !reflect.DeepEqual(data["words"], []any{"pear", "Apple", "fig", "apple"}) {
+		t.Errorf("the data was changed: %v", data["words"])
+	}
+
+	// The functions that take a query run it with the options of the
+	// evaluation, so they cannot be called outside of a query
+	funcs := ListFunctions()
+	for _, ft := range []FT_FunctionType{FT_SortBy, FT_DistinctBy, FT_GroupBy, FT_CountBy, FT_SumBy, FT_AverageBy, FT_MinimumBy, FT_MaximumBy} {
+		if _, err := funcs[ft].Fn(FunctionParameterTypes{&FP_String{"$.Price"}}, data["items"]); !errors.Is(err, ErrOnlyInQuery) {
+			t.Errorf("%s: expected ErrOnlyInQuery from Fn, got %v", ft, err)
+		}
+	}
+}
+
+func Test_GroupBy(t *testing.T) {
+	t.Parallel()
+
+	data := map[string]any{
+		"consignments": []any{
+			map[string]any{"id": "1", "carrier": "TNT", "weight": 10.5, "items": 2},
+			map[string]any{"id": "2", "carrier": "Toll", "weight": 4, "items": 1},
+			map[string]any{"id": "3", "carrier": "TNT", "weight": 2.25, "items": 5},
+			map[string]any{"id": "4", "carrier": "Aramex", "weight": nil, "items": 1},
+			map[string]any{"id": "5", "carrier": nil, "weight": 1, "items": 1},
+		},
+		"keys": []any{nil, "", "1", 1, 1.0, "true", true, "null", `"x`, `\"x`},
+	}
+
+	d := decimal.NewFromFloat
+
+	tests := []struct {
+		query    string
+		expected any
+		isError  bool
+	}{
+		{query: `$.consignments.GroupBy("$.carrier").TNT.Count()`, expected: d(2)},
+		{query: `$.consignments.GroupBy("$.carrier").TNT.Select("$.id")`, expected: []any{"1", "3"}},
+		{query: `$.consignments.GroupBy("$.items").1.Count()`, expected: d(3)},
+		{query: `$.consignments.CountBy("$.carrier").Toll`, expected: d(1)},
+		{query: `$.consignments.CountBy("$.carrier").Sum()`, expected: d(5)},
+		{query: `$.consignments.SumBy("$.carrier", "$.weight").TNT`, expected: d(12.75)},
+		{query: `$.consignments.SumBy("$.carrier", "$.weight").Aramex`, expected: d(0)},
+		{query: `$.consignments.AverageBy("$.carrier", "$.items").TNT`, expected: d(3.5)},
+		{query: `$.consignments.MinimumBy("$.carrier", "$.weight").TNT`, expected: d(2.25)},
+		{query: `$.consignments.MaximumBy("$.carrier", "$.weight").TNT`, expected: d(10.5)},
+		{query: `$.consignments.MaximumBy("$.carrier", "$.weight").Aramex`, expected: nil},
+		{query: `$.consignments.CountBy("$.carrier").AsJSON()`, expected: `{"Aramex":"1","TNT":"2","Toll":"1","null":"1"}`},
+		// Values of different types that are written the same way are in
+		// separate groups
+		{query: `$.keys.CountBy("$").AsJSON()`, expected: `{"\"\"":"1","\"1\"":"1","\"\\\"x\"":"1","\"null\"":"1","\"true\"":"1","1":"2","\\\"x":"1","null":"1","true":"1"}`},
+		{query: `$.keys.GroupBy("$").1.Count()`, expected: d(2)},
+		{query: `$.keys.GroupBy("$")["\"1\""].Count()`, expected: d(1)},
+		{query: `$.keys.GroupBy("$").null.Count()`, expected: d(1)},
+		{query: `$.consignments.SumBy("$.carrier", "$.items.Multiply(2)").TNT`, expected: d(14)},
+		// The groups are in the order of their names
+		{query: `$.consignments.GroupBy("$.carrier").Keys()`, expected: []any{"Aramex", "TNT", "Toll", "null"}},
+		{query: `$.consignments.GroupBy("$.carrier").Values().Map(@.First().id)`, expected: []any{"4", "1", "2", "5"}},
+		{query: `$.consignments.GroupBy("$.id").Values().Map(@.First().carrier?)`, expected: []any{"TNT", "Toll", "TNT", "Aramex", nil}},
+		{query: `$.consignments.CountBy("$.carrier").Entries().Select("$.key")`, expected: []any{"Aramex", "TNT", "Toll", "null"}},
+		{query: `$.consignments.SumBy("$.carrier", "$.carrier")`, isError: true},
+		{query: `$.consignments.GroupBy("$")`, isError: true},
+		{query: `$.consignments.SumBy("$.carrier")`, isError: true},
+		{query: `$.consignments.First().GroupBy("$.carrier")`, isError: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if d, ok := test.expected.(decimal.Decimal); ok {
+			if od, ok := out.(decimal.Decimal); !ok || !od.Equal(d) {
+				t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+		}
+	}
+}
+
+func Test_MapFunctions(t *testing.T) {
+	t.Parallel()
+
+	type Base struct {
+		ID string `json:"id"`
+	}
+	type consignment struct {
+		Base
+		Carrier string  `json:"carrier"`
+		Weight  float64 `json:"weight"`
+		Secret  string  `json:"-"`
+	}
+	type tagged struct {
+		ConsignmentNumber string `json:"ref"`
+		CarrierName       string `json:"carrier"`
+	}
+
+	data := map[string]any{
+		"rates":       map[string]any{"Toll": 12.5, "TNT": 9, "Aramex": "n/a"},
+		"carrier":     "tnt",
+		"consignment": consignment{Base: Base{ID: "C1"}, Carrier: "Toll", Weight: 4, Secret: "x"},
+		"tagged":      tagged{ConsignmentNumber: "C1", CarrierName: "Toll"},
+		"empty":       map[string]any{},
+		"list": []any{
+			map[string]any{"carrier": "TNT"},
+			map[string]any{"carrier": "Toll"},
+			map[string]any{"carrier": "TNT"},
+		},
+	}
+
+	d := decimal.NewFromFloat
+
+	tests := []struct {
+		query    string
+		expected any
+		isError  bool
+	}{
+		{query: `$.rates.Keys()`, expected: []any{"Aramex", "TNT", "Toll"}},
+		{query: `$.rates.Values()`, expected: []any{"n/a", decimal.NewFromInt(9), d(12.5)}},
+		{query: `$.rates.Entries().First()`, expected: map[string]any{"key": "Aramex", "value": "n/a"}},
+		{query: `$.rates.Entries()[@.key.Prefix("T")].Count()`, expected: d(2)},
+		{query: `$.rates.Entries()[@.value.NotEqual("n/a")].Select("$.key")`, expected: []any{"TNT", "Toll"}},
+		{query: `$.rates.HasKey("toll")`, expected: true},
+		{query: `$.rates.HasKey("StarTrack")`, expected: false},
+		{query: `$.rates.Get($.carrier)`, expected: d(9)},
+		{query: `$.rates.Get("Aramex")`, expected: "n/a"},
+		{query: `$.consignment.Keys()`, expected: []any{"id", "carrier", "weight"}},
+		{query: `$.consignment.Values()`, expected: []any{"C1", "Toll", d(4)}},
+		{query: `$.consignment.HasKey("Carrier")`, expected: true},
+		{query: `$.consignment.HasKey("Secret")`, expected: false},
+		{query: `$.consignment.Get("id")`, expected: "C1"},
+		// Fields are picked by the same names as a path, including Go names
+		{query: `$.tagged.Pick("ConsignmentNumber")`, expected: map[string]any{"ref": "C1"}},
+		{query: `$.tagged.Pick("REF", "carrierName")`, expected: map[string]any{"ref": "C1", "carrier": "Toll"}},
+		{query: `$.tagged.Omit("consignmentNumber")`, expected: map[string]any{"carrier": "Toll"}},
+		{query: `$.tagged.Pick("Missing")`, expected: map[string]any{}},
+		{query: `$.empty.Keys()`, expected: []any{}},
+		{query: `$.empty.Values()`, expected: []any{}},
+		{query: `$.empty.Entries()`, expected: []any{}},
+		{query: `$.list.GroupBy("$.carrier").Keys()`, expected: []any{"TNT", "Toll"}},
+		{query: `$.list.CountBy("$.carrier").Values()`, expected: []any{decimal.NewFromInt(2), decimal.NewFromInt(1)}},
+		{query: `$.rates.Get("StarTrack")`, isError: true},
+		{query: `$.list.Keys()`, isError: true},
+		{query: `$.carrier.HasKey("a")`, isError: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if d, ok := test.expected.(decimal.Decimal); ok {
+			if od, ok := out.(decimal.Decimal); !ok || !od.Equal(d) {
+				t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+		}
+	}
+
+	// Get returns the same error as a path when the key is not found
+	op, err := ParseString(`$.rates.Get("StarTrack")`)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if _, err := op.Do(data, data); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func Test_BracketKeys(t *testing.T) {
+	t.Parallel()
+
+	data := map[string]any{
+		"key with.dots": "a",
+		"first name":    "bob",
+		`say "hi"`:      "hello",
+		"Add":           "not a function",
+		"steps": map[string]any{
+			"3dedbf75-1c91": map[string]any{"result": "ok"},
+		},
+		"list": []any{
+			map[string]any{"a.b": 1, "name": "one"},
+			map[string]any{"a.b": 2, "name": "two"},
+		},
+	}
+
+	tests := []struct {
+		query    string
+		expected any
+		printed  string
+		isError  bool
+	}{
+		{query: `$["key with.dots"]`, expected: "a", printed: `$["key with.dots"]`},
+		{query: `$.steps["3dedbf75-1c91"].result`, expected: "ok", printed: `$.steps.3dedbf75-1c91.result`},
+		{query: `$["steps"]["3dedbf75-1c91"]["result"]`, expected: "ok", printed: `$.steps.3dedbf75-1c91.result`},
+		{query: `$["first name"].ToUpper()`, expected: "BOB", printed: `$["first name"].ToUpper()`},
+		{query: `$["say \"hi\""]`, expected: "hello", printed: `$["say \"hi\""]`},
+		{query: `$["Add"]`, expected: "not a function", printed: `$.Add`},
+		{query: `$.list[@["a.b"] == 2].First().name`, expected: "two"},
+		{query: `$.list.First()["a.b"]`, expected: decimal.NewFromInt(1)},
+		{query: `$[ "key with.dots" ]`, expected: "a", printed: `$["key with.dots"]`},
+		{query: `$.list.First()[ "a.b" ]`, expected: decimal.NewFromInt(1)},
+		{query: `$.list[ @["a.b"] == 2 ].First().name`, expected: "two"},
+		{query: `$["missing key"]`, isError: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		if test.printed != "" && op.Sprint(0) != test.printed {
+			t.Errorf("'%s': expected to print %s, got %s", test.query, test.printed, op.Sprint(0))
+		}
+
+		// The printed query must parse to the same query
+		reparsed, err := ParseString(op.Sprint(0))
+		if err != nil {
+			t.Errorf("'%s': failed to parse printed query: %v", test.query, err)
+			continue
+		}
+		if reparsed.Sprint(0) != op.Sprint(0) {
+			t.Errorf("'%s': printed query changed after parsing; was %s, got %s", test.query, op.Sprint(0), reparsed.Sprint(0))
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if d, ok := test.expected.(decimal.Decimal); ok {
+			if od, ok := out.(decimal.Decimal); !ok || !od.Equal(d) {
+				t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+		}
+	}
+
+	for _, query := range []string{
+		`$["abc"`,
+		`$["abc" "d"]`,
+		`$[abc"]`,
+	} {
+		if _, err := ParseString(query); err == nil {
+			t.Errorf("'%s': expected a parse error", query)
+		}
+	}
+}
+
+func Test_Slices(t *testing.T) {
+	t.Parallel()
+
+	data := map[string]any{
+		"items":  []any{"a", "b", "c", "d", "e"},
+		"rates":  []any{1.5, 2.5, 3.5},
+		"empty":  []any{},
+		"object": map[string]any{"a": 1},
+		"orders": []any{
+			map[string]any{"id": "A", "weight": 3},
+			map[string]any{"id": "B", "weight": 1},
+			map[string]any{"id": "C", "weight": 2},
+		},
+	}
+
+	tests := []struct {
+		query    string
+		expected any
+		isError  bool
+	}{
+		{query: `$.items[1:3]`, expected: []any{"b", "c"}},
+		{query: `$.items[-2:]`, expected: []any{"d", "e"}},
+		{query: `$.items[:-3]`, expected: []any{"a", "b"}},
+		{query: `$.items[::2]`, expected: []any{"a", "c", "e"}},
+		{query: `$.items[::-1]`, expected: []any{"e", "d", "c", "b", "a"}},
+		{query: `$.items[3:0:-2]`, expected: []any{"d", "b"}},
+		{query: `$.items[ 1 : -1 ]`, expected: []any{"b", "c", "d"}},
+		{query: `$.items[:]`, expected: []any{"a", "b", "c", "d", "e"}},
+		{query: `$.items[-100:100]`, expected: []any{"a", "b", "c", "d", "e"}},
+		{query: `$.items[3:1]`, expected: []any{}},
+		{query: `$.empty[1:]`, expected: []any{}},
+		{query: `$.rates[1:].Sum()`, expected: decimal.NewFromInt(6)},
+		{query: `$.orders.SortBy("$.weight")[:2].Select("$.id")`, expected: []any{"B", "C"}},
+		{query: `$.orders[@.weight > 1][1:].First().id`, expected: "C"},
+		{query: `$.items.Index(-1)`, expected: "e"},
+		{query: `$.items.Index(-5)`, expected: "a"},
+		{query: `$.items.Index(-6)`, isError: true},
+		{query: `$.items.Index(5)`, isError: true},
+		{query: `$.object[0:1]`, isError: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		// The printed query must parse to the same query
+		reparsed, err := ParseString(op.Sprint(0))
+		if err != nil {
+			t.Errorf("'%s': failed to parse printed query: %v", test.query, err)
+			continue
+		}
+		if reparsed.Sprint(0) != op.Sprint(0) {
+			t.Errorf("'%s': printed query changed after parsing; was %s, got %s", test.query, op.Sprint(0), reparsed.Sprint(0))
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if d, ok := test.expected.(decimal.Decimal); ok {
+			if od, ok := out.(decimal.Decimal); !ok || !od.Equal(d) {
+				t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+		}
+	}
+
+	// Slices do not hide the path that they are part of
+	op, err := ParseString(`$.orders[1:].First().id`)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if got := AddressedPaths(op); !reflect.DeepEqual(got, [][]string{{"orders", "id"}}) {
+		t.Errorf("expected addressed paths [[orders id]], got %v", got)
+	}
+	if got := GetRootFieldsAccessed(op); !reflect.DeepEqual(got, []string{"orders"}) {
+		t.Errorf("expected root fields [orders], got %v", got)
+	}
+
+	for _, query := range []string{
+		`$.items[1:2:0]`,
+		`$.items[1:2:3:4]`,
+		`$.items[1-2:3]`,
+		`$.items[1:3`,
+	} {
+		if _, err := ParseString(query); err == nil {
+			t.Errorf("'%s': expected a parse error", query)
+		}
+	}
+}
+
+func Test_WildcardAndRecursiveDescent(t *testing.T) {
+	t.Parallel()
+
+	type link struct {
+		Name string `json:"name"`
+		Next *link  `json:"next"`
+	}
+	first := &link{Name: "first"}
+	first.Next = &link{Name: "second", Next: first}
+
+	type step struct {
+		Result string `json:"result"`
+		Weight int    `json:"weight"`
+	}
+
+	data := map[string]any{
+		"steps": map[string]any{
+			"b": map[string]any{"result": "two", "weight": 2},
+			"a": map[string]any{"result": "one", "weight": 1, "inner": map[string]any{"result": "nested"}},
+		},
+		"structSteps": []any{step{Result: "x", Weight: 3}, step{Result: "y", Weight: 4}},
+		"matrix":      []any{[]any{1, 2}, []any{3}},
+		"links":       first,
+		"name":        "root",
+	}
+
+	tests := []struct {
+		query    string
+		expected any
+		isError  bool
+	}{
+		{query: `$.steps.*.result`, expected: []any{"one", "two"}},
+		{query: `$.steps.*.weight.Sum()`, expected: decimal.NewFromInt(3)},
+		{query: `$.steps.*.Count()`, expected: decimal.NewFromInt(2)},
+		{query: `$.structSteps.*.result`, expected: []any{"x", "y"}},
+		{query: `$.structSteps.First().*`, expected: []any{"x", decimal.NewFromInt(3)}},
+		{query: `$.matrix.*.*.Sum()`, expected: decimal.NewFromInt(6)},
+		{query: `$.matrix.*.Count()`, expected: decimal.NewFromInt(2)},
+		{query: `$.steps..result`, expected: []any{"nested", "one", "two"}},
+		{query: `$..RESULT.Count()`, expected: decimal.NewFromInt(5)},
+		{query: `$.steps..["result"].First()`, expected: "nested"},
+		{query: `$.steps..[ "result" ].First()`, expected: "nested"},
+		{query: `$.links..name`, expected: []any{"first", "second"}},
+		{query: `$.steps..missing`, expected: []any{}},
+		{query: `$.name.*`, isError: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		// The printed query must parse to the same query
+		reparsed, err := ParseString(op.Sprint(0))
+		if err != nil {
+			t.Errorf("'%s': failed to parse printed query: %v", test.query, err)
+			continue
+		}
+		if reparsed.Sprint(0) != op.Sprint(0) {
+			t.Errorf("'%s': printed query changed after parsing; was %s, got %s", test.query, op.Sprint(0), reparsed.Sprint(0))
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if d, ok := test.expected.(decimal.Decimal); ok {
+			if od, ok := out.(decimal.Decimal); !ok || !od.Equal(d) {
+				t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+		}
+	}
+
+	// Wildcards and recursive descents are part of the addressed paths and
+	// the root fields; a recursive descent at the root keeps the name that
+	// is looked for in both
+	for _, test := range []struct {
+		query      string
+		paths      [][]string
+		rootFields []string
+	}{
+		{`$.steps.*.result`, [][]string{{"steps", WildcardSegment, "result"}}, []string{"steps"}},
+		{`$.*.result`, [][]string{{WildcardSegment, "result"}}, []string{WildcardSegment}},
+		{`$..consignmentNumber`, [][]string{{RecursiveDescentSegment, "consignmentNumber"}}, []string{RecursiveDescentSegment + ".consignmentNumber"}},
+		{`$.steps..result.First()`, [][]string{{"steps", RecursiveDescentSegment, "result"}}, []string{"steps"}},
+	} {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Fatalf("'%s': failed to parse: %v", test.query, err)
+		}
+
+		if got := AddressedPaths(op); !reflect.DeepEqual(got, test.paths) {
+			t.Errorf("'%s': expected addressed paths %v, got %v", test.query, test.paths, got)
+		}
+		if got := GetRootFieldsAccessed(op); !reflect.DeepEqual(got, test.rootFields) {
+			t.Errorf("'%s': expected root fields %v, got %v", test.query, test.rootFields, got)
+		}
+	}
+
+	for _, query := range []string{
+		`$..`,
+		`$..Count()`,
+		`$..*`,
+	} {
+		if _, err := ParseString(query); err == nil {
+			t.Errorf("'%s': expected a parse error", query)
+		}
+	}
+}
+
+func Test_Conditionals(t *testing.T) {
+	t.Parallel()
+
+	data := map[string]any{
+		"weight":        150,
+		"light":         5,
+		"pickupAddress": map[string]any{"suburb": "Sydney"},
+		"empty":         map[string]any{"value": nil},
+		"name":          "Toll",
+	}
+
+	tests := []struct {
+		query    string
+		expected any
+		isError  bool
+	}{
+		{query: `$.If($.weight > 100, "PALLET", "CARTON")`, expected: "PALLET"},
+		{query: `$.If($.light > 100, "PALLET", "CARTON")`, expected: "CARTON"},
+		{query: `$.weight.If(@.Greater(100), "PALLET", "CARTON")`, expected: "PALLET"},
+		{query: `$.If($.missing?, "yes", "no")`, expected: "no"},
+		{query: `$.If($.weight > 100, $.pickupAddress, $.missing.field).suburb`, expected: "Sydney"},
+		{query: `$.If($.light > 100, $.missing.field, "CARTON")`, expected: "CARTON"},
+		{query: `$.If($.light > 100, "PALLET", $.missing.field)`, isError: true},
+		{query: `$.If($.name, "PALLET", "CARTON")`, isError: true},
+		{query: `$.If($.name, "PALLET")`, isError: true},
+		{query: `$.Coalesce($.deliveryAddress, $.pickupAddress).suburb`, expected: "Sydney"},
+		{query: `$.Coalesce($.empty.value, $.name)`, expected: "Toll"},
+		{query: `$.Coalesce($.name, $.name.Add(1))`, expected: "Toll"},
+		{query: `$.Coalesce($.missing, $.empty.value)`, expected: nil},
+		{query: `$.Coalesce($.missing, $.name.Add(1))`, isError: true},
+		{query: `$.empty?.value?.Coalesce("n/a")`, expected: "n/a"},
+		{query: `$.deliveryAddress?.suburb?.Coalesce($.pickupAddress.suburb)`, expected: "Sydney"},
+		{query: `$.name.Coalesce("n/a")`, expected: "Toll"},
+		{query: `$.empty.value.Default(0).Add(1)`, expected: decimal.NewFromInt(1)},
+		{query: `$.light.Default($.name.Add(1))`, expected: decimal.NewFromInt(5)},
+		{query: `$.empty.value.Default($.name.Add(1))`, isError: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if d, ok := test.expected.(decimal.Decimal); ok {
+			if od, ok := out.(decimal.Decimal); !ok || !od.Equal(d) {
+				t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expected, out)
+		}
+	}
+}
+
+func Test_Literals(t *testing.T) {
+	t.Parallel()
+
+	data := map[string]any{
+		"consignmentNumber": "C123",
+		"items": []any{
+			map[string]any{"weight": 1.5, "dg": false},
+			map[string]any{"weight": 2.25, "dg": true},
+		},
+		"receiver": map[string]any{"name": "Bob", "suburb": "Sydney", "phone": "0400"},
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+		isError  bool
+	}{
+		{query: `{ "ref": $.consignmentNumber, "kg": $.items.Select("$.weight").Sum() }`, expected: "map[kg:3.75 ref:C123]"},
+		{query: `{"ref":$.consignmentNumber,"count":2,"dg":true,"note":null,"label":"x"}`, expected: "map[count:2 dg:true label:x note:<nil> ref:C123]"},
+		{query: `[$.consignmentNumber, 1.50, -2, $.receiver.name]`, expected: "[C123 1.5 -2 Bob]"},
+		{query: `{"receiver": {"name": $.receiver.name}, "weights": [$.items.First().weight]}`, expected: "map[receiver:map[name:Bob] weights:[1.5]]"},
+		{query: `{"heavy": $.items.Select("$.weight").Sum() > 3, "dg": $.items[@.dg == true].Count()}`, expected: "map[dg:1 heavy:true]"},
+		{query: `{}`, expected: "map[]"},
+		{query: `[]`, expected: "[]"},
+		{query: `$.receiver.Pick("name", "SUBURB")`, expected: "map[name:Bob suburb:Sydney]"},
+		{query: `$.receiver.Omit("phone")`, expected: "map[name:Bob suburb:Sydney]"},
+		{query: `$.receiver.Pick("missing")`, expected: "map[]"},
+		{query: `#r = {"name": $.receiver.name, "kg": 2}; #r.kg.Add(1)`, expected: "3"},
+		{query: `#r = $.receiver.Pick("name"); {"to": #r, "ref": $.consignmentNumber}`, expected: "map[ref:C123 to:map[name:Bob]]"},
+		{query: `{"a": $.missing}`, isError: true},
+		{query: `[$.missing]`, isError: true},
+		{query: `$.receiver.Pick(1)`, isError: true},
+		{query: `$.consignmentNumber.Omit("a")`, isError: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		// The printed query must parse to the same query
+		reparsed, err := ParseString(op.Sprint(0))
+		if err != nil {
+			t.Errorf("'%s': failed to parse printed query: %v", test.query, err)
+			continue
+		}
+		if reparsed.Sprint(0) != op.Sprint(0) {
+			t.Errorf("'%s': printed query changed after parsing; was %s, got %s", test.query, op.Sprint(0), reparsed.Sprint(0))
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if got := fmt.Sprint(out); got != test.expected {
+			t.Errorf("'%s': expected %s, got %s", test.query, test.expected, got)
+		}
+	}
+
+	for _, query := range []string{
+		`{"a": 1, "a": 2}`,
+		`{"a": 1,}`,
+		`{"a" 1}`,
+		`[1, 2`,
+		`{"a": 1}.a`,
+		`{"a": 1} == $.x`,
+		`$.x == [1]`,
+		`$.isValid && [1]`,
+		`$.Coalesce($.a, {"b": 1})`,
+	} {
+		if _, err := ParseString(query); err == nil {
+			t.Errorf("'%s': expected a parse error", query)
+		}
+	}
+}
+
+func Test_Lambdas(t *testing.T) {
+	t.Parallel()
+
+	data := map[string]any{
+		"minTotal": 5,
+		"items": []any{
+			map[string]any{"price": 2, "qty": 3, "dg": true, "tags": []any{"fragile", "heavy"}},
+			map[string]any{"price": 1.5, "qty": 2, "dg": false, "tags": []any{}},
+			map[string]any{"price": 4, "qty": 1, "tags": []any{"heavy"}},
+		},
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+		isError  bool
+	}{
+		{query: `$.items.Map(@.price.Multiply(@.qty))`, expected: "[6 3 4]"},
+		{query: `$.items.Map(@.price * @.qty).Sum()`, expected: "13"},
+		{query: `$.items.Map($.minTotal.Subtract(@.qty))`, expected: "[2 3 4]"},
+		{query: `$.items.Where(@.price * @.qty >= $.minTotal).Count()`, expected: "1"},
+		{query: `$.items.Where(@.dg?).Count()`, expected: "1"},
+		{query: `$.items.Where(@.dg? == false).Count()`, expected: "1"},
+		{query: `$.items.Where(@.tags[@ == "heavy"].Count() > 0).Map(@.price)`, expected: "[2 4]"},
+		{query: `$.items.All(@.qty > 0)`, expected: "true"},
+		{query: `$.items.All(@.qty > 1 && @.price < 3)`, expected: "false"},
+		{query: `$.items.AnyMatch(@.dg == true)`, expected: "true"},
+		{query: `$.items.AnyMatch(@.price > $.minTotal)`, expected: "false"},
+		{query: `$.items.Reduce(0, #acc.Add(@.price.Multiply(@.qty)))`, expected: "13"},
+		{query: `$.items.Reduce($.minTotal, #acc + @.qty)`, expected: "11"},
+		{query: `#acc = $.minTotal; $.items.Reduce(0, #acc + @.qty).Add(#acc)`, expected: "11"},
+		{query: `$.items.Map(@.tags.Where(@ == "heavy").Count().Add(@.qty))`, expected: "[4 2 2]"},
+		{query: `$.items[@.price > 1.5].Map(@.qty)`, expected: "[3 1]"},
+		{query: `$[@.qty > 1]`, isError: true},
+		{query: `$.items.Map(@.missing)`, isError: true},
+		{query: `$.items.Where(@.qty)`, isError: true},
+		{query: `$.items.Where(@.dg).Count()`, isError: true},
+		{query: `$.items.Where(@.missing).Count()`, isError: true},
+		{query: `$.items.Where(@.missing?).Count()`, expected: "0"},
+		{query: `$.minTotal.Map(@)`, isError: true},
+		{query: `$.items.Reduce(0)`, isError: true},
+		{query: `$.items.Map(@.tags.AnyMatch(@ == "heavy"))`, expected: "[true false true]"},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		// The printed query must parse to the same query
+		reparsed, err := ParseString(op.Sprint(0))
+		if err != nil {
+			t.Errorf("'%s': failed to parse printed query: %v", test.query, err)
+			continue
+		}
+		if reparsed.Sprint(0) != op.Sprint(0) {
+			t.Errorf("'%s': printed query changed after parsing; was %s, got %s", test.query, op.Sprint(0), reparsed.Sprint(0))
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if got := fmt.Sprint(out); got != test.expected {
+			t.Errorf("'%s': expected %s, got %s", test.query, test.expected, got)
+		}
+	}
+}
+
+func Test_Quantifiers(t *testing.T) {
+	t.Parallel()
+
+	data := map[string]any{
+		"maxKg": 10,
+		"items": []any{
+			map[string]any{"kg": 2, "dg": true},
+			map[string]any{"kg": 12, "dg": false},
+			map[string]any{"kg": 4, "dg": true},
+		},
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+		isError  bool
+	}{
+		{query: `$.items.All(@.dg == true)`, expected: "false"},
+		{query: `$.items.All(@.kg > 1)`, expected: "true"},
+		{query: `$.items.None(@.kg > $.maxKg)`, expected: "false"},
+		{query: `$.items.None(@.kg > 20 || @.missing?)`, expected: "true"},
+		{query: `$.items.Exactly(2, @.dg)`, expected: "true"},
+		{query: `$.items.Exactly(1, @.dg)`, expected: "false"},
+		{query: `$.items.Exactly(0, @.kg > 20)`, expected: "true"},
+		{query: `$.items.Exactly(4, @.dg)`, expected: "false"},
+		{query: `$.items[@.dg == true].Exactly(2, @.kg < $.maxKg)`, expected: "true"},
+		{query: `$.items.Exactly(1.5, @.dg)`, isError: true},
+		{query: `$.items.Exactly(-1, @.dg)`, isError: true},
+		{query: `$.items.None(@.kg)`, isError: true},
+		{query: `$.maxKg.None(@)`, isError: true},
+		{query: `$.items.All(@.missing)`, isError: true},
+		{query: `$.items.None(@.missing)`, isError: true},
+		{query: `$.items.None(@.kg > 10 || @.missing)`, isError: true},
+		{query: `$.items.Exactly(0, @.missing)`, isError: true},
+		{query: `$.items.All(@.missing?)`, expected: "false"},
+		{query: `$.items.All(@.missing? == true)`, expected: "false"},
+		{query: `$.items.None(@.missing?)`, expected: "true"},
+		{query: `$.items.None(@.missing? == true)`, expected: "true"},
+		{query: `$.items.Exactly(0, @.missing?)`, expected: "true"},
+		{query: `$.items.Exactly(3, @.missing? == null)`, expected: "true"},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", test.query, err)
+			continue
+		}
+
+		out, err := op.Do(data, data)
+		if test.isError {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got %v", test.query, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if got := fmt.Sprint(out); got != test.expected {
+			t.Errorf("'%s': expected %s, got %s", test.query, test.expected, got)
+		}
+	}
+
+	// The condition is not run for the elements after the result is known,
+	// so they cannot fail the query
+	shortCircuited := map[string]any{"items": []any{1, "a"}}
+	for _, query := range []string{`$.items.All(@ > 1)`, `$.items.None(@ == 1)`, `$.items.Exactly(0, @ == 1)`} {
+		op, err := ParseString(query)
+		if err != nil {
+			t.Errorf("'%s': failed to parse: %v", query, err)
+			continue
+		}
+
+		if out, err := op.Do(shortCircuited, shortCircuited); err != nil || out != false {
+			t.Errorf("'%s': expected false, got %v, %v", query, out, err)
+		}
+	}
+
+	explanations := map[string]string{
+		`$.step1.result.All(@.age == 3)`:                            `all result have age equal to {{3}}`,
+		`$.step1.result.None(@.age > $.step1.num && @.name == "a")`: `no result have age greater than {{$.step1.num}} and name equal to {{"a"}}`,
+		`$.step1.result.Exactly(2, @.age < 18)`:                     `exactly {{2}} result have age less than {{18}}`,
+		`$.step1.result.All(@.name.Count() > 1)`:                    `all result match {{@.name.Count().Greater(1)}}`,
+	}
+
+	for query, expected := range explanations {
+		tc, err := CueValidate(query, cueStringForTests, "step2")
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", query, err)
+			continue
+		}
+
+		path, ok := tc.(*Path)
+		if !ok || len(path.Parts) == 0 {
+			t.Errorf("'%s': expected a path, got %T", query, tc)
+			continue
+		}
+
+		fn, ok := path.Parts[len(path.Parts)-1].(*Function)
+		if !ok || fn.FunctionExplanation == nil || *fn.FunctionExplanation != expected {
+			got := ""
+			if ok && fn.FunctionExplanation != nil {
+				got = *fn.FunctionExplanation
+			}
+			t.Errorf("'%s': expected the explanation '%s', got '%s'", query, expected, got)
+		}
+	}
+}
+
+func Test_StructTags(t *testing.T) {
+	type Address struct {
+		Street string `json:"street"`
+		City   string `yaml:"town" json:"city"`
+	}
+
+	type Contact struct {
+		Name string
+	}
+
+	type Other struct {
+		Name string
+	}
+
+	type Tagged struct {
+		*Address
+		Contact
+		Other
+
+		ID       int    `mpath:"id" json:"consignment_id"`
+		Secret   string `mpath:"-" json:"secret"`
+		Ignored  string `json:"-"`
+		Weight   int    `json:"weight,omitempty"`
+		Code     string `mpath:",omitempty" json:"consignment_code"`
+		internal string
+	}
+
+	data := Tagged{
+		Address: &Address{Street: "1 Main St", City: "Sydney"},
+		ID:      7,
+		Secret:  "hidden",
+		Ignored: "ignored",
+		Weight:  12,
+		Code:    "ABC",
+	}
+
+	tests := []struct {
+		query     string
+		expect    any
+		expectErr bool
+	}{
+		{query: "$.id", expect: decimal.NewFromInt(7)},
+		{query: "$.ID", expect: decimal.NewFromInt(7)},
+		{query: "$.consignment_id", expectErr: true},
+		{query: "$.secret", expectErr: true},
+		{query: "$.Secret", expectErr: true},
+		{query: "$.Ignored", expectErr: true},
+		{query: "$.weight", expect: decimal.NewFromInt(12)},
+		{query: "$.street", expect: "1 Main St"},
+		{query: "$.city", expect: "Sydney"},
+		{query: "$.internal", expectErr: true},
+		// Contact.Name and Other.Name are at the same depth, so neither is promoted
+		{query: "$.Name", expectErr: true},
+		{query: "$.Contact.Name", expect: ""},
+		// An mpath tag with no name names the field by its Go name
+		{query: "$.Code", expect: "ABC"},
+		{query: "$.consignment_code", expectErr: true},
+	}
+
+	for _, test := range tests {
+		op, err := ParseString(test.query)
+		if err != nil {
+			t.Fatalf("failed to parse '%s': %v", test.query, err)
+		}
+
+		out, err := op.Do(data, data)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("'%s': expected error, got %v", test.query, out)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("'%s': got unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.expect) {
+			t.Errorf("'%s': expected %v, got %v", test.query, test.expect, out)
+		}
+	}
+
+	// Fields of a nil embedded pointer are not found
+	op, _ := ParseString("$.street")
+	if _, err := op.Do(Tagged{}, Tagged{}); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound for nil embedded struct, got: %v", err)
+	}
+
+	// The precedence can be set for each evaluation, including of a plan
+	op, _ = ParseString("$.town")
+	opts := EvalOptions{StructTags: []string{"yaml", "json"}}
+	if out, err := DoContext(context.Background(), op, data, opts); err != nil || out != "Sydney" {
+		t.Errorf("expected yaml tag from the options to name the field; got %v (%v)", out, err)
+	}
+
+	plan, err := Compile(op)
+	if err != nil {
+		t.Fatalf("failed to compile query: %v", err)
+	}
+
+	if out, err := plan.DoContext(context.Background(), data, opts); err != nil || out != "Sydney" {
+		t.Errorf("expected yaml tag from the options to name the field of a plan; got %v (%v)", out, err)
+	}
+
+	if _, err := plan.Do(data); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected the plan to use the default precedence without options, got: %v", err)
+	}
+
+	op, _ = ParseString("$.consignment_code")
+	if out, err := DoContext(context.Background(), op, data, EvalOptions{StructTags: []string{"json"}}); err != nil || out != "ABC" {
+		t.Errorf("expected json tag from the options to name the field; got %v (%v)", out, err)
+	}
+
+	// Changing the default precedence changes which tag names the field
+	SetStructTagPrecedence("yaml", "json")
+	defer SetStructTagPrecedence(defaultStructTagPrecedence...)
+
+	op, _ = ParseString("$.town")
+	if out, err := op.Do(data, data); err != nil || out != "Sydney" {
+		t.Errorf("expected yaml tag to name the field; got %v (%v)", out, err)
+	}
+}
+
+func Test_Compile(t *testing.T) {
+	t.Parallel()
+
+	var dataAsMap map[string]any
+	var dataAsStruct TestDataStruct
+
+	if err := json.Unmarshal([]byte(jsn), &dataAsMap); err != nil {
+		t.Fatalf("got unexpected json marshal error: %v", err)
+	}
+
+	if err := json.Unmarshal([]byte(jsn), &dataAsStruct); err != nil {
+		t.Fatalf("got unexpected json marshal error: %v", err)
+	}
+
+	for _, test := range testQueries {
+		op, err := ParseString(test.Query)
+		if err != nil {
+			t.Errorf("'%s' has error: %v", test.Name, err)
+			continue
+		}
+
+		plan, err := Compile(op)
+		if err != nil {
+			t.Errorf("'%s' got error from Compile(): %v", test.Name, err)
+			continue
 		}
 
-		for i, fpWanted := range test.ExpectedAddressedPaths {
-			fpGot := addressedPaths[i]
-			if len(fpWanted) != len(fpGot) {
-				t.Errorf("'%s': got bad addressedPaths length at index %d: wanted: %d; got: %d", test.Name, i, len(fpWanted), len(fpGot))
-				gotError = true
+		// Each plan is run more than once so that the cached values are used
+		for _, data := range []any{dataAsMap, dataAsStruct, dataAsStruct} {
+			want, wantErr := op.Do(data, data)
+			got, gotErr := plan.Do(data)
+
+			if (wantErr == nil) != (gotErr == nil) {
+				t.Errorf("'%s': compiled plan returned error '%v'; wanted '%v'", test.Name, gotErr, wantErr)
 				continue
 			}
 
-			for ii, fpWI := range fpWanted {
-				fpGI := fpGot[ii]
-
-				if fpGI != fpWI {
-					gotError = true
-					t.Errorf("'%s': wrong addressedPaths value at index %d: wanted: '%s'; got: '%s'", test.Name, ii, fpWI, fpGI)
-				}
+			if !reflect.DeepEqual(want, got) {
+				t.Errorf("'%s': compiled plan returned %v; wanted %v", test.Name, got, want)
 			}
 		}
+	}
 
-	Error:
-		if gotError {
-			for _, w := range test.ExpectedAddressedPaths {
-				t.Errorf("'%s': wanted: %v", test.Name, w)
-			}
-			for _, g := range addressedPaths {
-				t.Errorf("'%s': got: %v", test.Name, g)
+	// A plan can be run from many goroutines at once
+	op, err := ParseString(`{AND,$.list[@.name.DoesMatchRegex("^[A-Z]")].Any(),$.struct.field1.Equal("abcDEF")}`)
+	if err != nil {
+		t.Fatalf("failed to parse query: %v", err)
+	}
+
+	plan, err := Compile(op)
+	if err != nil {
+		t.Fatalf("failed to compile query: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if out, err := plan.Do(dataAsStruct); err != nil || out != true {
+				t.Errorf("expected true from concurrent plan, got %v (%v)", out, err)
 			}
-		}
+		}()
 	}
-}
+	wg.Wait()
 
-func Test_ParseErrors(t *testing.T) {
-	t.Parallel()
+	op, err = ParseString(`$.string.DoesMatchRegex("[a-z")`)
+	if err != nil {
+		t.Fatalf("failed to parse query: %v", err)
+	}
 
-	tests := []struct {
-		Name              string
-		Query             string
-		ExpectErrorString string
-	}{
-		{
-			Name:              "opPath access root in filter",
-			Query:             `$.x[$.a.Equal("b")]`,
-			ExpectErrorString: "cannot use '$' (root) inside filter: error at line 1 col 6: invalid next character '$': must be '@'",
-		},
+	if _, err = Compile(op); err == nil {
+		t.Errorf("expected error compiling invalid regular expression")
 	}
 
-	// We need only test that the Sprint doesn't throw an error
-	for _, test := range tests {
-		op, err := ParseString(test.Query)
-		if err == nil {
-			t.Errorf("%s: expected error, got none", test.Name)
-			continue
-		}
-		if err.Error() != test.ExpectErrorString {
-			t.Errorf("%s: got wrong error string; wanted '%s', got: '%s'", test.Name, test.ExpectErrorString, err.Error())
-			continue
-		}
-		if op != nil {
-			t.Errorf("%s: expected nil op", test.Name)
+	// Patterns that are only known at run time do not grow the plan without limit
+	op, err = ParseString(`$.value.DoesMatchRegex($.pattern)`)
+	if err != nil {
+		t.Fatalf("failed to parse query: %v", err)
+	}
+
+	plan, err = Compile(op)
+	if err != nil {
+		t.Fatalf("failed to compile query: %v", err)
+	}
+
+	for i := 0; i < DefaultPlanCacheSize+10; i++ {
+		data := map[string]any{"value": "a1", "pattern": fmt.Sprintf("^a%d$", i)}
+		if out, err := plan.Do(data); err != nil || out != (i == 1) {
+			t.Fatalf("pattern %d: got %v (%v)", i, out, err)
 		}
 	}
+
+	if stats := plan.regexps.Stats(); stats.Size != DefaultPlanCacheSize || stats.Evictions != 10 {
+		t.Errorf("expected the plan to keep %d regular expressions, got %+v", DefaultPlanCacheSize, stats)
+	}
 }
 
-func Test_ManualMap(t *testing.T) {
+func Test_Variables(t *testing.T) {
 	t.Parallel()
 
-	query := "$.x.Multiply(12.146)"
+	data := map[string]any{"weight": 10, "rate": 2}
 
-	data := map[string]any{
-		"x": 10,
+	op, err := ParseString("$.weight.Multiply(#rate)")
+	if err != nil {
+		t.Fatalf("failed to parse query: %v", err)
 	}
 
-	op, err := ParseString(query)
+	out, err := DoWithVariables(op, data, map[string]any{"rate": 1.5})
+	if err != nil {
+		t.Fatalf("failed to do query: %v", err)
+	}
+	if d, ok := out.(decimal.Decimal); !ok || !d.Equal(decimal.NewFromInt(15)) {
+		t.Errorf("expected 15, got %v", out)
+	}
 
+	if _, err = op.Do(data, data); !errors.Is(err, ErrVariableNotFound) {
+		t.Errorf("expected ErrVariableNotFound, got: %v", err)
+	}
+
+	// Variables declared in the query take precedence over those passed in
+	op, err = ParseString("#rate = $.rate; $.weight.Multiply(#rate)")
 	if err != nil {
-		t.Fatalf("Failed to parse string: %s", err)
+		t.Fatalf("failed to parse query: %v", err)
 	}
 
-	_, err = op.Do(data, data)
+	out, err = DoWithVariables(op, data, map[string]any{"rate": 1.5})
+	if err != nil {
+		t.Fatalf("failed to do query: %v", err)
+	}
+	if d, ok := out.(decimal.Decimal); !ok || !d.Equal(decimal.NewFromInt(20)) {
+		t.Errorf("expected 20, got %v", out)
+	}
 
+	// The pretty printed query must parse to the same query
+	reparsed, err := ParseString(op.Sprint(0))
 	if err != nil {
-		t.Fatalf("Failed to do mpath: %s", err)
+		t.Fatalf("failed to parse printed query: %v", err)
+	}
+	if reparsed.Sprint(0) != op.Sprint(0) {
+		t.Errorf("printed query changed after parsing; was %s, got %s", op.Sprint(0), reparsed.Sprint(0))
+	}
+
+	for _, query := range []string{
+		"#rate = $.rate; #rate = $.weight; $.weight.Multiply(#rate)",
+		"#rate = $.rate $.weight.Multiply(#rate)",
+		"#rate = $.rate;",
+		"$.weight; #rate = $.rate",
+	} {
+		if _, err := ParseString(query); err == nil {
+			t.Errorf("expected error parsing '%s', got none", query)
+		}
 	}
 }
 
-func Test_DecimalAtRoot(t *testing.T) {
+func Test_DoContext(t *testing.T) {
 	t.Parallel()
 
-	const testName = "Test_DecimalAtRoot"
+	items := []any{}
+	for i := 0; i < 100; i++ {
+		items = append(items, map[string]any{"id": i, "tags": []any{"a", "b"}})
+	}
+	data := map[string]any{"items": items}
 
-	data := float64(40)
-	op, err := ParseString("$")
+	const query = `$.items[@.id.Less(50)].Select("$.tags")`
+	op, err := ParseString(query)
 	if err != nil {
-		t.Errorf("'%s' has error: %v,", testName, err)
-		return
+		t.Fatalf("failed to parse query: %v", err)
 	}
 
-	dataToUse, err := op.Do(data, data)
+	if out, err := DoContext(context.Background(), op, data, EvalOptions{}); err != nil {
+		t.Errorf("got unexpected error: %v", err)
+	} else if l := len(out.([]any)); l != 100 {
+		t.Errorf("expected 100 tags, got %d", l)
+	}
+
+	var stepErr *StepLimitError
+	if _, err := DoContext(context.Background(), op, data, EvalOptions{MaxSteps: 50}); !errors.As(err, &stepErr) {
+		t.Errorf("expected StepLimitError, got: %v", err)
+	}
+
+	var sizeErr *CollectionSizeLimitError
+	if _, err := DoContext(context.Background(), op, data, EvalOptions{MaxCollectionSize: 60}); !errors.As(err, &sizeErr) {
+		t.Errorf("expected CollectionSizeLimitError, got: %v", err)
+	} else if sizeErr.Limit != 60 {
+		t.Errorf("expected limit of 60, got %d", sizeErr.Limit)
+	}
+
+	var depthErr *DepthLimitError
+	if _, err := DoContext(context.Background(), op, data, EvalOptions{MaxDepth: 3}); !errors.As(err, &depthErr) {
+		t.Errorf("expected DepthLimitError, got: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DoContext(ctx, op, data, EvalOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+
+	// Cancelling part way through a filter stops the evaluation
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	reg := NewFunctionRegistry()
+	err = reg.Register(FunctionDescriptor{
+		Name:    "CancelEvaluation",
+		ValidOn: inputOrOutput(PT_Any, IOOT_Single),
+		Returns: inputOrOutput(PT_Boolean, IOOT_Single),
+		Fn: func(rtParams FunctionParameterTypes, val any) (any, error) {
+			calls++
+			cancel()
+			return true, nil
+		},
+	})
 	if err != nil {
-		t.Errorf("'%s' got error from Do(): %v", testName, err)
-		return
+		t.Fatalf("failed to register function: %v", err)
 	}
 
-	if d, ok := dataToUse.(decimal.Decimal); ok {
-		t.Logf("value was float and was %s", d)
-	} else {
-		t.Error("wasn't decimal.Decimal")
+	op, err = reg.ParseString(`$.items[@.id.CancelEvaluation()]`)
+	if err != nil {
+		t.Fatalf("failed to parse query: %v", err)
+	}
+
+	if _, err := DoContext(ctx, op, data, EvalOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected evaluation to stop after 1 call, got %d", calls)
 	}
 }
 
-func Test_CustomStringTypeMap(t *testing.T) {
+func Test_FunctionRegistry(t *testing.T) {
 	t.Parallel()
 
-	const outStrConst = "hello world"
-	data := map[CustomStringTypeForTest]any{"varname": outStrConst}
-	queryString := "$.varname"
+	reg := NewFunctionRegistry()
 
-	op, err := ParseString(queryString)
+	freightRate := FunctionDescriptor{
+		Name:        "FreightRate",
+		Description: "Multiplies the weight by the rate per kilogram",
+		Params:      singleParam("rate", PT_Number, IOOT_Single),
+		ValidOn:     inputOrOutput(PT_Number, IOOT_Single),
+		Returns:     inputOrOutput(PT_Number, IOOT_Single),
+		Fn: func(rtParams FunctionParameterTypes, val any) (any, error) {
+			weight, ok := val.(decimal.Decimal)
+			if !ok {
+				return nil, fmt.Errorf("weight was not a number")
+			}
+
+			rate := rtParams.Numbers()
+			if len(rate) != 1 {
+				return nil, fmt.Errorf("expected a single rate")
+			}
+
+			return weight.Mul(rate[0].Value), nil
+		},
+	}
+
+	if err := reg.Register(freightRate); err != nil {
+		t.Fatalf("failed to register function: %v", err)
+	}
+
+	if err := reg.Register(freightRate); !errors.Is(err, ErrFunctionAlreadyRegistered) {
+		t.Errorf("expected ErrFunctionAlreadyRegistered, got: %v", err)
+	}
+
+	if err := reg.Register(FunctionDescriptor{Name: FT_Equal, Fn: freightRate.Fn, ValidOn: freightRate.ValidOn, Returns: freightRate.Returns}); !errors.Is(err, ErrFunctionAlreadyRegistered) {
+		t.Errorf("expected ErrFunctionAlreadyRegistered for built in function, got: %v", err)
+	}
+
+	invalid := freightRate
+	invalid.Name = "BadParams"
+	invalid.Params = append(singleParam("rates", PT_Number, IOOT_Variadic), singleParam("currency", PT_String, IOOT_Single)...)
+	if err := reg.Register(invalid); !errors.Is(err, ErrInvalidFunctionDescriptor) {
+		t.Errorf("expected ErrInvalidFunctionDescriptor for non-final variadic, got: %v", err)
+	}
+
+	invalid.Params = singleParam("rate", PT_ParameterType("Decimal"), IOOT_Single)
+	if err := reg.Register(invalid); !errors.Is(err, ErrInvalidFunctionDescriptor) {
+		t.Errorf("expected ErrInvalidFunctionDescriptor for unknown parameter type, got: %v", err)
+	}
+
+	for reason, change := range map[string]func(fd *FunctionDescriptor){
+		"duplicate parameter names": func(fd *FunctionDescriptor) {
+			fd.Params = append(singleParam("rate", PT_Number, IOOT_Single), singleParam("rate", PT_Number, IOOT_Single)...)
+		},
+		"missing Fn": func(fd *FunctionDescriptor) {
+			fd.Fn = nil
+		},
+		"unknown ValidOn io type": func(fd *FunctionDescriptor) {
+			fd.ValidOn = inputOrOutput(PT_Number, IOOT_InputOrOutputType("Many"))
+		},
+		"unknown Returns io type": func(fd *FunctionDescriptor) {
+			fd.Returns = inputOrOutput(PT_Number, IOOT_InputOrOutputType(""))
+		},
+		"required parameter after optional parameter": func(fd *FunctionDescriptor) {
+			fd.Params = append(singleParam("rate (optional)", PT_Number, IOOT_Single), singleParam("currency", PT_String, IOOT_Single)...)
+		},
+	} {
+		fd := freightRate
+		fd.Name = "Invalid"
+		change(&fd)
+		if err := reg.Register(fd); !errors.Is(err, ErrInvalidFunctionDescriptor) {
+			t.Errorf("expected ErrInvalidFunctionDescriptor for %s, got: %v", reason, err)
+		}
+	}
+
+	optional := freightRate
+	optional.Name = "FreightRateIn"
+	optional.Params = append(singleParam("rate", PT_Number, IOOT_Single), singleParam("currency (optional)", PT_String, IOOT_Single)...)
+	if err := reg.Register(optional); err != nil {
+		t.Errorf("expected optional parameters after required parameters to be valid, got: %v", err)
+	}
+
+	data := map[string]any{"weight": 10}
 
+	op, err := reg.ParseString("$.weight.FreightRate(1.5)")
 	if err != nil {
-		t.Errorf("failed to parse query: %s", err)
+		t.Fatalf("failed to parse query: %v", err)
 	}
 
 	out, err := op.Do(data, data)
+	if err != nil {
+		t.Fatalf("failed to do query: %v", err)
+	}
+
+	if d, ok := out.(decimal.Decimal); !ok || !d.Equal(decimal.NewFromInt(15)) {
+		t.Errorf("expected 15, got %v", out)
+	}
 
+	// The queries run by functions such as Select are parsed by the same
+	// registry, whether the operation is run directly, with DoContext or as a
+	// plan
+	items := map[string]any{"items": []any{map[string]any{"weight": 2}, map[string]any{"weight": 4}}}
+	subOp, err := reg.ParseString(`$.items.Select("@.weight.FreightRate(2)").Sum()`)
 	if err != nil {
-		t.Errorf("failed to do mpath: %s", err)
+		t.Fatalf("failed to parse query with a subquery: %v", err)
 	}
 
-	outStr, ok := out.(string)
-	if !ok {
-		t.Error("out was not a string")
+	plan, err := Compile(subOp)
+	if err != nil {
+		t.Fatalf("failed to compile query with a subquery: %v", err)
 	}
 
-	if outStr != outStrConst {
-		t.Errorf("outStr was wrong; expected: '%s', got '%s'", outStrConst, outStr)
+	for name, run := range map[string]func() (any, error){
+		"Do":        func() (any, error) { return subOp.Do(items, items) },
+		"DoContext": func() (any, error) { return DoContext(context.Background(), subOp, items, EvalOptions{}) },
+		"Plan":      func() (any, error) { return plan.Do(items) },
+	} {
+		out, err := run()
+		if err != nil {
+			t.Errorf("%s: failed to run the custom function in a subquery: %v", name, err)
+			continue
+		}
+
+		if d, ok := out.(decimal.Decimal); !ok || !d.Equal(decimal.NewFromInt(12)) {
+			t.Errorf("%s: expected 12, got %v", name, out)
+		}
+	}
+
+	if defaultOp, err := ParseString("$.weight.FreightRate(1.5)"); err != nil {
+		t.Errorf("failed to parse query with default registry: %v", err)
+	} else if _, err := defaultOp.Do(data, data); err == nil {
+		t.Errorf("expected the default registry not to know about FreightRate")
+	}
+
+	if _, ok := reg.ListFunctions()["FreightRate"]; !ok {
+		t.Errorf("expected ListFunctions to include FreightRate")
+	}
+
+	if _, ok := ListFunctions()["FreightRate"]; ok {
+		t.Errorf("expected package ListFunctions not to include FreightRate")
+	}
+
+	if names := getAvailableFunctionsForKind(reg, inputOrOutput(PT_Number, IOOT_Single)); !strInStrSlice("FreightRate", names) {
+		t.Errorf("expected FreightRate to be available for numbers; got %v", names)
+	}
+
+	tc, err := reg.CueValidate("$.weight.FreightRate(1.5)", `weight: int`, "")
+	if err != nil {
+		t.Fatalf("failed to validate query: %v", err)
+	}
+
+	if tc.HasErrors() {
+		t.Errorf("expected no validation errors, got: %s", tc.GetErrors())
 	}
 }
 
@@ -423,6 +2916,103 @@ var (
 				[]string{"bool"},
 			},
 		},
+		{
+			Name:               "Variable as function parameter",
+			Query:              `#total = $.numbers.Sum(); $.number.Add(#total)`,
+			Expect_decimal:     decimal.NewFromFloat(8146),
+			ExpectedResultType: RT_decimal,
+			ExpectedRootFields: []string{"number", "numbers"},
+			ExpectedAddressedPaths: [][]string{
+				[]string{"numbers"},
+				[]string{"number"},
+			},
+		},
+		{
+			Name:               "Variable as path root",
+			Query:              `#first = $.list.First(); #first.name`,
+			Expect_string:      "Bruce Whitney",
+			ExpectedResultType: RT_string,
+			ExpectedRootFields: []string{"list"},
+			ExpectedAddressedPaths: [][]string{
+				[]string{"list"},
+			},
+		},
+		{
+			Name:               "Variable in filter",
+			Query:              `#id = $.index.Subtract(5); $.list[@.id.Equal(#id)].First().name`,
+			Expect_string:      "Gladys Daugherty",
+			ExpectedResultType: RT_string,
+			ExpectedRootFields: []string{"index", "list"},
+			ExpectedAddressedPaths: [][]string{
+				[]string{"index"},
+				[]string{"list", "id"},
+				[]string{"list", "name"},
+			},
+		},
+		{
+			Name:               "Variable referring to earlier variable",
+			Query:              `#a = $.number; #b = #a.Add(1); {AND,#b.Equal(1235),$.bool}`,
+			Expect_bool:        true,
+			ExpectedResultType: RT_bool,
+			ExpectedRootFields: []string{"bool", "number"},
+			ExpectedAddressedPaths: [][]string{
+				[]string{"number"},
+				[]string{"bool"},
+			},
+		},
+		{
+			Name:               "Logical operation as variable",
+			Query:              `#isBig = {$.number.Greater(1000)}; {AND,#isBig,$.bool}`,
+			Expect_bool:        true,
+			ExpectedResultType: RT_bool,
+			ExpectedRootFields: []string{"bool", "number"},
+			ExpectedAddressedPaths: [][]string{
+				[]string{"number"},
+				[]string{"bool"},
+			},
+		},
+		{
+			Name:               "Tagged struct field",
+			Query:              `$.consignment_number`,
+			Expect_string:      "CN-1001",
+			ExpectedResultType: RT_string,
+			ExpectedRootFields: []string{"consignment_number"},
+			ExpectedAddressedPaths: [][]string{
+				[]string{"consignment_number"},
+			},
+		},
+		{
+			Name:               "Embedded struct field",
+			Query:              `$.carrier.Equal("Fast Freight")`,
+			Expect_bool:        true,
+			ExpectedResultType: RT_bool,
+			ExpectedRootFields: []string{"carrier"},
+			ExpectedAddressedPaths: [][]string{
+				[]string{"carrier"},
+			},
+		},
+		{
+			Name:               "Infix comparisons",
+			Query:              `$.number >= 1000 && !($.string == "abc" || $.numbers.Sum() < 10)`,
+			Expect_bool:        true,
+			ExpectedResultType: RT_bool,
+			ExpectedRootFields: []string{"number", "numbers", "string"},
+			ExpectedAddressedPaths: [][]string{
+				[]string{"number"},
+				[]string{"string"},
+				[]string{"numbers"},
+			},
+		},
+		{
+			Name:               "Infix comparison in filter",
+			Query:              `$.numbers[@ > 2000].Count() == 1`,
+			Expect_bool:        true,
+			ExpectedResultType: RT_bool,
+			ExpectedRootFields: []string{"numbers"},
+			ExpectedAddressedPaths: [][]string{
+				[]string{"numbers"},
+			},
+		},
 		{
 			Name:               "Sum numbers alone",
 			Query:              `$.numbers.Sum()`,
@@ -1429,15 +4019,8 @@ var (
 	}
 )
 
-type ResultType string
-
-const (
-	RT_string  ResultType = "string"
-	RT_decimal ResultType = "decimal"
-	RT_bool    ResultType = "bool"
-	RT_array   ResultType = "array"
-	RT_error   ResultType = "error"
-)
+// RT_error is used by the tests to expect an error rather than a result
+const RT_error ResultType = "error"
 
 type CustomStringTypeForTest string
 
@@ -1460,6 +4043,8 @@ var jsn = `
 	  "toml": "consignmentID = 112_360\nconsignmentName = \"Test consignment\"\n"
 	},
 	"isNull": null,
+	"consignment_number": "CN-1001",
+	"carrier": "Fast Freight",
 	"emptyArray": [],	
 	"emptyString": "",
 	"emptyObject": {},
@@ -1556,7 +4141,14 @@ var jsn = `
   }
 `
 
+type TestDataEmbedded struct {
+	Carrier string `json:"carrier"`
+}
+
 type TestDataStruct struct {
+	TestDataEmbedded
+	ConsignmentNumber string `json:"consignment_number"`
+
 	Report_Generator struct {
 		Result []struct {
 			Ext  string `json:"ext"`
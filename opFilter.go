@@ -42,13 +42,22 @@ func (x *opFilter) Sprint(depth int) (out string) {
 }
 
 func (x *opFilter) Do(currentData, originalData any) (dataToUse any, err error) {
+	return x.do(evaluationFor(x), currentData, originalData)
+}
+
+func (x *opFilter) do(ev *evaluation, currentData, originalData any) (dataToUse any, err error) {
+	if err = ev.enter(); err != nil {
+		return nil, err
+	}
+	defer ev.leave()
+
 	val, ok, wasStruct := getAsStructOrSlice(currentData)
 	if !ok {
 		return nil, fmt.Errorf("value was not object or array and cannot be filtered")
 	}
 
 	if wasStruct {
-		res, err := x.LogicalOperation.Do(val, originalData)
+		res, err := x.LogicalOperation.do(ev, val, originalData)
 		if err != nil {
 			return nil, err
 		}
@@ -61,13 +70,20 @@ func (x *opFilter) Do(currentData, originalData any) (dataToUse any, err error)
 
 	newOut := []any{}
 	for _, v := range val.([]any) {
-		res, err := x.LogicalOperation.Do(v, originalData)
+		if err := ev.cancelled(); err != nil {
+			return nil, err
+		}
+
+		res, err := x.LogicalOperation.do(ev, v, originalData)
 		if err != nil {
 			return nil, err
 		}
 
 		if res.(bool) {
 			newOut = append(newOut, v)
+			if err := ev.checkCollectionSize(len(newOut)); err != nil {
+				return nil, err
+			}
 		}
 
 	}
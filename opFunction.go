@@ -3,9 +3,9 @@ package mpath
 import (
 	"encoding/json"
 	"fmt"
-	"strconv"
 	"strings"
 	sc "text/scanner"
+	"time"
 
 	"cuelang.org/go/cue"
 	"github.com/shopspring/decimal"
@@ -18,9 +18,18 @@ type opFunction struct {
 
 	Params FunctionParameterTypes
 	opCommon
+
+	// calledOnRoot is set when the function is called on the root (e.g.
+	// $.Coalesce($.a, $.b)) rather than on a value
+	calledOnRoot bool
+	registry     *FunctionRegistry
 }
 
-func (x *opFunction) Validate(rootValue cue.Value, cuePath CuePath, previousType InputOrOutput, blockedRootFields []string) (part *Function, returnedType InputOrOutput, returnsKnownValues bool, err error) {
+// Validate validates the function against the value at the cue path;
+// cueDescribesValue is false if the cue at the path does not describe the
+// value that the function is called on, as it was returned by an earlier
+// function
+func (x *opFunction) Validate(rootValue cue.Value, cuePath CuePath, previousType InputOrOutput, cueDescribesValue bool, blockedRootFields []string) (part *Function, returnedType InputOrOutput, returnsKnownValues bool, err error) {
 	cuePathValue, err := findValueAtPath(rootValue, cuePath)
 	if err != nil {
 		return &Function{
@@ -47,14 +56,14 @@ func (x *opFunction) Validate(rootValue cue.Value, cuePath CuePath, previousType
 	}
 
 	// Find the function descriptor
-	fd, ok := funcMap[x.FunctionType]
+	fd, ok := x.registry.lookup(x.FunctionType)
 	if !ok {
 		errMessage := "unknown function"
 		part.Error = &errMessage
 		return
 	}
 
-	if fd.ValidOn.IOType != IOOT_Variadic && fd.ValidOn.Type != PT_Any && fd.ValidOn.Type != previousType.Type {
+	if fd.ValidOn.IOType != IOOT_Variadic && fd.ValidOn.Type != PT_Any && !fd.ValidOn.Type.accepts(previousType.Type) {
 		errMessage := fmt.Sprintf("cannot use this function on type %s; can use on %s", previousType.Type, fd.ValidOn.Type)
 		part.Error = &errMessage
 	}
@@ -83,10 +92,19 @@ func (x *opFunction) Validate(rootValue cue.Value, cuePath CuePath, previousType
 		paramReturns := p.IsFuncParam()
 		paramReturns.CueExpr = paramReturns.Type.CueExpr()
 
+		// The body of a lambda is validated against the elements
+		paramRootValue, paramCuePath := rootValue, cuePath
+		if fd.lambda && i == len(x.Params)-1 {
+			if x.FunctionType == FT_Reduce && i > 0 {
+				paramRootValue = withAccumulator(paramRootValue, part.FunctionParameters[0].Type)
+			}
+			paramRootValue, paramCuePath = withLambdaElement(paramRootValue, cuePath)
+		}
+
 		switch t := p.(type) {
 		case *FP_Path:
 			var pathOp *Path
-			pathOp, _ = t.Value.Validate(rootValue, cuePath, blockedRootFields)
+			pathOp, _ = t.Value.Validate(paramRootValue, paramCuePath, blockedRootFields)
 			param.Part = pathOp
 			if pathOp.Error != nil {
 				param.Error = pathOp.Error
@@ -104,7 +122,7 @@ func (x *opFunction) Validate(rootValue cue.Value, cuePath CuePath, previousType
 
 		case *FP_LogicalOperation:
 			var logOp *LogicalOperation
-			logOp = t.Value.Validate(rootValue, cuePath, blockedRootFields)
+			logOp = t.Value.Validate(paramRootValue, paramCuePath, blockedRootFields)
 			param.Part = logOp
 			if logOp.Error != nil {
 				param.Error = logOp.Error
@@ -150,32 +168,50 @@ func (x *opFunction) Validate(rootValue cue.Value, cuePath CuePath, previousType
 			if paramReturns.IOType != IOOT_Single {
 				errMessage := fmt.Sprintf("incorrect parameter type: expected single value, got %s", paramReturns.IOType)
 				param.Error = &errMessage
+				continue
 			}
-			continue
 		case IOOT_Array:
 			if paramReturns.IOType != IOOT_Array {
 				errMessage := fmt.Sprintf("incorrect parameter type: expected array value, got %s", paramReturns.IOType)
 				param.Error = &errMessage
+				continue
 			}
-			continue
 		case IOOT_Variadic:
 			// Do nothing, this can accept either a single or an array value
 		}
 
-		if pd.Type != PT_Any && pd.Type != paramReturns.Type {
+		// The types of all parameters are checked, so that arithmetic on a
+		// string is reported before the query is run (e.g. `$.num + "1"`)
+		if pd.Type != PT_Any && paramReturns.Type != PT_Any && !pd.Type.accepts(paramReturns.Type) {
 			// This means that the parameter does not accept "Any" type and the returned type is wrong for the expected input
 			errMessage := fmt.Sprintf("incorrect parameter type: wanted '%s'; got '%s'", pd.Type, paramReturns.Type)
 			param.Error = &errMessage
+			continue
+		}
+
+		if err := pd.Type.validateLiteral(p); err != nil {
+			errMessage := fmt.Sprintf("invalid parameter: %v", err)
+			param.Error = &errMessage
 		}
 	}
 
-	explanation := fd.explanationFunc(*part)
+	part.calledOn = fieldName(cuePath)
+	explanation := fd.ExplanationFunc(*part)
 	part.FunctionExplanation = &explanation
 
 	var k cue.Kind
 	k, _ = getUnderlyingKind(cuePathValue)
 
-	if fd.Returns.Type == PT_Any {
+	switch {
+	case fd.returnTypeFn != nil:
+		returnedType = fd.returnTypeFn(previousType, part.FunctionParameters)
+	case fd.Returns.Type != PT_Any:
+	case !cueDescribesValue:
+		if fd.ReturnsKnownValues {
+			// The elements are the same type as before
+			returnedType.Type = previousType.Type
+		}
+	default:
 		switch k {
 		// Primative Kinds:
 		case cue.BoolKind:
@@ -194,7 +230,7 @@ func (x *opFunction) Validate(rootValue cue.Value, cuePath CuePath, previousType
 	part.Type.CueExpr = fd.Returns.Type.CueExpr()
 	returnsKnownValues = fd.ReturnsKnownValues
 
-	if fd.ReturnsKnownValues && previousType.IOType == IOOT_Array && k == cue.StructKind {
+	if fd.ReturnsKnownValues && cueDescribesValue && previousType.IOType == IOOT_Array && k == cue.StructKind {
 		cuePathValue, _ = getUnderlyingValue(cuePathValue)
 
 		// We can find available fields
@@ -211,11 +247,62 @@ func (x *opFunction) Validate(rootValue cue.Value, cuePath CuePath, previousType
 			part.Error = &errMessage
 		}
 	}
-	part.Available.Functions = append(part.Available.Functions, getAvailableFunctionsForKind(returnedType)...)
+	part.Available.Functions = append(part.Available.Functions, getAvailableFunctionsForKind(x.registry, returnedType)...)
 
 	return
 }
 
+// fieldName returns the name of the field at the end of the cue path, or an
+// empty string if the path does not end in a field
+func fieldName(cuePath CuePath) string {
+	if len(cuePath) == 0 {
+		return ""
+	}
+
+	last := cuePath[len(cuePath)-1]
+	if field, ok := strings.CutPrefix(last, cuePathQuoted); ok {
+		return field
+	}
+
+	// Definitions and the segments for wildcards and recursive descents are
+	// not fields
+	if !strings.HasPrefix(last, "#") && !strings.HasPrefix(last, "\x00") {
+		return last
+	}
+
+	return ""
+}
+
+// validateIndexInRange returns an error if the function is Index with a
+// literal index that is outside of a list in the cue that has a fixed length
+func (x *opFunction) validateIndexInRange(rootValue cue.Value, cuePath CuePath) error {
+	if x.FunctionType != FT_Index || len(x.Params) != 1 {
+		return nil
+	}
+
+	index, ok := x.Params[0].(*FP_Number)
+	if !ok {
+		return nil
+	}
+
+	cuePathValue, err := findValueAtPath(rootValue, cuePath)
+	if err != nil || cuePathValue.IncompleteKind() != cue.ListKind {
+		return nil
+	}
+
+	// The length of an open list (e.g. [...int]) is not known
+	length, err := cuePathValue.Len().Int64()
+	if err != nil {
+		return nil
+	}
+
+	if idx := index.Value.IntPart(); idx >= length || idx < -length {
+		return fmt.Errorf("index %s is out of range for a list of length %d", index.Value, length)
+	}
+
+	return nil
+}
+
 func (x *opFunction) Type() OT_OpType { return OT_Function }
 
 func (x *opFunction) Sprint(depth int) (out string) {
@@ -229,13 +316,36 @@ func (x *opFunction) Sprint(depth int) (out string) {
 }
 
 func (x *opFunction) Do(currentData, originalData any) (dataToUse any, err error) {
+	return x.do(evaluationFor(x), currentData, originalData)
+}
+
+func (x *opFunction) do(ev *evaluation, currentData, originalData any) (dataToUse any, err error) {
+	if err = ev.enter(); err != nil {
+		return nil, err
+	}
+	defer ev.leave()
+
+	funcToRun, ok := x.registry.lookup(x.FunctionType)
+	if !ok {
+		return nil, fmt.Errorf("unrecognised function")
+	}
+
+	if funcToRun.lazyFn != nil {
+		// The function runs the parameters that it needs itself
+		params := lazyParameters{ev: ev, params: x.Params, currentData: currentData, originalData: originalData}
+		if x.calledOnRoot {
+			return funcToRun.lazyFn(params, nil)
+		}
+		return funcToRun.lazyFn(params, convertToDecimalIfNumber(currentData))
+	}
+
 	var rtParams FunctionParameterTypes
 
 	// get the pathParams and put them in the appropriate bucket
 	for _, param := range x.Params {
 		var ppOp Operation
 		switch t := param.(type) {
-		case *FP_Number, *FP_String, *FP_Bool:
+		case *FP_Number, *FP_String, *FP_Bool, *FP_DateTime:
 			rtParams = append(rtParams, t)
 			continue
 		case *FP_Path:
@@ -244,7 +354,7 @@ func (x *opFunction) Do(currentData, originalData any) (dataToUse any, err error
 			ppOp = t.Value
 		}
 
-		res, err := ppOp.Do(currentData, originalData)
+		res, err := ppOp.do(ev, currentData, originalData)
 		if err != nil {
 			return nil, fmt.Errorf("issue with path parameter: %w", err)
 		}
@@ -255,6 +365,13 @@ func (x *opFunction) Do(currentData, originalData any) (dataToUse any, err error
 			rtParams = append(rtParams, &FP_String{resType})
 		case bool:
 			rtParams = append(rtParams, &FP_Bool{resType})
+		case time.Time:
+			rtParams = append(rtParams, &FP_DateTime{resType})
+		case *time.Time:
+			if resType == nil {
+				return nil, fmt.Errorf("unhandled param path type: %T", resType)
+			}
+			rtParams = append(rtParams, &FP_DateTime{*resType})
 		case []decimal.Decimal:
 			for _, rt := range resType {
 				rtParams = append(rtParams, &FP_Number{rt})
@@ -288,6 +405,8 @@ func (x *opFunction) Do(currentData, originalData any) (dataToUse any, err error
 					rtParams = append(rtParams, &FP_String{pvType})
 				case bool:
 					rtParams = append(rtParams, &FP_Bool{pvType})
+				case time.Time:
+					rtParams = append(rtParams, &FP_DateTime{pvType})
 				default:
 					return nil, fmt.Errorf("unhandled param path type: %T", pv)
 				}
@@ -299,12 +418,11 @@ func (x *opFunction) Do(currentData, originalData any) (dataToUse any, err error
 
 	currentData = convertToDecimalIfNumber(currentData)
 
-	funcToRun, ok := funcMap[x.FunctionType]
-	if !ok {
-		return nil, fmt.Errorf("unrecognised function")
+	if funcToRun.evalFn != nil {
+		return funcToRun.evalFn(ev, rtParams, currentData)
 	}
 
-	return funcToRun.fn(rtParams, currentData)
+	return funcToRun.Fn(rtParams, currentData)
 }
 
 func (x *opFunction) Parse(s *scanner, r rune) (nextR rune, err error) {
@@ -312,7 +430,8 @@ func (x *opFunction) Parse(s *scanner, r rune) (nextR rune, err error) {
 		return r, erInvalid(s, '(')
 	}
 
-	x.FunctionType, err = ft_GetByName(s.TokenText())
+	x.registry = s.registry
+	x.FunctionType, err = ft_GetByName(x.registry, s.TokenText())
 	if err != nil {
 		x.IsInvalid = true
 		x.FunctionType = FT_FunctionType(s.TokenText())
@@ -323,6 +442,9 @@ func (x *opFunction) Parse(s *scanner, r rune) (nextR rune, err error) {
 	r = s.Scan()
 	x.userString += string(r)
 
+	// Move past the opening parenthesis
+	r = s.Scan()
+
 	for {
 		if r == sc.EOF {
 			break
@@ -337,59 +459,17 @@ func (x *opFunction) Parse(s *scanner, r rune) (nextR rune, err error) {
 		case ')':
 			x.userString += string(r)
 			// This is the end of the function
-			return s.Scan(), nil
-		case '$', '@':
-			// This is a path
-			if r, err = x.addOpToParamsAndParse(s, r); err != nil {
-				return r, err
+			if fd, ok := x.registry.lookup(x.FunctionType); ok && fd.lambda && len(x.Params) > 0 {
+				bindLambdaBody(paramOperation(x.Params[len(x.Params)-1]), x.FunctionType == FT_Reduce)
 			}
-			continue
-		case '{':
-			// This is a logical operation
-			if r, err = x.addLogicalOperationToParamsAndParse(s, r); err != nil {
+			return s.Scan(), nil
+		case '$', '@', '#', '{', '!', '(', sc.String, sc.RawString, sc.Char, sc.Float, sc.Int, sc.Ident:
+			// This is a literal, a path or a logical operation, any of which
+			// may be the start of an expression
+			if r, err = x.addExpressionToParamsAndParse(s, r); err != nil {
 				return r, err
 			}
 			continue
-		case sc.String, sc.RawString, sc.Char:
-			tt := s.TokenText()
-			x.userString += string(tt)
-
-			if len(tt) >= 2 && strings.HasPrefix(tt, `"`) && strings.HasSuffix(tt, `"`) {
-				tt = tt[1 : len(tt)-1]
-			}
-			tt = unescape(tt)
-			x.Params = append(x.Params, &FP_String{tt})
-		case sc.Float, sc.Int:
-			// tt := s.TokenText()
-			// x.userString += string(tt)
-
-			// f, err := strconv.ParseFloat(tt, 64)
-			// if err != nil {
-			// 	// This should not be possible, but handle it just in case
-			// 	return r, erAt(s, "couldn't convert number as string '%s' to number", s.TokenText())
-			// }
-			// x.Params = append(x.Params, &FP_Number{decimal.NewFromFloat(f)})
-			r, err = dealWithNumbers(s, x, r)
-			if err != nil {
-				return r, erInvalid(s)
-			}
-		case sc.Ident:
-
-			//must be bool
-			tt := s.TokenText()
-			switch tt {
-			case "true":
-				x.userString += tt
-				x.Params = append(x.Params, &FP_Bool{true})
-			case "false":
-				x.userString += tt
-				x.Params = append(x.Params, &FP_Bool{false})
-			default:
-				r, err = dealWithNumbers(s, x, r)
-				if err != nil {
-					return r, erInvalid(s)
-				}
-			}
 		}
 		r = s.Scan()
 	}
@@ -445,45 +525,36 @@ func isRuneInString(c rune, s string) bool {
 	return false
 }
 
-func dealWithNumbers(s *scanner, x *opFunction, r rune) (rune, error) {
-	tt := s.TokenText()
-
-	// peek the scanner to see if the next character is a dot
-	if pk := s.sx.Peek(); pk == '.' {
-		// this should be a decimal
-		s.Scan() // scan the dot
-		pk = s.sx.Peek()
-		if isRuneInString(pk, "0123456789") {
-			s.Scan() // move to the next token, should be the remainder of the number
-			ttk := s.TokenText()
-			tt += "." + ttk
-		}
+func (x *opFunction) addExpressionToParamsAndParse(s *scanner, r rune) (nextR rune, err error) {
+	p := &exprParser{s: s}
+	o, nextR, err := p.parseLogical(r, nil, "||")
+	if err != nil {
+		return nextR, err
 	}
 
-	x.userString += string(tt)
+	// Literals are passed as they are, and arithmetic on numbers has been
+	// done as the query was parsed, e.g. `Add(1 + 2)` is `Add(3)`
+	if o.isLiteral() {
+		if o.isNull {
+			return nextR, erAt(s, "null cannot be used as a parameter")
+		}
+		x.Params = append(x.Params, o.literal)
+		x.userString += o.literalText
 
-	f, err := strconv.ParseFloat(tt, 64)
-	if err != nil {
-		// This should not be possible, but handle it just in case
-		return r, erAt(s, "couldn't convert number as string '%s' to number", s.TokenText())
+		return nextR, nil
 	}
-	x.Params = append(x.Params, &FP_Number{decimal.NewFromFloat(f)})
-	return r, nil
-}
 
-func (x *opFunction) addOpToParamsAndParse(s *scanner, r rune) (nextR rune, err error) {
-	op := &opPath{}
-	x.Params = append(x.Params, &FP_Path{op})
-	nextR, err = op.Parse(s, r)
+	op := o.op
+	switch t := op.(type) {
+	case *opPath:
+		x.Params = append(x.Params, &FP_Path{t})
+	case *opLogicalOperation:
+		x.Params = append(x.Params, &FP_LogicalOperation{t})
+	default:
+		return nextR, erAt(s, "objects and arrays cannot be used as parameters")
+	}
 	x.userString += op.UserString()
-	return
-}
 
-func (x *opFunction) addLogicalOperationToParamsAndParse(s *scanner, r rune) (nextR rune, err error) {
-	op := &opLogicalOperation{}
-	x.Params = append(x.Params, &FP_LogicalOperation{op})
-	nextR, err = op.Parse(s, r)
-	x.userString += op.UserString()
 	return
 }
 
@@ -599,6 +670,26 @@ func (x *FP_Bool) MarshalJSON() ([]byte, error) {
 	return functionParameterMarshalJSON(x.Value, "Bool")
 }
 
+// FP_DateTime is only used for the results of path parameters, as dates
+// cannot be written in a query
+type FP_DateTime struct {
+	Value time.Time
+}
+
+func (p FP_DateTime) String() string {
+	return fmt.Sprintf(`"%s"`, p.Value.Format(time.RFC3339Nano))
+}
+
+func (x *FP_DateTime) IsFuncParam() (returns InputOrOutput) {
+	return inputOrOutput(PT_DateTime, IOOT_Single)
+}
+
+func (x *FP_DateTime) GetValue() any { return x.Value }
+
+func (x *FP_DateTime) MarshalJSON() ([]byte, error) {
+	return functionParameterMarshalJSON(x.Value, "DateTime")
+}
+
 type FP_Path struct {
 	Value *opPath
 }
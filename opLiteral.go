@@ -0,0 +1,378 @@
+package mpath
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	sc "text/scanner"
+	"unicode"
+
+	"cuelang.org/go/cue"
+	"github.com/pkg/errors"
+)
+
+// opLiteral builds an object or an array from the values of its members, e.g.
+// { "ref": $.consignmentNumber, "kg": $.items.Select("$.weight").Sum() } or
+// [$.pickupDate, $.deliveryDate]
+type opLiteral struct {
+	IsArray bool
+	Members []*literalMember
+	opCommon
+
+	registry *FunctionRegistry
+}
+
+// literalMember is a field of an object literal or an element of an array
+// literal
+type literalMember struct {
+	// Key is the name of the field; it is empty for the elements of arrays
+	Key string
+
+	// Operation is nil if the member is a literal value, which is held in
+	// Value (or neither, for null)
+	Operation Operation
+	Value     FunctionParameterType
+}
+
+var (
+	objectLiteralRegexp = regexp.MustCompile(`^\s*(}|"(?:[^"\\]|\\.)*"\s*:)`)
+	literalValueRegexp  = regexp.MustCompile(`^(\.\d+)?\s*[,}\]]`)
+)
+
+// isObjectLiteralAhead returns whether the '{' that was just scanned is the
+// start of an object literal (which starts with a quoted key, or is empty)
+// rather than a logical operation
+func isObjectLiteralAhead(s *scanner) bool {
+	return objectLiteralRegexp.MatchString(s.source[min(s.sx.Pos().Offset, len(s.source)):])
+}
+
+// isLiteralValueAhead returns whether the token that was just scanned is a
+// literal value on its own, rather than the start of an expression
+func isLiteralValueAhead(s *scanner, r rune) bool {
+	switch {
+	case r == sc.String, r == sc.RawString, r == sc.Char:
+	case r == sc.Ident && isLiteralIdent(s.TokenText()):
+	default:
+		return false
+	}
+
+	return literalValueRegexp.MatchString(s.source[min(s.sx.Pos().Offset, len(s.source)):])
+}
+
+func (m *literalMember) String() string {
+	switch {
+	case m.Operation != nil:
+		return m.Operation.UserString()
+	case m.Value != nil:
+		return m.Value.String()
+	}
+
+	return "null"
+}
+
+func (m *literalMember) sprint(depth int) string {
+	if m.Operation != nil {
+		return strings.TrimLeft(m.Operation.Sprint(depth), "\t")
+	}
+
+	return m.String()
+}
+
+func (x *opLiteral) Validate(rootValue cue.Value, cuePath CuePath, blockedRootFields []string) (literal *Literal, value cue.Value) {
+	ctx := rootValue.Context()
+
+	literal = &Literal{
+		literalFields: literalFields{
+			String:    x.UserString(),
+			Available: &Available{},
+		},
+	}
+
+	values := make([]cue.Value, len(x.Members))
+	types := make([]InputOrOutput, len(x.Members))
+	for i, m := range x.Members {
+		member := &LiteralMember{String: m.String()}
+		if !x.IsArray {
+			member.Key = strPtr(m.Key)
+			literal.Available.Fields = append(literal.Available.Fields, m.Key)
+		}
+
+		member.Part, types[i], values[i] = m.validate(rootValue, cuePath, blockedRootFields)
+		member.Type = types[i]
+		literal.Members = append(literal.Members, member)
+	}
+
+	if x.IsArray {
+		value = ctx.NewList(values...)
+
+		// Arrays of arrays are arrays of any values
+		elementType := PT_Any
+		if common := commonType(types...); len(types) > 0 && common.IOType == IOOT_Single {
+			elementType = common.Type
+		}
+		literal.Type = inputOrOutput(elementType, IOOT_Array)
+	} else {
+		value = ctx.CompileString("{}")
+		for i, m := range x.Members {
+			value = value.FillPath(cue.MakePath(cue.Str(m.Key)), values[i])
+		}
+		literal.Type = inputOrOutput(PT_Object, IOOT_Single)
+	}
+
+	if err := value.Err(); err != nil {
+		literal.SetError(fmt.Sprintf("failed to describe the value: %v", err))
+	}
+
+	literal.Type.CueExpr = getExpr(value)
+	literal.Available.Functions = getAvailableFunctionsForKind(x.registry, literal.Type)
+
+	return
+}
+
+// validate validates the member, returning the cue value that describes it
+func (m *literalMember) validate(rootValue cue.Value, cuePath CuePath, blockedRootFields []string) (part CanBeAPart, returnedType InputOrOutput, value cue.Value) {
+	ctx := rootValue.Context()
+
+	switch t := m.Operation.(type) {
+	case nil:
+		returnedType = inputOrOutput(PT_Any, IOOT_Single)
+		if m.Value != nil {
+			returnedType = m.Value.IsFuncParam()
+		}
+		return nil, returnedType, ctx.CompileString(m.String())
+
+	case *opPath:
+		path, returnedType := t.Validate(rootValue, cuePath, blockedRootFields)
+		path.String = t.UserString()
+		return path, returnedType, t.describedBy(rootValue, returnedType, blockedRootFields)
+
+	case *opLogicalOperation:
+		return t.Validate(rootValue, cuePath, blockedRootFields), inputOrOutput(PT_Boolean, IOOT_Single), ctx.CompileString("bool")
+
+	case *opLiteral:
+		literal, value := t.Validate(rootValue, cuePath, blockedRootFields)
+		return literal, literal.ReturnType(), value
+	}
+
+	return nil, returnedType, ctx.CompileString("_")
+}
+
+// describedBy returns the cue value that describes the values that the path
+// returns; if the path does not address a value in the cue, it is described
+// by its type
+func (x *opPath) describedBy(rootValue cue.Value, returnedType InputOrOutput, blockedRootFields []string) cue.Value {
+	if cuePath := x.addressedCuePath(rootValue, blockedRootFields); cuePath != nil {
+		if v, err := findValueAtPath(rootValue, cuePath); err == nil {
+			isList := v.IncompleteKind() == cue.ListKind
+			switch {
+			case isList == (returnedType.IOType == IOOT_Array):
+				return v
+			case isList:
+				// A function has returned one of the elements (e.g. First)
+				if elem, err := getUnderlyingValue(v); err == nil {
+					return elem
+				}
+			}
+		}
+	}
+
+	return describeType(rootValue.Context(), returnedType)
+}
+
+// describeType returns the cue value that describes the values of the type
+func describeType(ctx *cue.Context, t InputOrOutput) cue.Value {
+	expr := "_"
+	if typeExpr := *t.Type.CueExpr(); typeExpr != "" {
+		expr = typeExpr
+	}
+	if t.IOType == IOOT_Array {
+		expr = "[..." + expr + "]"
+	}
+
+	return ctx.CompileString(expr)
+}
+
+func (x *opLiteral) Type() OT_OpType { return OT_Literal }
+
+func (x *opLiteral) Sprint(depth int) (out string) {
+	startChar, endChar := "{", "}"
+	if x.IsArray {
+		startChar, endChar = "[", "]"
+	}
+
+	out += repeatTabs(depth) + startChar
+	if len(x.Members) == 0 {
+		return out + endChar
+	}
+
+	for i, m := range x.Members {
+		out += "\n" + repeatTabs(depth+1)
+		if !x.IsArray {
+			out += fmt.Sprintf(`"%s": `, escape(m.Key))
+		}
+		out += m.sprint(depth + 1)
+		if i != len(x.Members)-1 {
+			out += ","
+		}
+	}
+
+	out += "\n" + repeatTabs(depth) + endChar
+
+	return
+}
+
+func (x *opLiteral) Do(currentData, originalData any) (dataToUse any, err error) {
+	return x.do(evaluationFor(x), currentData, originalData)
+}
+
+func (x *opLiteral) do(ev *evaluation, currentData, originalData any) (dataToUse any, err error) {
+	if err = ev.enter(); err != nil {
+		return nil, err
+	}
+	defer ev.leave()
+
+	if err = ev.checkCollectionSize(len(x.Members)); err != nil {
+		return nil, err
+	}
+
+	values := make([]any, len(x.Members))
+	for i, m := range x.Members {
+		if values[i], err = m.do(ev, currentData, originalData); err != nil {
+			if x.IsArray {
+				return nil, fmt.Errorf("failed to evaluate element %d: %w", i, err)
+			}
+			return nil, fmt.Errorf("failed to evaluate field '%s': %w", m.Key, err)
+		}
+	}
+
+	if x.IsArray {
+		return values, nil
+	}
+
+	out := make(map[string]any, len(values))
+	for i, m := range x.Members {
+		out[m.Key] = values[i]
+	}
+
+	return out, nil
+}
+
+func (m *literalMember) do(ev *evaluation, currentData, originalData any) (val any, err error) {
+	switch {
+	case m.Operation != nil:
+		if val, err = m.Operation.do(ev, currentData, originalData); err != nil {
+			return nil, err
+		}
+	case m.Value != nil:
+		return m.Value.GetValue(), nil
+	default:
+		return nil, nil
+	}
+
+	if _, ok := val.(string); !ok {
+		val = convertToDecimalIfNumber(val)
+	}
+
+	return val, nil
+}
+
+func (x *opLiteral) Parse(s *scanner, r rune) (nextR rune, err error) {
+	x.registry = s.registry
+
+	closingRune := '}'
+	switch r {
+	case '{':
+	case '[':
+		x.IsArray = true
+		closingRune = ']'
+	default:
+		return r, erInvalid(s, '{', '[')
+	}
+
+	keys := map[string]bool{}
+	for r = s.Scan(); r != closingRune; {
+		if len(x.Members) > 0 {
+			if r != ',' {
+				return r, erInvalid(s, ',', closingRune)
+			}
+			r = s.Scan()
+		}
+
+		m := &literalMember{}
+		if !x.IsArray {
+			if r != sc.String {
+				return r, errors.Wrap(erInvalid(s, '"'), "expected a quoted key")
+			}
+			m.Key = unescape(unquote(s.TokenText()))
+			if keys[m.Key] {
+				return r, erAt(s, "the key \"%s\" is used more than once", m.Key)
+			}
+			keys[m.Key] = true
+
+			// As ':' is an ident rune, it is read on its own rather than
+			// scanned, which could read it together with the value
+			for unicode.IsSpace(s.sx.Peek()) {
+				s.sx.Next()
+			}
+			if s.sx.Next() != ':' {
+				return r, erAt(s, "expected ':' after the key \"%s\"", m.Key)
+			}
+			r = s.Scan()
+		}
+
+		if r, err = m.parse(s, r); err != nil {
+			return r, err
+		}
+		x.Members = append(x.Members, m)
+	}
+
+	x.setUserString()
+
+	return s.Scan(), nil
+}
+
+func (m *literalMember) parse(s *scanner, r rune) (nextR rune, err error) {
+	p := &exprParser{s: s}
+
+	if isLiteralValueAhead(s, r) {
+		var o operand
+		if o, r, err = p.parseOperand(r, nil); err != nil {
+			return r, err
+		}
+		m.Value = o.literal
+
+		return r, nil
+	}
+
+	// Expressions can also start with a literal or a unary minus, e.g.
+	// `10 < $.weight`
+	switch r {
+	case '{', '[', '$', '@', '#', '(', '!', sc.String, sc.RawString, sc.Char:
+	case sc.Ident:
+		if tt := s.TokenText(); tt != "-" && !isLiteralIdent(tt) {
+			return r, erInvalid(s, '{', '[', '$', '@', '#')
+		}
+	default:
+		return r, erInvalid(s, '{', '[', '$', '@', '#')
+	}
+
+	m.Operation, r, err = p.parseExpression(r, nil)
+
+	return r, err
+}
+
+func (x *opLiteral) setUserString() {
+	members := make([]string, len(x.Members))
+	for i, m := range x.Members {
+		members[i] = m.String()
+		if !x.IsArray {
+			members[i] = fmt.Sprintf(`"%s":`, escape(m.Key)) + members[i]
+		}
+	}
+
+	if x.IsArray {
+		x.userString = "[" + strings.Join(members, ",") + "]"
+	} else {
+		x.userString = "{" + strings.Join(members, ",") + "}"
+	}
+}
@@ -2,6 +2,7 @@ package mpath
 
 import (
 	"fmt"
+	"strings"
 	sc "text/scanner"
 
 	"cuelang.org/go/cue"
@@ -62,11 +63,28 @@ func (x *opLogicalOperation) Validate(rootValue cue.Value, cuePath CuePath, bloc
 	return
 }
 
-func (x *opLogicalOperation) addOpToOperationsAndParse(op Operation, s *scanner, r rune) (nextR rune, err error) {
-	x.Operations = append(x.Operations, op)
-	nextR, err = op.Parse(s, r)
-	x.userString += op.UserString()
-	return
+// setUserString sets the user string of a logical operation that was built
+// from an expression, as if it had been written out in full
+func (x *opLogicalOperation) setUserString() {
+	parts := make([]string, 0, len(x.Operations)+1)
+	switch x.LogicalOperationType {
+	case LOT_And:
+		parts = append(parts, "AND")
+	case LOT_Or:
+		parts = append(parts, "OR")
+	default:
+		parts = append(parts, string(x.LogicalOperationType))
+	}
+
+	for _, op := range x.Operations {
+		parts = append(parts, op.UserString())
+	}
+
+	if x.IsFilter {
+		x.userString = "[" + strings.Join(parts, ",") + "]"
+	} else {
+		x.userString = "{" + strings.Join(parts, ",") + "}"
+	}
 }
 
 func (x *opLogicalOperation) Type() OT_OpType { return OT_LogicalOperation }
@@ -108,8 +126,21 @@ func (x *opLogicalOperation) Sprint(depth int) (out string) {
 }
 
 func (x *opLogicalOperation) Do(currentData, originalData any) (dataToUse any, err error) {
+	return x.do(evaluationFor(x), currentData, originalData)
+}
+
+func (x *opLogicalOperation) do(ev *evaluation, currentData, originalData any) (dataToUse any, err error) {
+	if err = ev.enter(); err != nil {
+		return nil, err
+	}
+	defer ev.leave()
+
 	for _, op := range x.Operations {
-		res, err := op.Do(currentData, originalData)
+		if err := ev.cancelled(); err != nil {
+			return nil, err
+		}
+
+		res, err := op.do(ev, currentData, originalData)
 		if err != nil {
 			return nil, err
 		}
@@ -158,7 +189,7 @@ func (x *opLogicalOperation) Parse(s *scanner, r rune) (nextR rune, err error) {
 			x.LogicalOperationType = LOT_Or
 		}
 		r = s.Scan()
-	} else if r == sc.Ident {
+	} else if r == sc.Ident && !isLiteralIdent(tokenText) && tokenText != "-" {
 		// This is a misspelt operation type
 		x.userString += tokenText
 		x.IsInvalid = true
@@ -183,12 +214,17 @@ func (x *opLogicalOperation) Parse(s *scanner, r rune) (nextR rune, err error) {
 			r = s.Scan()
 			continue
 
-		case '$', '@':
-			// This is an opPath
-			op = &opPath{MustEndInFunctionOrIdent: true, IsFilter: x.IsFilter}
-		case '{':
-			// This is an opLogicalOperation
-			op = &opLogicalOperation{}
+		case '$', '@', '#', '{', '(', '!', sc.String, sc.RawString, sc.Char, sc.Ident:
+			// This is an opPath or an opLogicalOperation, which may be
+			// written as an expression
+			p := &exprParser{s: s, isFilter: x.IsFilter}
+			if op, r, err = p.parseBooleanExpression(r); err != nil {
+				return r, err
+			}
+
+			x.Operations = append(x.Operations, op)
+			x.userString += op.UserString()
+			continue
 		case '}', ']':
 			x.userString += string(r)
 
@@ -199,10 +235,6 @@ func (x *opLogicalOperation) Parse(s *scanner, r rune) (nextR rune, err error) {
 		default:
 			return r, erInvalid(s)
 		}
-
-		if r, err = x.addOpToOperationsAndParse(op, s, r); err != nil {
-			return r, err
-		}
 	}
 
 	return
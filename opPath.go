@@ -14,8 +14,26 @@ type opPath struct {
 	StartAtRoot              bool
 	IsFilter                 bool
 	MustEndInFunctionOrIdent bool
-	Operations               []Operation
+
+	// VariableName is set when the path starts at a variable (e.g. `#total`)
+	// rather than at the data
+	VariableName string
+	Operations   []Operation
 	opCommon
+
+	// startsAtElement is set when the path is in the body of a lambda and
+	// starts at '@', which is the element rather than the value that any
+	// function within the body is called on
+	startsAtElement bool
+
+	// literal is set when the path starts at a number in parentheses (e.g.
+	// `(10).Divide($.count)`, which is how `10 / $.count` is written out)
+	// rather than at the data
+	literal *FP_Number
+
+	// variable is the declaration of the variable in the query, if any
+	variable *variableDeclaration
+	registry *FunctionRegistry
 }
 
 func (x *opPath) Validate(rootValue cue.Value, cuePath CuePath, blockedRootFields []string) (path *Path, returnedType InputOrOutput) {
@@ -30,8 +48,27 @@ func (x *opPath) Validate(rootValue cue.Value, cuePath CuePath, blockedRootField
 	}
 	var err error
 
+	if x.startsAtElement {
+		if depth := lambdaDepth(rootValue); depth > 0 {
+			cuePath = CuePath{lambdaDefinition(depth)}
+		}
+	}
+
+	var variable variableValidation
+	if x.VariableName != "" {
+		variable = x.validateVariable(rootValue, blockedRootFields)
+		if variable.part.HasErrors() {
+			return errFunc(fmt.Errorf("%s", variable.part.GetErrors()))
+		}
+
+		cuePath = variable.cuePath
+		if cuePath == nil {
+			cuePath = CuePath{}
+		}
+	}
+
 	var cuePathValue cue.Value
-	if len(cuePath) == 0 || x.StartAtRoot {
+	if len(cuePath) == 0 || (x.StartAtRoot && x.VariableName == "") {
 		cuePathValue = rootValue
 	} else {
 		cuePathValue, err = findValueAtPath(rootValue, cuePath)
@@ -58,35 +95,88 @@ func (x *opPath) Validate(rootValue cue.Value, cuePath CuePath, blockedRootField
 		},
 	}
 
-	switch x.StartAtRoot {
-	case true:
+	var shouldErrorRemaining bool
+	var part CanBeAPart
+	var foundFirstIdent bool
+	var previousWasFuncWithoutKnownReturn bool
+
+	// cueDescribesValue is cleared once a function has returned values that
+	// are not in the cue at the cue path (e.g. Keys)
+	cueDescribesValue := x.literal == nil
+
+	// cueDescribesLength is cleared once the elements of a list may have
+	// been filtered, sliced or otherwise changed, so that the length of a
+	// closed list in the cue is no longer known
+	cueDescribesLength := x.VariableName == "" && x.literal == nil
+
+	// selectsMany is set by a wildcard or a recursive descent, after which
+	// idents select the field from each of the values
+	var selectsMany bool
+
+	switch {
+	case x.VariableName != "":
+		rootPart.String = "#" + x.VariableName
+		rootPart.Type.Type = variable.returnType.Type
+		rootPart.Type.IOType = variable.returnType.IOType
+		returnedType = variable.returnType
+
+		// Functions can be called on the variable itself, and the fields of
+		// the variable are not root fields
+		part = rootPart
+		foundFirstIdent = true
+
+		rootPart.Available = &Available{
+			Functions: getAvailableFunctionsForKind(x.registry, returnedType),
+		}
+
+		if returnedType.Type == PT_Object {
+			if variable.cuePath == nil {
+				previousWasFuncWithoutKnownReturn = true
+			} else if returnedType.IOType == IOOT_Single {
+				rootPart.Available.Fields, err = getAvailableFieldsForValue(cuePathValue, blockedRootFields)
+				if err != nil {
+					return errFunc(fmt.Errorf("failed to list available fields from cue: %w", err))
+				}
+			}
+		}
+	case x.literal != nil:
+		rootPart.String = "(" + x.literal.Value.String() + ")"
+		rootPart.Type.Type = PT_Number
+		rootPart.Type.IOType = IOOT_Single
+		returnedType = rootPart.Type
+
+		// Only functions can be called on the number
+		part = rootPart
+		foundFirstIdent = true
+
+		rootPart.Available = &Available{
+			Functions: getAvailableFunctionsForKind(x.registry, returnedType),
+		}
+	case x.StartAtRoot:
 		rootPart.String = "$"
 		rootPart.Type.Type = PT_Root
 		rootPart.Type.IOType = IOOT_Single
 		cuePath = CuePath{}
-	case false:
+	default:
 		rootPart.String = "@"
 		rootPart.Type.Type = PT_ElementRoot
 		rootPart.Type.IOType = IOOT_Single
 	}
 
-	availableFields, err := getAvailableFieldsForValue(cuePathValue, blockedRootFields)
-	if err != nil {
-		return errFunc(fmt.Errorf("failed to list available fields from cue: %w", err))
-	}
+	if x.VariableName == "" && x.literal == nil {
+		availableFields, err := getAvailableFieldsForValue(cuePathValue, blockedRootFields)
+		if err != nil {
+			return errFunc(fmt.Errorf("failed to list available fields from cue: %w", err))
+		}
 
-	if len(availableFields) > 0 {
-		rootPart.Available = &Available{
-			Fields: availableFields,
+		if len(availableFields) > 0 {
+			rootPart.Available = &Available{
+				Fields: availableFields,
+			}
 		}
 	}
 
 	rdm := map[string]struct{}{}
-
-	var shouldErrorRemaining bool
-	var part CanBeAPart
-	var foundFirstIdent bool
-	var previousWasFuncWithoutKnownReturn bool
 	for _, op := range x.Operations {
 		if shouldErrorRemaining {
 			var str string
@@ -95,6 +185,10 @@ func (x *opPath) Validate(rootValue cue.Value, cuePath CuePath, blockedRootField
 				str = t.UserString()
 			case *opFilter:
 				str = t.UserString()
+			case *opSlice:
+				str = t.UserString()
+			case *opWildcard, *opRecursiveDescent:
+				str = op.UserString()
 			default:
 				continue
 			}
@@ -132,7 +226,7 @@ func (x *opPath) Validate(rootValue cue.Value, cuePath CuePath, blockedRootField
 				continue
 			}
 
-			if returnedType.IOType == IOOT_Array {
+			if returnedType.IOType == IOOT_Array && !selectsMany {
 				shouldErrorRemaining = true
 				errMessage := "cannot address into array value"
 				path.Parts = append(path.Parts, &PathIdent{
@@ -163,15 +257,63 @@ func (x *opPath) Validate(rootValue cue.Value, cuePath CuePath, blockedRootField
 				}
 			}
 
-			cuePath = cuePath.Add(t.IdentName)
+			cuePath = cuePath.Add(t.cuePathSegment())
 
 			// opPathIdent Validate advances the next value
-			part, returnedType = t.Validate(rootValue, cuePath, blockedRootFields)
+			var pi *PathIdent
+			pi, returnedType = t.Validate(rootValue, cuePath, blockedRootFields)
+			if selectsMany {
+				returnedType = manyOf(x.registry, pi, returnedType)
+			}
+			part = pi
+			path.Parts = append(path.Parts, part)
+			pi.Type = returnedType
+			if part.HasErrors() {
+				return
+			}
+			cueDescribesLength = cueDescribesValue && !selectsMany
+
+		case *opWildcard, *opRecursiveDescent:
+			if previousWasFuncWithoutKnownReturn {
+				// We cannot address into unknown return values, so we will return
+				break
+			}
+
+			if returnedType.IOType == IOOT_Single && returnedType.Type.IsPrimitive() {
+				shouldErrorRemaining = true
+				errMessage := "cannot address into primitive value"
+				path.Parts = append(path.Parts, &PathIdent{
+					pathIdentFields: pathIdentFields{
+						String: op.UserString(),
+						HasError: HasError{
+							Error: &errMessage,
+						},
+					},
+				})
+				continue
+			}
+			foundFirstIdent = true
+
+			if rd, ok := t.(*opRecursiveDescent); ok {
+				cuePath = cuePath.Add(cuePathDescendant + rd.IdentName)
+			} else {
+				cuePath = cuePath.Add(cuePathWildcard)
+			}
+
+			// The values are validated in the same way as an ident, as the cue
+			// path describes each of them
+			ident := &opPathIdent{opCommon: opCommon{userString: op.UserString()}, registry: x.registry}
+			var pi *PathIdent
+			pi, returnedType = ident.Validate(rootValue, cuePath, blockedRootFields)
+			returnedType = manyOf(x.registry, pi, returnedType)
+			part = pi
 			path.Parts = append(path.Parts, part)
-			part.(*PathIdent).Type = returnedType
+			pi.Type = returnedType
 			if part.HasErrors() {
 				return
 			}
+			selectsMany = true
+			cueDescribesLength = false
 
 		case *opFilter:
 			pi, ok := part.(*PathIdent)
@@ -189,8 +331,33 @@ func (x *opPath) Validate(rootValue cue.Value, cuePath CuePath, blockedRootField
 			if pi.Filter.Error != nil {
 				return errFunc(fmt.Errorf("%s", *pi.Filter.Error))
 			}
+			cueDescribesLength = false
+
+		case *opSlice:
+			if part == nil {
+				return errFunc(fmt.Errorf("tried to slice the root"))
+			}
+
+			// opSlice Validate does not advance the next value, but the cue
+			// no longer describes how many elements there are
+			slice := t.Validate(part.ReturnType())
+			path.Parts = append(path.Parts, slice)
+			if slice.HasErrors() {
+				return
+			}
+			slice.Available = &Available{
+				Functions: getAvailableFunctionsForKind(x.registry, returnedType),
+			}
+			part = slice
+			cueDescribesLength = false
 
 		case *opFunction:
+			if part == nil && ft_IsValidOnAny(x.registry, t.FunctionType) {
+				// Functions that can be used on any value (e.g. Now) can
+				// be called on the root
+				part = rootPart
+			}
+
 			if part == nil {
 				errMessage := "functions cannot be called here"
 				path.Error = &errMessage
@@ -198,11 +365,20 @@ func (x *opPath) Validate(rootValue cue.Value, cuePath CuePath, blockedRootField
 			}
 
 			returnsKnownValues := false
-			part, returnedType, returnsKnownValues, err = t.Validate(rootValue, cuePath, part.ReturnType(), blockedRootFields)
+			part, returnedType, returnsKnownValues, err = t.Validate(rootValue, cuePath, part.ReturnType(), cueDescribesValue, blockedRootFields)
 			if err != nil {
 				shouldErrorRemaining = true
 			}
-			if !returnsKnownValues && (returnedType.Type == PT_Object) {
+			if cueDescribesLength && cueDescribesValue {
+				if err := t.validateIndexInRange(rootValue, cuePath); err != nil {
+					part.SetError(err.Error())
+					shouldErrorRemaining = true
+				}
+			}
+			cueDescribesValue = cueDescribesValue && returnsKnownValues
+			cueDescribesLength = false
+			selectsMany = false
+			if !cueDescribesValue && (returnedType.Type == PT_Object) {
 				previousWasFuncWithoutKnownReturn = true
 			}
 			path.Parts = append(path.Parts, part)
@@ -216,6 +392,22 @@ func (x *opPath) Validate(rootValue cue.Value, cuePath CuePath, blockedRootField
 	return
 }
 
+// manyOf returns the type of an array of the values that are described by the
+// part, and updates the functions that are available on the part to match
+func manyOf(registry *FunctionRegistry, part *PathIdent, t InputOrOutput) InputOrOutput {
+	if t.IOType == IOOT_Array {
+		// The values are arrays themselves
+		t.Type = PT_Any
+	}
+	t.IOType = IOOT_Array
+
+	if part.Available != nil {
+		part.Available.Functions = getAvailableFunctionsForKind(registry, t)
+	}
+
+	return t
+}
+
 func (x *opPath) addOpToOperationsAndParse(op Operation, s *scanner, r rune) (nextR rune, err error) {
 	x.Operations = append(x.Operations, op)
 	nextR, err = op.Parse(s, r)
@@ -229,10 +421,14 @@ func (x *opPath) Sprint(depth int) (out string) {
 
 	out += repeatTabs(depth)
 
-	switch x.StartAtRoot {
-	case true:
+	switch {
+	case x.VariableName != "":
+		out += "#" + x.VariableName
+	case x.literal != nil:
+		out += "(" + x.literal.Value.String() + ")"
+	case x.StartAtRoot:
 		out += "$"
-	case false:
+	default:
 		out += "@"
 	}
 
@@ -240,7 +436,7 @@ func (x *opPath) Sprint(depth int) (out string) {
 
 	for _, op := range x.Operations {
 		var thisStr string
-		if op.Type() != OT_Filter {
+		if ident, ok := op.(*opPathIdent); !(ok && ident.needsBrackets()) && op.Type() != OT_Filter && op.Type() != OT_Slice {
 			thisStr = "."
 		}
 		thisStr += op.Sprint(depth)
@@ -255,14 +451,33 @@ func (x *opPath) Sprint(depth int) (out string) {
 }
 
 func (x *opPath) Do(currentData, originalData any) (dataToUse any, err error) {
+	return x.do(evaluationFor(x), currentData, originalData)
+}
+
+func (x *opPath) do(ev *evaluation, currentData, originalData any) (dataToUse any, err error) {
+	if err = ev.enter(); err != nil {
+		return nil, err
+	}
+	defer ev.leave()
+
 	if x.StartAtRoot && x.IsFilter {
 		return nil, fmt.Errorf("cannot access root data in filter")
 	}
 
-	if x.StartAtRoot {
+	switch {
+	case x.VariableName != "":
+		if dataToUse, err = ev.variable(x.VariableName); err != nil {
+			return nil, err
+		}
+	case x.literal != nil:
+		dataToUse = x.literal.Value
+	case x.StartAtRoot:
 		dataToUse = originalData
-	} else {
+	default:
 		dataToUse = currentData
+		if element, ok := ev.element(); ok && x.startsAtElement {
+			dataToUse = element
+		}
 	}
 
 	if len(x.Operations) == 0 {
@@ -286,10 +501,12 @@ func (x *opPath) Do(currentData, originalData any) (dataToUse any, err error) {
 			}
 		}
 
-		dataToUse, err = op.Do(dataToUse, originalData)
+		dataToUse, err = op.do(ev, dataToUse, originalData)
 		if err != nil {
 			if errors.Is(err, ErrKeyNotFound) {
 				if op.PropagateNull() {
+					// The missing field is null, e.g. $.a?
+					dataToUse, err = nil, nil
 					priorResultWasNil = true
 					continue
 				}
@@ -300,6 +517,10 @@ func (x *opPath) Do(currentData, originalData any) (dataToUse any, err error) {
 			return nil, fmt.Errorf("path op failed: %w", err)
 		}
 
+		if err = ev.checkOutput(dataToUse); err != nil {
+			return nil, err
+		}
+
 		if isNil(dataToUse) {
 			priorResultWasNil = true
 		}
@@ -309,6 +530,8 @@ func (x *opPath) Do(currentData, originalData any) (dataToUse any, err error) {
 }
 
 func (x *opPath) Parse(s *scanner, r rune) (nextR rune, err error) {
+	x.registry = s.registry
+
 	switch r {
 	case '$':
 		if x.IsFilter {
@@ -317,60 +540,131 @@ func (x *opPath) Parse(s *scanner, r rune) (nextR rune, err error) {
 		x.StartAtRoot = true
 	case '@':
 		// do nothing, this is the default
+	case '#':
+		if r = s.Scan(); r != sc.Ident {
+			return r, errors.Wrap(erInvalid(s), "expected variable name after '#'")
+		}
+		x.setVariable(s, s.TokenText())
+		return x.parseOperations(s, s.Scan())
 	default:
-		return r, erInvalid(s, '$', '@')
+		return r, erInvalid(s, '$', '@', '#')
 	}
 	x.userString += string(r)
 
-	r = s.Scan()
+	return x.parseOperations(s, s.Scan())
+}
+
+// endsInBoolean returns whether the path can be assumed to return a boolean
+func (x *opPath) endsInBoolean() bool {
+	if len(x.Operations) == 0 {
+		// we can assume that the user has provided a boolean variable
+		return x.VariableName != ""
+	}
+
+	switch t := x.Operations[len(x.Operations)-1].(type) {
+	case *opFunction:
+		return ft_IsBoolFunc(t.registry, t.FunctionType)
+	case *opPathIdent:
+		// we can assume that the user has provided a boolean property
+		return true
+	}
+
+	return false
+}
+
+// selectsMany returns whether the operations so far end in a wildcard or a
+// recursive descent, followed by any number of idents
+func (x *opPath) selectsMany() bool {
+	for i := len(x.Operations) - 1; i >= 0; i-- {
+		switch x.Operations[i].(type) {
+		case *opPathIdent:
+			continue
+		case *opWildcard, *opRecursiveDescent:
+			return true
+		}
+
+		return false
+	}
+
+	return false
+}
+
+// appendFunction adds a call to the function at the end of the path
+func (x *opPath) appendFunction(fn *opFunction) {
+	x.Operations = append(x.Operations, fn)
+	x.userString += "." + fn.UserString()
+}
+
+// setLiteral starts the path at the number, which is written in parentheses
+func (x *opPath) setLiteral(s *scanner, number *FP_Number) {
+	x.literal = number
+	x.registry = s.registry
+	x.userString += "(" + number.Value.String() + ")"
+}
 
+func (x *opPath) setVariable(s *scanner, name string) {
+	x.VariableName = name
+	x.variable = s.variables[name]
+	x.registry = s.registry
+	x.userString += "#" + name
+}
+
+func (x *opPath) parseOperations(s *scanner, r rune) (nextR rune, err error) {
 	var op Operation
+
+	// afterDot is set when the last token was the '.' that must come before
+	// each name, so that `$.a b` is not read as `$.a.b`
+	afterDot := false
 	for { //i := 1; i > 0; i++ {
 		if r == sc.EOF {
 			break
 		}
 
+		if isPathEnd(s, r) {
+			// This should mean we are finished the path; the operators
+			// are dealt with by the expression that the path is part of
+			if x.MustEndInFunctionOrIdent && !x.endsInBoolean() {
+				// return r, erAt(s, "paths that are part of a logical operation must end in a boolean function")
+				x.IsInvalid = true
+			}
+
+			return r, nil
+		}
+
 		switch r {
 		case '.':
 			x.userString += string(r)
-			// This is the separator, we can move on
 			r = s.Scan()
-			continue
-
-		case ',', ')', ']', '}':
 			switch r {
-			case ',':
-				// x.userString += string(r)
-			case ')':
-				// do nothing?
-			}
-
-			// This should mean we are finished the path
-			if x.MustEndInFunctionOrIdent {
-				if len(x.Operations) > 0 {
-					if pf, ok := x.Operations[len(x.Operations)-1].(*opFunction); x.Operations[len(x.Operations)-1].Type() == OT_Function && ok {
-						if ft_IsBoolFunc(pf.FunctionType) {
-							return r, nil
-						}
-					}
-					if _, ok := x.Operations[len(x.Operations)-1].(*opPathIdent); ok {
-						// we can assume that the user has provided a boolean property
-						return r, nil
-					}
-				}
-
-				// return r, erAt(s, "paths that are part of a logical operation must end in a boolean function")
-				x.IsInvalid = true
-				return r, nil
+			case '*':
+				// This is a wildcard, e.g. $.steps.*
+				op = &opWildcard{OfEach: x.selectsMany()}
+			case '.':
+				// This is a recursive descent, e.g. $..name
+				op = &opRecursiveDescent{}
+			default:
+				// This is the separator, we can move on
+				afterDot = true
+				continue
 			}
 
-			return r, nil
-
 		case sc.Ident:
+			if !afterDot {
+				if strings.ContainsAny(s.TokenText()[:1], "+-*/%") {
+					// e.g. `$.a -2`
+					return r, erOperatorNotSeparated(s)
+				}
+				return r, errors.Wrap(erInvalid(s, '.'), "expected '.' before the field name")
+			}
+
 			// Need to check if this is the name of a function
 			p := s.sx.Peek()
+			if _, ok := x.registry.lookup(FT_FunctionType(s.TokenText())); p == '(' && !ok && endsInArithmeticOperator(s.TokenText()) {
+				// e.g. `$.a+($.b)`
+				return r, erOperatorNotSeparated(s)
+			}
 			if p == '(' {
-				op = &opFunction{}
+				op = &opFunction{calledOnRoot: x.StartAtRoot && len(x.Operations) == 0}
 			} else {
 				// This should be a field name
 				op = &opPathIdent{}
@@ -378,18 +672,56 @@ func (x *opPath) Parse(s *scanner, r rune) (nextR rune, err error) {
 
 		case '[':
 			// x.userString += string(r)
-			// This is a filter
-			op = &opFilter{}
+			switch {
+			case isQuotedKeyAhead(s):
+				// This is a quoted key, e.g. ["first name"]
+				op = &opPathIdent{}
+			case isSliceAhead(s):
+				// This is a slice, e.g. [1:3]
+				op = &opSlice{}
+			default:
+				// This is a filter
+				op = &opFilter{}
+			}
 
 		default:
 			// log.Printf("got %s (%d) [%t] (%d) \n", string(r), r, unicode.IsPrint(r), '\x00')
+			if x.endsInArithmeticOperator() {
+				return r, erOperatorNotSeparated(s)
+			}
 			return r, erInvalid(s)
 		}
 
 		if r, err = x.addOpToOperationsAndParse(op, s, r); err != nil {
 			return r, err
 		}
+		afterDot = false
 	}
 
 	return
 }
+
+// endsInArithmeticOperator returns whether the last operation is an ident
+// whose name ends in an arithmetic operator, e.g. `$.a+` when `$.a+$.b` is
+// read
+func (x *opPath) endsInArithmeticOperator() bool {
+	if len(x.Operations) == 0 {
+		return false
+	}
+
+	ident, ok := x.Operations[len(x.Operations)-1].(*opPathIdent)
+	return ok && endsInArithmeticOperator(ident.IdentName)
+}
+
+// isPathEnd returns whether the path ends at r, either because it is a
+// separator or because it is the start of an operator
+func isPathEnd(s *scanner, r rune) bool {
+	switch r {
+	case ',', ')', ']', '}', ';':
+		return true
+	case sc.Ident:
+		return isArithmeticIdent(s.TokenText())
+	}
+
+	return isOperatorRune(r)
+}
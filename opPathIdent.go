@@ -3,14 +3,23 @@ package mpath
 import (
 	"fmt"
 	"reflect"
+	"regexp"
 	"strings"
+	sc "text/scanner"
+	"unicode"
 
 	"cuelang.org/go/cue"
+	"github.com/pkg/errors"
 )
 
 type opPathIdent struct {
 	IdentName string
 	opCommon
+
+	registry *FunctionRegistry
+
+	// quoted is set when the name was written as a quoted key, e.g. ["#tag"]
+	quoted bool
 }
 
 func (x *opPathIdent) Validate(rootValue cue.Value, cuePath CuePath, blockedRootFields []string) (part *PathIdent, returnedType InputOrOutput) {
@@ -134,22 +143,61 @@ loop:
 		return errFunc(fmt.Errorf("encountered unknown cue kind %v", k))
 	}
 
-	part.Available.Functions = getAvailableFunctionsForKind(returnedType)
+	part.Available.Functions = getAvailableFunctionsForKind(x.registry, returnedType)
 	part.Type = returnedType
 	returnedType.CueExpr = getExpr(cuePathValue)
 
 	return
 }
 
+// cuePathSegment returns the segment of a cue path for the name; a quoted key
+// that starts with '#' is a field rather than a definition
+func (x *opPathIdent) cuePathSegment() string {
+	if x.quoted && strings.HasPrefix(x.IdentName, "#") {
+		return cuePathQuoted + x.IdentName
+	}
+
+	return x.IdentName
+}
+
 func (x *opPathIdent) Type() OT_OpType { return OT_PathIdent }
 
 func (x *opPathIdent) Sprint(depth int) (out string) {
+	if x.needsBrackets() {
+		return fmt.Sprintf(`["%s"]`, escape(x.IdentName))
+	}
+
 	return x.IdentName
 }
 
+// needsBrackets returns whether the name cannot be written as an ident, and
+// so must be written as a quoted key, e.g. ["first name"]
+func (x *opPathIdent) needsBrackets() bool {
+	if x.IdentName == "" || isArithmeticIdent(x.IdentName) || strings.HasSuffix(x.IdentName, "?") {
+		return true
+	}
+
+	for _, r := range x.IdentName {
+		if invalidRunes[r] || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
 var ErrKeyNotFound = fmt.Errorf("key not found")
 
-func (x *opPathIdent) Do(currentData, _ any) (dataToUse any, err error) {
+func (x *opPathIdent) Do(currentData, originalData any) (dataToUse any, err error) {
+	return x.do(evaluationFor(x), currentData, originalData)
+}
+
+func (x *opPathIdent) do(ev *evaluation, currentData, _ any) (dataToUse any, err error) {
+	if err = ev.enter(); err != nil {
+		return nil, err
+	}
+	defer ev.leave()
+
 	// Ident paths require that the data is a struct or map[string]any
 
 	// Deal with maps
@@ -191,10 +239,15 @@ func (x *opPathIdent) Do(currentData, _ any) (dataToUse any, err error) {
 
 	// If we get here, the data must be a struct
 	// and we will look for the field by name
-	return getValuesByName(x.IdentName, currentData)
+	return getValuesByName(x.IdentName, currentData, ev.fieldIndex)
 }
 
 func (x *opPathIdent) Parse(s *scanner, r rune) (nextR rune, err error) {
+	x.registry = s.registry
+	if r == '[' {
+		return x.parseQuoted(s)
+	}
+
 	x.IdentName = s.TokenText()
 	x.userString = x.IdentName
 	if strings.HasSuffix(x.IdentName, "?") {
@@ -204,3 +257,30 @@ func (x *opPathIdent) Parse(s *scanner, r rune) (nextR rune, err error) {
 
 	return s.Scan(), nil
 }
+
+var quotedKeyRegexp = regexp.MustCompile(`^\s*"(?:[^"\\]|\\.)*"\s*]`)
+
+// isQuotedKeyAhead returns whether the '[' that was just scanned is the start
+// of a quoted key rather than a filter, e.g. [ "first name" ]
+func isQuotedKeyAhead(s *scanner) bool {
+	return quotedKeyRegexp.MatchString(s.source[min(s.sx.Pos().Offset, len(s.source)):])
+}
+
+// parseQuoted parses a key that is written in brackets, e.g. ["first name"],
+// which can contain any character
+func (x *opPathIdent) parseQuoted(s *scanner) (nextR rune, err error) {
+	if r := s.Scan(); r != sc.String {
+		return r, errors.Wrap(erInvalid(s, '"'), "expected a quoted key after '['")
+	}
+
+	text := s.TokenText()
+	x.IdentName = unescape(unquote(text))
+
+	if r := s.Scan(); r != ']' {
+		return r, errors.Wrap(erInvalid(s, ']'), "expected ']' after the quoted key")
+	}
+	x.userString = "[" + text + "]"
+	x.quoted = true
+
+	return s.Scan(), nil
+}
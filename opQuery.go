@@ -0,0 +1,232 @@
+package mpath
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	sc "text/scanner"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/ast"
+)
+
+// variableDeclaration is a variable declared at the top of a query, e.g.
+// `#total = $.items.Select("$.price").Sum();`
+type variableDeclaration struct {
+	Name      string
+	Operation Operation
+}
+
+// opQuery is the top level operation of a query that declares variables; the
+// variables are evaluated once, in order, before the operation is run
+type opQuery struct {
+	Variables []*variableDeclaration
+	Operation Operation
+	opCommon
+}
+
+func (x *opQuery) Type() OT_OpType { return OT_Query }
+
+func (x *opQuery) Sprint(depth int) (out string) {
+	for _, v := range x.Variables {
+		out += repeatTabs(depth) + "#" + v.Name + " = " + strings.TrimLeft(v.Operation.Sprint(depth), "\t") + ";\n"
+	}
+
+	if x.Operation != nil {
+		out += x.Operation.Sprint(depth)
+	}
+
+	return
+}
+
+func (x *opQuery) Do(currentData, originalData any) (dataToUse any, err error) {
+	return x.do(evaluationFor(x), currentData, originalData)
+}
+
+func (x *opQuery) do(ev *evaluation, currentData, originalData any) (dataToUse any, err error) {
+	if err = ev.enter(); err != nil {
+		return nil, err
+	}
+	defer ev.leave()
+
+	for _, v := range x.Variables {
+		val, err := v.Operation.do(ev, currentData, originalData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate variable '#%s': %w", v.Name, err)
+		}
+
+		ev.variables[v.Name] = val
+	}
+
+	return x.Operation.do(ev, currentData, originalData)
+}
+
+func (x *opQuery) Parse(s *scanner, r rune) (nextR rune, err error) {
+	for r == '#' {
+		if r = s.Scan(); r != sc.Ident {
+			return r, erInvalid(s)
+		}
+		name := s.TokenText()
+
+		if r = s.Scan(); r != '=' || s.sx.Peek() == '=' {
+			// This is not a declaration, so it must be the operation itself,
+			// which starts with a path that starts at a variable
+			path := &opPath{}
+			path.setVariable(s, name)
+			if r, err = path.parseOperations(s, r); err != nil {
+				return r, err
+			}
+
+			p := &exprParser{s: s}
+			x.Operation, r, err = p.parseExpression(r, path)
+			if x.Operation != nil {
+				x.userString += x.Operation.UserString()
+			}
+			return r, err
+		}
+
+		if _, ok := s.variables[name]; ok {
+			return r, erAt(s, "variable '#%s' is already declared", name)
+		}
+
+		var op Operation
+		switch r = s.Scan(); {
+		case isRuneInString(r, "{[$@#(!"), startsWithLiteral(s, r):
+			p := &exprParser{s: s}
+			if op, r, err = p.parseExpression(r, nil); err != nil {
+				return r, err
+			}
+		default:
+			return r, erInvalid(s, '{', '$', '@', '#')
+		}
+
+		if r != ';' {
+			return r, erInvalid(s, ';')
+		}
+
+		v := &variableDeclaration{Name: name, Operation: op}
+		x.Variables = append(x.Variables, v)
+		s.variables[name] = v
+		x.userString += "#" + name + "=" + op.UserString() + ";"
+
+		r = s.Scan()
+	}
+
+	switch {
+	case isRuneInString(r, "{[$@(!"), startsWithLiteral(s, r):
+		p := &exprParser{s: s}
+		if x.Operation, r, err = p.parseExpression(r, nil); err != nil {
+			return r, err
+		}
+	case r == sc.EOF:
+		return r, erAt(s, "variables must be followed by an operation")
+	default:
+		return r, erInvalid(s, '{', '$', '@', '#')
+	}
+
+	x.userString += x.Operation.UserString()
+
+	return r, nil
+}
+
+// variableValidation is the result of validating the declaration of a
+// variable, and is used to validate the paths that start at the variable
+type variableValidation struct {
+	part       CanBeAPart
+	returnType InputOrOutput
+
+	// cuePath is the path to the value of the variable in the cue value; it
+	// is nil if the value cannot be addressed into
+	cuePath CuePath
+
+	// value describes a variable that is an object or array literal, which
+	// must be added to the cue value at the cue path
+	value *cue.Value
+}
+
+// cueDefinition is the name of the definition that holds the value of a
+// variable that is an object or array literal while the query is validated
+func (x *variableDeclaration) cueDefinition() string {
+	return "#mpathVariable" + hex.EncodeToString([]byte(x.Name))
+}
+
+func (x *variableDeclaration) validate(rootValue cue.Value, blockedRootFields []string) (vv variableValidation) {
+	switch t := x.Operation.(type) {
+	case *opPath:
+		path, _ := t.Validate(rootValue, CuePath{}, blockedRootFields)
+		vv.part = path
+		vv.returnType = path.ReturnType()
+		vv.cuePath = t.addressedCuePath(rootValue, blockedRootFields)
+
+	case *opLogicalOperation:
+		vv.part = t.Validate(rootValue, CuePath{}, blockedRootFields)
+		vv.returnType = inputOrOutput(PT_Boolean, IOOT_Single)
+
+	case *opLiteral:
+		literal, value := t.Validate(rootValue, CuePath{}, blockedRootFields)
+		vv.part = literal
+		vv.returnType = literal.ReturnType()
+		vv.cuePath = CuePath{x.cueDefinition()}
+		vv.value = &value
+	}
+
+	return
+}
+
+// validateVariable validates the variable that the path starts at. Variables
+// that are not declared in the query are passed in when the query is run, so
+// their type is taken from the cue definition of the same name, if there is
+// one (e.g. `#rate: number`).
+func (x *opPath) validateVariable(rootValue cue.Value, blockedRootFields []string) (vv variableValidation) {
+	if x.variable != nil {
+		return x.variable.validate(rootValue, blockedRootFields)
+	}
+
+	def := "#" + x.VariableName
+	if ast.IsValidIdent(def) && rootValue.LookupPath(cue.MakePath(cue.Def(def))).Exists() {
+		ident := &opPathIdent{IdentName: def, registry: x.registry}
+		ident.userString = def
+
+		vv.part, vv.returnType = ident.Validate(rootValue, CuePath{def}, blockedRootFields)
+		vv.cuePath = CuePath{def}
+		return
+	}
+
+	vv.part = &PathIdent{
+		pathIdentFields: pathIdentFields{
+			String: def,
+			HasError: HasError{
+				Error: strPtr(fmt.Sprintf("variable '%s' is not declared in the query or in the cue definitions", def)),
+			},
+		},
+	}
+
+	return
+}
+
+// addressedCuePath returns the cue path of the value that the path returns,
+// or nil if the value cannot be addressed into
+func (x *opPath) addressedCuePath(rootValue cue.Value, blockedRootFields []string) (cuePath CuePath) {
+	cuePath = CuePath{}
+	if x.VariableName != "" {
+		if cuePath = x.validateVariable(rootValue, blockedRootFields).cuePath; cuePath == nil {
+			return nil
+		}
+	}
+
+	cuePath = append(CuePath{}, cuePath...)
+	for _, op := range x.Operations {
+		switch t := op.(type) {
+		case *opPathIdent:
+			cuePath = cuePath.Add(t.cuePathSegment())
+		case *opWildcard, *opRecursiveDescent:
+			return nil
+		case *opFunction:
+			if fd, ok := t.registry.lookup(t.FunctionType); !ok || !fd.ReturnsKnownValues {
+				return nil
+			}
+		}
+	}
+
+	return
+}
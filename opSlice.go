@@ -0,0 +1,166 @@
+package mpath
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	sc "text/scanner"
+)
+
+// opSlice selects a range of the elements of an array, e.g. [1:3], [-2:] or
+// [::2]; the indices are zero based, and negative indices count back from the
+// end of the array
+type opSlice struct {
+	Start *int
+	Stop  *int
+	Step  *int
+	opCommon
+}
+
+var sliceRegexp = regexp.MustCompile(`^[\s\d:-]*:[\s\d:-]*$`)
+
+// isSliceAhead returns whether the '[' that was just scanned is the start of
+// a slice rather than a filter
+func isSliceAhead(s *scanner) bool {
+	rest := s.source[min(s.sx.Pos().Offset, len(s.source)):]
+	end := strings.IndexRune(rest, ']')
+	if end < 0 {
+		return false
+	}
+
+	return sliceRegexp.MatchString(rest[:end])
+}
+
+func (x *opSlice) Validate(previousType InputOrOutput) (slice *Slice) {
+	slice = &Slice{
+		sliceFields: sliceFields{
+			String: x.UserString(),
+			Type:   previousType,
+		},
+	}
+
+	if previousType.IOType != IOOT_Array {
+		errMessage := fmt.Sprintf("not an array (was %s); only arrays can be sliced", previousType.IOType)
+		slice.Error = &errMessage
+	}
+
+	return
+}
+
+func (x *opSlice) Type() OT_OpType { return OT_Slice }
+
+func (x *opSlice) Sprint(depth int) (out string) {
+	index := func(i *int) string {
+		if i == nil {
+			return ""
+		}
+		return strconv.Itoa(*i)
+	}
+
+	out = "[" + index(x.Start) + ":" + index(x.Stop)
+	if x.Step != nil {
+		out += ":" + index(x.Step)
+	}
+
+	return out + "]"
+}
+
+func (x *opSlice) Do(currentData, originalData any) (dataToUse any, err error) {
+	return x.do(evaluationFor(x), currentData, originalData)
+}
+
+func (x *opSlice) do(ev *evaluation, currentData, _ any) (dataToUse any, err error) {
+	if err = ev.enter(); err != nil {
+		return nil, err
+	}
+	defer ev.leave()
+
+	val, ok, wasStruct := getAsStructOrSlice(currentData)
+	if !ok || wasStruct {
+		return nil, fmt.Errorf("value was not array and cannot be sliced")
+	}
+
+	elements := val.([]any)
+	start, stop, step := x.indices(len(elements))
+
+	newOut := []any{}
+	for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+		newOut = append(newOut, elements[i])
+	}
+
+	return newOut, nil
+}
+
+// indices returns the first index, the index to stop before and the step for
+// an array of the length, in the same way as python does
+func (x *opSlice) indices(length int) (start, stop, step int) {
+	step = 1
+	if x.Step != nil {
+		step = *x.Step
+	}
+
+	lower, upper := 0, length
+	if step < 0 {
+		lower, upper = -1, length-1
+	}
+
+	bound := func(i *int, def int) int {
+		if i == nil {
+			return def
+		}
+
+		idx := *i
+		if idx < 0 {
+			idx += length
+		}
+
+		return max(lower, min(idx, upper))
+	}
+
+	if step < 0 {
+		return bound(x.Start, upper), bound(x.Stop, lower), step
+	}
+
+	return bound(x.Start, lower), bound(x.Stop, upper), step
+}
+
+func (x *opSlice) Parse(s *scanner, r rune) (nextR rune, err error) {
+	if r != '[' {
+		return r, erInvalid(s, '[')
+	}
+
+	// As ':' and '-' are ident runes, the slice is read as one or more idents
+	var text string
+	for r = s.Scan(); r != ']'; r = s.Scan() {
+		if r != sc.Ident {
+			return r, erInvalid(s, ']')
+		}
+		text += s.TokenText()
+	}
+	x.userString = "[" + text + "]"
+
+	parts := strings.Split(text, ":")
+	if len(parts) > 3 {
+		return r, erAt(s, "a slice can have at most a start, a stop and a step")
+	}
+
+	indices := []**int{&x.Start, &x.Stop, &x.Step}
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+
+		idx, err := strconv.Atoi(part)
+		if err != nil {
+			return r, erAt(s, "invalid slice index '%s'", part)
+		}
+		*indices[i] = &idx
+	}
+
+	if x.Step != nil && *x.Step == 0 {
+		return r, erAt(s, "slice step cannot be zero")
+	}
+
+	return s.Scan(), nil
+}
@@ -0,0 +1,215 @@
+package mpath
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	sc "text/scanner"
+
+	"github.com/pkg/errors"
+)
+
+// opWildcard selects all of the children of a map, struct or array, e.g.
+// $.steps.*.result; the children of maps are in the order of their keys, and
+// the children of structs are in the order their fields are declared
+type opWildcard struct {
+	// OfEach is set when the wildcard follows another wildcard or a recursive
+	// descent, so that it selects the children of each of the values that
+	// they selected (e.g. $.*.*)
+	OfEach bool
+	opCommon
+}
+
+// childValues returns the elements of an array, or the values of the fields of
+// a map or struct
+func childValues(ev *evaluation, val any) (values []any, ok bool) {
+	if out, ok, wasStruct := getAsStructOrSlice(val); ok && !wasStruct {
+		for _, v := range out.([]any) {
+			if _, ok := v.(string); !ok {
+				v = convertToDecimalIfNumber(v)
+			}
+			values = append(values, v)
+		}
+
+		return values, true
+	}
+
+	_, values, err := objectFields(ev, val, "")
+	if err != nil {
+		return nil, false
+	}
+
+	return values, true
+}
+
+func (x *opWildcard) Type() OT_OpType { return OT_Wildcard }
+
+func (x *opWildcard) Sprint(depth int) (out string) {
+	return "*"
+}
+
+func (x *opWildcard) Do(currentData, originalData any) (dataToUse any, err error) {
+	return x.do(evaluationFor(x), currentData, originalData)
+}
+
+func (x *opWildcard) do(ev *evaluation, currentData, _ any) (dataToUse any, err error) {
+	if err = ev.enter(); err != nil {
+		return nil, err
+	}
+	defer ev.leave()
+
+	var values []any
+	if x.OfEach {
+		parents, _ := childValues(ev, currentData)
+		for _, p := range parents {
+			// Values without children are skipped
+			children, _ := childValues(ev, p)
+			values = append(values, children...)
+		}
+	} else {
+		var ok bool
+		if values, ok = childValues(ev, currentData); !ok {
+			return nil, fmt.Errorf("value was not object or array and has no children")
+		}
+	}
+
+	if err = ev.checkCollectionSize(len(values)); err != nil {
+		return nil, err
+	}
+
+	if values == nil {
+		values = []any{}
+	}
+
+	return values, nil
+}
+
+func (x *opWildcard) Parse(s *scanner, r rune) (nextR rune, err error) {
+	if r != '*' {
+		return r, erInvalid(s, '*')
+	}
+	x.userString = "*"
+
+	return s.Scan(), nil
+}
+
+// opRecursiveDescent selects the values of the fields with the name at any
+// depth, e.g. $..consignmentNumber; the values are in the order they appear in
+// the data, and a value comes before any values that are within it
+type opRecursiveDescent struct {
+	IdentName string
+	opCommon
+}
+
+// referenceKey identifies a value that can be part of a cycle
+type referenceKey struct {
+	t   reflect.Type
+	ptr uintptr
+	len int
+}
+
+func (x *opRecursiveDescent) Type() OT_OpType { return OT_RecursiveDescent }
+
+func (x *opRecursiveDescent) Sprint(depth int) (out string) {
+	return "." + (&opPathIdent{IdentName: x.IdentName}).Sprint(depth)
+}
+
+func (x *opRecursiveDescent) Do(currentData, originalData any) (dataToUse any, err error) {
+	return x.do(evaluationFor(x), currentData, originalData)
+}
+
+func (x *opRecursiveDescent) do(ev *evaluation, currentData, _ any) (dataToUse any, err error) {
+	if err = ev.enter(); err != nil {
+		return nil, err
+	}
+	defer ev.leave()
+
+	out := []any{}
+
+	// Pointers, maps and slices that are being walked are skipped if they
+	// are found again within themselves
+	walking := map[referenceKey]bool{}
+
+	var walk func(val any) error
+	walk = func(val any) error {
+		if err := ev.cancelled(); err != nil {
+			return err
+		}
+
+		v := reflect.ValueOf(val)
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Map, reflect.Slice:
+			if v.IsNil() {
+				return nil
+			}
+
+			key := referenceKey{t: v.Type(), ptr: v.Pointer()}
+			if v.Kind() == reflect.Slice {
+				key.len = v.Len()
+			}
+			if walking[key] {
+				return nil
+			}
+			walking[key] = true
+			defer delete(walking, key)
+		}
+
+		if elements, ok, wasStruct := getAsStructOrSlice(val); ok && !wasStruct {
+			for _, e := range elements.([]any) {
+				if err := walk(e); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
+		keys, values, err := objectFields(ev, val, "")
+		if err != nil {
+			// Primitives have no fields
+			return nil
+		}
+
+		for i, key := range keys {
+			if strings.EqualFold(key, x.IdentName) {
+				out = append(out, values[i])
+				if err := ev.checkCollectionSize(len(out)); err != nil {
+					return err
+				}
+			}
+
+			if err := walk(values[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err = walk(currentData); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (x *opRecursiveDescent) Parse(s *scanner, r rune) (nextR rune, err error) {
+	if r != '.' {
+		return r, erInvalid(s, '.')
+	}
+
+	r = s.Scan()
+	isQuoted := r == '[' && isQuotedKeyAhead(s)
+	if !(r == sc.Ident && s.sx.Peek() != '(') && !isQuoted {
+		return r, errors.Wrap(erInvalid(s), "expected a field name after '..'")
+	}
+
+	ident := &opPathIdent{}
+	if nextR, err = ident.Parse(s, r); err != nil {
+		return nextR, err
+	}
+	x.IdentName = ident.IdentName
+	x.userString = "." + ident.UserString()
+
+	return nextR, nil
+}
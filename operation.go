@@ -17,6 +17,8 @@ type Operation interface {
 	UserString() string
 
 	PropagateNull() bool
+
+	do(ev *evaluation, currentData, originalData any) (dataToUse any, err error)
 }
 
 type opCommon struct {
@@ -42,15 +44,42 @@ const (
 	OT_Filter
 	OT_LogicalOperation
 	OT_Function
+	OT_Query
+	OT_Slice
+	OT_Wildcard
+	OT_RecursiveDescent
+	OT_Literal
+)
+
+// The segments of the paths returned by AddressedPaths and
+// GetRootFieldsAccessed that stand for a wildcard (e.g. $.steps.*.result is
+// ["steps", "*", "result"]) and a recursive descent (e.g. $..name is
+// ["**", "name"], and the root field "**.name")
+const (
+	WildcardSegment         = "*"
+	RecursiveDescentSegment = "**"
 )
 
 func GetRootFieldsAccessed(op Operation) (rootFieldsAccessed []string) {
 	accessed := map[string]struct{}{}
 
 	switch t := op.(type) {
+	case *opQuery:
+		for _, v := range t.Variables {
+			for _, val := range GetRootFieldsAccessed(v.Operation) {
+				accessed[val] = struct{}{}
+			}
+		}
+
+		for _, val := range GetRootFieldsAccessed(t.Operation) {
+			accessed[val] = struct{}{}
+		}
+
 	case *opPath:
 		thisPath := []string{}
-		haveSeenIdent := false
+		// The idents of a path that starts at a variable or a number are not
+		// root fields
+		haveSeenIdent := t.VariableName != "" || t.literal != nil
 		for _, pop := range t.Operations {
 			switch ot := pop.(type) {
 			case *opPathIdent:
@@ -58,6 +87,18 @@ func GetRootFieldsAccessed(op Operation) (rootFieldsAccessed []string) {
 					haveSeenIdent = true
 					thisPath = append(thisPath, ot.IdentName)
 				}
+			case *opWildcard:
+				if !haveSeenIdent && !t.IsFilter {
+					haveSeenIdent = true
+					thisPath = append(thisPath, WildcardSegment)
+				}
+			case *opRecursiveDescent:
+				if !haveSeenIdent && !t.IsFilter {
+					// The name is kept, as it is the field being looked
+					// for at any depth, e.g. "**.name"
+					haveSeenIdent = true
+					thisPath = append(thisPath, RecursiveDescentSegment, ot.IdentName)
+				}
 			case *opFilter:
 				for _, logOp := range ot.LogicalOperation.Operations {
 					for _, val := range GetRootFieldsAccessed(logOp) {
@@ -83,6 +124,13 @@ func GetRootFieldsAccessed(op Operation) (rootFieldsAccessed []string) {
 				accessed[val] = struct{}{}
 			}
 		}
+
+	case *opLiteral:
+		for _, m := range t.Members {
+			for _, val := range GetRootFieldsAccessed(m.Operation) {
+				accessed[val] = struct{}{}
+			}
+		}
 	}
 
 	for acc := range accessed {
@@ -97,11 +145,31 @@ func GetRootFieldsAccessed(op Operation) (rootFieldsAccessed []string) {
 func AddressedPaths(op Operation) (addressedPaths [][]string) {
 	// check stuff
 	switch v := op.(type) {
+	case *opQuery:
+		for _, decl := range v.Variables {
+			addressedPaths = append(addressedPaths, AddressedPaths(decl.Operation)...)
+		}
+
+		addressedPaths = append(addressedPaths, AddressedPaths(v.Operation)...)
+
 	case *opPath:
 		if len(v.Operations) < 1 {
 			break
 		}
 
+		if v.VariableName != "" || v.literal != nil {
+			// The idents of a path that starts at a variable or a number do
+			// not address the data, but the parameters of its functions might
+			for _, subOp := range v.Operations {
+				if f, ok := subOp.(*opFunction); ok {
+					for _, p := range f.Params.Paths() {
+						addressedPaths = append(addressedPaths, AddressedPaths(p.Value)...)
+					}
+				}
+			}
+			break
+		}
+
 		idents := []string{}
 
 		for _, subOp := range v.Operations {
@@ -109,6 +177,12 @@ func AddressedPaths(op Operation) (addressedPaths [][]string) {
 			case *opPathIdent:
 				idents = append(idents, vv.IdentName)
 
+			case *opWildcard:
+				idents = append(idents, WildcardSegment)
+
+			case *opRecursiveDescent:
+				idents = append(idents, RecursiveDescentSegment, vv.IdentName)
+
 			case *opFilter:
 				for _, logOp := range vv.LogicalOperation.Operations {
 					for _, val := range AddressedPaths(logOp) {
@@ -129,6 +203,11 @@ func AddressedPaths(op Operation) (addressedPaths [][]string) {
 		for _, p := range v.Operations {
 			addressedPaths = append(addressedPaths, AddressedPaths(p)...)
 		}
+
+	case *opLiteral:
+		for _, m := range v.Members {
+			addressedPaths = append(addressedPaths, AddressedPaths(m.Operation)...)
+		}
 	}
 
 	retAddressedPaths := make([][]string, 0, len(addressedPaths))
@@ -0,0 +1,193 @@
+package mpath
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+)
+
+// Plan is an operation that has been compiled to be run many times, such as
+// against each of a large number of values of the same Go type.
+//
+// A plan caches the struct field that each path ident resolves to for each
+// Go type it is run against, the regular expressions used as parameters of
+// DoesMatchRegex, ReplaceRegex and RemoveKeysByRegex, and the queries run by
+// Select, SortBy and DistinctBy. Each of these caches keeps at most
+// DefaultPlanCacheSize values, evicting the least recently used. A plan is safe
+// for concurrent use.
+type Plan struct {
+	op Operation
+
+	// registry is the registry that parsed the operation, which also parses
+	// the queries run by Select, SortBy and DistinctBy
+	registry *FunctionRegistry
+
+	// structFields is the struct field resolver at the time of compiling
+	structFields *structFieldResolver
+
+	// fieldIndexes is a cache of fieldIndexKey to fieldIndexResult
+	fieldIndexes *lruCache
+	// regexps is a cache of pattern to *regexp.Regexp
+	regexps *lruCache
+	// operations is a cache of query to Operation
+	operations *lruCache
+}
+
+type fieldIndexKey struct {
+	typ       reflect.Type
+	identName string
+}
+
+type fieldIndexResult struct {
+	index []int
+	found bool
+}
+
+// regexParamFuncs are the functions that take a regular expression as their
+// first parameter
+var regexParamFuncs = map[FT_FunctionType]bool{
+	FT_DoesMatchRegex:    true,
+	FT_ReplaceRegex:      true,
+	FT_RemoveKeysByRegex: true,
+}
+
+// Compile turns the operation into a plan. The regular expressions that are
+// passed to functions as literal strings are compiled immediately, so an
+// invalid regular expression is returned as an error.
+func Compile(op Operation) (plan *Plan, err error) {
+	if op == nil {
+		return nil, fmt.Errorf("no operation to compile")
+	}
+
+	plan = &Plan{
+		op:           op,
+		registry:     registryOf(op),
+		structFields: getStructFieldResolver(),
+		fieldIndexes: newLRUCache(DefaultPlanCacheSize),
+		regexps:      newLRUCache(DefaultPlanCacheSize),
+		operations:   newLRUCache(DefaultPlanCacheSize),
+	}
+
+	walkOperations(op, func(o Operation) {
+		f, ok := o.(*opFunction)
+		if err != nil || !ok || !regexParamFuncs[f.FunctionType] || len(f.Params) == 0 {
+			return
+		}
+
+		if p, ok := f.Params[0].(*FP_String); ok {
+			if _, rErr := plan.regexp(p.Value); rErr != nil {
+				err = fmt.Errorf("func %s: regular expression '%s' is invalid: %w", f.FunctionType, p.Value, rErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// Do runs the plan against the data.
+func (p *Plan) Do(data any) (dataToUse any, err error) {
+	return p.DoContext(context.Background(), data, EvalOptions{})
+}
+
+// DoContext runs the plan against the data, in the same way as the package
+// level DoContext.
+func (p *Plan) DoContext(ctx context.Context, data any, opts EvalOptions) (dataToUse any, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, fmt.Errorf("evaluation cancelled: %w", err)
+	}
+
+	ev := newEvaluation(ctx, opts)
+	ev.plan = p
+	ev.registry = p.registry
+
+	return p.op.do(ev, data, data)
+}
+
+// Operation returns the operation that the plan was compiled from.
+func (p *Plan) Operation() Operation {
+	return p.op
+}
+
+func (p *Plan) fieldIndex(t reflect.Type, identName string) (index []int, found bool) {
+	key := fieldIndexKey{typ: t, identName: identName}
+	if res, ok := p.fieldIndexes.get(key); ok {
+		r := res.(fieldIndexResult)
+		return r.index, r.found
+	}
+
+	index, found = p.structFields.fieldIndex(t, identName)
+	p.fieldIndexes.add(key, fieldIndexResult{index: index, found: found})
+
+	return
+}
+
+func (p *Plan) regexp(pattern string) (*regexp.Regexp, error) {
+	if exp, ok := p.regexps.get(pattern); ok {
+		return exp.(*regexp.Regexp), nil
+	}
+
+	exp, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	p.regexps.add(pattern, exp)
+
+	return exp, nil
+}
+
+func (p *Plan) parse(query string) (op Operation, err error) {
+	if op, ok := p.operations.get(query); ok {
+		return op.(Operation), nil
+	}
+
+	if op, err = p.registry.ParseString(query); err != nil {
+		return nil, err
+	}
+	p.operations.add(query, op)
+
+	return op, nil
+}
+
+// walkOperations calls fn for the operation and each operation within it
+func walkOperations(op Operation, fn func(Operation)) {
+	if op == nil {
+		return
+	}
+
+	fn(op)
+
+	switch t := op.(type) {
+	case *opQuery:
+		for _, v := range t.Variables {
+			walkOperations(v.Operation, fn)
+		}
+		walkOperations(t.Operation, fn)
+	case *opPath:
+		for _, o := range t.Operations {
+			walkOperations(o, fn)
+		}
+	case *opFilter:
+		walkOperations(t.LogicalOperation, fn)
+	case *opLogicalOperation:
+		for _, o := range t.Operations {
+			walkOperations(o, fn)
+		}
+	case *opLiteral:
+		for _, m := range t.Members {
+			walkOperations(m.Operation, fn)
+		}
+	case *opFunction:
+		for _, p := range t.Params {
+			switch pt := p.(type) {
+			case *FP_Path:
+				walkOperations(pt.Value, fn)
+			case *FP_LogicalOperation:
+				walkOperations(pt.Value, fn)
+			}
+		}
+	}
+}
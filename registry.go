@@ -0,0 +1,265 @@
+package mpath
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var (
+	ErrFunctionAlreadyRegistered = fmt.Errorf("function is already registered")
+	ErrInvalidFunctionDescriptor = fmt.Errorf("invalid function descriptor")
+)
+
+// FunctionRegistry is a set of functions that can be called from a query.
+//
+// A new registry contains all of the built in functions; further functions can
+// be added with Register. Queries parsed by a registry can only call the
+// functions that the registry knew about at the time of parsing, and a registry
+// never affects queries parsed by any other registry.
+type FunctionRegistry struct {
+	mu        sync.RWMutex
+	functions map[FT_FunctionType]FunctionDescriptor
+
+	// operationCache holds the operations parsed by CueValidate, and
+	// cueValueCache holds the cue files it compiled
+	operationCache Cache
+	cueValueCache  Cache
+}
+
+// defaultRegistry is used by the package level functions (e.g. ParseString);
+// it is set in init as the built in functions refer back to ParseString
+var defaultRegistry *FunctionRegistry
+
+func init() {
+	defaultRegistry = NewFunctionRegistry()
+}
+
+// NewFunctionRegistry returns a registry that contains the built in functions.
+func NewFunctionRegistry() *FunctionRegistry {
+	r := &FunctionRegistry{
+		functions:      make(map[FT_FunctionType]FunctionDescriptor, len(funcMap)),
+		operationCache: NewLRUCache(DefaultOperationCacheSize),
+		cueValueCache:  NewLRUCache(DefaultCueValueCacheSize),
+	}
+
+	for k, v := range funcMap {
+		r.functions[k] = v
+	}
+
+	return r
+}
+
+// Register adds a custom function to the registry. An error is returned if a
+// function with the same name already exists, or if the descriptor is not
+// internally consistent.
+func (r *FunctionRegistry) Register(fd FunctionDescriptor) error {
+	if err := validateFunctionDescriptor(fd); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidFunctionDescriptor, fd.Name, err)
+	}
+
+	if fd.ExplanationFunc == nil {
+		description := fd.Description
+		fd.ExplanationFunc = func(tf Function) string {
+			return description
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.functions[fd.Name]; ok {
+		return fmt.Errorf("%w: %s", ErrFunctionAlreadyRegistered, fd.Name)
+	}
+
+	r.functions[fd.Name] = fd
+
+	return nil
+}
+
+// ListFunctions returns the descriptors of all functions in the registry.
+func (r *FunctionRegistry) ListFunctions() (funcs map[FT_FunctionType]FunctionDescriptor) {
+	if r == nil {
+		r = defaultRegistry
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	funcs = make(map[FT_FunctionType]FunctionDescriptor, len(r.functions))
+	for k, v := range r.functions {
+		funcs[k] = v
+	}
+
+	return
+}
+
+// registryOf returns the registry that parsed the operation, which is the
+// default registry if none of its operations know it
+func registryOf(op Operation) (reg *FunctionRegistry) {
+	walkOperations(op, func(o Operation) {
+		if reg != nil {
+			return
+		}
+
+		switch t := o.(type) {
+		case *opPath:
+			reg = t.registry
+		case *opPathIdent:
+			reg = t.registry
+		case *opFunction:
+			reg = t.registry
+		case *opLiteral:
+			reg = t.registry
+		}
+	})
+
+	if reg == nil {
+		reg = defaultRegistry
+	}
+
+	return
+}
+
+// ParseString converts a query to a tree of operations that may call any of
+// the functions in the registry.
+func (r *FunctionRegistry) ParseString(ss string) (topOp Operation, err error) {
+	return r.ParseReadSeeker(strings.NewReader(ss))
+}
+
+// ParseReadSeeker takes an io.ReadSeeker and parses it into an operation tree
+// that may call any of the functions in the registry.
+func (r *FunctionRegistry) ParseReadSeeker(rs io.ReadSeeker) (topOp Operation, err error) {
+	return parseReadSeeker(r, rs)
+}
+
+// SetCaches replaces the caches used by CueValidate for the parsed queries and
+// the compiled cue files; a nil cache leaves the current one in place.
+func (r *FunctionRegistry) SetCaches(operations, cueValues Cache) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if operations != nil {
+		r.operationCache = operations
+	}
+
+	if cueValues != nil {
+		r.cueValueCache = cueValues
+	}
+}
+
+// CacheStats returns the statistics of the caches used by CueValidate.
+func (r *FunctionRegistry) CacheStats() (operations, cueValues CacheStats) {
+	operationCache, cueValueCache := r.caches()
+	return operationCache.Stats(), cueValueCache.Stats()
+}
+
+// ResetCaches empties the caches used by CueValidate.
+func (r *FunctionRegistry) ResetCaches() {
+	operationCache, cueValueCache := r.caches()
+	operationCache.Reset()
+	cueValueCache.Reset()
+}
+
+func (r *FunctionRegistry) caches() (operations, cueValues Cache) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.operationCache, r.cueValueCache
+}
+
+func (r *FunctionRegistry) lookup(ft FT_FunctionType) (fd FunctionDescriptor, ok bool) {
+	if r == nil {
+		r = defaultRegistry
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	fd, ok = r.functions[ft]
+	return
+}
+
+func validateFunctionDescriptor(fd FunctionDescriptor) error {
+	if fd.Name == "" {
+		return fmt.Errorf("name must not be empty")
+	}
+
+	for i, c := range fd.Name {
+		if invalidRunes[c] || unicode.IsSpace(c) || !unicode.IsPrint(c) || c == '?' {
+			return fmt.Errorf("name contains invalid character '%s'", string(c))
+		}
+
+		if i == 0 && !unicode.IsLetter(c) {
+			return fmt.Errorf("name must start with a letter")
+		}
+	}
+
+	if fd.Fn == nil {
+		return fmt.Errorf("no implementation provided")
+	}
+
+	if err := validateInputOrOutput(fd.ValidOn); err != nil {
+		return fmt.Errorf("validOn: %w", err)
+	}
+
+	if err := validateInputOrOutput(fd.Returns); err != nil {
+		return fmt.Errorf("returns: %w", err)
+	}
+
+	if fd.ReturnsKnownValues && fd.ValidOn.IOType != IOOT_Array {
+		return fmt.Errorf("only functions valid on arrays can return known values")
+	}
+
+	names := map[string]bool{}
+	for i, pd := range fd.Params {
+		if pd.Name == "" {
+			return fmt.Errorf("parameter at position %d has no name", i)
+		}
+
+		if names[pd.Name] {
+			return fmt.Errorf("parameter '%s': the name is used more than once", pd.Name)
+		}
+		names[pd.Name] = true
+
+		if err := validateInputOrOutput(pd.InputOrOutput); err != nil {
+			return fmt.Errorf("parameter '%s': %w", pd.Name, err)
+		}
+
+		if pd.IOType == IOOT_Variadic && i != len(fd.Params)-1 {
+			return fmt.Errorf("parameter '%s': only the last parameter can be variadic", pd.Name)
+		}
+
+		if i > 0 && isOptionalParam(fd.Params[i-1]) && !isOptionalParam(pd) && pd.IOType != IOOT_Variadic {
+			return fmt.Errorf("parameter '%s': required parameters cannot follow the optional parameter '%s'", pd.Name, fd.Params[i-1].Name)
+		}
+	}
+
+	return nil
+}
+
+// optionalParamSuffix ends the names of parameters that can be left out,
+// e.g. "padding (optional)"
+const optionalParamSuffix = "(optional)"
+
+func isOptionalParam(pd ParameterDescriptor) bool {
+	return strings.HasSuffix(pd.Name, optionalParamSuffix)
+}
+
+func validateInputOrOutput(iot InputOrOutput) error {
+	switch iot.Type {
+	case PT_String, PT_Bytes, PT_Boolean, PT_Number, PT_Any, PT_Object, PT_DateTime, PT_TimeZone:
+	default:
+		return fmt.Errorf("unknown type '%s'", iot.Type)
+	}
+
+	switch iot.IOType {
+	case IOOT_Single, IOOT_Array, IOOT_Variadic:
+	default:
+		return fmt.Errorf("unknown io type '%s'", iot.IOType)
+	}
+
+	return nil
+}
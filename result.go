@@ -0,0 +1,278 @@
+package mpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/shopspring/decimal"
+)
+
+// ResultType classifies the values that are returned by running an operation.
+type ResultType string
+
+const (
+	RT_string   ResultType = "string"
+	RT_decimal  ResultType = "decimal"
+	RT_bool     ResultType = "bool"
+	RT_array    ResultType = "array"
+	RT_object   ResultType = "object"
+	RT_datetime ResultType = "datetime"
+	RT_null     ResultType = "null"
+	RT_unknown  ResultType = "unknown"
+)
+
+var decimalType = reflect.TypeOf(decimal.Decimal{})
+
+// ResultTypeOf returns the type of a value returned by running an operation.
+// Numbers of any Go type are decimals, times are datetimes, and other structs
+// and maps are objects.
+func ResultTypeOf(val any) ResultType {
+	if val == nil {
+		return RT_null
+	}
+
+	v := reflect.ValueOf(val)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return RT_null
+		}
+		v = v.Elem()
+	}
+
+	switch v.Type() {
+	case decimalType:
+		return RT_decimal
+	case timeType:
+		return RT_datetime
+	}
+
+	return resultTypeOfKind(v.Kind())
+}
+
+// resultTypeOfType returns the type of result that can be decoded into the Go
+// type; it is empty if any type of result can be
+func resultTypeOfType(t reflect.Type) ResultType {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t {
+	case decimalType:
+		return RT_decimal
+	case timeType:
+		return RT_datetime
+	}
+
+	if t.Kind() == reflect.Interface {
+		return ""
+	}
+
+	return resultTypeOfKind(t.Kind())
+}
+
+func resultTypeOfKind(k reflect.Kind) ResultType {
+	switch {
+	case isNumberKind(k):
+		return RT_decimal
+	case k == reflect.String:
+		return RT_string
+	case k == reflect.Bool:
+		return RT_bool
+	case k == reflect.Slice || k == reflect.Array:
+		return RT_array
+	case k == reflect.Map || k == reflect.Struct:
+		return RT_object
+	}
+
+	return RT_unknown
+}
+
+// ResultTypeError is returned when the result of an operation is not of the
+// type that was asked for.
+type ResultTypeError struct {
+	Expected ResultType
+	Actual   ResultType
+}
+
+func (e *ResultTypeError) Error() string {
+	return fmt.Sprintf("expected a result of type '%s', but got '%s'", e.Expected, e.Actual)
+}
+
+// Eval runs the operation against the data and decodes the result into T.
+// See DecodeResult for how the result is decoded.
+func Eval[T any](op Operation, data any) (out T, err error) {
+	result, err := op.Do(data, data)
+	if err != nil {
+		return out, err
+	}
+
+	return DecodeResult[T](result)
+}
+
+// DecodeResult decodes a value returned by running an operation into T. A
+// result that is already a T is returned as is; otherwise the result must be
+// of the matching ResultType (e.g. an object for a struct or map, or a decimal
+// for any number type), and is decoded in the same way as encoding/json would
+// decode it, with decimals at any depth decoded as numbers. A null result can be decoded into a pointer, slice, map or
+// interface, which are left as nil.
+func DecodeResult[T any](result any) (out T, err error) {
+	if v, ok := result.(T); ok {
+		return v, nil
+	}
+
+	target := reflect.TypeOf(&out).Elem()
+	expected := resultTypeOfType(target)
+	actual := ResultTypeOf(result)
+
+	if actual == RT_null {
+		switch target.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface:
+			return out, nil
+		}
+	}
+
+	if expected != "" && expected != actual {
+		return out, &ResultTypeError{Expected: expected, Actual: actual}
+	}
+
+	b, err := json.Marshal(jsonCompatible(result))
+	if err != nil {
+		return out, fmt.Errorf("failed to encode result of type '%s': %w", actual, err)
+	}
+
+	if err = json.Unmarshal(b, &out); err != nil {
+		return out, fmt.Errorf("failed to decode result of type '%s' into %T: %w", actual, out, err)
+	}
+
+	return out, nil
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// jsonCompatible replaces the decimals in the result with json numbers, so
+// that they can be decoded into any number type. Decimals are found at any
+// depth, including within structs and typed maps and slices, which are
+// replaced with maps and slices that encode to the same json.
+func jsonCompatible(val any) any {
+	if d, ok := val.(decimal.Decimal); ok {
+		return json.Number(d.String())
+	}
+
+	if val == nil {
+		return nil
+	}
+
+	v := reflect.ValueOf(val)
+	if v.Type().Implements(jsonMarshalerType) && reflect.PointerTo(decimalType) != v.Type() {
+		// e.g. a time.Time, which encodes itself
+		return val
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return jsonCompatible(v.Elem().Interface())
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 || (v.Kind() == reflect.Slice && v.IsNil()) {
+			// Bytes are encoded as base64, and a nil slice as null
+			return val
+		}
+
+		out := make([]any, v.Len())
+		for i := range out {
+			out[i] = jsonCompatible(v.Index(i).Interface())
+		}
+		return out
+
+	case reflect.Map:
+		if v.IsNil() || v.Type().Key().Kind() != reflect.String {
+			return val
+		}
+
+		out := make(map[string]any, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			out[it.Key().String()] = jsonCompatible(it.Value().Interface())
+		}
+		return out
+
+	case reflect.Struct:
+		out := map[string]any{}
+		for _, f := range jsonStructFields.fieldsOf(v.Type()) {
+			if f.embedded {
+				continue
+			}
+
+			fv, err := v.FieldByIndexErr(f.index)
+			if err != nil || !fv.CanInterface() {
+				// The field is within a nil embedded pointer
+				continue
+			}
+			out[f.name] = jsonCompatible(fv.Interface())
+		}
+		return out
+	}
+
+	return val
+}
+
+// jsonStructFields names the fields of structs in the same way as
+// encoding/json
+var jsonStructFields = structFieldResolverFor([]string{"json"})
+
+// EvalBool runs the operation against the data and returns the result, which
+// must be a boolean.
+func EvalBool(op Operation, data any) (out bool, err error) {
+	return Eval[bool](op, data)
+}
+
+// EvalString runs the operation against the data and returns the result,
+// which must be a string.
+func EvalString(op Operation, data any) (out string, err error) {
+	return Eval[string](op, data)
+}
+
+// EvalDecimal runs the operation against the data and returns the result,
+// which must be a number.
+func EvalDecimal(op Operation, data any) (out decimal.Decimal, err error) {
+	result, err := op.Do(data, data)
+	if err != nil {
+		return out, err
+	}
+
+	if d, ok := result.(decimal.Decimal); ok {
+		return d, nil
+	}
+
+	if rt := ResultTypeOf(result); rt != RT_decimal {
+		return out, &ResultTypeError{Expected: RT_decimal, Actual: rt}
+	}
+
+	_, out = convertToDecimalIfNumberAndCheck(reflect.Indirect(reflect.ValueOf(result)).Interface())
+
+	return out, nil
+}
+
+// EvalSlice runs the operation against the data and returns the result, which
+// must be an array. Numbers in the array are returned as decimals.
+func EvalSlice(op Operation, data any) (out []any, err error) {
+	result, err := op.Do(data, data)
+	if err != nil {
+		return out, err
+	}
+
+	if rt := ResultTypeOf(result); rt != RT_array {
+		return nil, &ResultTypeError{Expected: RT_array, Actual: rt}
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(result))
+	out = make([]any, v.Len())
+	for i := range out {
+		out[i] = convertToDecimalIfNumber(v.Index(i).Interface())
+	}
+
+	return out, nil
+}
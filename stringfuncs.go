@@ -0,0 +1,511 @@
+package mpath
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxStringLength limits the length of the strings made by Repeat, PadLeft
+// and PadRight
+const maxStringLength = 1 << 20
+
+// stringFunc runs fn on the value, which must be a string. Like the other
+// string functions, fn should count in characters (runes) rather than bytes.
+func stringFunc(rtParams FunctionParameterTypes, val any, fn func(string) any, fnName FT_FunctionType) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(0); !ok {
+		return nil, errNumParams(fnName, 0, got)
+	}
+
+	if valIfc, ok := val.(string); ok {
+		return fn(valIfc), nil
+	}
+
+	return nil, fmt.Errorf("func %s: value wasn't string", fnName)
+}
+
+func paramsGetIntAt(rtParams FunctionParameterTypes, position int) (i int, err error) {
+	if position >= len(rtParams) {
+		return 0, fmt.Errorf("no parameter at position %d", position)
+	}
+
+	d, err := paramsGetFirstOfNumber(rtParams[position : position+1])
+	if err != nil {
+		return 0, err
+	}
+
+	if !d.IsInteger() {
+		return 0, fmt.Errorf("parameter at position %d must be an integer", position)
+	}
+
+	return int(d.IntPart()), nil
+}
+
+const FT_ToUpper FT_FunctionType = "ToUpper"
+
+func func_ToUpper(rtParams FunctionParameterTypes, val any) (any, error) {
+	return stringFunc(rtParams, val, func(s string) any { return strings.ToUpper(s) }, FT_ToUpper)
+}
+
+const FT_ToLower FT_FunctionType = "ToLower"
+
+func func_ToLower(rtParams FunctionParameterTypes, val any) (any, error) {
+	return stringFunc(rtParams, val, func(s string) any { return strings.ToLower(s) }, FT_ToLower)
+}
+
+const FT_Title FT_FunctionType = "Title"
+
+func func_Title(rtParams FunctionParameterTypes, val any) (any, error) {
+	return stringFunc(rtParams, val, func(s string) any { return title(s) }, FT_Title)
+}
+
+// title makes the first letter of each word upper case, and the rest of the
+// letters lower case; words are separated by anything other than letters,
+// digits and apostrophes (so "o'brien" is "O'brien")
+func title(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+
+	inWord := false
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if inWord {
+				sb.WriteRune(unicode.ToLower(r))
+			} else {
+				sb.WriteRune(unicode.ToTitle(r))
+			}
+			inWord = true
+		case r == '\'' && inWord:
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune(r)
+			inWord = false
+		}
+	}
+
+	return sb.String()
+}
+
+const FT_TrimSpace FT_FunctionType = "TrimSpace"
+
+func func_TrimSpace(rtParams FunctionParameterTypes, val any) (any, error) {
+	return stringFunc(rtParams, val, func(s string) any { return strings.TrimSpace(s) }, FT_TrimSpace)
+}
+
+const FT_Length FT_FunctionType = "Length"
+
+func func_Length(rtParams FunctionParameterTypes, val any) (any, error) {
+	return stringFunc(rtParams, val, func(s string) any {
+		return decimal.NewFromInt(int64(utf8.RuneCountInString(s)))
+	}, FT_Length)
+}
+
+const FT_Split FT_FunctionType = "Split"
+
+func func_Split(rtParams FunctionParameterTypes, val any) (any, error) {
+	sep, err := paramsGetFirstOfString(rtParams)
+	if err != nil {
+		return errAny(FT_Split, err)
+	}
+
+	valIfc, ok := val.(string)
+	if !ok {
+		return nil, fmt.Errorf("func %s: value wasn't string", FT_Split)
+	}
+
+	// An empty string has no parts, rather than one empty part
+	out := []any{}
+	if valIfc == "" {
+		return out, nil
+	}
+
+	for _, part := range strings.Split(valIfc, sep) {
+		out = append(out, part)
+	}
+
+	return out, nil
+}
+
+const FT_Join FT_FunctionType = "Join"
+
+func func_Join(rtParams FunctionParameterTypes, val any) (any, error) {
+	sep, err := paramsGetFirstOfString(rtParams)
+	if err != nil {
+		return errString(FT_Join, err)
+	}
+
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("func %s: value wasn't array", FT_Join)
+	}
+
+	parts := make([]string, v.Len())
+	for i := range parts {
+		switch t := convertToDecimalIfNumber(v.Index(i).Interface()).(type) {
+		case string:
+			parts[i] = t
+		case decimal.Decimal:
+			parts[i] = t.String()
+		case bool:
+			parts[i] = fmt.Sprint(t)
+		case nil:
+			// null elements are empty
+		default:
+			return "", fmt.Errorf("func %s: cannot join element of type %T", FT_Join, t)
+		}
+	}
+
+	return strings.Join(parts, sep), nil
+}
+
+const FT_IndexOf FT_FunctionType = "IndexOf"
+
+func func_IndexOf(rtParams FunctionParameterTypes, val any) (any, error) {
+	substr, err := paramsGetFirstOfString(rtParams)
+	if err != nil {
+		return errAny(FT_IndexOf, err)
+	}
+
+	valIfc, ok := val.(string)
+	if !ok {
+		return nil, fmt.Errorf("func %s: value wasn't string", FT_IndexOf)
+	}
+
+	i := strings.Index(valIfc, substr)
+	if i > 0 {
+		i = utf8.RuneCountInString(valIfc[:i])
+	}
+
+	return decimal.NewFromInt(int64(i)), nil
+}
+
+const FT_Substring FT_FunctionType = "Substring"
+
+func func_Substring(rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(2); !ok {
+		return "", errNumParams(FT_Substring, 2, got)
+	}
+
+	start, err := paramsGetIntAt(rtParams, 0)
+	if err != nil {
+		return errString(FT_Substring, err)
+	}
+
+	length, err := paramsGetIntAt(rtParams, 1)
+	if err != nil {
+		return errString(FT_Substring, err)
+	}
+
+	if start < 0 || length < 0 {
+		return "", fmt.Errorf("func %s: start and length must not be negative", FT_Substring)
+	}
+
+	valIfc, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("func %s: value wasn't string", FT_Substring)
+	}
+
+	// The substring is cut short at the end of the string
+	runes := []rune(valIfc)
+	if start >= len(runes) {
+		return "", nil
+	}
+
+	return string(runes[start:min(start+length, len(runes))]), nil
+}
+
+func padFunc(rtParams FunctionParameterTypes, val any, left bool, fnName FT_FunctionType) (string, error) {
+	got, _ := rtParams.checkLengthOfParams(-1)
+	if got != 1 && got != 2 {
+		return "", fmt.Errorf("(%s) expected 1 or 2 params, got %d", fnName, got)
+	}
+
+	width, err := paramsGetIntAt(rtParams, 0)
+	if err != nil {
+		return errString(fnName, err)
+	}
+	if width > maxStringLength {
+		return "", fmt.Errorf("func %s: cannot pad to more than %d characters", fnName, maxStringLength)
+	}
+
+	pad := " "
+	if got == 2 {
+		if pad, err = paramsGetStringAt(rtParams, 1); err != nil {
+			return errString(fnName, err)
+		}
+		if pad == "" {
+			return "", fmt.Errorf("func %s: padding must not be an empty string", fnName)
+		}
+	}
+
+	valIfc, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("func %s: value wasn't string", fnName)
+	}
+
+	missing := width - utf8.RuneCountInString(valIfc)
+	if missing <= 0 {
+		return valIfc, nil
+	}
+
+	padRunes := []rune(strings.Repeat(pad, missing/utf8.RuneCountInString(pad)+1))[:missing]
+
+	if left {
+		return string(padRunes) + valIfc, nil
+	}
+
+	return valIfc + string(padRunes), nil
+}
+
+const FT_PadLeft FT_FunctionType = "PadLeft"
+
+func func_PadLeft(rtParams FunctionParameterTypes, val any) (any, error) {
+	return padFunc(rtParams, val, true, FT_PadLeft)
+}
+
+const FT_PadRight FT_FunctionType = "PadRight"
+
+func func_PadRight(rtParams FunctionParameterTypes, val any) (any, error) {
+	return padFunc(rtParams, val, false, FT_PadRight)
+}
+
+const FT_Repeat FT_FunctionType = "Repeat"
+
+func func_Repeat(rtParams FunctionParameterTypes, val any) (any, error) {
+	return stringPartFunc(rtParams, val, func(s string, i int) (string, error) {
+		if i < 0 {
+			return "", fmt.Errorf("func %s: count must not be negative", FT_Repeat)
+		}
+		if i > 0 && len(s) > maxStringLength/i {
+			return "", fmt.Errorf("func %s: cannot make a string of more than %d bytes", FT_Repeat, maxStringLength)
+		}
+
+		return strings.Repeat(s, i), nil
+	}, FT_Repeat)
+}
+
+// normalisation is how strings are normalised before they are compared by the
+// fold functions (e.g. EqualFold)
+type normalisation string
+
+const (
+	nm_None            normalisation = ""
+	nm_NFC             normalisation = "NFC"
+	nm_NFKD            normalisation = "NFKD"
+	nm_StripDiacritics normalisation = "StripDiacritics"
+)
+
+func parseNormalisation(s string) (normalisation, error) {
+	switch n := normalisation(s); n {
+	case nm_NFC, nm_NFKD, nm_StripDiacritics:
+		return n, nil
+	}
+
+	return nm_None, fmt.Errorf("'%s' is not a normalisation; use one of NFC, NFKD or StripDiacritics", s)
+}
+
+// explain describes the comparison made with the normalisation
+func (n normalisation) explain() string {
+	switch n {
+	case nm_NFC:
+		return "ignoring case, after NFC normalisation"
+	case nm_NFKD:
+		return "ignoring case, after NFKD normalisation"
+	case nm_StripDiacritics:
+		return "ignoring case and accents"
+	}
+
+	return "ignoring case"
+}
+
+// folder returns a func that normalises and case folds strings so that they
+// can be compared exactly; it must not be shared between goroutines
+func (n normalisation) folder() func(string) string {
+	var t transform.Transformer
+	switch n {
+	case nm_NFC:
+		t = norm.NFC
+	case nm_NFKD:
+		t = norm.NFKD
+	case nm_StripDiacritics:
+		t = transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	}
+
+	caser := cases.Fold()
+
+	return func(s string) string {
+		if t != nil {
+			if out, _, err := transform.String(t, s); err == nil {
+				s = out
+			}
+		}
+
+		return caser.String(s)
+	}
+}
+
+// explainedNormalisation returns the normalisation given as a parameter in an
+// explanation, where string literals are quoted
+func explainedNormalisation(param *FunctionParameter) (normalisation, bool) {
+	lit, err := strconv.Unquote(param.String)
+	if err != nil {
+		return nm_None, false
+	}
+
+	n, err := parseNormalisation(lit)
+
+	return n, err == nil
+}
+
+// foldExplanation explains a fold function with a single value to compare
+// against and an optional normalisation, e.g. "is equal to {{x}}, ignoring
+// case"
+func foldExplanation(tf Function, format string) string {
+	switch len(tf.FunctionParameters) {
+	case 1:
+		return fmt.Sprintf(format+", %s", tf.FunctionParameters[0].String, nm_None.explain())
+	case 2:
+		n, ok := explainedNormalisation(tf.FunctionParameters[1])
+		if !ok {
+			return ""
+		}
+		return fmt.Sprintf(format+", %s", tf.FunctionParameters[0].String, n.explain())
+	}
+
+	return ""
+}
+
+// anyOfFoldExplanation explains AnyOfFold and AnyOfFoldNormalised with the
+// values to compare against
+func anyOfFoldExplanation(values []*FunctionParameter, n normalisation) string {
+	if len(values) == 0 {
+		return "will return false as there are no parameters to compare against"
+	}
+
+	paramStrs := []string{}
+	for _, ps := range values {
+		paramStrs = append(paramStrs, fmt.Sprintf("{{%s}}", ps.String))
+	}
+
+	return fmt.Sprintf("checks whether the value is any of %s, %s", strings.Join(paramStrs, ", "), n.explain())
+}
+
+func stringFoldFunc(rtParams FunctionParameterTypes, val any, fn func(string, string) bool, fnName FT_FunctionType) (bool, error) {
+	got, _ := rtParams.checkLengthOfParams(-1)
+	if got != 1 && got != 2 {
+		return false, fmt.Errorf("(%s) expected 1 or 2 params, got %d", fnName, got)
+	}
+
+	param, err := paramsGetStringAt(rtParams, 0)
+	if err != nil {
+		return errBool(fnName, err)
+	}
+
+	n := nm_None
+	if got == 2 {
+		s, err := paramsGetStringAt(rtParams, 1)
+		if err != nil {
+			return errBool(fnName, err)
+		}
+		if n, err = parseNormalisation(s); err != nil {
+			return errBool(fnName, err)
+		}
+	}
+
+	valIfc, ok := val.(string)
+	if !ok {
+		return false, fmt.Errorf("func %s: value wasn't string", fnName)
+	}
+
+	fold := n.folder()
+
+	return fn(fold(valIfc), fold(param)), nil
+}
+
+const FT_EqualFold FT_FunctionType = "EqualFold"
+
+func func_EqualFold(rtParams FunctionParameterTypes, val any) (any, error) {
+	return stringFoldFunc(rtParams, val, func(a, b string) bool { return a == b }, FT_EqualFold)
+}
+
+const FT_ContainsFold FT_FunctionType = "ContainsFold"
+
+func func_ContainsFold(rtParams FunctionParameterTypes, val any) (any, error) {
+	return stringFoldFunc(rtParams, val, strings.Contains, FT_ContainsFold)
+}
+
+const FT_PrefixFold FT_FunctionType = "PrefixFold"
+
+func func_PrefixFold(rtParams FunctionParameterTypes, val any) (any, error) {
+	return stringFoldFunc(rtParams, val, strings.HasPrefix, FT_PrefixFold)
+}
+
+const FT_AnyOfFold FT_FunctionType = "AnyOfFold"
+
+func func_AnyOfFold(rtParams FunctionParameterTypes, val any) (any, error) {
+	return anyOfFold(FT_AnyOfFold, rtParams, val, nm_None)
+}
+
+const FT_AnyOfFoldNormalised FT_FunctionType = "AnyOfFoldNormalised"
+
+func func_AnyOfFoldNormalised(rtParams FunctionParameterTypes, val any) (any, error) {
+	if len(rtParams) == 0 {
+		return nil, errNumParams(FT_AnyOfFoldNormalised, 1, 0)
+	}
+
+	s, err := paramsGetStringAt(rtParams, 0)
+	if err != nil {
+		return errBool(FT_AnyOfFoldNormalised, err)
+	}
+
+	n, err := parseNormalisation(s)
+	if err != nil {
+		return errBool(FT_AnyOfFoldNormalised, err)
+	}
+
+	return anyOfFold(FT_AnyOfFoldNormalised, rtParams[1:], val, n)
+}
+
+// anyOfFold checks whether the value matches any of the parameters once both
+// have been normalised and case folded
+func anyOfFold(fnName FT_FunctionType, rtParams FunctionParameterTypes, val any, n normalisation) (any, error) {
+	values := make([]string, 0, len(rtParams))
+	for i := range rtParams {
+		s, err := paramsGetStringAt(rtParams, i)
+		if err != nil {
+			return errBool(fnName, err)
+		}
+		values = append(values, s)
+	}
+
+	valIfc, ok := val.(string)
+	if !ok {
+		return false, fmt.Errorf("func %s: value wasn't string", fnName)
+	}
+
+	fold := n.folder()
+	valIfc = fold(valIfc)
+
+	for _, v := range values {
+		if fold(v) == valIfc {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,268 @@
+package mpath
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultStructTagPrecedence is the order in which struct tags are used to name
+// the fields of a struct, unless changed with SetStructTagPrecedence
+var defaultStructTagPrecedence = []string{"mpath", "json", "yaml"}
+
+var currentStructFieldResolver atomic.Pointer[structFieldResolver]
+
+// structFieldResolvers is a map of the tags joined by commas to the
+// *structFieldResolver used for EvalOptions.StructTags
+var structFieldResolvers sync.Map
+
+func init() {
+	currentStructFieldResolver.Store(newStructFieldResolver(defaultStructTagPrecedence))
+}
+
+// SetStructTagPrecedence sets the default struct tags that are used to name the
+// fields of a struct, in order of precedence, for evaluations that do not set
+// EvalOptions.StructTags. The default is "mpath", "json", "yaml".
+//
+// A field is named by the first of the tags that it has a name in, or by its
+// Go name if it has none of them. A field with the value "-" in that tag is
+// hidden. Fields can always be addressed by their Go name if no field has a
+// matching tag name.
+//
+// Plans keep the precedence that was set when they were compiled.
+func SetStructTagPrecedence(tags ...string) {
+	currentStructFieldResolver.Store(newStructFieldResolver(append([]string{}, tags...)))
+}
+
+func getStructFieldResolver() *structFieldResolver {
+	return currentStructFieldResolver.Load()
+}
+
+// structFieldResolverFor returns the resolver for the tags, which is shared by
+// all evaluations that use the same tags so that the fields of each type are
+// only found once
+func structFieldResolverFor(tags []string) *structFieldResolver {
+	key := strings.Join(tags, ",")
+	if r, ok := structFieldResolvers.Load(key); ok {
+		return r.(*structFieldResolver)
+	}
+
+	r, _ := structFieldResolvers.LoadOrStore(key, newStructFieldResolver(append([]string{}, tags...)))
+	return r.(*structFieldResolver)
+}
+
+// structFieldResolver resolves ident names to struct fields in the same way
+// that encoding/json does, including the promotion of the fields of embedded
+// structs. The fields of each type are cached.
+type structFieldResolver struct {
+	tags []string
+
+	// fields is a map of reflect.Type to []structField
+	fields sync.Map
+}
+
+type structField struct {
+	name   string
+	goName string
+	index  []int
+	tagged bool
+
+	// embedded is set for an embedded struct, whose fields are promoted; it
+	// can only be addressed by its Go name
+	embedded bool
+}
+
+func newStructFieldResolver(tags []string) *structFieldResolver {
+	return &structFieldResolver{tags: tags}
+}
+
+// fieldIndex finds the field of the struct type that is addressed by the
+// ident name. A field named by a tag is preferred, then a field with the
+// same name ignoring case, then a field with a matching Go name.
+func (r *structFieldResolver) fieldIndex(t reflect.Type, identName string) (index []int, found bool) {
+	fields := r.fieldsOf(t)
+
+	for _, f := range fields {
+		if !f.embedded && f.name == identName {
+			return f.index, true
+		}
+	}
+
+	for _, f := range fields {
+		if !f.embedded && strings.EqualFold(f.name, identName) {
+			return f.index, true
+		}
+	}
+
+	for _, f := range fields {
+		if strings.EqualFold(f.goName, identName) {
+			return f.index, true
+		}
+	}
+
+	return nil, false
+}
+
+func (r *structFieldResolver) fieldsOf(t reflect.Type) []structField {
+	if fields, ok := r.fields.Load(t); ok {
+		return fields.([]structField)
+	}
+
+	fields := r.typeFields(t)
+	r.fields.Store(t, fields)
+
+	return fields
+}
+
+// fieldName returns the name of the field from the first of the tags that the
+// field has, or the Go name of the field if it has none of them or that tag
+// has no name (e.g. `json:",omitempty"`)
+func (r *structFieldResolver) fieldName(sf reflect.StructField) (name string, tagged, hidden bool) {
+	for _, tag := range r.tags {
+		value, ok := sf.Tag.Lookup(tag)
+		if !ok {
+			continue
+		}
+
+		if value == "-" {
+			return "", false, true
+		}
+
+		if name, _, _ = strings.Cut(value, ","); name != "" {
+			return name, true, false
+		}
+
+		return sf.Name, false, false
+	}
+
+	return sf.Name, false, false
+}
+
+// typeFields returns the fields of the struct type, with the fields of
+// embedded structs promoted following the rules of encoding/json: a field at
+// a shallower depth hides deeper fields of the same name, and fields of the
+// same name at the same depth hide each other unless exactly one is tagged.
+func (r *structFieldResolver) typeFields(t reflect.Type) []structField {
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+
+	var fields, embeddedFields []structField
+	visited := map[reflect.Type]bool{}
+
+	next := []embedded{{typ: t}}
+	for len(next) > 0 {
+		current := next
+		next = nil
+
+		for _, e := range current {
+			if visited[e.typ] {
+				continue
+			}
+			visited[e.typ] = true
+
+			for i := 0; i < e.typ.NumField(); i++ {
+				sf := e.typ.Field(i)
+
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+
+				if sf.Anonymous {
+					// Unexported embedded structs still have their exported
+					// fields promoted
+					if !sf.IsExported() && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if !sf.IsExported() {
+					continue
+				}
+
+				name, tagged, hidden := r.fieldName(sf)
+				if hidden {
+					continue
+				}
+
+				index := make([]int, len(e.index)+1)
+				copy(index, e.index)
+				index[len(e.index)] = i
+
+				if sf.Anonymous && !tagged && ft.Kind() == reflect.Struct {
+					next = append(next, embedded{typ: ft, index: index})
+					if sf.IsExported() {
+						embeddedFields = append(embeddedFields, structField{
+							goName:   sf.Name,
+							index:    index,
+							embedded: true,
+						})
+					}
+					continue
+				}
+
+				if !sf.IsExported() {
+					continue
+				}
+
+				fields = append(fields, structField{
+					name:   name,
+					goName: sf.Name,
+					index:  index,
+					tagged: tagged,
+				})
+			}
+		}
+	}
+
+	// Find the dominant field for each name
+	sort.SliceStable(fields, func(i, j int) bool {
+		ni, nj := strings.ToLower(fields[i].name), strings.ToLower(fields[j].name)
+		if ni != nj {
+			return ni < nj
+		}
+		if len(fields[i].index) != len(fields[j].index) {
+			return len(fields[i].index) < len(fields[j].index)
+		}
+		return fields[i].tagged && !fields[j].tagged
+	})
+
+	out := fields[:0]
+	for i := 0; i < len(fields); {
+		name := strings.ToLower(fields[i].name)
+
+		j := i + 1
+		for j < len(fields) && strings.ToLower(fields[j].name) == name {
+			j++
+		}
+
+		if dominant, ok := dominantField(fields[i:j]); ok {
+			out = append(out, dominant)
+		}
+		i = j
+	}
+
+	// Keep the fields in the order they are declared
+	sort.Slice(out, func(i, j int) bool {
+		for k := 0; k < len(out[i].index) && k < len(out[j].index); k++ {
+			if out[i].index[k] != out[j].index[k] {
+				return out[i].index[k] < out[j].index[k]
+			}
+		}
+		return len(out[i].index) < len(out[j].index)
+	})
+
+	return append(out, embeddedFields...)
+}
+
+// dominantField returns the field that hides the others of the same name,
+// which are sorted by depth and then by whether they are tagged
+func dominantField(fields []structField) (structField, bool) {
+	if len(fields) > 1 && len(fields[0].index) == len(fields[1].index) && fields[0].tagged == fields[1].tagged {
+		return structField{}, false
+	}
+
+	return fields[0], true
+}
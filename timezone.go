@@ -0,0 +1,95 @@
+package mpath
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	// The zone database is embedded so that results do not depend on the
+	// zoneinfo of the host
+	_ "time/tzdata"
+)
+
+// locations caches the zones that have been loaded by name
+var locations sync.Map
+
+// loadLocation returns the IANA time zone with the name (e.g.
+// "Australia/Perth"), or UTC for "UTC"
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+
+	if name == "" || name == "Local" {
+		// These would depend on the host
+		return nil, fmt.Errorf("'%s' is not a time zone", name)
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a time zone", name)
+	}
+
+	locations.Store(name, loc)
+
+	return loc, nil
+}
+
+func paramsGetLocationAt(rtParams FunctionParameterTypes, position int) (loc *time.Location, err error) {
+	name, err := paramsGetStringAt(rtParams, position)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadLocation(name)
+}
+
+const FT_InTimezone FT_FunctionType = "InTimezone"
+
+func func_InTimezone(rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(1); !ok {
+		return nil, errNumParams(FT_InTimezone, 1, got)
+	}
+
+	loc, err := paramsGetLocationAt(rtParams, 0)
+	if err != nil {
+		return errAny(FT_InTimezone, err)
+	}
+
+	t, err := convertToTime(val)
+	if err != nil {
+		return errAny(FT_InTimezone, err)
+	}
+
+	return t.In(loc), nil
+}
+
+const FT_ToUTC FT_FunctionType = "ToUTC"
+
+func func_ToUTC(rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(0); !ok {
+		return nil, errNumParams(FT_ToUTC, 0, got)
+	}
+
+	t, err := convertToTime(val)
+	if err != nil {
+		return errAny(FT_ToUTC, err)
+	}
+
+	return t.UTC(), nil
+}
+
+const FT_LocalDate FT_FunctionType = "LocalDate"
+
+func func_LocalDate(rtParams FunctionParameterTypes, val any) (any, error) {
+	if got, ok := rtParams.checkLengthOfParams(0); !ok {
+		return "", errNumParams(FT_LocalDate, 0, got)
+	}
+
+	t, err := convertToTime(val)
+	if err != nil {
+		return errString(FT_LocalDate, err)
+	}
+
+	return t.Format(time.DateOnly), nil
+}